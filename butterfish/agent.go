@@ -0,0 +1,224 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+// The agent loop shared by commands that let the model call tools. The model
+// is prompted, any tool calls in its response are run by Go handlers from a
+// registry, their output is added to history as historyTypeToolOutput blocks,
+// and the model is prompted again until it answers without calling a tool.
+//
+// Commands that prompt synchronously use Run. Goal mode gets its responses
+// from the shell's event loop, so it calls Start, NextStep and RunToolCalls
+// itself as responses arrive.
+
+// Handles a tool call, the returned string is the tool output for the model.
+// An error is also reported to the model so it can correct itself.
+type AgentToolHandler func(ctx context.Context, call *util.ToolCall) (string, error)
+
+// Returned by a handler whose output arrives later, like a command goal mode
+// runs in the shell. No output block is made for the call, the caller adds
+// the output to history itself once it has it.
+var ErrToolOutputPending = errors.New("tool output pending")
+
+type AgentTool struct {
+	Definition util.ToolDefinition
+	Handler    AgentToolHandler
+	// Calls to parallel tools in the same response run concurrently, they
+	// must not touch state that other calls use
+	Parallel bool
+}
+
+type AgentToolRegistry struct {
+	tools map[string]*AgentTool
+	order []string
+}
+
+func NewAgentToolRegistry(tools ...*AgentTool) *AgentToolRegistry {
+	registry := &AgentToolRegistry{tools: map[string]*AgentTool{}}
+	for _, tool := range tools {
+		registry.Register(tool)
+	}
+	return registry
+}
+
+// Add a tool, replacing any existing tool with the same name
+func (this *AgentToolRegistry) Register(tool *AgentTool) {
+	name := tool.Definition.Function.Name
+	if _, ok := this.tools[name]; !ok {
+		this.order = append(this.order, name)
+	}
+	this.tools[name] = tool
+}
+
+func (this *AgentToolRegistry) Get(name string) *AgentTool {
+	return this.tools[name]
+}
+
+// Tool definitions to send with a request, in registration order
+func (this *AgentToolRegistry) Definitions() []util.ToolDefinition {
+	definitions := []util.ToolDefinition{}
+	for _, name := range this.order {
+		definitions = append(definitions, this.tools[name].Definition)
+	}
+	return definitions
+}
+
+func (this *AgentToolRegistry) run(ctx context.Context, call *util.ToolCall) (string, bool) {
+	tool := this.tools[call.Function.Name]
+	if tool == nil {
+		return fmt.Sprintf("Error: unknown tool %s", call.Function.Name), true
+	}
+
+	output, err := tool.Handler(ctx, call)
+	if errors.Is(err, ErrToolOutputPending) {
+		return "", false
+	} else if err != nil {
+		log.Printf("Tool call %s failed: %s", call.Function.Name, err)
+		return fmt.Sprintf("Error: %s", err), true
+	}
+	return output, true
+}
+
+type AgentLimitError struct {
+	Limit string // "steps", "time", "commands" or "repeated failures"
+	Value string
+}
+
+func (this *AgentLimitError) Error() string {
+	return fmt.Sprintf("Agent stopped after reaching its %s limit of %s", this.Limit, this.Value)
+}
+
+type Agent struct {
+	Tools *AgentToolRegistry
+	// Most model turns per run, 0 for no limit
+	MaxSteps int
+	// Longest a run can take, 0 for no limit
+	MaxDuration time.Duration
+
+	steps   int
+	started time.Time
+}
+
+const (
+	DefaultAgentMaxSteps    = 25
+	DefaultAgentMaxDuration = 10 * time.Minute
+)
+
+func NewAgent(tools *AgentToolRegistry) *Agent {
+	return &Agent{
+		Tools:       tools,
+		MaxSteps:    DefaultAgentMaxSteps,
+		MaxDuration: DefaultAgentMaxDuration,
+	}
+}
+
+// Begin a run, resetting the step count and clock
+func (this *Agent) Start() {
+	this.steps = 0
+	this.started = time.Now()
+}
+
+// Count a model turn, returns an AgentLimitError if the run is over its
+// step or time limit and shouldn't prompt again.
+func (this *Agent) NextStep() error {
+	if this.MaxSteps > 0 && this.steps >= this.MaxSteps {
+		return &AgentLimitError{Limit: "steps", Value: fmt.Sprintf("%d", this.MaxSteps)}
+	}
+	if this.MaxDuration > 0 && time.Since(this.started) > this.MaxDuration {
+		return &AgentLimitError{Limit: "time", Value: this.MaxDuration.String()}
+	}
+	this.steps++
+	return nil
+}
+
+// Run the tool calls from a response and return their output as history
+// blocks, in the order the calls were made. Consecutive calls to parallel
+// tools run concurrently, other calls run one at a time. Calls with pending
+// output are left out.
+func (this *Agent) RunToolCalls(ctx context.Context, calls []*util.ToolCall) []util.HistoryBlock {
+	outputs := make([]string, len(calls))
+	done := make([]bool, len(calls))
+
+	for i := 0; i < len(calls); {
+		tool := this.Tools.Get(calls[i].Function.Name)
+		if tool == nil || !tool.Parallel {
+			outputs[i], done[i] = this.Tools.run(ctx, calls[i])
+			i++
+			continue
+		}
+
+		var wg sync.WaitGroup
+		for ; i < len(calls); i++ {
+			tool := this.Tools.Get(calls[i].Function.Name)
+			if tool == nil || !tool.Parallel {
+				break
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				outputs[i], done[i] = this.Tools.run(ctx, calls[i])
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	blocks := []util.HistoryBlock{}
+	for i, call := range calls {
+		if !done[i] {
+			continue
+		}
+		blocks = append(blocks, util.HistoryBlock{
+			Type:       historyTypeToolOutput,
+			Content:    outputs[i],
+			ToolCallId: call.Id,
+		})
+	}
+	return blocks
+}
+
+// Prompts the model with the history so far, the registry's tool
+// definitions should be sent with the request
+type AgentCompletionFunc func(history []util.HistoryBlock) (*util.CompletionResponse, error)
+
+// Prompt and run tools until the model responds without tool calls, returns
+// the history including the model's responses and tool output.
+func (this *Agent) Run(ctx context.Context, history []util.HistoryBlock, complete AgentCompletionFunc) ([]util.HistoryBlock, error) {
+	this.Start()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return history, err
+		}
+
+		err := this.NextStep()
+		if err != nil {
+			return history, err
+		}
+
+		resp, err := complete(history)
+		if err != nil {
+			return history, err
+		}
+
+		history = append(history, util.HistoryBlock{
+			Type:      historyTypeLLMOutput,
+			Content:   resp.Completion,
+			ToolCalls: resp.ToolCalls,
+		})
+
+		if len(resp.ToolCalls) == 0 {
+			return history, nil
+		}
+
+		history = append(history, this.RunToolCalls(ctx, resp.ToolCalls)...)
+	}
+}
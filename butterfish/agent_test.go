@@ -0,0 +1,107 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+func agentTestTool(name string, parallel bool, handler AgentToolHandler) *AgentTool {
+	return &AgentTool{
+		Definition: util.ToolDefinition{
+			Type:     "function",
+			Function: util.FunctionDefinition{Name: name},
+		},
+		Handler:  handler,
+		Parallel: parallel,
+	}
+}
+
+func agentTestCall(id, name string) *util.ToolCall {
+	return &util.ToolCall{Id: id, Type: "function", Function: util.FunctionCall{Name: name}}
+}
+
+func TestAgentRunToolCalls(t *testing.T) {
+	// both reads have to be running at once to get past the barrier
+	var barrier sync.WaitGroup
+	barrier.Add(2)
+	read := agentTestTool("read", true, func(ctx context.Context, call *util.ToolCall) (string, error) {
+		barrier.Done()
+		barrier.Wait()
+		return "read " + call.Id, nil
+	})
+	fail := agentTestTool("fail", false, func(ctx context.Context, call *util.ToolCall) (string, error) {
+		return "", errors.New("nope")
+	})
+	// output that comes later has no block, even when the error is wrapped
+	wait := agentTestTool("wait", false, func(ctx context.Context, call *util.ToolCall) (string, error) {
+		return "", fmt.Errorf("waiting on the shell: %w", ErrToolOutputPending)
+	})
+	agent := NewAgent(NewAgentToolRegistry(read, fail, wait))
+
+	done := make(chan []util.HistoryBlock)
+	go func() {
+		done <- agent.RunToolCalls(context.Background(), []*util.ToolCall{
+			agentTestCall("1", "read"),
+			agentTestCall("2", "read"),
+			agentTestCall("3", "fail"),
+			agentTestCall("4", "missing"),
+			agentTestCall("5", "wait"),
+		})
+	}()
+
+	var blocks []util.HistoryBlock
+	select {
+	case blocks = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("parallel tool calls didn't run concurrently")
+	}
+
+	assert.Equal(t, []util.HistoryBlock{
+		{Type: historyTypeToolOutput, Content: "read 1", ToolCallId: "1"},
+		{Type: historyTypeToolOutput, Content: "read 2", ToolCallId: "2"},
+		{Type: historyTypeToolOutput, Content: "Error: nope", ToolCallId: "3"},
+		{Type: historyTypeToolOutput, Content: "Error: unknown tool missing", ToolCallId: "4"},
+	}, blocks)
+}
+
+func TestAgentRun(t *testing.T) {
+	echo := agentTestTool("echo", false, func(ctx context.Context, call *util.ToolCall) (string, error) {
+		return "echoed", nil
+	})
+	agent := NewAgent(NewAgentToolRegistry(echo))
+
+	calls := 0
+	complete := func(history []util.HistoryBlock) (*util.CompletionResponse, error) {
+		calls++
+		if calls == 1 {
+			return &util.CompletionResponse{ToolCalls: []*util.ToolCall{agentTestCall("1", "echo")}}, nil
+		}
+		return &util.CompletionResponse{Completion: "done"}, nil
+	}
+
+	history, err := agent.Run(context.Background(), nil, complete)
+	assert.NoError(t, err)
+	assert.Len(t, history, 3)
+	assert.Equal(t, historyTypeToolOutput, history[1].Type)
+	assert.Equal(t, "echoed", history[1].Content)
+	assert.Equal(t, "done", history[2].Content)
+
+	// a model that never stops calling tools hits the step limit
+	agent.MaxSteps = 3
+	forever := func(history []util.HistoryBlock) (*util.CompletionResponse, error) {
+		return &util.CompletionResponse{ToolCalls: []*util.ToolCall{agentTestCall("1", "echo")}}, nil
+	}
+	history, err = agent.Run(context.Background(), nil, forever)
+	var limitErr *AgentLimitError
+	assert.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, "steps", limitErr.Limit)
+	assert.Len(t, history, 6)
+}
@@ -0,0 +1,549 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+// Client for the Anthropic Messages API, see
+// https://docs.anthropic.com/en/api/messages
+// This talks to the API directly over HTTP so that Claude models work without
+// going through an OpenAI-compatible proxy.
+
+const AnthropicDefaultBaseURL = "https://api.anthropic.com/v1"
+const AnthropicAPIVersion = "2023-06-01"
+
+// The Messages API requires max_tokens, this is used if the request doesn't
+// set it.
+const anthropicDefaultMaxTokens = 1024
+
+type Anthropic struct {
+	token   string
+	baseUrl string
+	client  *http.Client
+
+	// Model to use if a request asks for a model that isn't a Claude model,
+	// for example the gpt-4-turbo default of the prompt command.
+	DefaultModel string
+}
+
+func NewAnthropic(token, baseUrl string) *Anthropic {
+	if baseUrl == "" {
+		baseUrl = AnthropicDefaultBaseURL
+	}
+
+	return &Anthropic{
+		token:   token,
+		baseUrl: strings.TrimSuffix(baseUrl, "/"),
+		client:  &http.Client{},
+	}
+}
+
+func IsAnthropicModel(model string) bool {
+	model = strings.ToLower(model)
+	return strings.Contains(model, "claude") || strings.HasPrefix(model, "anthropic/")
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type anthropicContent struct {
+	Type string `json:"type"`
+
+	// type == text
+	Text string `json:"text,omitempty"`
+
+	// type == image
+	Source *anthropicImageSource `json:"source,omitempty"`
+
+	// type == tool_use
+	Id    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// type == tool_result
+	ToolUseId string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string             `json:"role"`
+	Content []anthropicContent `json:"content"`
+}
+
+type anthropicTool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputSchema any    `json:"input_schema"`
+}
+
+type anthropicRequest struct {
+	Model       string               `json:"model"`
+	System      string               `json:"system,omitempty"`
+	Messages    []anthropicMessage   `json:"messages"`
+	MaxTokens   int                  `json:"max_tokens"`
+	Temperature float32              `json:"temperature"`
+	Tools       []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice  *anthropicToolChoice `json:"tool_choice,omitempty"`
+	Stream      bool                 `json:"stream,omitempty"`
+}
+
+type anthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	Id         string             `json:"id"`
+	Content    []anthropicContent `json:"content"`
+	StopReason string             `json:"stop_reason"`
+	Usage      anthropicUsage     `json:"usage"`
+}
+
+type anthropicErrorBody struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// A single server-sent event from a streaming response, we decode all event
+// types into this struct and switch on Type.
+type anthropicStreamEvent struct {
+	Type         string             `json:"type"`
+	Index        int                `json:"index"`
+	Message      *anthropicResponse `json:"message"`
+	ContentBlock *anthropicContent  `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJson string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage *anthropicUsage `json:"usage"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func parseAnthropicError(status int, body []byte) error {
+	var errBody anthropicErrorBody
+	err := json.Unmarshal(body, &errBody)
+	if err != nil || errBody.Error.Message == "" {
+		return &APIError{Provider: "Anthropic", StatusCode: status, Message: string(body)}
+	}
+
+	return &APIError{
+		Provider:   "Anthropic",
+		StatusCode: status,
+		Type:       errBody.Error.Type,
+		Message:    errBody.Error.Message,
+	}
+}
+
+func (this *Anthropic) headers() map[string]string {
+	return map[string]string{
+		"x-api-key":         this.token,
+		"anthropic-version": AnthropicAPIVersion,
+	}
+}
+
+func (this *Anthropic) model(model string) string {
+	model = strings.TrimPrefix(model, "anthropic/")
+	if !IsAnthropicModel(model) && this.DefaultModel != "" {
+		log.Printf("Model %s is not an Anthropic model, using %s instead", model, this.DefaultModel)
+		return this.DefaultModel
+	}
+	return model
+}
+
+// Convert butterfish history into Anthropic messages. The Messages API only
+// has user and assistant roles, requires them to alternate, and requires
+// the first message to come from the user. Tool and function outputs become
+// tool_result blocks inside a user message. Legacy function calls don't have
+// ids so we make them up and pair them with the next function output.
+func ShellHistoryBlocksToAnthropic(blocks []util.HistoryBlock) []anthropicMessage {
+	messages := []anthropicMessage{}
+	pendingFunctionIds := map[string]string{}
+	functionCount := 0
+
+	push := func(role string, content ...anthropicContent) {
+		if len(content) == 0 {
+			return
+		}
+		last := len(messages) - 1
+		if last >= 0 && messages[last].Role == role {
+			messages[last].Content = append(messages[last].Content, content...)
+			return
+		}
+		messages = append(messages, anthropicMessage{Role: role, Content: content})
+	}
+
+	for _, block := range blocks {
+		role := ShellHistoryTypeToRole(block.Type)
+
+		switch role {
+		case "assistant":
+			content := []anthropicContent{}
+			if block.Content != "" {
+				content = append(content, anthropicContent{Type: "text", Text: block.Content})
+			}
+			if block.FunctionName != "" {
+				functionCount++
+				id := fmt.Sprintf("toolu_butterfish_%d", functionCount)
+				pendingFunctionIds[block.FunctionName] = id
+				content = append(content, anthropicContent{
+					Type:  "tool_use",
+					Id:    id,
+					Name:  block.FunctionName,
+					Input: toolCallArgs(block.FunctionParams),
+				})
+			}
+			for _, toolCall := range block.ToolCalls {
+				content = append(content, anthropicContent{
+					Type:  "tool_use",
+					Id:    toolCall.Id,
+					Name:  toolCall.Function.Name,
+					Input: toolCallArgs(toolCall.Function.Parameters),
+				})
+			}
+			push("assistant", content...)
+
+		case "function":
+			id, ok := pendingFunctionIds[block.FunctionName]
+			if !ok {
+				// output without a matching call, pass it along as text
+				push("user", anthropicContent{
+					Type: "text",
+					Text: fmt.Sprintf("Output of %s:\n%s", block.FunctionName, block.Content),
+				})
+				continue
+			}
+			delete(pendingFunctionIds, block.FunctionName)
+			push("user", anthropicContent{
+				Type:      "tool_result",
+				ToolUseId: id,
+				Content:   block.Content,
+			})
+
+		case "tool":
+			push("user", anthropicContent{
+				Type:      "tool_result",
+				ToolUseId: block.ToolCallId,
+				Content:   block.Content,
+			})
+
+		default:
+			if block.Content == "" {
+				continue
+			}
+			push("user", anthropicContent{Type: "text", Text: block.Content})
+		}
+	}
+
+	if len(messages) > 0 && messages[0].Role != "user" {
+		messages = append([]anthropicMessage{
+			{
+				Role:    "user",
+				Content: []anthropicContent{{Type: "text", Text: "(start of history)"}},
+			},
+		}, messages...)
+	}
+
+	return messages
+}
+
+func (this *Anthropic) buildRequest(request *util.CompletionRequest, stream bool) (*anthropicRequest, error) {
+	if request.SystemMessage == "" && request.HistoryBlocks == nil {
+		return nil, errors.New("system message required for Anthropic completion")
+	}
+
+	messages := ShellHistoryBlocksToAnthropic(request.HistoryBlocks)
+
+	if request.Prompt != "" || len(request.Images) > 0 {
+		content := []anthropicContent{}
+		for _, img := range request.Images {
+			content = append(content, anthropicContent{
+				Type: "image",
+				Source: &anthropicImageSource{
+					Type:      "base64",
+					MediaType: img.MimeType,
+					Data:      img.Base64Content,
+				},
+			})
+		}
+		if request.Prompt != "" {
+			content = append(content, anthropicContent{Type: "text", Text: request.Prompt})
+		}
+
+		last := len(messages) - 1
+		if last >= 0 && messages[last].Role == "user" {
+			messages[last].Content = append(messages[last].Content, content...)
+		} else {
+			messages = append(messages, anthropicMessage{Role: "user", Content: content})
+		}
+	}
+
+	if len(messages) == 0 {
+		return nil, errors.New("no messages to send to Anthropic")
+	}
+
+	maxTokens := request.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = anthropicDefaultMaxTokens
+	}
+
+	// Anthropic temperatures range from 0 to 1
+	temperature := request.Temperature
+	if temperature > 1 {
+		temperature = 1
+	}
+
+	req := &anthropicRequest{
+		Model:       this.model(request.Model),
+		System:      request.SystemMessage,
+		Messages:    messages,
+		MaxTokens:   maxTokens,
+		Temperature: temperature,
+		Stream:      stream,
+	}
+	reportModel(request.Ctx, req.Model)
+
+	// Both legacy functions and tools are sent as Anthropic tools
+	for _, f := range request.Functions {
+		req.Tools = append(req.Tools, anthropicToolFromFunction(f))
+	}
+	for _, t := range request.Tools {
+		req.Tools = append(req.Tools, anthropicToolFromFunction(t.Function))
+	}
+
+	// there's no structured output, so force a call to a tool that takes the
+	// response as its input
+	if len(request.ResponseSchema) > 0 {
+		req.Tools = append(req.Tools, anthropicTool{
+			Name:        jsonResponseName,
+			Description: "Respond with JSON matching the schema.",
+			InputSchema: request.ResponseSchema,
+		})
+		req.ToolChoice = &anthropicToolChoice{Type: "tool", Name: jsonResponseName}
+	}
+
+	return req, nil
+}
+
+func anthropicToolFromFunction(f util.FunctionDefinition) anthropicTool {
+	var schema any = f.Parameters
+	if f.Parameters.Type == "" {
+		schema = map[string]string{"type": "object"}
+	}
+
+	return anthropicTool{
+		Name:        f.Name,
+		Description: f.Description,
+		InputSchema: schema,
+	}
+}
+
+func (this *Anthropic) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	request = fitRequestToModel(request)
+	req, err := this.buildRequest(request, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Verbose {
+		logGenericCompletionRequest(request)
+	}
+
+	var resp anthropicResponse
+	err = withExponentialBackoff(func() error {
+		httpResp, innerErr := postJSON(request.Ctx, this.client,
+			this.baseUrl+"/messages", this.headers(), req, parseAnthropicError)
+		if innerErr != nil {
+			return innerErr
+		}
+		defer httpResp.Body.Close()
+		return json.NewDecoder(httpResp.Body).Decode(&resp)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.Builder{}
+	toolCalls := []*util.ToolCall{}
+	for _, block := range resp.Content {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "tool_use":
+			toolCalls = append(toolCalls, &util.ToolCall{
+				Id:   block.Id,
+				Type: "function",
+				Function: util.FunctionCall{
+					Name:       block.Name,
+					Parameters: string(block.Input),
+				},
+			})
+		}
+	}
+
+	response := util.CompletionResponse{
+		Completion: strings.TrimSpace(text.String()),
+		Usage: &util.Usage{
+			PromptTokens:     resp.Usage.InputTokens,
+			CompletionTokens: resp.Usage.OutputTokens,
+		},
+	}
+	toolCalls = takeJSONResponse(request, &response, toolCalls)
+	setResponseToolCalls(request, &response, toolCalls)
+
+	if request.Verbose {
+		LogCompletionResponse(response, resp.Id)
+	}
+	return &response, nil
+}
+
+func (this *Anthropic) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	request = fitRequestToModel(request)
+	req, err := this.buildRequest(request, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Verbose {
+		logGenericCompletionRequest(request)
+	}
+
+	innerCtx, cancel := context.WithCancel(request.Ctx)
+	defer cancel()
+
+	var httpResp *http.Response
+	err = withExponentialBackoff(func() error {
+		var innerErr error
+		httpResp, innerErr = postJSON(innerCtx, this.client,
+			this.baseUrl+"/messages", this.headers(), req, parseAnthropicError)
+		return innerErr
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	var id string
+	usage := &util.Usage{}
+	text := strings.Builder{}
+	// tool calls indexed by content block index
+	toolCalls := map[int]*util.ToolCall{}
+	toolOrder := []int{}
+
+	err = readEventStream(httpResp.Body, request.TokenTimeout, cancel, func(data []byte) error {
+		var event anthropicStreamEvent
+		err := json.Unmarshal(data, &event)
+		if err != nil {
+			return err
+		}
+
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil {
+				id = event.Message.Id
+				usage.PromptTokens = event.Message.Usage.InputTokens
+			}
+
+		case "message_delta":
+			// output tokens here are cumulative
+			if event.Usage != nil {
+				usage.CompletionTokens = event.Usage.OutputTokens
+			}
+
+		case "content_block_start":
+			if event.ContentBlock != nil && event.ContentBlock.Type == "tool_use" {
+				if len(toolOrder) > 0 {
+					writer.Write([]byte(")\n"))
+				}
+				toolCalls[event.Index] = &util.ToolCall{
+					Id:       event.ContentBlock.Id,
+					Type:     "function",
+					Function: util.FunctionCall{Name: event.ContentBlock.Name},
+				}
+				toolOrder = append(toolOrder, event.Index)
+				writer.Write([]byte(event.ContentBlock.Name))
+				writer.Write([]byte("("))
+			}
+
+		case "content_block_delta":
+			switch event.Delta.Type {
+			case "text_delta":
+				text.WriteString(event.Delta.Text)
+				writer.Write([]byte(event.Delta.Text))
+			case "input_json_delta":
+				toolCall, ok := toolCalls[event.Index]
+				if ok {
+					toolCall.Function.Parameters += event.Delta.PartialJson
+					writer.Write([]byte(event.Delta.PartialJson))
+				}
+			}
+
+		case "error":
+			if event.Error != nil {
+				return &APIError{
+					Provider: "Anthropic",
+					Type:     event.Error.Type,
+					Message:  event.Error.Message,
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(toolOrder) > 0 {
+		writer.Write([]byte(")"))
+	}
+	fmt.Fprintf(writer, "\n")
+
+	orderedToolCalls := []*util.ToolCall{}
+	for _, index := range toolOrder {
+		toolCall := toolCalls[index]
+		if toolCall.Function.Parameters == "" {
+			toolCall.Function.Parameters = "{}"
+		}
+		orderedToolCalls = append(orderedToolCalls, toolCall)
+	}
+
+	response := util.CompletionResponse{
+		Completion: text.String(),
+		Usage:      usage,
+	}
+	orderedToolCalls = takeJSONResponse(request, &response, orderedToolCalls)
+	setResponseToolCalls(request, &response, orderedToolCalls)
+
+	if request.Verbose {
+		LogCompletionResponse(response, id)
+	}
+	return &response, nil
+}
+
+func (this *Anthropic) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return nil, errors.New("Anthropic does not provide an embeddings API, use an OpenAI-compatible provider for embeddings")
+}
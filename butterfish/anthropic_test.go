@@ -0,0 +1,143 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+func TestShellHistoryBlocksToAnthropic(t *testing.T) {
+	blocks := []util.HistoryBlock{
+		{Type: historyTypeLLMOutput, Content: "hello"},
+		{Type: historyTypeShellInput, Content: "ls"},
+		{Type: historyTypeShellOutput, Content: "foo.txt"},
+		{Type: historyTypeLLMOutput, FunctionName: "command", FunctionParams: `{"cmd":"cat foo.txt"}`},
+		{Type: historyTypeFunctionOutput, FunctionName: "command", Content: "bar"},
+		{Type: historyTypeLLMOutput, ToolCalls: []*util.ToolCall{
+			{Id: "toolu_1", Function: util.FunctionCall{Name: "edit", Parameters: `{}`}},
+		}},
+		{Type: historyTypeToolOutput, ToolCallId: "toolu_1", Content: "done"},
+	}
+
+	messages := ShellHistoryBlocksToAnthropic(blocks)
+
+	// leading assistant message gets a user message in front, consecutive
+	// user blocks are merged
+	assert.Equal(t, 7, len(messages))
+	assert.Equal(t, "user", messages[0].Role)
+	assert.Equal(t, "assistant", messages[1].Role)
+	assert.Equal(t, "user", messages[2].Role)
+	assert.Equal(t, 2, len(messages[2].Content))
+
+	// legacy function call is paired with its output by a generated id
+	assert.Equal(t, "tool_use", messages[3].Content[0].Type)
+	assert.Equal(t, "tool_result", messages[4].Content[0].Type)
+	assert.Equal(t, messages[3].Content[0].Id, messages[4].Content[0].ToolUseId)
+	assert.Equal(t, "bar", messages[4].Content[0].Content)
+
+	// tool results keep their ids
+	assert.Equal(t, "toolu_1", messages[5].Content[0].Id)
+	assert.Equal(t, "toolu_1", messages[6].Content[0].ToolUseId)
+}
+
+func TestAnthropicCompletionStream(t *testing.T) {
+	var received anthropicRequest
+	var apiKey string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/messages", r.URL.Path)
+		apiKey = r.Header.Get("x-api-key")
+		json.NewDecoder(r.Body).Decode(&received)
+
+		events := []string{
+			`{"type":"message_start","message":{"id":"msg_1","content":[],"usage":{"input_tokens":10,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Listing "}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"files"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_9","name":"command","input":{}}}`,
+			`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"cmd\":"}}`,
+			`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":" \"ls\"}"}}`,
+			`{"type":"content_block_stop","index":1}`,
+			`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":12}}`,
+			`{"type":"message_stop"}`,
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			fmt.Fprintf(w, "event: x\ndata: %s\n\n", event)
+		}
+	}))
+	defer server.Close()
+
+	client := NewAnthropic("test-key", server.URL)
+	request := &util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "list files",
+		Model:         "claude-3-5-sonnet-latest",
+		SystemMessage: "be helpful",
+		Temperature:   1.5,
+		Functions: []util.FunctionDefinition{
+			{
+				Name: "command",
+				Parameters: jsonschema.Definition{
+					Type: jsonschema.Object,
+					Properties: map[string]jsonschema.Definition{
+						"cmd": {Type: jsonschema.String},
+					},
+				},
+			},
+		},
+		Images: []util.ImageContent{{Base64Content: "aGk=", MimeType: "image/png"}},
+	}
+
+	out := &bytes.Buffer{}
+	resp, err := client.CompletionStream(request, out)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "test-key", apiKey)
+	assert.Equal(t, "be helpful", received.System)
+	assert.True(t, received.Stream)
+	assert.Equal(t, float32(1), received.Temperature)
+	assert.Equal(t, anthropicDefaultMaxTokens, received.MaxTokens)
+	assert.Equal(t, 1, len(received.Tools))
+	assert.Equal(t, "image", received.Messages[0].Content[0].Type)
+	assert.Equal(t, "list files", received.Messages[0].Content[1].Text)
+
+	// request used functions so the tool call comes back as a function call
+	assert.Equal(t, "Listing files", resp.Completion)
+	assert.Equal(t, "command", resp.FunctionName)
+	assert.Equal(t, `{"cmd": "ls"}`, resp.FunctionParameters)
+	assert.Equal(t, "Listing filescommand({\"cmd\": \"ls\"})\n", out.String())
+	assert.Equal(t, &util.Usage{PromptTokens: 10, CompletionTokens: 12}, resp.Usage)
+}
+
+func TestAnthropicCompletionError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"type":"error","error":{"type":"invalid_request_error","message":"bad model"}}`))
+	}))
+	defer server.Close()
+
+	client := NewAnthropic("test-key", server.URL)
+	_, err := client.Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		Model:         "claude-3-haiku",
+		SystemMessage: "sys",
+	})
+
+	apiErr, ok := err.(*APIError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	assert.Equal(t, "bad model", apiErr.Message)
+}
@@ -0,0 +1,216 @@
+package butterfish
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Spending budgets. Limits in USD are set per feature (see the Feature
+// constants) and overall with the key "total", for the current day and the
+// current calendar month, e.g.
+//
+//	daily:
+//	  total: 2.00
+//	  autosuggest: 0.25
+//	monthly:
+//	  total: 30.00
+//	  goal_mode: 10.00
+//
+// Spend is seeded from the usage ledger and then updated by MeteredLLM as
+// calls are made. Once a limit is hit calls for that feature are refused
+// until the period rolls over.
+
+const BudgetTotal = "total"
+
+type BudgetConfig struct {
+	Daily   map[string]float64 `yaml:"daily"`
+	Monthly map[string]float64 `yaml:"monthly"`
+}
+
+// Load the budget config, returns nil if the file doesn't exist.
+func LoadBudgetConfig(path string) (*BudgetConfig, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	config := &BudgetConfig{}
+	err = yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing budgets file %s: %s", path, err)
+	}
+
+	for _, limits := range []map[string]float64{config.Daily, config.Monthly} {
+		for key, limit := range limits {
+			if limit < 0 {
+				return nil, fmt.Errorf("Budget for %s in %s is negative", key, path)
+			}
+		}
+	}
+
+	return config, nil
+}
+
+type BudgetExceededError struct {
+	Feature string // feature name or "total"
+	Period  string // "daily" or "monthly"
+	Limit   float64
+	Spent   float64
+}
+
+func (this *BudgetExceededError) Error() string {
+	return fmt.Sprintf("The %s %s budget of $%.2f has been used ($%.2f spent)",
+		this.Period, this.Feature, this.Limit, this.Spent)
+}
+
+// Budget tracks spend against a BudgetConfig. A nil Budget has no limits so
+// callers don't need to check whether budgets are configured.
+type Budget struct {
+	config *BudgetConfig
+
+	mutex      sync.Mutex
+	dayStart   time.Time
+	monthStart time.Time
+	daySpend   map[string]float64
+	monthSpend map[string]float64
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func startOfMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// Create a budget, records is the usage so far, anything before the start of
+// the current month is ignored.
+func NewBudget(config *BudgetConfig, records []UsageRecord) *Budget {
+	budget := &Budget{config: config}
+	budget.rollover(time.Now())
+	for _, record := range records {
+		budget.Add(record)
+	}
+	return budget
+}
+
+// Reset spend when we've moved into a new day or month, must hold the mutex.
+func (this *Budget) rollover(now time.Time) {
+	if day := startOfDay(now); !day.Equal(this.dayStart) {
+		this.dayStart = day
+		this.daySpend = map[string]float64{}
+	}
+	if month := startOfMonth(now); !month.Equal(this.monthStart) {
+		this.monthStart = month
+		this.monthSpend = map[string]float64{}
+	}
+}
+
+func (this *Budget) Add(record UsageRecord) {
+	if this == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.rollover(time.Now())
+
+	if record.Time.Before(this.monthStart) {
+		return
+	}
+	this.monthSpend[record.Feature] += record.Cost
+	this.monthSpend[BudgetTotal] += record.Cost
+
+	if record.Time.Before(this.dayStart) {
+		return
+	}
+	this.daySpend[record.Feature] += record.Cost
+	this.daySpend[BudgetTotal] += record.Cost
+}
+
+// Returns a BudgetExceededError if the feature or the total is over its daily
+// or monthly budget.
+func (this *Budget) Check(feature string) error {
+	if this == nil {
+		return nil
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.rollover(time.Now())
+
+	checks := []struct {
+		period string
+		limits map[string]float64
+		spend  map[string]float64
+	}{
+		{"daily", this.config.Daily, this.daySpend},
+		{"monthly", this.config.Monthly, this.monthSpend},
+	}
+
+	for _, check := range checks {
+		for _, key := range []string{feature, BudgetTotal} {
+			limit, ok := check.limits[key]
+			if !ok || key == "" {
+				continue
+			}
+			if check.spend[key] >= limit {
+				return &BudgetExceededError{
+					Feature: key,
+					Period:  check.period,
+					Limit:   limit,
+					Spent:   check.spend[key],
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// One line per configured limit describing what's left, for the shell
+// Status command.
+func (this *Budget) Status() []string {
+	if this == nil {
+		return nil
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.rollover(time.Now())
+
+	lines := []string{}
+	addLines := func(period string, limits, spend map[string]float64) {
+		keys := []string{}
+		for key := range limits {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			remaining := limits[key] - spend[key]
+			if remaining < 0 {
+				remaining = 0
+			}
+			lines = append(lines, fmt.Sprintf("%-8s %-14s $%.2f of $%.2f left",
+				period, key, remaining, limits[key]))
+		}
+	}
+
+	addLines("daily", this.config.Daily, this.daySpend)
+	addLines("monthly", this.config.Monthly, this.monthSpend)
+	return lines
+}
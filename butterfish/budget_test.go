@@ -0,0 +1,73 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+func TestBudget(t *testing.T) {
+	now := time.Now()
+	budget := NewBudget(&BudgetConfig{
+		Daily:   map[string]float64{FeatureAutosuggest: 0.5},
+		Monthly: map[string]float64{BudgetTotal: 10},
+	}, []UsageRecord{
+		// last month doesn't count
+		{Time: startOfMonth(now).Add(-time.Hour), Feature: FeatureAutosuggest, Cost: 100},
+		{Time: now, Feature: FeatureAutosuggest, Cost: 0.25},
+	})
+
+	assert.NoError(t, budget.Check(FeatureAutosuggest))
+	assert.NoError(t, budget.Check(FeatureGoalMode))
+
+	budget.Add(UsageRecord{Time: now, Feature: FeatureAutosuggest, Cost: 0.25})
+	err := budget.Check(FeatureAutosuggest)
+	assert.Error(t, err)
+	assert.Equal(t, "daily", err.(*BudgetExceededError).Period)
+	assert.NoError(t, budget.Check(FeatureGoalMode))
+
+	budget.Add(UsageRecord{Time: now, Feature: FeatureGoalMode, Cost: 9.5})
+	err = budget.Check(FeatureGoalMode)
+	assert.Error(t, err)
+	assert.Equal(t, BudgetTotal, err.(*BudgetExceededError).Feature)
+
+	lines := budget.Status()
+	assert.Equal(t, 2, len(lines))
+	assert.Contains(t, lines[0], "$0.00 of $0.50 left")
+
+	// a nil budget has no limits
+	var none *Budget
+	assert.NoError(t, none.Check(FeatureGoalMode))
+}
+
+func TestMeteredLLMBudget(t *testing.T) {
+	ledger, err := NewUsageLedger(filepath.Join(t.TempDir(), "usage.jsonl"))
+	assert.NoError(t, err)
+
+	budget := NewBudget(&BudgetConfig{
+		Daily: map[string]float64{FeatureGoalMode: 0.001},
+	}, nil)
+	scripted := &scriptedLLM{responses: []*util.CompletionResponse{
+		{Completion: "ls", Usage: &util.Usage{PromptTokens: 1000, CompletionTokens: 10}},
+	}}
+	metered := NewMeteredLLM(scripted, ledger, PriceTable{"gpt-4o": {2.5, 10}}, budget)
+
+	request := &util.CompletionRequest{
+		Ctx:     context.Background(),
+		Model:   "gpt-4o",
+		Feature: FeatureGoalMode,
+	}
+	_, err = metered.CompletionStream(request, &bytes.Buffer{})
+	assert.NoError(t, err)
+
+	// the first call spent the budget so the next is refused
+	_, err = metered.CompletionStream(request, &bytes.Buffer{})
+	assert.IsType(t, &BudgetExceededError{}, err)
+	assert.Equal(t, 1, scripted.calls)
+}
@@ -61,9 +61,76 @@ type ButterfishConfig struct {
 	BaseURL      string
 	TokenTimeout time.Duration // how long to wait for a token before timing out
 
+	// Anthropic API key, used with Claude models through the native Messages
+	// API. Found at https://console.anthropic.com/settings/keys
+	AnthropicToken   string
+	AnthropicBaseURL string
+
+	// Google Gemini API key, used with Gemini models.
+	// Found at https://aistudio.google.com/app/apikey
+	GeminiToken   string
+	GeminiBaseURL string
+
+	// If set, models are served by an Ollama server at this URL through its
+	// native API, e.g. http://localhost:11434. No API key is needed.
+	OllamaBaseURL string
+	// Caps the context window requested from Ollama, 0 for the model's full
+	// window
+	OllamaMaxContextLength int
+
+	// Model used for embeddings, if empty the client's default is used.
+	// Indexes record the model they were made with and are rebuilt if it
+	// changes.
+	EmbeddingModel string
+
 	// LLM API communication client that implements the LLM interface
 	LLMClient LLM
 
+	// Path of yaml file defining providers and which model roles use them.
+	// Defaults to ~/.config/butterfish/providers.yaml
+	ProvidersPath string
+
+	// Providers to use instead of loading ProvidersPath
+	Providers *ProvidersConfig
+
+	// If set, LLM requests and responses are recorded to or replayed from
+	// this file, see CassetteLLM for the modes
+	CassettePath string
+	CassetteMode string
+
+	// If set, responses to temperature 0 requests are cached in this
+	// directory, see CachedLLM. Zero TTL and size use the defaults.
+	CachePath     string
+	CacheTTL      time.Duration
+	CacheMaxBytes int64
+
+	// If set, shell history is recorded to a session in this directory, see
+	// SessionStore. Zero max age and size use the defaults.
+	SessionsPath     string
+	SessionsMaxAge   time.Duration
+	SessionsMaxBytes int64
+
+	// If set, token usage of every LLM call is appended to this ledger and
+	// priced with the defaults plus any prices in PricesPath
+	UsageLedgerPath string
+	PricesPath      string
+
+	// Path of yaml file with daily and monthly spending limits, see Budget.
+	// Budgets need the usage ledger to be enabled.
+	BudgetsPath string
+
+	// Path of yaml file with context windows, tokenizers and capabilities of
+	// models, merged over DefaultModelRegistry.
+	ModelsPath string
+
+	// Path of yaml file with extra patterns for redacting secrets from shell
+	// history, see Redactor. The built-in detectors are used if it's unset.
+	RedactionPath string
+
+	// Path of yaml file with rules for which goal mode commands are allowed,
+	// need confirmation or are denied, see CommandPolicy
+	CommandPolicyPath string
+
 	// Color scheme to use for the shell, see GruvboxDark below
 	ColorScheme *ColorScheme
 
@@ -94,6 +161,8 @@ type ButterfishConfig struct {
 	ShellLeavePromptAlone   bool   // don't try to edit the shell prompt
 	ShellAutosuggestEnabled bool   // whether to use autosuggest
 	ShellAutosuggestModel   string // used when we're autocompleting a command
+	// Temperature for autosuggest, only requests at 0 are cached
+	ShellAutosuggestTemperature float32
 	// how long to wait between when the user stos typing and we ask for an
 	// autosuggest
 	ShellAutosuggestTimeout time.Duration
@@ -105,6 +174,19 @@ type ButterfishConfig struct {
 	ShellMaxHistoryBlockTokens int
 	// Maximum tokens for the response, reserved when calculating history and passed as max_tokens during inference
 	ShellMaxResponseTokens int
+	// Session to resume shell history from, or SessionLatest, see
+	// SessionsPath. Empty starts a new session.
+	ShellResume string
+	// Run goal mode commands in a sandbox and review their changes before
+	// applying them, see Sandbox
+	GoalModeSandbox bool
+	// Limits after which goal mode gives up with FAILURE, 0 for no limit: the
+	// model turns, the commands run, how many times in a row the same command
+	// can fail and how long since the goal was given
+	GoalModeMaxTurns    int
+	GoalModeMaxCommands int
+	GoalModeMaxFailures int
+	GoalModeMaxDuration time.Duration
 
 	// Model, temp, and max tokens to use when executing the `gencmd` command
 	GencmdModel       string
@@ -169,6 +251,12 @@ type ButterfishCtx struct {
 	PromptLibrary PromptLibrary
 	// GPT client
 	LLMClient LLM
+	// spending limits, nil if no budgets are configured
+	Budget *Budget
+	// removes secrets from shell history before it's sent to the LLM
+	Redactor *Redactor
+	// decides which goal mode commands can run without confirmation
+	CommandPolicy *CommandPolicy
 	// landing space for generated commands
 	CommandRegister string
 	// embedding index for searching local files
@@ -217,23 +305,29 @@ var GruvboxLight = ColorScheme{
 }
 
 const BestCompletionModel = "gpt-3.5-turbo"
+const DefaultAutosuggestTemperature = 0.2
 
 func MakeButterfishConfig() *ButterfishConfig {
 	colorScheme := &GruvboxDark
 
 	return &ButterfishConfig{
-		Verbose:              0,
-		ColorScheme:          colorScheme,
-		Styles:               ColorSchemeToStyles(colorScheme),
-		GencmdModel:          BestCompletionModel,
-		GencmdTemperature:    0.6,
-		GencmdMaxTokens:      512,
-		ExeccheckModel:       BestCompletionModel,
-		ExeccheckTemperature: 0.6,
-		ExeccheckMaxTokens:   512,
-		SummarizeModel:       BestCompletionModel,
-		SummarizeTemperature: 0.7,
-		SummarizeMaxTokens:   1024,
+		Verbose:                     0,
+		ColorScheme:                 colorScheme,
+		Styles:                      ColorSchemeToStyles(colorScheme),
+		ShellAutosuggestTemperature: DefaultAutosuggestTemperature,
+		GencmdModel:                 BestCompletionModel,
+		GencmdTemperature:           0.6,
+		GencmdMaxTokens:             512,
+		ExeccheckModel:              BestCompletionModel,
+		ExeccheckTemperature:        0.6,
+		ExeccheckMaxTokens:          512,
+		SummarizeModel:              BestCompletionModel,
+		SummarizeTemperature:        0.7,
+		SummarizeMaxTokens:          1024,
+		GoalModeMaxTurns:            DefaultAgentMaxSteps,
+		GoalModeMaxCommands:         DefaultGoalModeMaxCommands,
+		GoalModeMaxFailures:         DefaultGoalModeMaxFailures,
+		GoalModeMaxDuration:         DefaultAgentMaxDuration,
 	}
 }
 
@@ -278,7 +372,8 @@ func sanitizeTTYString(data string) string {
 	return filterNonPrintable(stripANSI(data))
 }
 
-func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.File, func() error, error) {
+// Returns the pty, the pid of the command, and a cleanup function
+func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.File, int, func() error, error) {
 	// Create arbitrary command.
 	var cmd *exec.Cmd
 
@@ -296,7 +391,7 @@ func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.Fi
 	// Start the command with a pty.
 	ptmx, err := pty.Start(cmd)
 	if err != nil {
-		return nil, nil, err
+		return nil, 0, nil, err
 	}
 
 	// Handle pty size.
@@ -317,7 +412,7 @@ func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.Fi
 		ptmx.Close()
 		signal.Stop(ch)
 		close(ch)
-		return nil, nil, err
+		return nil, 0, nil, err
 	}
 
 	cleanup := func() error {
@@ -332,7 +427,7 @@ func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.Fi
 		return term.Restore(int(os.Stdin.Fd()), oldState)
 	}
 
-	return ptmx, cleanup, nil
+	return ptmx, cmd.Process.Pid, cleanup, nil
 }
 
 func (this *ButterfishCtx) CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error) {
@@ -365,6 +460,9 @@ func (this *ButterfishCtx) initVectorIndex(pathsToLoad []string) error {
 
 	out := util.NewStyledWriter(this.Out, this.Config.Styles.Foreground)
 	index := embedding.NewDiskCachedEmbeddingIndex(this, out)
+	if model := embeddingModelName(this.LLMClient); model != "unknown" {
+		index.EmbeddingModel = model
+	}
 
 	if this.Config.Verbose > 0 {
 		index.SetOutput(this.Out)
@@ -459,17 +557,197 @@ func NewDiskPromptLibrary(path string, verbose bool, writer io.Writer) (*prompt.
 	return promptLibrary, nil
 }
 
-func initLLM(config *ButterfishConfig) (LLM, error) {
-	if config.OpenAIToken == "" && config.LLMClient != nil {
-		return nil, errors.New("Must provide either an OpenAI Token or an LLM client.")
-	} else if config.OpenAIToken != "" && config.LLMClient != nil {
-		return nil, errors.New("Must provide either an OpenAI Token or an LLM client, not both.")
-	} else if config.OpenAIToken != "" {
+// Create the LLM client, if providers are configured then requests are
+// routed to a client by model role, otherwise we use the default client.
+func initLLM(config *ButterfishConfig, budget *Budget) (LLM, error) {
+	providers := config.Providers
+	if providers == nil && config.ProvidersPath != "" {
+		var err error
+		providers, err = LoadProvidersConfig(config.ProvidersPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	defaultLLM, err := initDefaultLLM(config)
+	if err == nil {
+		setEmbeddingModel(defaultLLM, config.EmbeddingModel)
+	}
+	llm, err := newRoutedLLM(providers, defaultLLM, err)
+	if err == nil {
+		discoverOllamaContextLengths(config, llm)
+	}
+	// metering goes inside the cache so cache hits aren't counted as spend
+	if err == nil && config.UsageLedgerPath != "" {
+		llm, err = initMeteredLLM(config, llm, budget)
+	}
+	if err == nil && config.CachePath != "" {
+		llm, err = NewCachedLLM(llm, config.CachePath, config.CacheTTL, config.CacheMaxBytes)
+	}
+	if config.CassettePath == "" {
+		return llm, err
+	}
+
+	// strict replay never calls the client so we don't need an API key
+	if err != nil {
+		if config.CassetteMode != CassetteModeStrict {
+			return nil, err
+		}
+		llm = nil
+	}
+	return NewCassetteLLM(llm, config.CassettePath, config.CassetteMode)
+}
+
+func initMeteredLLM(config *ButterfishConfig, llm LLM, budget *Budget) (LLM, error) {
+	ledger, err := NewUsageLedger(config.UsageLedgerPath)
+	if err != nil {
+		return nil, err
+	}
+
+	prices, err := LoadPriceTable(config.PricesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMeteredLLM(llm, ledger, prices, budget), nil
+}
+
+// Load budgets and seed them with this month's spend from the ledger, returns
+// nil if no budgets are configured.
+func initBudget(config *ButterfishConfig) (*Budget, error) {
+	if config.BudgetsPath == "" || config.UsageLedgerPath == "" {
+		return nil, nil
+	}
+
+	budgetConfig, err := LoadBudgetConfig(config.BudgetsPath)
+	if err != nil || budgetConfig == nil {
+		return nil, err
+	}
+
+	ledger, err := NewUsageLedger(config.UsageLedgerPath)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := ledger.Read(startOfMonth(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBudget(budgetConfig, records), nil
+}
+
+func initRedactor(config *ButterfishConfig) (*Redactor, error) {
+	var redactionConfig *RedactionConfig
+	if config.RedactionPath != "" {
+		var err error
+		redactionConfig, err = LoadRedactionConfig(config.RedactionPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return NewRedactor(redactionConfig)
+}
+
+func initCommandPolicy(config *ButterfishConfig) (*CommandPolicy, error) {
+	var policyConfig *CommandPolicyConfig
+	if config.CommandPolicyPath != "" {
+		var err error
+		policyConfig, err = LoadCommandPolicyConfig(config.CommandPolicyPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return NewCommandPolicy(policyConfig)
+}
+
+// Pick the LLM client based on the configured model type, Claude and Gemini
+// models go through their native clients if we have a key for them, otherwise
+// we use the OpenAI client (which may point at a compatible proxy).
+func initDefaultLLM(config *ButterfishConfig) (LLM, error) {
+	hasToken := config.OpenAIToken != "" || config.AnthropicToken != "" ||
+		config.GeminiToken != ""
+
+	if hasToken && config.LLMClient != nil {
+		return nil, errors.New("Must provide either an API token or an LLM client, not both.")
+	} else if config.LLMClient != nil {
+		return config.LLMClient, nil
+	}
+
+	if config.OllamaBaseURL != "" {
+		ollama := NewOllama(config.OllamaBaseURL)
+		ollama.MaxContextLength = config.OllamaMaxContextLength
+		return ollama, nil
+	}
+
+	if config.ModelType == ModelTypeAnthropic && config.AnthropicToken != "" {
+		anthropic := NewAnthropic(config.AnthropicToken, config.AnthropicBaseURL)
+		anthropic.DefaultModel = config.ShellPromptModel
+		return anthropic, nil
+	}
+
+	if config.ModelType == ModelTypeGemini && config.GeminiToken != "" {
+		gemini := NewGemini(config.GeminiToken, config.GeminiBaseURL)
+		gemini.DefaultModel = config.ShellPromptModel
+		return gemini, nil
+	}
+
+	if config.OpenAIToken != "" {
 		gpt := NewGPT(config.OpenAIToken, config.BaseURL)
 		return gpt, nil
-	} else {
-		return config.LLMClient, nil
 	}
+
+	if config.ModelType == ModelTypeAnthropic {
+		return nil, errors.New("Claude model configured but no Anthropic API key found, set ANTHROPIC_API_KEY in butterfish.env or the environment.")
+	}
+	if config.ModelType == ModelTypeGemini {
+		return nil, errors.New("Gemini model configured but no Gemini API key found, set GEMINI_API_KEY in butterfish.env or the environment.")
+	}
+	return nil, errors.New("Must provide either an OpenAI Token or an LLM client.")
+}
+
+// Local models aren't in the model registry, so look up the context lengths
+// of the configured models on every Ollama client, whether it came from
+// BUTTERFISH_OLLAMA_URL or the providers file, before they're used to size
+// prompts.
+func discoverOllamaContextLengths(config *ButterfishConfig, llm LLM) {
+	models := []string{
+		config.ShellPromptModel,
+		config.ShellAutosuggestModel,
+		config.GencmdModel,
+		config.ExeccheckModel,
+		config.SummarizeModel,
+	}
+
+	visited := map[*Ollama]bool{}
+	var walk func(llm LLM, models []string)
+	walk = func(llm LLM, models []string) {
+		switch client := llm.(type) {
+		case *Ollama:
+			if !visited[client] {
+				visited[client] = true
+				client.DiscoverContextLengths(models)
+			}
+		case *RateLimitedLLM:
+			walk(client.inner, models)
+		case *RoutedLLM:
+			walk(client.Default, models)
+			for _, roleClient := range client.Roles {
+				walk(roleClient, models)
+			}
+		case *FallbackLLM:
+			for _, backend := range client.Backends {
+				if backend.Model != "" {
+					walk(backend.LLM, []string{backend.Model})
+				} else {
+					walk(backend.LLM, models)
+				}
+			}
+		}
+	}
+	walk(llm, models)
 }
 
 func initPromptLibrary(config *ButterfishConfig) (PromptLibrary, error) {
@@ -488,7 +766,18 @@ func initPromptLibrary(config *ButterfishConfig) (PromptLibrary, error) {
 }
 
 func NewButterfish(ctx context.Context, config *ButterfishConfig) (*ButterfishCtx, error) {
-	llmClient, err := initLLM(config)
+	models, err := LoadModelRegistry(config.ModelsPath)
+	if err != nil {
+		return nil, err
+	}
+	SetModelRegistry(models)
+
+	budget, err := initBudget(config)
+	if err != nil {
+		return nil, err
+	}
+
+	llmClient, err := initLLM(config, budget)
 	if err != nil {
 		return nil, err
 	}
@@ -498,6 +787,16 @@ func NewButterfish(ctx context.Context, config *ButterfishConfig) (*ButterfishCt
 		return nil, err
 	}
 
+	redactor, err := initRedactor(config)
+	if err != nil {
+		return nil, err
+	}
+
+	commandPolicy, err := initCommandPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 
 	butterfishCtx := &ButterfishCtx{
@@ -507,6 +806,9 @@ func NewButterfish(ctx context.Context, config *ButterfishConfig) (*ButterfishCt
 		InConsoleMode: false,
 		Config:        config,
 		LLMClient:     llmClient,
+		Budget:        budget,
+		Redactor:      redactor,
+		CommandPolicy: commandPolicy,
 		Out:           os.Stdout,
 	}
 
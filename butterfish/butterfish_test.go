@@ -1,9 +1,14 @@
 package butterfish
 
 import (
+	"bytes"
+	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
 )
 
 func TestFixCommandParse(t *testing.T) {
@@ -102,3 +107,180 @@ func TestIncompleteAnsiSequence(t *testing.T) {
 	assert.False(t, incompleteAnsiSequence([]byte{0x1b, 0x5b, 0x30, 0x3b, 0x31, 0x3b, 0x32, 0x6d, 0x1b, 0x5b, 0x30, 0x6d}))
 	assert.False(t, incompleteAnsiSequence([]byte{0x20, 0x20, 0x1b, 0x5b, 0x30, 0x3b, 0x31, 0x3b, 0x32, 0x6d, 0x1b, 0x5b, 0x30, 0x6d}))
 }
+
+func TestShellHistoryToolCalls(t *testing.T) {
+	history := NewShellHistory()
+	history.Append(historyTypePrompt, "list files")
+	history.Append(historyTypeLLMOutput, "Listing files.")
+
+	call := &util.ToolCall{Id: "call_1", Type: "function", Function: util.FunctionCall{Name: "command", Parameters: `{"cmd": "ls"}`}}
+	history.AddToolCalls([]*util.ToolCall{call})
+	history.AppendToolOutput("call_1", "foo.txt\n")
+	history.AppendToolOutput("call_1", "Exit Code: 0\n")
+
+	assert.Len(t, history.Blocks, 3)
+	assert.Equal(t, []*util.ToolCall{call}, history.Blocks[1].ToolCalls)
+	assert.Equal(t, "foo.txt\nExit Code: 0\n", history.Blocks[2].Content.String())
+
+	encoder := NewEstimateTokenizer(TokenizerClaude)
+	blocks, _ := getHistoryBlocksByTokens(history, encoder, 512, 4096, 0)
+	assert.Len(t, blocks, 3)
+	assert.Equal(t, "call_1", blocks[2].ToolCallId)
+
+	// without room for the call its output is dropped too
+	blocks, _ = getHistoryBlocksByTokens(history, encoder, 512, 12, 0)
+	assert.Empty(t, blocks)
+}
+
+func TestParseGoalModeJSON(t *testing.T) {
+	call, err := parseGoalModeJSON(`{"reasoning": "look around", "tool": "command", "arguments": {"cmd": "ls"}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "", call.Id)
+	assert.Equal(t, "command", call.Function.Name)
+	assert.Equal(t, `{"cmd": "ls"}`, call.Function.Parameters)
+
+	_, err = parseGoalModeJSON(`command({"cmd": "ls"})`)
+	assert.Error(t, err)
+	_, err = parseGoalModeJSON(`{"tool": "rm", "arguments": {}}`)
+	assert.Error(t, err)
+}
+
+func TestGoalModeLimits(t *testing.T) {
+	answers := &bytes.Buffer{}
+	state := &ShellState{
+		Butterfish: &ButterfishCtx{Config: &ButterfishConfig{
+			GoalModeMaxCommands: 3,
+			GoalModeMaxFailures: 2,
+		}},
+		ChildIn:                &bytes.Buffer{},
+		PromptGoalAnswerWriter: answers,
+		Color:                  DarkShellColorScheme,
+		History:                NewShellHistory(),
+		GoalModePlan:           &GoalPlan{Steps: []*PlanStep{{Description: "Fix the build", Status: PlanRunning}}},
+		GoalMode:               true,
+		GoalModeGoal:           "fix the build",
+		GoalModeUnsafe:         true,
+	}
+	tools := state.goalModeTools()
+	state.GoalModeAgent = NewAgent(tools)
+	state.GoalModeAgent.MaxSteps = 0
+	state.GoalModeAgent.Start()
+
+	run := func(cmd string, exitCode int) (string, error) {
+		call := &util.ToolCall{Id: "1", Function: util.FunctionCall{
+			Name: "command", Parameters: `{"cmd": "` + cmd + `"}`}}
+		output, err := tools.Get("command").Handler(context.Background(), call)
+		if err == ErrToolOutputPending {
+			state.goalModeCommandDone(exitCode)
+			state.ActiveToolCall = nil
+		}
+		return output, err
+	}
+
+	// the same command failing again stops goal mode, unless it changed
+	run("make", 2)
+	assert.NoError(t, state.goalModeLimits())
+	run("make", 2)
+	assert.ErrorContains(t, state.goalModeLimits(), "repeated failures limit of 2")
+	run("make clean", 0)
+	assert.NoError(t, state.goalModeLimits())
+
+	// a command over the limit isn't run, the model gets the summary
+	output, err := run("make", 0)
+	assert.NoError(t, err)
+	assert.False(t, state.GoalMode)
+	assert.Equal(t, `Exited goal mode with FAILURE. Agent stopped after reaching its commands limit of 3.
+The goal was: fix the build
+3 commands were run:
+  [exit 2] make
+  [exit 2] make
+  [exit 0] make clean
+The plan had 0/1 steps done:
+1. [running] Fix the build
+`, output)
+	assert.Contains(t, answers.String(), output)
+
+	// running out of time exits even while a command hasn't returned
+	state.GoalMode = true
+	state.goalModeCommands = nil
+	state.GoalModeAgent.MaxDuration = time.Millisecond
+	state.goalModeTimer = time.NewTimer(state.GoalModeAgent.MaxDuration)
+	_, err = tools.Get("command").Handler(context.Background(), &util.ToolCall{Id: "2",
+		Function: util.FunctionCall{Name: "command", Parameters: `{"cmd": "tail -f log"}`}})
+	assert.Equal(t, ErrToolOutputPending, err)
+	<-state.goalModeTimeout()
+	state.GoalModeTimedOut()
+	assert.False(t, state.GoalMode)
+	assert.Nil(t, state.ActiveToolCall)
+	assert.Nil(t, state.goalModeTimeout())
+	assert.Contains(t, answers.String(), "time limit of 1ms")
+	assert.Contains(t, answers.String(), "[not finished] tail -f log")
+}
+
+func TestGoalModeCommandInterrupted(t *testing.T) {
+	childIn := &bytes.Buffer{}
+	state := &ShellState{
+		Butterfish:             &ButterfishCtx{Config: &ButterfishConfig{}},
+		ChildIn:                childIn,
+		ParentOut:              &bytes.Buffer{},
+		PromptGoalAnswerWriter: &bytes.Buffer{},
+		Color:                  DarkShellColorScheme,
+		History:                NewShellHistory(),
+		GoalModePlan:           &GoalPlan{},
+		Prompt:                 NewShellBuffer(),
+		GoalMode:               true,
+		GoalModeGoal:           "list files",
+	}
+	tools := state.goalModeTools()
+	state.GoalModeAgent = NewAgent(tools)
+	state.GoalModeAgent.Start()
+
+	propose := func(id string) *util.ToolCall {
+		call := &util.ToolCall{Id: id, Function: util.FunctionCall{
+			Name: "command", Parameters: `{"cmd": "ls"}`}}
+		state.History.AddToolCalls([]*util.ToolCall{call})
+		_, err := tools.Get("command").Handler(context.Background(), call)
+		assert.Equal(t, ErrToolOutputPending, err)
+		return call
+	}
+
+	// an edit to the command goes in its output, right after the call
+	propose("call_1")
+	state.setState(stateShell)
+	state.Command = NewShellBuffer()
+	state.Command.Write(" -la")
+	state.ParentInput(context.Background(), []byte("\r"))
+	last := state.History.Blocks[len(state.History.Blocks)-1]
+	assert.Equal(t, historyTypeToolOutput, last.Type)
+	assert.Equal(t, "call_1", last.ToolCallId)
+	assert.Equal(t, "The user typed \" -la\" into the command before running it.\n", last.Content.String())
+	state.ActiveToolCall = nil
+
+	// a prompt instead of Enter answers the call and clears the shell's line
+	childIn.Reset()
+	propose("call_2")
+	// out of turns, so prompting again ends goal mode rather than calling a model
+	state.GoalModeAgent.MaxSteps = 1
+	state.GoalModeAgent.steps = 1
+	state.Prompt.Write("use find instead")
+	state.GoalModeChat()
+	assert.Equal(t, "ls\x15", childIn.String())
+	assert.Nil(t, state.ActiveToolCall)
+	blocks := state.History.Blocks
+	assert.Equal(t, []*util.ToolCall{{Id: "call_2", Function: util.FunctionCall{
+		Name: "command", Parameters: `{"cmd": "ls"}`}}}, blocks[len(blocks)-3].ToolCalls)
+	assert.Equal(t, "call_2", blocks[len(blocks)-2].ToolCallId)
+	assert.Equal(t, "The user interrupted this command and said: use find instead", blocks[len(blocks)-2].Content.String())
+	assert.False(t, state.GoalMode)
+}
+
+func TestParseCommandParams(t *testing.T) {
+	cmd, err := parseCommandParams(`{"cmd": "echo \"hi\""}`)
+	assert.NoError(t, err)
+	assert.Equal(t, `echo "hi"`, cmd)
+
+	// models sometimes don't escape quotes
+	cmd, err = parseCommandParams(`{"cmd": "echo "hi""}`)
+	assert.NoError(t, err)
+	assert.Equal(t, `echo "hi"`, cmd)
+}
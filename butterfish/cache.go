@@ -0,0 +1,266 @@
+package butterfish
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+// CachedLLM keeps responses to idempotent requests on disk so that identical
+// requests (autosuggest in particular re-asks the same thing many times) can
+// be answered without calling the API. Only requests with a temperature of 0
+// are cached since otherwise the caller is asking for variety. Entries are
+// keyed the same way as cassettes plus the model role, expire after a TTL,
+// and the oldest entries are removed when the cache grows past its size
+// limit. The cache is pruned on startup and then every cachePruneInterval or
+// after a tenth of the size limit has been written, rather than on every
+// write.
+
+const DefaultCacheTTL = 24 * time.Hour
+const DefaultCacheMaxBytes = 64 * 1024 * 1024
+const cachePruneInterval = time.Hour
+
+type cacheEntry struct {
+	Created  time.Time                `json:"created"`
+	Chunks   []string                 `json:"chunks,omitempty"`
+	Response *util.CompletionResponse `json:"response"`
+}
+
+type CachedLLM struct {
+	inner    LLM
+	path     string
+	ttl      time.Duration
+	maxBytes int64
+
+	mutex     sync.Mutex
+	lastPrune time.Time
+	written   int64
+}
+
+func NewCachedLLM(inner LLM, path string, ttl time.Duration, maxBytes int64) (*CachedLLM, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(path, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultCacheMaxBytes
+	}
+
+	cache := &CachedLLM{
+		inner:    inner,
+		path:     path,
+		ttl:      ttl,
+		maxBytes: maxBytes,
+	}
+	cache.prune()
+	return cache, nil
+}
+
+func isCacheable(request *util.CompletionRequest) bool {
+	return request.Temperature == 0
+}
+
+// Cassettes deliberately ignore routing, but with providers configured the
+// same model name can go to a different backend per role, so the cache keys
+// on the role as well.
+func cacheRequestKey(call string, request *util.CompletionRequest) string {
+	key := request.ModelRole + "\n" + cassetteRequestKey(call, request, nil)
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func (this *CachedLLM) entryPath(key string) string {
+	return filepath.Join(this.path, key+".json")
+}
+
+func (this *CachedLLM) get(key string) *cacheEntry {
+	path := this.entryPath(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var entry cacheEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil || entry.Response == nil {
+		os.Remove(path)
+		return nil
+	}
+
+	if time.Since(entry.Created) > this.ttl {
+		os.Remove(path)
+		return nil
+	}
+
+	return &entry
+}
+
+func (this *CachedLLM) put(key string, entry *cacheEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Cache: error encoding entry: %s", err)
+		return
+	}
+
+	// write then rename so concurrent readers never see a partial entry
+	tmp, err := os.CreateTemp(this.path, "tmp-*")
+	if err != nil {
+		log.Printf("Cache: error writing entry: %s", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), this.entryPath(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Cache: error writing entry: %s", err)
+		return
+	}
+
+	this.mutex.Lock()
+	this.written += int64(len(data))
+	due := this.written > this.maxBytes/10 || time.Since(this.lastPrune) > cachePruneInterval
+	this.mutex.Unlock()
+	if due {
+		this.prune()
+	}
+}
+
+// Remove expired entries, then the oldest entries until we're under the
+// size limit.
+func (this *CachedLLM) prune() {
+	this.mutex.Lock()
+	this.lastPrune = time.Now()
+	this.written = 0
+	this.mutex.Unlock()
+
+	dirEntries, err := os.ReadDir(this.path)
+	if err != nil {
+		return
+	}
+
+	type cacheFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	files := []cacheFile{}
+	var total int64
+	for _, dirEntry := range dirEntries {
+		if !strings.HasSuffix(dirEntry.Name(), ".json") {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+
+		path := filepath.Join(this.path, dirEntry.Name())
+		if time.Since(info.ModTime()) > this.ttl {
+			os.Remove(path)
+			continue
+		}
+
+		files = append(files, cacheFile{path, info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+
+	if total <= this.maxBytes {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, file := range files {
+		if total <= this.maxBytes {
+			break
+		}
+		os.Remove(file.path)
+		total -= file.size
+	}
+}
+
+func (this *CachedLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	if !isCacheable(request) {
+		return this.inner.CompletionStream(request, writer)
+	}
+
+	key := cacheRequestKey(cassetteCallStream, request)
+	if entry := this.get(key); entry != nil {
+		if request.Verbose {
+			log.Printf("Cache: serving %s request from cache", request.Model)
+		}
+		for _, chunk := range entry.Chunks {
+			writer.Write([]byte(chunk))
+		}
+		return entry.Response, nil
+	}
+
+	recorder := &chunkRecorder{writer: writer}
+	response, err := this.inner.CompletionStream(request, recorder)
+	if err != nil {
+		return nil, err
+	}
+
+	this.put(key, &cacheEntry{
+		Created:  time.Now(),
+		Chunks:   recorder.chunks,
+		Response: response,
+	})
+	return response, nil
+}
+
+func (this *CachedLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	if !isCacheable(request) {
+		return this.inner.Completion(request)
+	}
+
+	key := cacheRequestKey(cassetteCallCompletion, request)
+	if entry := this.get(key); entry != nil {
+		if request.Verbose {
+			log.Printf("Cache: serving %s request from cache", request.Model)
+		}
+		return entry.Response, nil
+	}
+
+	response, err := this.inner.Completion(request)
+	if err != nil {
+		return nil, err
+	}
+
+	this.put(key, &cacheEntry{
+		Created:  time.Now(),
+		Response: response,
+	})
+	return response, nil
+}
+
+func (this *CachedLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return this.inner.Embeddings(ctx, input, verbose)
+}
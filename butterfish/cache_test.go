@@ -0,0 +1,61 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+func TestCachedLLM(t *testing.T) {
+	scripted := &scriptedLLM{responses: []*util.CompletionResponse{
+		{Completion: "ls -la"},
+		{Completion: "ls -lh"},
+		{Completion: "ls -R"},
+		{Completion: "ls -a"},
+	}}
+	cache, err := NewCachedLLM(scripted, t.TempDir(), time.Hour, 0)
+	assert.NoError(t, err)
+
+	request := &util.CompletionRequest{
+		Ctx:    context.Background(),
+		Model:  "gpt-4o-mini",
+		Prompt: "ls",
+	}
+
+	// the second identical request is replayed from the cache
+	for i := 0; i < 2; i++ {
+		out := &bytes.Buffer{}
+		resp, err := cache.CompletionStream(request, out)
+		assert.NoError(t, err)
+		assert.Equal(t, "ls -la", resp.Completion)
+		assert.Equal(t, "\x1b[0mls -la", out.String())
+	}
+	assert.Equal(t, 1, scripted.calls)
+
+	// non-zero temperature isn't cached
+	request.Temperature = 0.7
+	resp, err := cache.CompletionStream(request, &bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.Equal(t, "ls -lh", resp.Completion)
+	assert.Equal(t, 2, scripted.calls)
+
+	// expired entries are refetched
+	cache.ttl = time.Nanosecond
+	request.Temperature = 0
+	resp, err = cache.CompletionStream(request, &bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.Equal(t, "ls -R", resp.Completion)
+
+	// the same request routed by another role can hit a different provider
+	cache.ttl = time.Hour
+	request.ModelRole = ModelRoleAutosuggest
+	resp, err = cache.CompletionStream(request, &bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.Equal(t, "ls -a", resp.Completion)
+	assert.Equal(t, 4, scripted.calls)
+}
@@ -0,0 +1,366 @@
+package butterfish
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/go-homedir"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+// CassetteLLM records LLM interactions to a file (a cassette) and replays
+// them later, so that end-to-end behaviour like goal mode or edit can be
+// tested without a network. Requests are keyed by a hash of the parts of the
+// request that affect the answer, streamed responses keep their chunks so
+// that replaying writes the same output the same way.
+//
+// Modes:
+//   - record: always call the wrapped client, starting a fresh cassette
+//   - replay: replay known requests, record unknown ones
+//   - strict: replay known requests, fail on unknown ones
+
+const (
+	CassetteModeRecord = "record"
+	CassetteModeReplay = "replay"
+	CassetteModeStrict = "strict"
+)
+
+const (
+	cassetteCallStream     = "stream"
+	cassetteCallCompletion = "completion"
+	cassetteCallEmbeddings = "embeddings"
+)
+
+type CassetteInteraction struct {
+	Key  string `json:"key"`
+	Call string `json:"call"`
+	// Model and prompt aren't used for matching, they make the file readable
+	Model      string                   `json:"model,omitempty"`
+	Prompt     string                   `json:"prompt,omitempty"`
+	Chunks     []string                 `json:"chunks,omitempty"`
+	Response   *util.CompletionResponse `json:"response,omitempty"`
+	Embeddings [][]float32              `json:"embeddings,omitempty"`
+}
+
+type cassetteFile struct {
+	Interactions []CassetteInteraction `json:"interactions"`
+}
+
+type CassetteLLM struct {
+	inner LLM
+	path  string
+	mode  string
+
+	mutex        sync.Mutex
+	interactions []CassetteInteraction
+	// number of times each key has been replayed, identical requests are
+	// replayed in the order they were recorded
+	played map[string]int
+}
+
+// Wrap inner with a cassette at path. In strict mode inner may be nil since
+// it's never called.
+func NewCassetteLLM(inner LLM, path, mode string) (*CassetteLLM, error) {
+	if mode == "" {
+		mode = CassetteModeReplay
+	}
+	if mode != CassetteModeRecord && mode != CassetteModeReplay && mode != CassetteModeStrict {
+		return nil, fmt.Errorf("Unknown cassette mode %s, expected record, replay or strict", mode)
+	}
+	if inner == nil && mode != CassetteModeStrict {
+		return nil, fmt.Errorf("Cassette mode %s needs an LLM client to record from", mode)
+	}
+
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cassette := &CassetteLLM{
+		inner:  inner,
+		path:   path,
+		mode:   mode,
+		played: map[string]int{},
+	}
+
+	// record mode starts from scratch, so we don't load
+	if mode == CassetteModeRecord {
+		return cassette, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && mode == CassetteModeReplay {
+		return cassette, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var file cassetteFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing cassette %s: %s", path, err)
+	}
+	cassette.interactions = file.Interactions
+
+	return cassette, nil
+}
+
+// The parts of a request that determine the answer. Context, verbosity,
+// timeouts and routing are left out, and text is stripped of ANSI escapes and
+// surrounding whitespace since those vary between terminals.
+type cassetteKey struct {
+	Call           string
+	Model          string
+	Prompt         string
+	SystemMessage  string
+	MaxTokens      int
+	Temperature    float32
+	HistoryBlocks  []util.HistoryBlock
+	Functions      []util.FunctionDefinition
+	Tools          []util.ToolDefinition
+	Images         []util.ImageContent
+	ResponseSchema json.RawMessage
+	Input          []string
+}
+
+func normalizeCassetteText(s string) string {
+	return strings.TrimSpace(ansiRegexp.ReplaceAllString(s, ""))
+}
+
+// The summary after a finished command, see commandSummary, has its duration
+// and the date it ran, which change on every recording
+var cassetteCommandSummary = regexp.MustCompile(`\s*\[(exit -?\d+|running)(, [^\]]*)?\]$`)
+
+// History blocks with command summaries stripped, and tool call ids, which
+// some clients make up at random, replaced by their order in the request
+func normalizeCassetteHistory(blocks []util.HistoryBlock) []util.HistoryBlock {
+	ids := map[string]string{}
+	normalizeId := func(id string) string {
+		if id == "" {
+			return ""
+		}
+		if _, ok := ids[id]; !ok {
+			ids[id] = fmt.Sprintf("call_%d", len(ids))
+		}
+		return ids[id]
+	}
+
+	normalized := []util.HistoryBlock{}
+	for _, block := range blocks {
+		block.Content = normalizeCassetteText(block.Content)
+		if block.Type == historyTypeShellInput {
+			block.Content = cassetteCommandSummary.ReplaceAllString(block.Content, "")
+		}
+
+		toolCalls := block.ToolCalls
+		block.ToolCalls = nil
+		for _, toolCall := range toolCalls {
+			call := *toolCall
+			call.Id = normalizeId(call.Id)
+			block.ToolCalls = append(block.ToolCalls, &call)
+		}
+		block.ToolCallId = normalizeId(block.ToolCallId)
+
+		normalized = append(normalized, block)
+	}
+	return normalized
+}
+
+func cassetteRequestKey(call string, request *util.CompletionRequest, input []string) string {
+	key := cassetteKey{Call: call}
+
+	if request != nil {
+		key.Model = request.Model
+		key.Prompt = normalizeCassetteText(request.Prompt)
+		key.SystemMessage = normalizeCassetteText(request.SystemMessage)
+		key.MaxTokens = request.MaxTokens
+		key.Temperature = request.Temperature
+		key.Functions = request.Functions
+		key.Tools = request.Tools
+		key.Images = request.Images
+		key.ResponseSchema = request.ResponseSchema
+
+		if len(request.HistoryBlocks) > 0 {
+			key.HistoryBlocks = normalizeCassetteHistory(request.HistoryBlocks)
+		}
+	}
+
+	for _, s := range input {
+		key.Input = append(key.Input, normalizeCassetteText(s))
+	}
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		panic(err)
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// Find the next recorded interaction for a key, if a request was made more
+// times than it was recorded then the last recording is reused.
+func (this *CassetteLLM) lookup(key string) *CassetteInteraction {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	matches := []int{}
+	for i := range this.interactions {
+		if this.interactions[i].Key == key {
+			matches = append(matches, i)
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+
+	n := this.played[key]
+	this.played[key] = n + 1
+	if n >= len(matches) {
+		n = len(matches) - 1
+	}
+
+	interaction := this.interactions[matches[n]]
+	return &interaction
+}
+
+func (this *CassetteLLM) record(interaction CassetteInteraction) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.interactions = append(this.interactions, interaction)
+
+	data, err := json.MarshalIndent(cassetteFile{Interactions: this.interactions}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(this.path), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(this.path, data, 0644)
+}
+
+// Returns the recorded interaction for the key, or nil if the request should
+// go to the wrapped client.
+func (this *CassetteLLM) replay(key string, request *util.CompletionRequest) (*CassetteInteraction, error) {
+	if this.mode == CassetteModeRecord {
+		return nil, nil
+	}
+
+	interaction := this.lookup(key)
+	if interaction != nil {
+		return interaction, nil
+	}
+
+	if this.mode == CassetteModeStrict {
+		summary := ""
+		if request != nil {
+			summary = fmt.Sprintf(" (model %s, prompt %q)", request.Model, request.Prompt)
+		}
+		return nil, fmt.Errorf("No recording in cassette %s for request %s%s", this.path, key[:12], summary)
+	}
+	return nil, nil
+}
+
+// Records each chunk written to the underlying writer
+type chunkRecorder struct {
+	writer io.Writer
+	chunks []string
+}
+
+func (this *chunkRecorder) Write(p []byte) (int, error) {
+	this.chunks = append(this.chunks, string(p))
+	return this.writer.Write(p)
+}
+
+func (this *CassetteLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	key := cassetteRequestKey(cassetteCallStream, request, nil)
+	interaction, err := this.replay(key, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if interaction != nil {
+		for _, chunk := range interaction.Chunks {
+			writer.Write([]byte(chunk))
+		}
+		return interaction.Response, nil
+	}
+
+	recorder := &chunkRecorder{writer: writer}
+	response, err := this.inner.CompletionStream(request, recorder)
+	if err != nil {
+		return nil, err
+	}
+
+	err = this.record(CassetteInteraction{
+		Key:      key,
+		Call:     cassetteCallStream,
+		Model:    request.Model,
+		Prompt:   request.Prompt,
+		Chunks:   recorder.chunks,
+		Response: response,
+	})
+	return response, err
+}
+
+func (this *CassetteLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	key := cassetteRequestKey(cassetteCallCompletion, request, nil)
+	interaction, err := this.replay(key, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if interaction != nil {
+		return interaction.Response, nil
+	}
+
+	response, err := this.inner.Completion(request)
+	if err != nil {
+		return nil, err
+	}
+
+	err = this.record(CassetteInteraction{
+		Key:      key,
+		Call:     cassetteCallCompletion,
+		Model:    request.Model,
+		Prompt:   request.Prompt,
+		Response: response,
+	})
+	return response, err
+}
+
+func (this *CassetteLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	key := cassetteRequestKey(cassetteCallEmbeddings, nil, input)
+	interaction, err := this.replay(key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if interaction != nil {
+		return interaction.Embeddings, nil
+	}
+
+	embeddings, err := this.inner.Embeddings(ctx, input, verbose)
+	if err != nil {
+		return nil, err
+	}
+
+	err = this.record(CassetteInteraction{
+		Key:        key,
+		Call:       cassetteCallEmbeddings,
+		Embeddings: embeddings,
+	})
+	return embeddings, err
+}
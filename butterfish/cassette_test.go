@@ -0,0 +1,119 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+// LLM that streams a fixed sequence of responses, one per call
+type scriptedLLM struct {
+	namedLLM
+	responses []*util.CompletionResponse
+	calls     int
+}
+
+func (this *scriptedLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	response := this.responses[this.calls]
+	this.calls++
+	writer.Write([]byte("\x1b[0m"))
+	writer.Write([]byte(response.Completion))
+	return response, nil
+}
+
+func runCassetteEdit(t *testing.T, llm LLM) (*LineBuffer, string) {
+	out := &bytes.Buffer{}
+	ctx := &ButterfishCtx{
+		Ctx:       context.Background(),
+		Out:       out,
+		Config:    MakeButterfishConfig(),
+		LLMClient: llm,
+	}
+
+	options := &CliCommandConfig{}
+	options.Edit.Model = "gpt-4o"
+	options.Edit.NoColor = true
+
+	lineBuffer := &LineBuffer{Lines: []string{"package main", "", "func main() {}"}}
+	err := ctx.EditLineBuffer(lineBuffer, "add a print", options)
+	assert.NoError(t, err)
+	return lineBuffer, out.String()
+}
+
+func TestCassetteEditReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "edit.json")
+	scripted := &scriptedLLM{responses: []*util.CompletionResponse{
+		{
+			Completion: "Adding a print.",
+			ToolCalls: []*util.ToolCall{{
+				Id:   "call_1",
+				Type: "function",
+				Function: util.FunctionCall{
+					Name:       "edit",
+					Parameters: `{"range_start": 3, "range_end": 3, "code_edit": "func main() { println(\"hi\") }\n"}`,
+				},
+			}},
+		},
+		{Completion: "DONE!"},
+	}}
+
+	recorder, err := NewCassetteLLM(scripted, path, CassetteModeRecord)
+	assert.NoError(t, err)
+	recorded, recordedOut := runCassetteEdit(t, recorder)
+	assert.Equal(t, 2, scripted.calls)
+
+	// strict replay needs no client
+	replayer, err := NewCassetteLLM(nil, path, CassetteModeStrict)
+	assert.NoError(t, err)
+	replayed, replayedOut := runCassetteEdit(t, replayer)
+
+	assert.Equal(t, recorded.String(), replayed.String())
+	assert.Equal(t, recordedOut, replayedOut)
+	assert.Contains(t, replayed.String(), `println("hi")`)
+
+	// unknown requests fail in strict mode
+	_, err = replayer.CompletionStream(&util.CompletionRequest{Prompt: "something else"}, io.Discard)
+	assert.Error(t, err)
+}
+
+func TestCassetteShellHistoryReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shell.json")
+
+	// the same shell session at a different time, with made up tool call ids
+	request := func(ranAt time.Time) *util.CompletionRequest {
+		history := NewShellHistory()
+		history.Append(historyTypeShellInput, "make")
+		history.Blocks[0].Time = ranAt
+		history.Append(historyTypeShellOutput, "missing target")
+		history.FinishCommand(2)
+		id := newToolCallId()
+		history.Append(historyTypePrompt, "!fix the build")
+		history.AddToolCalls([]*util.ToolCall{{Id: id, Function: util.FunctionCall{
+			Name: "command", Parameters: `{"cmd": "make all"}`}}})
+		history.AppendToolOutput(id, "ok")
+
+		encoder := NewEstimateTokenizer(TokenizerClaude)
+		blocks, _ := getHistoryBlocksByTokens(history, encoder, 512, 4096, 0)
+		assert.Contains(t, blocks[0].Content, "[exit 2, ")
+		return &util.CompletionRequest{Model: "gpt-4o", Prompt: "what next?", HistoryBlocks: blocks}
+	}
+
+	scripted := &scriptedLLM{responses: []*util.CompletionResponse{{Completion: "DONE!"}}}
+	recorder, err := NewCassetteLLM(scripted, path, CassetteModeRecord)
+	assert.NoError(t, err)
+	_, err = recorder.CompletionStream(request(time.Now().Add(-36*time.Hour)), io.Discard)
+	assert.NoError(t, err)
+
+	replayer, err := NewCassetteLLM(nil, path, CassetteModeStrict)
+	assert.NoError(t, err)
+	response, err := replayer.CompletionStream(request(time.Now().Add(-time.Second)), io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, "DONE!", response.Completion)
+}
@@ -0,0 +1,648 @@
+package butterfish
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// Goal mode saves a checkpoint of the working tree before each command it
+// runs, so the user can undo what the agent changed with the Undo and Rewind
+// prompts.
+//
+// In a git repository a checkpoint is a pair of commits like the ones git
+// stash makes, one with the index and one with the working tree including
+// untracked files, kept from garbage collection by a ref under
+// refs/butterfish/checkpoints. Restoring one puts back the files, the index
+// and HEAD. Ignored files, like .env, are copied to the file store below, but
+// ignored directories, like node_modules, are left out.
+//
+// Elsewhere the directory is scanned and its files copied to a temporary
+// content-addressed store, later scans only read the files whose size or
+// modification time changed.
+
+const DefaultMaxCheckpoints = 50
+
+// Limits for checkpoints of directories that aren't git repositories
+const (
+	checkpointMaxFiles      = 20000
+	checkpointMaxFileBytes  = 16 * 1024 * 1024
+	checkpointMaxTotalBytes = 256 * 1024 * 1024
+)
+
+const checkpointRefPrefix = "refs/butterfish/checkpoints/"
+
+// Commits need an identity, and the user may not have configured one
+var checkpointGitIdentity = []string{
+	"GIT_AUTHOR_NAME=butterfish",
+	"GIT_AUTHOR_EMAIL=butterfish@localhost",
+	"GIT_COMMITTER_NAME=butterfish",
+	"GIT_COMMITTER_EMAIL=butterfish@localhost",
+}
+
+type Checkpoint struct {
+	// The command the checkpoint was saved before
+	Command string
+	// The directory it restores, the top of the repository for git
+	Dir  string
+	Time time.Time
+	// Ignored directories of a git repository, which aren't restored
+	IgnoredDirs []string
+
+	git   *gitCheckpoint
+	files fileManifest
+}
+
+// The checkpoints of a shell session, oldest first
+type Checkpoints struct {
+	list  []*Checkpoint
+	max   int
+	count int
+	// where file contents are copied, made on first use
+	store string
+	// the last scan of each directory
+	scans map[string]fileManifest
+}
+
+func NewCheckpoints(max int) *Checkpoints {
+	return &Checkpoints{
+		max:   max,
+		scans: map[string]fileManifest{},
+	}
+}
+
+func (this *Checkpoints) Len() int {
+	return len(this.list)
+}
+
+// Save a checkpoint of dir before running command, the oldest checkpoint is
+// dropped once there are more than the maximum
+func (this *Checkpoints) Create(dir, command string) (*Checkpoint, error) {
+	checkpoint := &Checkpoint{Command: command, Dir: dir, Time: time.Now()}
+	if err := checkpointAllowed(dir); err != nil {
+		return nil, err
+	}
+
+	if root, err := runGit(dir, nil, "", "rev-parse", "--show-toplevel"); err == nil {
+		if err := checkpointAllowed(root); err != nil {
+			return nil, err
+		}
+		this.count++
+		ref := fmt.Sprintf("%s%d-%d", checkpointRefPrefix, os.Getpid(), this.count)
+		checkpoint.Dir = root
+		checkpoint.git, err = gitSnapshot(root, ref, command)
+		if err == nil {
+			err = this.snapshotIgnored(checkpoint)
+		}
+		if err != nil {
+			checkpoint.drop()
+			return nil, fmt.Errorf("Error saving a checkpoint of %s: %s", root, err)
+		}
+	} else {
+		checkpoint.files, err = this.snapshotFiles(dir)
+		if err != nil {
+			return nil, fmt.Errorf("Error saving a checkpoint of %s: %s", dir, err)
+		}
+	}
+
+	this.list = append(this.list, checkpoint)
+	if len(this.list) > this.max {
+		this.list[0].drop()
+		this.list = this.list[1:]
+	}
+	return checkpoint, nil
+}
+
+// Restore the checkpoint saved before the nth last command and drop it and
+// the ones after it, returns the restored checkpoint
+func (this *Checkpoints) Rewind(n int) (*Checkpoint, error) {
+	if n < 1 || n > len(this.list) {
+		return nil, fmt.Errorf("There are %d checkpoints, can't rewind %d commands", len(this.list), n)
+	}
+
+	index := len(this.list) - n
+	checkpoint := this.list[index]
+	var err error
+	if checkpoint.git != nil {
+		err = checkpoint.git.restore()
+		if err == nil {
+			err = restoreIgnored(checkpoint.Dir, checkpoint.files, this.store)
+		}
+	} else {
+		err = restoreFiles(checkpoint.Dir, checkpoint.files, this.store)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error restoring the checkpoint of %s: %s", checkpoint.Dir, err)
+	}
+
+	for _, dropped := range this.list[index:] {
+		dropped.drop()
+	}
+	this.list = this.list[:index]
+	return checkpoint, nil
+}
+
+// Drop all checkpoints and remove their refs and copied files
+func (this *Checkpoints) Close() {
+	for _, checkpoint := range this.list {
+		checkpoint.drop()
+	}
+	this.list = nil
+	if this.store != "" {
+		os.RemoveAll(this.store)
+		this.store = ""
+	}
+}
+
+func (this *Checkpoint) drop() {
+	if this.git != nil {
+		runGit(this.git.repo, nil, "", "update-ref", "-d", this.git.ref)
+	}
+}
+
+// The home directory and / are too big to copy and restoring them would undo
+// far more than the agent did, so they aren't checkpointed
+func checkpointAllowed(dir string) error {
+	dir = filepath.Clean(dir)
+	if dir == string(filepath.Separator) {
+		return fmt.Errorf("Skipped the checkpoint of %s, the root directory isn't checkpointed", dir)
+	}
+	if home, err := homedir.Dir(); err == nil && dir == filepath.Clean(home) {
+		return fmt.Errorf("Skipped the checkpoint of %s, the home directory isn't checkpointed", dir)
+	}
+	return nil
+}
+
+// Run git in dir and return its trimmed output
+func runGit(dir string, env []string, stdin string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], message)
+		}
+		return "", fmt.Errorf("git %s: %s", args[0], err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+type gitCheckpoint struct {
+	repo string
+	ref  string
+	// trees of the working tree and the index
+	tree  string
+	index string
+	// the commit and the branch HEAD pointed to, empty in a new repository
+	// and when HEAD is detached
+	head   string
+	branch string
+}
+
+func gitSnapshot(repo, ref, command string) (*gitCheckpoint, error) {
+	this := &gitCheckpoint{repo: repo, ref: ref}
+	var err error
+	if this.index, err = runGit(repo, nil, "", "write-tree"); err != nil {
+		return nil, err
+	}
+	if this.tree, err = this.worktree(); err != nil {
+		return nil, err
+	}
+	this.head, _ = runGit(repo, nil, "", "rev-parse", "--verify", "-q", "HEAD")
+	this.branch, _ = runGit(repo, nil, "", "symbolic-ref", "-q", "HEAD")
+
+	// commit the trees the way git stash does so they're kept
+	var parents []string
+	if this.head != "" {
+		parents = []string{"-p", this.head}
+	}
+	indexCommit, err := runGit(repo, checkpointGitIdentity, "",
+		append([]string{"commit-tree", this.index, "-m", "butterfish index"}, parents...)...)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := runGit(repo, checkpointGitIdentity, "",
+		append([]string{"commit-tree", this.tree, "-m", "butterfish checkpoint before: " + command},
+			append(parents, "-p", indexCommit)...)...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := runGit(repo, nil, "", "update-ref", ref, commit); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+// Write a tree of the working tree as git add -A would stage it, using a copy
+// of the index so the real one isn't touched
+func (this *gitCheckpoint) worktree() (string, error) {
+	index, err := this.tempIndex(true)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(index)
+
+	env := []string{"GIT_INDEX_FILE=" + index}
+	if _, err := runGit(this.repo, env, "", "add", "-A"); err != nil {
+		return "", err
+	}
+	return runGit(this.repo, env, "", "write-tree")
+}
+
+// Path for a temporary index file, a copy of the real index speeds up git add
+// since it knows which files are unchanged
+func (this *gitCheckpoint) tempIndex(copyIndex bool) (string, error) {
+	file, err := os.CreateTemp("", "butterfish-index-")
+	if err != nil {
+		return "", err
+	}
+	path := file.Name()
+	file.Close()
+	// git wants a missing file rather than an empty one
+	os.Remove(path)
+
+	if !copyIndex {
+		return path, nil
+	}
+	real, err := runGit(this.repo, nil, "", "rev-parse", "--git-path", "index")
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(real) {
+		real = filepath.Join(this.repo, real)
+	}
+	data, err := os.ReadFile(real)
+	if os.IsNotExist(err) {
+		return path, nil
+	} else if err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, data, 0600)
+}
+
+func (this *gitCheckpoint) restore() error {
+	current, err := this.worktree()
+	if err != nil {
+		return err
+	}
+	diff, err := runGit(this.repo, nil, "", "diff-tree", "-r", "-z", "--no-renames", "--name-status", this.tree, current)
+	if err != nil {
+		return err
+	}
+
+	// remove the files that were added, and check out the rest
+	var paths []string
+	fields := strings.Split(strings.TrimSuffix(diff, "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		status, path := fields[i], fields[i+1]
+		if status != "A" {
+			paths = append(paths, path)
+			continue
+		}
+		err := os.Remove(filepath.Join(this.repo, path))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removeEmptyDirs(this.repo, filepath.Dir(path))
+	}
+
+	if len(paths) > 0 {
+		index, err := this.tempIndex(false)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(index)
+
+		env := []string{"GIT_INDEX_FILE=" + index}
+		if _, err := runGit(this.repo, env, "", "read-tree", this.tree); err != nil {
+			return err
+		}
+		stdin := strings.Join(paths, "\x00") + "\x00"
+		if _, err := runGit(this.repo, env, stdin, "checkout-index", "-f", "-z", "--stdin"); err != nil {
+			return err
+		}
+	}
+
+	// commands may have switched branches, committed or staged files
+	if this.branch != "" {
+		branch, _ := runGit(this.repo, nil, "", "symbolic-ref", "-q", "HEAD")
+		if branch != this.branch {
+			if _, err := runGit(this.repo, nil, "", "symbolic-ref", "HEAD", this.branch); err != nil {
+				return err
+			}
+		}
+	}
+	head, _ := runGit(this.repo, nil, "", "rev-parse", "--verify", "-q", "HEAD")
+	if this.head != "" && head != this.head {
+		args := []string{"update-ref", "HEAD", this.head}
+		if this.branch == "" {
+			args = []string{"update-ref", "--no-deref", "HEAD", this.head}
+		}
+		if _, err := runGit(this.repo, nil, "", args...); err != nil {
+			return err
+		}
+	}
+	_, err = runGit(this.repo, nil, "", "read-tree", this.index)
+	return err
+}
+
+// Remove dir and its parents below root while they're empty
+func removeEmptyDirs(root, dir string) {
+	for dir != "." && dir != string(filepath.Separator) {
+		if os.Remove(filepath.Join(root, dir)) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+type fileEntry struct {
+	Mode    fs.FileMode
+	Size    int64
+	ModTime time.Time
+	// sha256 of the contents, empty if the file was too big to copy
+	Hash string
+	// the target of a symlink
+	Link string
+}
+
+// The files in a directory by relative path
+type fileManifest map[string]fileEntry
+
+func (this fileEntry) unchanged(info fs.FileInfo) bool {
+	return info.Mode() == this.Mode && info.Size() == this.Size && info.ModTime().Equal(this.ModTime)
+}
+
+// Only regular files, directories and symlinks are checkpointed
+func checkpointable(mode fs.FileMode) bool {
+	return mode.IsRegular() || mode.IsDir() || mode&fs.ModeSymlink != 0
+}
+
+// The directory file contents are copied to, made on first use
+func (this *Checkpoints) fileStore() (string, error) {
+	if this.store == "" {
+		store, err := os.MkdirTemp("", "butterfish-checkpoints-")
+		if err != nil {
+			return "", err
+		}
+		this.store = store
+	}
+	return this.store, nil
+}
+
+// Copy the ignored files of a git checkpoint, which git add -A leaves out.
+// Whole ignored directories are only listed, they tend to be dependencies or
+// build output that are too big to copy and can be made again.
+func (this *Checkpoints) snapshotIgnored(checkpoint *Checkpoint) error {
+	output, err := runGit(checkpoint.Dir, nil, "", "ls-files", "-z", "--others", "--ignored", "--exclude-standard", "--directory")
+	if err != nil || output == "" {
+		return err
+	}
+	store, err := this.fileStore()
+	if err != nil {
+		return err
+	}
+
+	checkpoint.files = fileManifest{}
+	var totalBytes int64
+	for _, rel := range strings.Split(strings.TrimSuffix(output, "\x00"), "\x00") {
+		if strings.HasSuffix(rel, "/") {
+			checkpoint.IgnoredDirs = append(checkpoint.IgnoredDirs, rel)
+			continue
+		}
+
+		path := filepath.Join(checkpoint.Dir, rel)
+		info, err := os.Lstat(path)
+		if err != nil || !checkpointable(info.Mode()) {
+			continue
+		}
+		file := fileEntry{Mode: info.Mode(), Size: info.Size(), ModTime: info.ModTime()}
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			file.Link, err = os.Readlink(path)
+		case info.Size() <= checkpointMaxFileBytes && totalBytes+info.Size() <= checkpointMaxTotalBytes:
+			file.Hash, err = storeFile(store, path)
+			totalBytes += info.Size()
+		}
+		if err != nil {
+			return err
+		}
+		checkpoint.files[rel] = file
+	}
+	return nil
+}
+
+// Put back the ignored files of a git checkpoint. Ignored files made since
+// are kept, since git doesn't track them they may be wanted.
+func restoreIgnored(dir string, manifest fileManifest, store string) error {
+	var tooBig []string
+	for rel, file := range manifest {
+		path := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		restored, err := restoreEntry(path, file, store)
+		if err != nil {
+			return err
+		}
+		if !restored {
+			tooBig = append(tooBig, rel)
+		}
+	}
+
+	if len(tooBig) > 0 {
+		sort.Strings(tooBig)
+		return fmt.Errorf("These files were too big to checkpoint and weren't restored: %s", strings.Join(tooBig, ", "))
+	}
+	return nil
+}
+
+func (this *Checkpoints) snapshotFiles(dir string) (fileManifest, error) {
+	if _, err := this.fileStore(); err != nil {
+		return nil, err
+	}
+
+	last := this.scans[dir]
+	manifest := fileManifest{}
+	var totalBytes int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." || !checkpointable(entry.Type()) {
+			return err
+		}
+		if len(manifest) >= checkpointMaxFiles {
+			return fmt.Errorf("There are more than %d files, too many to checkpoint", checkpointMaxFiles)
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		file := fileEntry{Mode: info.Mode(), Size: info.Size(), ModTime: info.ModTime()}
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			file.Link, err = os.Readlink(path)
+		case !info.Mode().IsRegular():
+		case last[rel].unchanged(info):
+			file.Hash = last[rel].Hash
+		case info.Size() <= checkpointMaxFileBytes:
+			file.Hash, err = storeFile(this.store, path)
+		}
+		if file.Hash != "" {
+			totalBytes += info.Size()
+			if totalBytes > checkpointMaxTotalBytes {
+				return fmt.Errorf("There are more than %d MB of files, too much to checkpoint", checkpointMaxTotalBytes/(1024*1024))
+			}
+		}
+		manifest[rel] = file
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	this.scans[dir] = manifest
+	return manifest, nil
+}
+
+// Copy a file into the store named by the hash of its contents
+func storeFile(store, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	object := filepath.Join(store, hash[:2], hash[2:])
+	if _, err := os.Stat(object); err == nil {
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(object), 0700); err != nil {
+		return "", err
+	}
+	temp := object + ".tmp"
+	if err := os.WriteFile(temp, data, 0600); err != nil {
+		return "", err
+	}
+	return hash, os.Rename(temp, object)
+}
+
+// Put dir back the way it was in the manifest
+func restoreFiles(dir string, manifest fileManifest, store string) error {
+	// remove what wasn't there before, a removed directory goes as a whole
+	var extra []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." || !checkpointable(entry.Type()) {
+			return err
+		}
+		if file, ok := manifest[rel]; !ok || file.Mode.Type() != entry.Type() {
+			extra = append(extra, path)
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range extra {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	// parents sort before their children
+	paths := make([]string, 0, len(manifest))
+	for rel := range manifest {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+
+	var tooBig []string
+	for _, rel := range paths {
+		restored, err := restoreEntry(filepath.Join(dir, rel), manifest[rel], store)
+		if err != nil {
+			return err
+		}
+		if !restored {
+			tooBig = append(tooBig, rel)
+		}
+	}
+
+	// directory permissions go last in case they're read-only
+	for i := len(paths) - 1; i >= 0; i-- {
+		if file := manifest[paths[i]]; file.Mode.IsDir() {
+			if err := os.Chmod(filepath.Join(dir, paths[i]), file.Mode.Perm()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(tooBig) > 0 {
+		return fmt.Errorf("These files were too big to checkpoint and weren't restored: %s", strings.Join(tooBig, ", "))
+	}
+	return nil
+}
+
+// Put back one entry of a manifest, returns false for a changed file that was
+// too big to copy
+func restoreEntry(path string, file fileEntry, store string) (bool, error) {
+	info, statErr := os.Lstat(path)
+
+	switch {
+	case file.Mode.IsDir():
+		return true, os.MkdirAll(path, 0700)
+	case file.Mode&fs.ModeSymlink != 0:
+		if link, _ := os.Readlink(path); statErr == nil && link == file.Link {
+			return true, nil
+		}
+		os.Remove(path)
+		return true, os.Symlink(file.Link, path)
+	case statErr == nil && file.unchanged(info):
+		return true, nil
+	case file.Hash == "":
+		return false, nil
+	default:
+		return true, restoreFile(path, file, store)
+	}
+}
+
+func restoreFile(path string, file fileEntry, store string) error {
+	data, err := os.ReadFile(filepath.Join(store, file.Hash[:2], file.Hash[2:]))
+	if err != nil {
+		return err
+	}
+	temp := path + ".butterfish-restore"
+	if err := os.WriteFile(temp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Chmod(temp, file.Mode.Perm()); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, path)
+}
@@ -0,0 +1,200 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func TestFileCheckpoints(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "a\n", "src/b.txt": "b\n"})
+
+	checkpoints := NewCheckpoints(DefaultMaxCheckpoints)
+	defer checkpoints.Close()
+
+	_, err := checkpoints.Create(dir, "rm -r src")
+	assert.NoError(t, err)
+	assert.NoError(t, os.RemoveAll(filepath.Join(dir, "src")))
+	writeFiles(t, dir, map[string]string{"a.txt": "changed\n", "build/out": "x"})
+
+	_, err = checkpoints.Create(dir, "echo c > c.txt")
+	assert.NoError(t, err)
+	writeFiles(t, dir, map[string]string{"c.txt": "c\n"})
+	assert.Equal(t, 2, checkpoints.Len())
+
+	// undo the last command
+	checkpoint, err := checkpoints.Rewind(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "echo c > c.txt", checkpoint.Command)
+	assert.NoFileExists(t, filepath.Join(dir, "c.txt"))
+	assert.Equal(t, "changed\n", readFile(t, filepath.Join(dir, "a.txt")))
+
+	// and the one before it
+	_, err = checkpoints.Rewind(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "a\n", readFile(t, filepath.Join(dir, "a.txt")))
+	assert.Equal(t, "b\n", readFile(t, filepath.Join(dir, "src/b.txt")))
+	assert.NoDirExists(t, filepath.Join(dir, "build"))
+	assert.Equal(t, 0, checkpoints.Len())
+
+	_, err = checkpoints.Rewind(1)
+	assert.ErrorContains(t, err, "There are 0 checkpoints")
+
+	// the home directory and / are refused rather than copied
+	_, err = checkpoints.Create("/", "rm -rf /")
+	assert.ErrorContains(t, err, "root directory isn't checkpointed")
+	home, err := homedir.Dir()
+	assert.NoError(t, err)
+	_, err = checkpoints.Create(home, "rm -rf ~")
+	assert.ErrorContains(t, err, "home directory isn't checkpointed")
+}
+
+func TestGitCheckpoints(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	repo, err := filepath.EvalSymlinks(t.TempDir())
+	assert.NoError(t, err)
+	git := func(args ...string) string {
+		output, err := runGit(repo, checkpointGitIdentity, "", args...)
+		assert.NoError(t, err)
+		return output
+	}
+	git("init", "-q")
+	writeFiles(t, repo, map[string]string{"main.go": "package main\n", ".gitignore": "*.log\n.env\nbuild/\n"})
+	git("add", ".")
+	git("commit", "-q", "-m", "first")
+	head := git("rev-parse", "HEAD")
+	writeFiles(t, repo, map[string]string{"notes.txt": "untracked\n", "debug.log": "ignored\n",
+		".env": "TOKEN=1\n", "build/out": "x"})
+
+	checkpoints := NewCheckpoints(DefaultMaxCheckpoints)
+	defer checkpoints.Close()
+
+	// checkpoints are of the whole repository
+	checkpoint, err := checkpoints.Create(repo, "go fmt && git commit -am fmt")
+	assert.NoError(t, err)
+	assert.Equal(t, repo, checkpoint.Dir)
+	assert.NotEmpty(t, git("for-each-ref", checkpointRefPrefix))
+	// ignored files are copied, but ignored directories only listed
+	assert.Equal(t, []string{"build/"}, checkpoint.IgnoredDirs)
+
+	writeFiles(t, repo, map[string]string{"main.go": "package main\n\nfunc main() {}\n", "new/x.go": "package x\n"})
+	assert.NoError(t, os.Remove(filepath.Join(repo, "notes.txt")))
+	assert.NoError(t, os.Remove(filepath.Join(repo, ".env")))
+	writeFiles(t, repo, map[string]string{"debug.log": "clobbered\n"})
+	git("add", "-A")
+	git("commit", "-q", "-m", "second")
+	writeFiles(t, repo, map[string]string{"staged.txt": "staged\n"})
+	git("add", "staged.txt")
+
+	_, err = checkpoints.Rewind(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "package main\n", readFile(t, filepath.Join(repo, "main.go")))
+	assert.Equal(t, "untracked\n", readFile(t, filepath.Join(repo, "notes.txt")))
+	assert.NoDirExists(t, filepath.Join(repo, "new"))
+	assert.NoFileExists(t, filepath.Join(repo, "staged.txt"))
+	assert.Equal(t, "ignored\n", readFile(t, filepath.Join(repo, "debug.log")))
+	assert.Equal(t, "TOKEN=1\n", readFile(t, filepath.Join(repo, ".env")))
+	assert.Equal(t, head, git("rev-parse", "HEAD"))
+	assert.Equal(t, "?? notes.txt", git("status", "--porcelain"))
+	// the ref is gone with the checkpoint
+	assert.Empty(t, git("for-each-ref", checkpointRefPrefix))
+}
+
+func TestGoalModeUndo(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "a\n"})
+
+	history := NewShellHistory()
+	history.SetCwd(dir)
+	state := &ShellState{
+		Butterfish:             &ButterfishCtx{Config: &ButterfishConfig{}},
+		ChildIn:                &bytes.Buffer{},
+		PromptAnswerWriter:     &bytes.Buffer{},
+		PromptGoalAnswerWriter: &bytes.Buffer{},
+		PromptOutputChan:       make(chan *util.CompletionResponse),
+		Color:                  DarkShellColorScheme,
+		History:                history,
+		GoalModePlan:           &GoalPlan{},
+		Prompt:                 NewShellBuffer(),
+		Checkpoints:            NewCheckpoints(DefaultMaxCheckpoints),
+		GoalModeUnsafe:         true,
+	}
+	defer state.Checkpoints.Close()
+
+	// each command saves a checkpoint before it runs
+	tools := state.goalModeTools()
+	for _, cmd := range []string{"rm a.txt", "touch b.txt"} {
+		state.ActiveToolCall = nil
+		call := &util.ToolCall{Id: "1", Function: util.FunctionCall{
+			Name: "command", Parameters: `{"cmd": "` + cmd + `"}`}}
+		_, err := tools.Get("command").Handler(context.Background(), call)
+		assert.Equal(t, ErrToolOutputPending, err)
+	}
+	state.ActiveToolCall = nil
+	assert.Equal(t, 2, state.Checkpoints.Len())
+	assert.NoError(t, os.Remove(filepath.Join(dir, "a.txt")))
+	writeFiles(t, dir, map[string]string{"b.txt": ""})
+
+	state.Prompt.Write("Rewind 2")
+	assert.True(t, state.HandleLocalPrompt())
+	response := <-state.PromptOutputChan
+	assert.Equal(t, "Rewound "+dir+" to before the goal mode command `rm a.txt`, undoing the changes of the last 2 commands.\n",
+		response.Completion)
+	assert.Equal(t, "a\n", readFile(t, filepath.Join(dir, "a.txt")))
+	assert.NoFileExists(t, filepath.Join(dir, "b.txt"))
+
+	// without checkpoints it's a prompt for the model
+	state.Prompt.Clear()
+	state.Prompt.Write("Undo")
+	assert.False(t, state.HandleLocalPrompt())
+
+	// in safe mode the checkpoint waits until the user submits the command,
+	// and a cancelled command leaves none
+	state.GoalModeUnsafe = false
+	call := &util.ToolCall{Id: "2", Function: util.FunctionCall{
+		Name: "command", Parameters: `{"cmd": "rm a.txt"}`}}
+	_, err := tools.Get("command").Handler(context.Background(), call)
+	assert.Equal(t, ErrToolOutputPending, err)
+	assert.Equal(t, 0, state.Checkpoints.Len())
+	state.GoalModeExit()
+	state.checkpointSubmitted()
+	assert.Equal(t, 0, state.Checkpoints.Len())
+
+	_, err = tools.Get("command").Handler(context.Background(), call)
+	assert.Equal(t, ErrToolOutputPending, err)
+	state.checkpointSubmitted()
+	assert.Equal(t, 1, state.Checkpoints.Len())
+
+	n, ok := parseRewind("rewind 3")
+	assert.Equal(t, 3, n)
+	assert.True(t, ok)
+	_, ok = parseRewind("rewind the tape")
+	assert.False(t, ok)
+}
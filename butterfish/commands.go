@@ -63,6 +63,7 @@ type CliCommandConfig struct {
 		Functions     string   `short:"f" default:"" help:"Path to json file with functions to use for prompt."`
 		NoColor       bool     `default:"false" help:"Disable color output."`
 		NoBackticks   bool     `default:"false" help:"Strip out backticks around codeblocks."`
+		JsonSchema    string   `default:"" help:"Path to a JSON schema file, the response is requested as JSON matching the schema, validated, and printed to stdout without styling."`
 	} `cmd:"" help:"Run an LLM prompt without wrapping, stream results back. This is a straight-through call to the LLM from the command line with a given prompt. This accepts piped input, if there is both piped input and a prompt then they will be concatenated together (prompt first). It is recommended that you wrap the prompt with quotes. The default GPT model is gpt-4-turbo."`
 
 	Promptedit struct {
@@ -137,6 +138,15 @@ type CliCommandConfig struct {
 		Temperature float32  `short:"T" default:"0.7" help:"Temperature to use for the analysis."`
 		Prompt      string   `short:"p" default:"Describe this image in detail" help:"Custom prompt for image analysis."`
 	} `cmd:"" help:"Analyze images using vision models. Provide detailed descriptions and insights about the images."`
+
+	Usage struct {
+		Days int `short:"d" default:"30" help:"Number of days of usage to report."`
+	} `cmd:"" help:"Report LLM token usage and estimated cost by day, model and feature. Every LLM call is recorded in ~/.butterfish/usage.jsonl and priced with a built-in price table, which can be overridden in ~/.config/butterfish/prices.yaml."`
+
+	Sessions struct {
+		Prune  bool   `default:"false" help:"Remove sessions that are past the age or size limit."`
+		Delete string `short:"d" default:"" help:"Id of a session to delete."`
+	} `cmd:"" help:"List the shell sessions in ~/.butterfish/sessions. Butterfish shell records its history to a session, which can be resumed with 'butterfish shell --resume <id>' (or '--resume last') to give the LLM the context of earlier commands."`
 }
 
 func (this *ButterfishCtx) getPipedStdin() string {
@@ -308,6 +318,7 @@ func (this *ButterfishCtx) ExecCommand(
 			Functions:   options.Prompt.Functions,
 			NoColor:     options.Prompt.NoColor,
 			NoBackticks: options.Prompt.NoBackticks,
+			JsonSchema:  options.Prompt.JsonSchema,
 			Verbose:     this.Config.Verbose,
 		}
 
@@ -584,6 +595,8 @@ func (this *ButterfishCtx) ExecCommand(
 			Ctx:           this.Ctx,
 			Prompt:        prompt,
 			Model:         options.Indexquestion.Model,
+			ModelRole:     ModelRolePrompt,
+			Feature:       FeatureIndexQuestion,
 			MaxTokens:     options.Indexquestion.NumTokens,
 			Temperature:   options.Indexquestion.Temperature,
 			SystemMessage: "N/A",
@@ -601,6 +614,37 @@ func (this *ButterfishCtx) ExecCommand(
 		err := this.AnalyzeImages(files, options.Image.Model, options.Image.NumTokens, options.Image.Temperature, options.Image.Prompt, this.Config.Verbose > 0)
 		return err
 
+	case "usage":
+		if this.Config.UsageLedgerPath == "" {
+			return errors.New("Usage ledger is not configured")
+		}
+		return PrintUsageReport(this.Out, this.Config.UsageLedgerPath, options.Usage.Days)
+
+	case "sessions":
+		if this.Config.SessionsPath == "" {
+			return errors.New("Shell sessions are not configured")
+		}
+		store, err := NewSessionStore(this.Config.SessionsPath,
+			this.Config.SessionsMaxAge, this.Config.SessionsMaxBytes)
+		if err != nil {
+			return err
+		}
+
+		if options.Sessions.Delete != "" {
+			err = store.Delete(options.Sessions.Delete)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(this.Out, "Deleted session %s\n", options.Sessions.Delete)
+			return nil
+		}
+		if options.Sessions.Prune {
+			removed := store.Prune("")
+			fmt.Fprintf(this.Out, "Removed %d sessions\n", removed)
+			return nil
+		}
+		return PrintSessions(this.Out, this.Config.SessionsPath)
+
 	default:
 		return errors.New("Unrecognized command: " + parsed.Command())
 
@@ -627,12 +671,16 @@ type promptCommand struct {
 	Verbose     int
 	History     []util.HistoryBlock
 	Tools       []util.ToolDefinition
+	Feature     string // defaults to FeaturePrompt
+	JsonSchema  string // path to a schema the response must match
 }
 
 func (this *ButterfishCtx) Prompt(cmd *promptCommand) (*util.CompletionResponse, error) {
 	writer := this.Out
 
-	if !cmd.NoColor {
+	// JSON output is for scripts, so it's printed plain once validated rather
+	// than streamed through the styling writers
+	if cmd.JsonSchema == "" && !cmd.NoColor {
 		color := styleToEscape(this.Config.Styles.Answer.GetForeground())
 		highlight := styleToEscape(this.Config.Styles.Highlight.GetForeground())
 		this.Out.Write([]byte(color))
@@ -646,7 +694,7 @@ func (this *ButterfishCtx) Prompt(cmd *promptCommand) (*util.CompletionResponse,
 			}
 			writer = util.NewStyleCodeblocksWriter(this.Out, termWidth, color, highlight, colorScheme)
 		}
-	} else if cmd.NoBackticks {
+	} else if cmd.JsonSchema == "" && cmd.NoBackticks {
 		// this is an else because the code blocks writer will strip out backticks
 		// on its own, so this is only used if we don't have color AND we don't
 		// want backticks
@@ -679,10 +727,17 @@ func (this *ButterfishCtx) Prompt(cmd *promptCommand) (*util.CompletionResponse,
 		}
 	}
 
+	feature := cmd.Feature
+	if feature == "" {
+		feature = FeaturePrompt
+	}
+
 	req := &util.CompletionRequest{
 		Ctx:           this.Ctx,
 		Prompt:        cmd.Prompt,
 		Model:         cmd.Model,
+		ModelRole:     ModelRolePrompt,
+		Feature:       feature,
 		MaxTokens:     cmd.NumTokens,
 		Temperature:   cmd.Temperature,
 		SystemMessage: sysMsg,
@@ -693,9 +748,73 @@ func (this *ButterfishCtx) Prompt(cmd *promptCommand) (*util.CompletionResponse,
 		TokenTimeout:  this.Config.TokenTimeout,
 	}
 
+	if cmd.JsonSchema != "" {
+		schema, err := LoadJSONSchema(cmd.JsonSchema)
+		if err != nil {
+			return nil, err
+		}
+		req.ResponseSchema = schema
+
+		resp, err := this.CompleteJSON(req, jsonResponseRetries)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(this.Out, "%s\n", resp.Completion)
+		return resp, nil
+	}
+
 	return this.LLMClient.CompletionStream(req, writer)
 }
 
+// How many times to ask again when a JSON response doesn't match the schema
+const jsonResponseRetries = 2
+
+// Models sometimes wrap JSON in a markdown code block even when asked not to
+var jsonCodeBlockRegex = regexp.MustCompile("(?s)^```[a-zA-Z]*\\s*\n(.*?)\n?```$")
+
+func cleanJSONResponse(completion string) string {
+	completion = strings.TrimSpace(completion)
+	if match := jsonCodeBlockRegex.FindStringSubmatch(completion); match != nil {
+		completion = strings.TrimSpace(match[1])
+	}
+	return completion
+}
+
+// Run a request with a ResponseSchema and validate the response against it.
+// If it doesn't validate then we ask again with the validation error, up to
+// retries times, and return the last error if the model never gets it right.
+// The returned response's Completion is the validated JSON.
+func (this *ButterfishCtx) CompleteJSON(request *util.CompletionRequest, retries int) (*util.CompletionResponse, error) {
+	req := *request
+	req.HistoryBlocks = append([]util.HistoryBlock{}, request.HistoryBlocks...)
+
+	for attempt := 0; ; attempt++ {
+		resp, err := this.LLMClient.Completion(&req)
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Completion = cleanJSONResponse(resp.Completion)
+		err = ValidateJSONSchema(req.ResponseSchema, []byte(resp.Completion))
+		if err == nil {
+			return resp, nil
+		}
+		if attempt >= retries {
+			return nil, fmt.Errorf("Response doesn't match the JSON schema after %d attempts: %s", attempt+1, err)
+		}
+
+		if req.Verbose {
+			log.Printf("JSON response failed validation, retrying: %s", err)
+		}
+
+		// move the prompt and bad answer into history and ask for a fix
+		req.HistoryBlocks = append(req.HistoryBlocks,
+			util.HistoryBlock{Type: historyTypePrompt, Content: req.Prompt},
+			util.HistoryBlock{Type: historyTypeLLMOutput, Content: resp.Completion})
+		req.Prompt = fmt.Sprintf("That response failed JSON schema validation: %s\nRespond again with only JSON that matches the schema.", err)
+	}
+}
+
 var EditSysMsg = `You're helping an expert programmer edit a file of code. You can either respond with questions and clarifications, or you can use the edit() tool, which replaces a range from the file with new code. In some cases you may want to call edit() multiple times, I will apply the edits and give you the updated file after every call. Use the most recent file for your edits. If there are no more edits, just say "DONE!"`
 
 var EditTools = []util.ToolDefinition{
@@ -739,55 +858,35 @@ func (this *ButterfishCtx) EditLineBuffer(lineBuffer *LineBuffer, prompt string,
 		},
 	}
 
-	for {
-		// prep prompting arguments
-		commandConfig := &promptCommand{
+	// edits change line numbers for later edits, so they can't run in parallel
+	tools := NewAgentToolRegistry(&AgentTool{
+		Definition: EditTools[0],
+		Handler: func(ctx context.Context, call *util.ToolCall) (string, error) {
+			err := ApplyEditToolToLineBuffer(call, lineBuffer)
+			if err != nil {
+				return "", err
+			}
+			return lineBuffer.PrefixLineNumbers(), nil
+		},
+	})
+
+	agent := NewAgent(tools)
+	_, err := agent.Run(this.Ctx, history, func(history []util.HistoryBlock) (*util.CompletionResponse, error) {
+		return this.Prompt(&promptCommand{
 			SysMsg:      EditSysMsg,
 			Model:       options.Edit.Model,
 			NumTokens:   options.Edit.NumTokens,
 			Temperature: options.Edit.Temperature,
-			Tools:       EditTools,
+			Tools:       tools.Definitions(),
 			NoColor:     options.Edit.NoColor,
 			NoBackticks: options.Edit.NoBackticks,
 			Verbose:     this.Config.Verbose,
 			History:     history,
-		}
-
-		// send prompt
-		resp, err := this.Prompt(commandConfig)
-		if err != nil {
-			return err
-		}
-
-		// add response to history
-		history = append(history, util.HistoryBlock{
-			Type:      historyTypeLLMOutput,
-			Content:   resp.Completion,
-			ToolCalls: resp.ToolCalls,
+			Feature:     FeatureEdit,
 		})
-
-		// if there's no more tool calls then we're done
-		if resp.ToolCalls == nil || len(resp.ToolCalls) == 0 {
-			break
-		}
-
-		// execute tool calls and add to history
-		for _, toolCall := range resp.ToolCalls {
-			if toolCall.Function.Name == "edit" {
-				err := ApplyEditToolToLineBuffer(toolCall, lineBuffer)
-				if err != nil {
-					return err
-				}
-
-				history = append(history, util.HistoryBlock{
-					Type:       historyTypeToolOutput,
-					Content:    lineBuffer.PrefixLineNumbers(),
-					ToolCallId: toolCall.Id,
-				})
-			} else {
-				return errors.New("Unknown tool call: " + toolCall.Function.Name)
-			}
-		}
+	})
+	if err != nil {
+		return err
 	}
 
 	if this.Config.Verbose > 1 {
@@ -831,19 +930,57 @@ func (this *ButterfishCtx) gencmdCommand(description string) (string, error) {
 		Ctx:           this.Ctx,
 		Prompt:        promptStr,
 		Model:         this.Config.GencmdModel,
+		ModelRole:     ModelRoleGencmd,
+		Feature:       FeatureGencmd,
 		MaxTokens:     this.Config.GencmdMaxTokens,
 		Temperature:   this.Config.GencmdTemperature,
 		SystemMessage: sysMsg,
 		TokenTimeout:  this.Config.TokenTimeout,
 	}
 
+	// legacy completion models can't do structured output, they get the
+	// prompt alone
+	if _, info := Models().Lookup(req.Model); !info.IsCompletionModel() {
+		req.ResponseSchema = gencmdSchema
+	}
+
 	resp, err := this.LLMClient.Completion(req)
 	if err != nil {
 		return "", err
 	}
 
-	this.updateCommandRegister(resp.Completion)
-	return resp.Completion, nil
+	command := parseGencmdResponse(req, resp.Completion)
+	this.updateCommandRegister(command)
+	return command, nil
+}
+
+var gencmdSchema = json.RawMessage(`{
+  "type": "object",
+  "properties": {
+    "command": {"type": "string", "description": "The shell command"}
+  },
+  "required": ["command"],
+  "additionalProperties": false
+}`)
+
+// Pull the command out of a structured gencmd response. Providers that
+// ignore the schema answer in text as the prompt asks, so anything that
+// doesn't validate is used as-is.
+func parseGencmdResponse(request *util.CompletionRequest, completion string) string {
+	if len(request.ResponseSchema) == 0 {
+		return completion
+	}
+
+	cleaned := cleanJSONResponse(completion)
+	if ValidateJSONSchema(request.ResponseSchema, []byte(cleaned)) != nil {
+		return completion
+	}
+
+	var parsed struct {
+		Command string `json:"command"`
+	}
+	json.Unmarshal([]byte(cleaned), &parsed)
+	return parsed.Command
 }
 
 // We're parsing the results from an LLM requesting a command fix, we expect
@@ -902,6 +1039,8 @@ func (this *ButterfishCtx) execAndCheck(ctx context.Context, cmd string) error {
 			Ctx:           this.Ctx,
 			Prompt:        prompt,
 			Model:         this.Config.ExeccheckModel,
+			ModelRole:     ModelRoleExeccheck,
+			Feature:       FeatureExeccheck,
 			MaxTokens:     this.Config.ExeccheckMaxTokens,
 			Temperature:   this.Config.ExeccheckTemperature,
 			SystemMessage: "N/A",
@@ -1035,6 +1174,8 @@ func (this *ButterfishCtx) SummarizeChunks(chunks [][]byte) error {
 	req := &util.CompletionRequest{
 		Ctx:           this.Ctx,
 		Model:         this.Config.SummarizeModel,
+		ModelRole:     ModelRoleSummarize,
+		Feature:       FeatureSummarize,
 		MaxTokens:     this.Config.SummarizeMaxTokens,
 		Temperature:   this.Config.SummarizeTemperature,
 		SystemMessage: "N/A",
@@ -1097,6 +1238,10 @@ func (this *ButterfishCtx) AnalyzeImages(files []string, model string, numTokens
 		log.Printf("[DEBUG] Using model for image analysis: %s", model)
 	}
 
+	if foundModel, info := Models().Lookup(model); foundModel != "" && !info.SupportsVision() {
+		return fmt.Errorf("Model %s doesn't support images, use a vision model or set vision: true for it in models.yaml", model)
+	}
+
 	writer := util.NewStyledWriter(this.Out, this.Config.Styles.Answer)
 
 	for _, file := range files {
@@ -1132,6 +1277,8 @@ func (this *ButterfishCtx) AnalyzeImages(files []string, model string, numTokens
 			Ctx:           this.Ctx,
 			Prompt:        userPrompt,
 			Model:         model,
+			ModelRole:     ModelRoleImage,
+			Feature:       FeatureImage,
 			MaxTokens:     numTokens,
 			Temperature:   temperature,
 			SystemMessage: sysMsg,
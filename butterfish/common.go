@@ -9,75 +9,17 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/mattn/go-runewidth"
 )
 
-// See https://platform.openai.com/docs/models/overview
-var MODEL_TO_NUM_TOKENS = map[string]int{
-	"gpt-4o":                      128000,
-	"gpt-4o-2024-05-13":           128000,
-	"gpt-4":                       8192,
-	"gpt-4-1106":                  128000,
-	"gpt-4-0125-preview":          128000,
-	"gpt-4-vision":                128000,
-	"gpt-4-0314":                  8192,
-	"gpt-4-0613":                  8192,
-	"gpt-4-32k":                   32768,
-	"gpt-4-32k-0314":              32768,
-	"gpt-4-32k-0613":              32768,
-	"gpt-4-turbo":                 128000,
-	"gpt-4-turbo-preview":         128000,
-	"gpt-4-turbo-2024-04-09":      128000,
-	"gpt-3.5-turbo":               16384,
-	"gpt-3.5-turbo-0301":          4096,
-	"gpt-3.5-turbo-0613":          4096,
-	"gpt-3.5-turbo-1106":          16384,
-	"gpt-3.5-turbo-0125":          16384,
-	"gpt-3.5-turbo-16k":           16384,
-	"gpt-3.5-turbo-16k-0613":      16384,
-	"gpt-3.5-turbo-instruct":      4096,
-	"gpt-3.5-turbo-instruct-0913": 4096,
-	"text-davinci-003":            2047,
-	"text-davinci-002":            2047,
-	"code-davinci-002":            8001,
-	"code-davinci-001":            8001,
-	"text-curie-001":              2049,
-	"text-babbage-001":            2049,
-	"text-ada-001":                2049,
-	"davinci":                     2049,
-	"curie":                       2049,
-	"babbage":                     2049,
-	"ada":                         2049,
-	"code-cushman-002":            2048,
-	"code-cushman-001":            2048,
-}
-
-// these token numbers come from
-// https://github.com/pkoukk/tiktoken-go#counting-tokens-for-chat-api-calls
-var MODEL_TO_TOKENS_PER_MESSAGE = map[string]int{
-	"gpt-4o":                 3,
-	"gpt-4o-2024-05-13":      3,
-	"gpt-4":                  3,
-	"gpt-4-0314":             3,
-	"gpt-4-0613":             3,
-	"gpt-4-32k":              3,
-	"gpt-4-32k-0314":         3,
-	"gpt-4-32k-0613":         3,
-	"gpt-3.5-turbo":          4,
-	"gpt-3.5-turbo-0301":     4,
-	"gpt-3.5-turbo-1613":     4,
-	"gpt-3.5-turbo-1106":     4,
-	"gpt-3.5-turbo-16k":      4,
-	"gpt-3.5-turbo-16k-0613": 4,
-}
-
 // Given a model name (e.g. gpt-4-32k-0613), search the kv map for the
 // value associated with the model name. If the model name is not found,
 // attempt to find a simpler model name by removing the last segment
 // (delimited by -) and searching again.
 // returns (model found, value)
-func findModelValue(model string, kv map[string]int) (string, int) {
+func findModelValue[V any](model string, kv map[string]V) (string, V) {
 	value, ok := kv[model]
 	if ok {
 		return model, value
@@ -98,14 +40,28 @@ func findModelValue(model string, kv map[string]int) (string, int) {
 		}
 	}
 
-	return "", -1
+	var zero V
+	return "", zero
+}
+
+// Context window sizes learned at runtime, e.g. from a local Ollama server,
+// these take precedence over the model registry.
+var discoveredNumTokens sync.Map
+
+func SetNumTokensForModel(model string, numTokens int) {
+	discoveredNumTokens.Store(model, numTokens)
 }
 
 func NumTokensForModel(model string) int {
-	foundModel, numTokens := findModelValue(model, MODEL_TO_NUM_TOKENS)
+	if numTokens, ok := discoveredNumTokens.Load(model); ok {
+		return numTokens.(int)
+	}
+
+	foundModel, info := Models().Lookup(model)
+	numTokens := info.ContextWindow
 
 	// couldn't find model
-	if foundModel == "" {
+	if foundModel == "" || numTokens <= 0 {
 		log.Printf("WARNING: Unknown model %s, using default context window size of 8192 tokens", model)
 		return 8192
 	}
@@ -123,14 +79,17 @@ func NumTokensForModel(model string) int {
 }
 
 func NumTokensPerMessageForModel(model string) int {
-	foundModel, numTokens := findModelValue(model, MODEL_TO_TOKENS_PER_MESSAGE)
+	foundModel, info := Models().Lookup(model)
 
 	if foundModel == "" {
 		log.Printf("WARNING: Unknown model %s, using default num tokens per message 5", model)
 		return 5
 	}
+	if info.TokensPerMessage <= 0 {
+		return 5
+	}
 
-	return numTokens
+	return info.TokensPerMessage
 }
 
 // Data type for passing byte chunks from a wrapped command around
@@ -294,6 +253,12 @@ func PrintLoggingBox(box LoggingBox) {
 	log.Println(buf.String())
 }
 
+// Write a box to writer rather than the log, for showing it to the user
+func FprintLoggingBox(writer io.Writer, box LoggingBox) {
+	printLoggingBox(box, writer, 0, []string{})
+	writer.Write([]byte("\033[0m"))
+}
+
 // wrap a string based on a rune array, don't worry about spacing or word wrapping
 func wrapStringRunes(s string, width int) []string {
 	runes := []rune(s)
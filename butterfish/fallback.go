@@ -0,0 +1,201 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+// A backend in a fallback chain, if Model is set it replaces the request's
+// model when calling this backend (e.g. the secondary is a different
+// provider that doesn't know the primary's model names).
+type FallbackBackend struct {
+	Name  string
+	LLM   LLM
+	Model string
+}
+
+// FallbackLLM implements the LLM interface by trying an ordered list of
+// backends. If a backend fails with an error that suggests the provider is
+// down or out of quota we move on to the next one, other errors (e.g. a bad
+// request) are returned immediately since another backend won't help.
+type FallbackLLM struct {
+	Backends []FallbackBackend
+}
+
+func NewFallbackLLM(backends ...FallbackBackend) *FallbackLLM {
+	return &FallbackLLM{Backends: backends}
+}
+
+// Decide whether an error from a backend is worth failing over on: timeouts,
+// network errors, 5xx responses, rate limits and quota errors.
+func isFailoverError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var tokenTimeoutErr *TokenTimeoutError
+	if errors.As(err, &tokenTimeoutErr) {
+		return true
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return isFailoverStatus(apiErr.StatusCode) ||
+			apiErr.Type == "overloaded_error" || apiErr.Type == "RESOURCE_EXHAUSTED"
+	}
+
+	var openaiErr *openai.APIError
+	if errors.As(err, &openaiErr) {
+		return isFailoverStatus(openaiErr.HTTPStatusCode)
+	}
+
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return isFailoverStatus(requestErr.HTTPStatusCode)
+	}
+
+	// ERR_429 and the rate limit error from withExponentialBackoff are only
+	// detectable by their text
+	return strings.Contains(err.Error(), "429")
+}
+
+func isFailoverStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// Returned by a backend that can't take the call, the next one is tried
+type fallbackSkipError struct {
+	reason string
+}
+
+func (this *fallbackSkipError) Error() string { return this.reason }
+
+// Tracks whether a backend has written any output so we can separate a
+// partial answer from the next backend's answer.
+type writeTracker struct {
+	writer  io.Writer
+	written bool
+}
+
+func (this *writeTracker) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		this.written = true
+	}
+	return this.writer.Write(p)
+}
+
+// Call f with each backend in turn until one succeeds or fails with an error
+// that isn't worth failing over on.
+func (this *FallbackLLM) try(
+	ctx context.Context,
+	request *util.CompletionRequest,
+	f func(backend FallbackBackend, request *util.CompletionRequest) error,
+) error {
+	if len(this.Backends) == 0 {
+		return errors.New("No backends configured for fallback")
+	}
+
+	var errs []error
+	for _, backend := range this.Backends {
+		backendRequest := request
+		if request != nil && backend.Model != "" {
+			requestCopy := *request
+			requestCopy.Model = backend.Model
+			backendRequest = &requestCopy
+		}
+
+		err := f(backend, backendRequest)
+		if err == nil {
+			if len(errs) > 0 {
+				log.Printf("Fallback: backend %s answered after %d failure(s)", backend.Name, len(errs))
+			} else {
+				log.Printf("Fallback: backend %s answered", backend.Name)
+			}
+			return nil
+		}
+
+		// the caller cancelled, don't keep going
+		if ctx != nil && ctx.Err() != nil {
+			return err
+		}
+
+		var skipErr *fallbackSkipError
+		if !isFailoverError(err) && !errors.As(err, &skipErr) {
+			return err
+		}
+
+		log.Printf("Fallback: backend %s failed: %s", backend.Name, err)
+		errs = append(errs, fmt.Errorf("%s: %w", backend.Name, err))
+	}
+
+	return fmt.Errorf("All backends failed:\n%w", errors.Join(errs...))
+}
+
+func (this *FallbackLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	var response *util.CompletionResponse
+	tracker := &writeTracker{writer: writer}
+
+	err := this.try(request.Ctx, request, func(backend FallbackBackend, request *util.CompletionRequest) error {
+		// start the next answer on its own line if the last one got partway
+		if tracker.written {
+			writer.Write([]byte("\n"))
+			tracker.written = false
+		}
+
+		var err error
+		response, err = backend.LLM.CompletionStream(request, tracker)
+		return err
+	})
+
+	return response, err
+}
+
+func (this *FallbackLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	var response *util.CompletionResponse
+
+	err := this.try(request.Ctx, request, func(backend FallbackBackend, request *util.CompletionRequest) error {
+		var err error
+		response, err = backend.LLM.Completion(request)
+		return err
+	})
+
+	return response, err
+}
+
+// Embeddings from different models can't be compared, so only the backends
+// with the same embedding model as the first one are tried, that's the model
+// indexes are stamped with.
+func (this *FallbackLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	var embeddings [][]float32
+	model := embeddingModelName(this)
+
+	err := this.try(ctx, nil, func(backend FallbackBackend, _ *util.CompletionRequest) error {
+		if backendModel := embeddingModelName(backend.LLM); backendModel != model {
+			return &fallbackSkipError{fmt.Sprintf("embeds with %s rather than %s", backendModel, model)}
+		}
+		var err error
+		embeddings, err = backend.LLM.Embeddings(ctx, input, verbose)
+		return err
+	})
+
+	return embeddings, err
+}
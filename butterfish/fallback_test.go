@@ -0,0 +1,91 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+// LLM that writes some output then fails with the given error
+type failingLLM struct {
+	namedLLM
+	err   error
+	model string
+}
+
+func (this *failingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	this.model = request.Model
+	writer.Write([]byte("partial"))
+	return nil, this.err
+}
+
+func TestFallbackLLM(t *testing.T) {
+	primary := &failingLLM{err: newTokenTimeoutError(time.Second)}
+	secondary := &failingLLM{err: &APIError{Provider: "Anthropic", StatusCode: http.StatusServiceUnavailable}}
+	fallback := NewFallbackLLM(
+		FallbackBackend{Name: "primary", LLM: primary},
+		FallbackBackend{Name: "secondary", LLM: secondary, Model: "claude-3-5-haiku-latest"},
+		FallbackBackend{Name: "tertiary", LLM: namedLLM("tertiary")},
+	)
+
+	request := &util.CompletionRequest{Ctx: context.Background(), Model: "gpt-4o"}
+	out := &bytes.Buffer{}
+	resp, err := fallback.CompletionStream(request, out)
+	assert.NoError(t, err)
+	assert.Equal(t, "tertiary", resp.Completion)
+	assert.Equal(t, "partial\npartial\n", out.String())
+
+	// model overrides don't leak into the caller's request
+	assert.Equal(t, "gpt-4o", primary.model)
+	assert.Equal(t, "claude-3-5-haiku-latest", secondary.model)
+	assert.Equal(t, "gpt-4o", request.Model)
+
+	// a bad request isn't worth failing over on
+	primary.err = &APIError{Provider: "OpenAI", StatusCode: http.StatusBadRequest}
+	_, err = fallback.CompletionStream(request, io.Discard)
+	assert.Equal(t, primary.err, err)
+}
+
+func TestIsFailoverError(t *testing.T) {
+	assert.True(t, isFailoverError(errors.New(ERR_429)))
+	assert.True(t, isFailoverError(context.DeadlineExceeded))
+	assert.True(t, isFailoverError(&APIError{StatusCode: http.StatusBadGateway}))
+	assert.False(t, isFailoverError(&APIError{StatusCode: http.StatusUnauthorized}))
+	assert.False(t, isFailoverError(context.Canceled))
+}
+
+func TestFallbackEmbeddings(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	server := newOllamaTestServer(t, nil)
+	defer server.Close()
+
+	other := NewOllama(server.URL)
+	other.EmbeddingModel = "mxbai-embed-large"
+	fallback := NewFallbackLLM(
+		FallbackBackend{Name: "primary", LLM: NewOllama(down.URL)},
+		FallbackBackend{Name: "other", LLM: other},
+		FallbackBackend{Name: "local", LLM: NewOllama(server.URL)},
+	)
+
+	// the backend with another embedding model is skipped
+	embeddings, err := fallback.Embeddings(context.Background(), []string{"a", "b"}, false)
+	assert.NoError(t, err)
+	assert.Len(t, embeddings, 2)
+	assert.Equal(t, "nomic-embed-text", embeddingModelName(fallback))
+
+	fallback.Backends = fallback.Backends[:2]
+	_, err = fallback.Embeddings(context.Background(), []string{"a"}, false)
+	assert.ErrorContains(t, err, "other: embeds with mxbai-embed-large rather than nomic-embed-text")
+}
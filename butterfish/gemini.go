@@ -0,0 +1,551 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+// Client for the Google Gemini API, see
+// https://ai.google.dev/api/generate-content
+// Like the Anthropic client this talks to the REST API directly.
+
+const GeminiDefaultBaseURL = "https://generativelanguage.googleapis.com/v1beta"
+const GeminiEmbeddingsModel = "text-embedding-004"
+
+type Gemini struct {
+	token   string
+	baseUrl string
+	client  *http.Client
+
+	// Model to use if a request asks for a model that isn't a Gemini model
+	DefaultModel string
+	// Model used for the Embeddings call
+	EmbeddingModel string
+}
+
+func NewGemini(token, baseUrl string) *Gemini {
+	if baseUrl == "" {
+		baseUrl = GeminiDefaultBaseURL
+	}
+
+	return &Gemini{
+		token:          token,
+		baseUrl:        strings.TrimSuffix(baseUrl, "/"),
+		client:         &http.Client{},
+		EmbeddingModel: GeminiEmbeddingsModel,
+	}
+}
+
+func IsGeminiModel(model string) bool {
+	model = strings.ToLower(model)
+	return strings.Contains(model, "gemini") || strings.HasPrefix(model, "google/")
+}
+
+type geminiInlineData struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type geminiFunctionCall struct {
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type geminiFunctionResponse struct {
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	InlineData       *geminiInlineData       `json:"inlineData,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiFunctionDeclaration struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+}
+
+type geminiTool struct {
+	FunctionDeclarations []geminiFunctionDeclaration `json:"functionDeclarations"`
+}
+
+type geminiGenerationConfig struct {
+	Temperature        float32         `json:"temperature"`
+	MaxOutputTokens    int             `json:"maxOutputTokens,omitempty"`
+	ResponseMimeType   string          `json:"responseMimeType,omitempty"`
+	ResponseJsonSchema json.RawMessage `json:"responseJsonSchema,omitempty"`
+}
+
+type geminiRequest struct {
+	SystemInstruction *geminiContent         `json:"systemInstruction,omitempty"`
+	Contents          []geminiContent        `json:"contents"`
+	Tools             []geminiTool           `json:"tools,omitempty"`
+	GenerationConfig  geminiGenerationConfig `json:"generationConfig"`
+}
+
+type geminiUsage struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+}
+
+func (this *geminiUsage) toUsage() *util.Usage {
+	if this == nil {
+		return nil
+	}
+	return &util.Usage{
+		PromptTokens:     this.PromptTokenCount,
+		CompletionTokens: this.CandidatesTokenCount,
+	}
+}
+
+type geminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata *geminiUsage `json:"usageMetadata"`
+	ResponseId    string       `json:"responseId"`
+}
+
+type geminiErrorBody struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+func parseGeminiError(status int, body []byte) error {
+	var errBody geminiErrorBody
+	err := json.Unmarshal(body, &errBody)
+	if err != nil || errBody.Error.Message == "" {
+		return &APIError{Provider: "Gemini", StatusCode: status, Message: string(body)}
+	}
+
+	return &APIError{
+		Provider:   "Gemini",
+		StatusCode: status,
+		Type:       errBody.Error.Status,
+		Message:    errBody.Error.Message,
+	}
+}
+
+func (this *Gemini) headers() map[string]string {
+	return map[string]string{
+		"x-goog-api-key": this.token,
+	}
+}
+
+func (this *Gemini) model(model string) string {
+	model = strings.TrimPrefix(model, "google/")
+	model = strings.TrimPrefix(model, "models/")
+	if !IsGeminiModel(model) && this.DefaultModel != "" {
+		return this.DefaultModel
+	}
+	return model
+}
+
+// Gemini takes an OpenAPI-style schema subset with upper case type names
+// and no support for fields like additionalProperties, so we translate the
+// jsonschema definition rather than sending it as-is.
+func geminiSchema(def jsonschema.Definition) map[string]any {
+	out := map[string]any{}
+	if def.Type != "" {
+		out["type"] = strings.ToUpper(string(def.Type))
+	}
+	if def.Description != "" {
+		out["description"] = def.Description
+	}
+	if len(def.Enum) > 0 {
+		out["enum"] = def.Enum
+	}
+	if len(def.Properties) > 0 {
+		properties := map[string]any{}
+		for name, prop := range def.Properties {
+			properties[name] = geminiSchema(prop)
+		}
+		out["properties"] = properties
+	}
+	if len(def.Required) > 0 {
+		out["required"] = def.Required
+	}
+	if def.Items != nil {
+		out["items"] = geminiSchema(*def.Items)
+	}
+	return out
+}
+
+func geminiDeclaration(f util.FunctionDefinition) geminiFunctionDeclaration {
+	declaration := geminiFunctionDeclaration{
+		Name:        f.Name,
+		Description: f.Description,
+	}
+	// a declaration without parameters must omit the field entirely
+	if len(f.Parameters.Properties) > 0 {
+		declaration.Parameters = geminiSchema(f.Parameters)
+	}
+	return declaration
+}
+
+// Convert butterfish history into Gemini contents. Gemini uses the roles
+// user and model, function results are sent back as functionResponse parts
+// from the user, keyed by function name rather than a call id.
+func ShellHistoryBlocksToGemini(blocks []util.HistoryBlock) []geminiContent {
+	contents := []geminiContent{}
+	// tool call ids of the last turn with calls mapped to function names so
+	// that tool outputs can be converted to named function responses. Older
+	// sessions numbered ids from 0 in each response, so the ids of earlier
+	// turns are forgotten rather than confused with these.
+	toolCallNames := map[string]string{}
+
+	push := func(role string, parts ...geminiPart) {
+		if len(parts) == 0 {
+			return
+		}
+		last := len(contents) - 1
+		if last >= 0 && contents[last].Role == role {
+			contents[last].Parts = append(contents[last].Parts, parts...)
+			return
+		}
+		contents = append(contents, geminiContent{Role: role, Parts: parts})
+	}
+
+	for _, block := range blocks {
+		switch ShellHistoryTypeToRole(block.Type) {
+		case "assistant":
+			parts := []geminiPart{}
+			if block.Content != "" {
+				parts = append(parts, geminiPart{Text: block.Content})
+			}
+			if block.FunctionName != "" {
+				parts = append(parts, geminiPart{FunctionCall: &geminiFunctionCall{
+					Name: block.FunctionName,
+					Args: toolCallArgs(block.FunctionParams),
+				}})
+			}
+			if len(block.ToolCalls) > 0 {
+				toolCallNames = map[string]string{}
+			}
+			for _, toolCall := range block.ToolCalls {
+				if name, ok := toolCallNames[toolCall.Id]; ok {
+					log.Printf("Tool call id %s is used by both %s and %s, keeping %s", toolCall.Id, name, toolCall.Function.Name, name)
+				} else {
+					toolCallNames[toolCall.Id] = toolCall.Function.Name
+				}
+				parts = append(parts, geminiPart{FunctionCall: &geminiFunctionCall{
+					Name: toolCall.Function.Name,
+					Args: toolCallArgs(toolCall.Function.Parameters),
+				}})
+			}
+			push("model", parts...)
+
+		case "function", "tool":
+			name := block.FunctionName
+			if name == "" {
+				name = toolCallNames[block.ToolCallId]
+			}
+			push("user", geminiPart{FunctionResponse: &geminiFunctionResponse{
+				Name:     name,
+				Response: map[string]any{"content": block.Content},
+			}})
+
+		default:
+			if block.Content == "" {
+				continue
+			}
+			push("user", geminiPart{Text: block.Content})
+		}
+	}
+
+	if len(contents) > 0 && contents[0].Role != "user" {
+		contents = append([]geminiContent{
+			{Role: "user", Parts: []geminiPart{{Text: "(start of history)"}}},
+		}, contents...)
+	}
+
+	return contents
+}
+
+func (this *Gemini) buildRequest(request *util.CompletionRequest) (*geminiRequest, error) {
+	contents := ShellHistoryBlocksToGemini(request.HistoryBlocks)
+
+	if request.Prompt != "" || len(request.Images) > 0 {
+		parts := []geminiPart{}
+		if request.Prompt != "" {
+			parts = append(parts, geminiPart{Text: request.Prompt})
+		}
+		for _, img := range request.Images {
+			parts = append(parts, geminiPart{InlineData: &geminiInlineData{
+				MimeType: img.MimeType,
+				Data:     img.Base64Content,
+			}})
+		}
+
+		last := len(contents) - 1
+		if last >= 0 && contents[last].Role == "user" {
+			contents[last].Parts = append(contents[last].Parts, parts...)
+		} else {
+			contents = append(contents, geminiContent{Role: "user", Parts: parts})
+		}
+	}
+
+	if len(contents) == 0 {
+		return nil, errors.New("no content to send to Gemini")
+	}
+
+	req := &geminiRequest{
+		Contents: contents,
+		GenerationConfig: geminiGenerationConfig{
+			Temperature:     request.Temperature,
+			MaxOutputTokens: request.MaxTokens,
+		},
+	}
+
+	// the callers use "N/A" when they don't care about the system message
+	if request.SystemMessage != "" && request.SystemMessage != "N/A" {
+		req.SystemInstruction = &geminiContent{
+			Parts: []geminiPart{{Text: request.SystemMessage}},
+		}
+	}
+
+	declarations := []geminiFunctionDeclaration{}
+	for _, f := range request.Functions {
+		declarations = append(declarations, geminiDeclaration(f))
+	}
+	for _, t := range request.Tools {
+		declarations = append(declarations, geminiDeclaration(t.Function))
+	}
+	if len(declarations) > 0 {
+		req.Tools = []geminiTool{{FunctionDeclarations: declarations}}
+	}
+
+	if len(request.ResponseSchema) > 0 {
+		req.GenerationConfig.ResponseMimeType = "application/json"
+		req.GenerationConfig.ResponseJsonSchema = request.ResponseSchema
+	}
+
+	reportModel(request.Ctx, this.model(request.Model))
+	return req, nil
+}
+
+// Collect text and function calls out of a (possibly partial) response.
+// Gemini doesn't give function calls ids so we make them up.
+func (this *geminiResponse) collect(text *strings.Builder, toolCalls []*util.ToolCall) []*util.ToolCall {
+	if len(this.Candidates) == 0 {
+		return toolCalls
+	}
+
+	for _, part := range this.Candidates[0].Content.Parts {
+		if part.Text != "" {
+			text.WriteString(part.Text)
+		}
+		if part.FunctionCall != nil {
+			args := string(part.FunctionCall.Args)
+			if args == "" {
+				args = "{}"
+			}
+			toolCalls = append(toolCalls, &util.ToolCall{
+				Id:   newToolCallId(),
+				Type: "function",
+				Function: util.FunctionCall{
+					Name:       part.FunctionCall.Name,
+					Parameters: args,
+				},
+			})
+		}
+	}
+
+	return toolCalls
+}
+
+func (this *Gemini) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	request = fitRequestToModel(request)
+	req, err := this.buildRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Verbose {
+		logGenericCompletionRequest(request)
+	}
+
+	url := fmt.Sprintf("%s/models/%s:generateContent", this.baseUrl, this.model(request.Model))
+	var resp geminiResponse
+
+	err = withExponentialBackoff(func() error {
+		httpResp, innerErr := postJSON(request.Ctx, this.client, url,
+			this.headers(), req, parseGeminiError)
+		if innerErr != nil {
+			return innerErr
+		}
+		defer httpResp.Body.Close()
+		return json.NewDecoder(httpResp.Body).Decode(&resp)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.Builder{}
+	toolCalls := resp.collect(&text, nil)
+
+	response := util.CompletionResponse{
+		Completion: strings.TrimSpace(text.String()),
+		Usage:      resp.UsageMetadata.toUsage(),
+	}
+	setResponseToolCalls(request, &response, toolCalls)
+
+	if request.Verbose {
+		LogCompletionResponse(response, resp.ResponseId)
+	}
+	return &response, nil
+}
+
+func (this *Gemini) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	request = fitRequestToModel(request)
+	req, err := this.buildRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Verbose {
+		logGenericCompletionRequest(request)
+	}
+
+	url := fmt.Sprintf("%s/models/%s:streamGenerateContent?alt=sse",
+		this.baseUrl, this.model(request.Model))
+
+	innerCtx, cancel := context.WithCancel(request.Ctx)
+	defer cancel()
+
+	var httpResp *http.Response
+	err = withExponentialBackoff(func() error {
+		var innerErr error
+		httpResp, innerErr = postJSON(innerCtx, this.client, url,
+			this.headers(), req, parseGeminiError)
+		return innerErr
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	var id string
+	var usage *util.Usage
+	text := strings.Builder{}
+	toolCalls := []*util.ToolCall{}
+
+	err = readEventStream(httpResp.Body, request.TokenTimeout, cancel, func(data []byte) error {
+		var chunk geminiResponse
+		err := json.Unmarshal(data, &chunk)
+		if err != nil {
+			return err
+		}
+		id = chunk.ResponseId
+		// each chunk carries the running totals
+		if chunk.UsageMetadata != nil {
+			usage = chunk.UsageMetadata.toUsage()
+		}
+
+		// function calls arrive whole rather than as argument deltas
+		chunkText := strings.Builder{}
+		numCalls := len(toolCalls)
+		toolCalls = chunk.collect(&chunkText, toolCalls)
+
+		writer.Write([]byte(chunkText.String()))
+		text.WriteString(chunkText.String())
+		for _, toolCall := range toolCalls[numCalls:] {
+			fmt.Fprintf(writer, "%s(%s)", toolCall.Function.Name, toolCall.Function.Parameters)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(writer, "\n")
+
+	response := util.CompletionResponse{
+		Completion: text.String(),
+		Usage:      usage,
+	}
+	setResponseToolCalls(request, &response, toolCalls)
+
+	if request.Verbose {
+		LogCompletionResponse(response, id)
+	}
+	return &response, nil
+}
+
+type geminiEmbedRequest struct {
+	Model   string        `json:"model"`
+	Content geminiContent `json:"content"`
+}
+
+type geminiBatchEmbedRequest struct {
+	Requests []geminiEmbedRequest `json:"requests"`
+}
+
+type geminiBatchEmbedResponse struct {
+	Embeddings []struct {
+		Values []float32 `json:"values"`
+	} `json:"embeddings"`
+}
+
+func (this *Gemini) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	model := "models/" + strings.TrimPrefix(this.EmbeddingModel, "models/")
+	req := geminiBatchEmbedRequest{}
+	for _, s := range input {
+		req.Requests = append(req.Requests, geminiEmbedRequest{
+			Model:   model,
+			Content: geminiContent{Parts: []geminiPart{{Text: s}}},
+		})
+	}
+
+	if verbose {
+		fmt.Printf("Embedding %d strings with %s\n", len(input), model)
+	}
+
+	url := fmt.Sprintf("%s/%s:batchEmbedContents", this.baseUrl, model)
+	result := [][]float32{}
+
+	err := withExponentialBackoff(func() error {
+		httpResp, err := postJSON(ctx, this.client, url, this.headers(), req, parseGeminiError)
+		if err != nil {
+			return err
+		}
+		defer httpResp.Body.Close()
+
+		var resp geminiBatchEmbedResponse
+		err = json.NewDecoder(httpResp.Body).Decode(&resp)
+		if err != nil {
+			return err
+		}
+
+		for _, embedding := range resp.Embeddings {
+			result = append(result, embedding.Values)
+		}
+		reportModel(ctx, this.EmbeddingModel)
+		return nil
+	})
+
+	return result, err
+}
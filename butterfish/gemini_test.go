@@ -0,0 +1,102 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+func TestShellHistoryBlocksToGemini(t *testing.T) {
+	blocks := []util.HistoryBlock{
+		{Type: historyTypeLLMOutput, Content: "hello"},
+		{Type: historyTypeShellInput, Content: "ls"},
+		{Type: historyTypeShellOutput, Content: "foo.txt"},
+		{Type: historyTypeLLMOutput, ToolCalls: []*util.ToolCall{
+			{Id: "call_0", Function: util.FunctionCall{Name: "edit", Parameters: `{"path":"foo.txt"}`}},
+		}},
+		{Type: historyTypeToolOutput, ToolCallId: "call_0", Content: "done"},
+	}
+
+	contents := ShellHistoryBlocksToGemini(blocks)
+
+	assert.Equal(t, 5, len(contents))
+	assert.Equal(t, "user", contents[0].Role)
+	assert.Equal(t, "model", contents[1].Role)
+	assert.Equal(t, 2, len(contents[2].Parts))
+	assert.Equal(t, "edit", contents[3].Parts[0].FunctionCall.Name)
+
+	// tool output is named after the call it answers
+	assert.Equal(t, "user", contents[4].Role)
+	assert.Equal(t, "edit", contents[4].Parts[0].FunctionResponse.Name)
+	assert.Equal(t, "done", contents[4].Parts[0].FunctionResponse.Response["content"])
+
+	// older sessions reused ids in each response, outputs answer the last turn
+	blocks = append(blocks,
+		util.HistoryBlock{Type: historyTypeLLMOutput, ToolCalls: []*util.ToolCall{
+			{Id: "call_0", Function: util.FunctionCall{Name: "command", Parameters: `{"cmd":"ls"}`}},
+		}},
+		util.HistoryBlock{Type: historyTypeToolOutput, ToolCallId: "call_0", Content: "foo.txt"},
+	)
+	contents = ShellHistoryBlocksToGemini(blocks)
+	assert.Equal(t, 7, len(contents))
+	assert.Equal(t, "edit", contents[4].Parts[0].FunctionResponse.Name)
+	assert.Equal(t, "command", contents[6].Parts[0].FunctionResponse.Name)
+}
+
+func TestGeminiCompletionStream(t *testing.T) {
+	var received geminiRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/models/gemini-1.5-flash:streamGenerateContent", r.URL.Path)
+		assert.Equal(t, "sse", r.URL.Query().Get("alt"))
+		assert.Equal(t, "test-key", r.Header.Get("x-goog-api-key"))
+		json.NewDecoder(r.Body).Decode(&received)
+
+		chunks := []string{
+			`{"candidates":[{"content":{"role":"model","parts":[{"text":"Hello "}]}}]}`,
+			`{"candidates":[{"content":{"role":"model","parts":[{"text":"there"}]}}]}`,
+			`{"candidates":[{"content":{"role":"model","parts":[{"functionCall":{"name":"command","args":{"cmd":"ls"}}}]},"finishReason":"STOP"}]}`,
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+	}))
+	defer server.Close()
+
+	client := NewGemini("test-key", server.URL)
+	request := &util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "what is this",
+		Model:         "google/gemini-1.5-flash",
+		SystemMessage: "be helpful",
+		Tools: []util.ToolDefinition{
+			{Type: "function", Function: util.FunctionDefinition{Name: "command"}},
+		},
+		Images: []util.ImageContent{{Base64Content: "aGk=", MimeType: "image/png"}},
+	}
+
+	out := &bytes.Buffer{}
+	resp, err := client.CompletionStream(request, out)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "be helpful", received.SystemInstruction.Parts[0].Text)
+	assert.Equal(t, "what is this", received.Contents[0].Parts[0].Text)
+	assert.Equal(t, "image/png", received.Contents[0].Parts[1].InlineData.MimeType)
+	assert.Equal(t, "command", received.Tools[0].FunctionDeclarations[0].Name)
+
+	assert.Equal(t, "Hello there", resp.Completion)
+	assert.Equal(t, 1, len(resp.ToolCalls))
+	assert.Equal(t, `{"cmd":"ls"}`, resp.ToolCalls[0].Function.Parameters)
+	assert.Regexp(t, `^call_[0-9a-f]{16}$`, resp.ToolCalls[0].Id)
+	assert.Equal(t, "Hello therecommand({\"cmd\":\"ls\"})\n", out.String())
+}
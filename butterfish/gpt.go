@@ -9,6 +9,7 @@ import (
 	"io"
 	"log"
 	"math"
+	"net/url"
 	"strings"
 	"time"
 
@@ -39,6 +40,13 @@ func IsLegacyModel(model string) bool {
 
 type GPT struct {
 	client *openai.Client
+
+	// Model used for the Embeddings call
+	EmbeddingModel string
+
+	// Whether to ask for usage at the end of a stream, other servers that
+	// speak the OpenAI dialect may reject the stream_options field
+	streamUsage bool
 }
 
 func NewGPT(token, baseUrl string) *GPT {
@@ -50,8 +58,18 @@ func NewGPT(token, baseUrl string) *GPT {
 	client := openai.NewClientWithConfig(config)
 
 	return &GPT{
-		client: client,
+		client:         client,
+		EmbeddingModel: string(GPTEmbeddingsModel),
+		streamUsage:    isOpenAIBaseURL(config.BaseURL),
+	}
+}
+
+func isOpenAIBaseURL(baseUrl string) bool {
+	parsed, err := url.Parse(baseUrl)
+	if err != nil {
+		return false
 	}
+	return parsed.Hostname() == "api.openai.com"
 }
 
 // If input can be parsed to JSON, return a nicely formatted and indented
@@ -333,6 +351,8 @@ func ShellHistoryBlocksToGPTChat(systemMsg string, blocks []util.HistoryBlock) [
 func (this *GPT) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
 	var result *util.CompletionResponse
 	var err error
+	request = fitRequestToModel(request)
+	reportModel(request.Ctx, request.Model)
 
 	if IsCompletionModel(request.Model) {
 		result, err = this.InstructCompletion(request)
@@ -350,17 +370,43 @@ func (this *GPT) Completion(request *util.CompletionRequest) (*util.CompletionRe
 	return result, err
 }
 
-// If the model is legacy or ends with -instruct then it should use completion
-// api, otherwise it should use the chat api.
+// The openai client omits a zero temperature from the request, which means
+// the API uses its default of 1, so we send the smallest non-zero value
+// instead to actually get deterministic output.
+func gptTemperature(temperature float32) float32 {
+	if temperature == 0 {
+		return math.SmallestNonzeroFloat32
+	}
+	return temperature
+}
+
+// If the model registry says so it should use the completion api, otherwise
+// it should use the chat api. Models not in the registry use the completion
+// api if they're legacy or end with -instruct.
 func IsCompletionModel(modelName string) bool {
+	foundModel, info := Models().Lookup(modelName)
+	if foundModel != "" {
+		return info.IsCompletionModel()
+	}
 	return IsLegacyModel(modelName) || strings.HasSuffix(modelName, "-instruct")
 }
 
 // We're doing completions through the chat API by default, this routes
-// to the legacy completion API if the model is the legacy model.
+// to the legacy completion API if the model is the legacy model. Models the
+// registry says can't stream get a normal completion written all at once.
 func (this *GPT) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
 	var result *util.CompletionResponse
 	var err error
+	request = fitRequestToModel(request)
+	reportModel(request.Ctx, request.Model)
+
+	if _, info := Models().Lookup(request.Model); !info.SupportsStreaming() {
+		result, err = this.Completion(request)
+		if err == nil {
+			_, err = writer.Write([]byte(result.Completion))
+		}
+		return result, err
+	}
 
 	if IsCompletionModel(request.Model) {
 		result, err = this.InstructCompletionStream(request, writer)
@@ -383,7 +429,7 @@ func (this *GPT) InstructCompletionStream(request *util.CompletionRequest, write
 		Prompt:      request.Prompt,
 		Model:       request.Model,
 		MaxTokens:   request.MaxTokens,
-		Temperature: request.Temperature,
+		Temperature: gptTemperature(request.Temperature),
 	}
 
 	strBuilder := strings.Builder{}
@@ -474,13 +520,56 @@ func (this *GPT) SimpleChatCompletionStream(request *util.CompletionRequest, wri
 		Model:       request.Model,
 		Messages:    messages,
 		MaxTokens:   request.MaxTokens,
-		Temperature: request.Temperature,
+		Temperature: gptTemperature(request.Temperature),
 		N:           1,
 		Functions:   convertToOpenaiFunctions(request.Functions),
 		Tools:       convertToOpenaiTools(request.Tools),
 	}
+	gptStructuredOutput(request, &req)
+
+	resp, err := this.doChatStreamCompletion(request.Ctx, req, writer, request.TokenTimeout, request.Verbose)
+	return gptJSONResponse(request, resp, err)
+}
+
+// Ask for JSON matching the request's response schema, if it has one. Models
+// without structured output are made to call a tool whose input is the
+// response instead, models without tools either are left to the prompt.
+func gptStructuredOutput(request *util.CompletionRequest, req *openai.ChatCompletionRequest) {
+	if len(request.ResponseSchema) == 0 {
+		return
+	}
+
+	_, info := Models().Lookup(request.Model)
+	if info.SupportsStructuredOutput() {
+		req.ResponseFormat = &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+				Name:   jsonResponseName,
+				Schema: request.ResponseSchema,
+			},
+		}
+	} else if info.SupportsTools() {
+		req.Tools = append(req.Tools, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        jsonResponseName,
+				Description: "Respond with JSON matching the schema.",
+				Parameters:  request.ResponseSchema,
+			},
+		})
+		req.ToolChoice = openai.ToolChoice{
+			Type:     openai.ToolTypeFunction,
+			Function: openai.ToolFunction{Name: jsonResponseName},
+		}
+	}
+}
 
-	return this.doChatStreamCompletion(request.Ctx, req, writer, request.TokenTimeout, request.Verbose)
+// Move a forced JSON response tool call to the completion
+func gptJSONResponse(request *util.CompletionRequest, response *util.CompletionResponse, err error) (*util.CompletionResponse, error) {
+	if err == nil && len(request.ResponseSchema) > 0 {
+		response.ToolCalls = takeJSONResponse(request, response, response.ToolCalls)
+	}
+	return response, err
 }
 
 func convertToOpenaiFunctions(funcs []util.FunctionDefinition) []openai.FunctionDefinition {
@@ -530,7 +619,7 @@ func (this *GPT) FullChatCompletionStream(request *util.CompletionRequest, write
 	if request.Prompt != "" || len(request.Images) > 0 {
 		if len(request.Images) > 0 {
 			parts := []openai.ChatMessagePart{}
-			
+
 			if request.Prompt != "" {
 				parts = append(parts, openai.ChatMessagePart{
 					Type: openai.ChatMessagePartTypeText,
@@ -563,14 +652,16 @@ func (this *GPT) FullChatCompletionStream(request *util.CompletionRequest, write
 		Model:       request.Model,
 		Messages:    gptHistory,
 		MaxTokens:   request.MaxTokens,
-		Temperature: request.Temperature,
+		Temperature: gptTemperature(request.Temperature),
 		N:           1,
 		Functions:   convertToOpenaiFunctions(request.Functions),
 		Tools:       convertToOpenaiTools(request.Tools),
 	}
+	gptStructuredOutput(request, &req)
 
-	return this.doChatStreamCompletion(
+	resp, err := this.doChatStreamCompletion(
 		request.Ctx, req, writer, request.TokenTimeout, request.Verbose)
+	return gptJSONResponse(request, resp, err)
 }
 
 func (this *GPT) doChatStreamCompletion(
@@ -581,6 +672,7 @@ func (this *GPT) doChatStreamCompletion(
 	verbose bool) (*util.CompletionResponse, error) {
 
 	var responseContent strings.Builder
+	var usage *util.Usage
 	var functionName string
 	var functionArgs strings.Builder
 	var toolCalls []*util.ToolCall
@@ -602,7 +694,7 @@ func (this *GPT) doChatStreamCompletion(
 
 		select {
 		case <-time.After(tokenTimeout):
-			chunkTimeoutErr = fmt.Errorf("Timed out waiting for streaming response, this call set a timeout of %v between streaming token responses, set by the --token-timeout (-z) parameter.", tokenTimeout)
+			chunkTimeoutErr = newTokenTimeoutError(tokenTimeout)
 			cancel()
 
 			// if we get a chunk or the context fininshes we don't do anything
@@ -621,6 +713,14 @@ func (this *GPT) doChatStreamCompletion(
 			go timeoutRoutine()
 		}
 
+		// usage comes in a final chunk with no choices
+		if resp.Usage != nil {
+			usage = &util.Usage{
+				PromptTokens:     resp.Usage.PromptTokens,
+				CompletionTokens: resp.Usage.CompletionTokens,
+			}
+		}
+
 		if resp.Choices == nil || len(resp.Choices) == 0 {
 			return
 		}
@@ -665,6 +765,10 @@ func (this *GPT) doChatStreamCompletion(
 					toolCall.Id = id
 				}
 				if name != "" {
+					// close the previous call when the model makes several
+					if toolCall.Function.Name == "" && *chunkToolCall.Index > 0 {
+						printWriter.Write([]byte(")\n"))
+					}
 					toolCall.Function.Name += name
 					printWriter.Write([]byte(name))
 					printWriter.Write([]byte("("))
@@ -684,6 +788,9 @@ func (this *GPT) doChatStreamCompletion(
 		responseContent.WriteString(text)
 	}
 
+	if this.streamUsage {
+		req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
 	if verbose {
 		LogChatCompletionRequest(req)
 	}
@@ -723,7 +830,6 @@ func (this *GPT) doChatStreamCompletion(
 		id = response.ID
 	}
 
-	// this doesn't yet handle multiple tool calls
 	if functionName != "" || len(toolCalls) > 0 {
 		printWriter.Write([]byte(")"))
 	}
@@ -735,6 +841,7 @@ func (this *GPT) doChatStreamCompletion(
 		FunctionName:       functionName,
 		ToolCalls:          toolCalls,
 		FunctionParameters: functionArgs.String(),
+		Usage:              usage,
 	}
 
 	if verbose {
@@ -749,7 +856,7 @@ func (this *GPT) InstructCompletion(request *util.CompletionRequest) (*util.Comp
 		Prompt:      request.Prompt,
 		Model:       request.Model,
 		MaxTokens:   request.MaxTokens,
-		Temperature: request.Temperature,
+		Temperature: gptTemperature(request.Temperature),
 	}
 
 	if request.Verbose {
@@ -771,6 +878,7 @@ func (this *GPT) InstructCompletion(request *util.CompletionRequest) (*util.Comp
 
 	response := util.CompletionResponse{
 		Completion: text,
+		Usage:      gptUsage(resp.Usage),
 	}
 
 	if request.Verbose {
@@ -785,7 +893,7 @@ func (this *GPT) FullChatCompletion(request *util.CompletionRequest) (*util.Comp
 	if request.Prompt != "" || len(request.Images) > 0 {
 		if len(request.Images) > 0 {
 			parts := []openai.ChatMessagePart{}
-			
+
 			if request.Prompt != "" {
 				parts = append(parts, openai.ChatMessagePart{
 					Type: openai.ChatMessagePartTypeText,
@@ -822,12 +930,14 @@ func (this *GPT) FullChatCompletion(request *util.CompletionRequest) (*util.Comp
 		Model:       request.Model,
 		Messages:    gptHistory,
 		MaxTokens:   request.MaxTokens,
-		Temperature: request.Temperature,
+		Temperature: gptTemperature(request.Temperature),
 		N:           1,
 		Functions:   convertToOpenaiFunctions(request.Functions),
 	}
+	gptStructuredOutput(request, &req)
 
-	return this.doChatCompletion(request.Ctx, req, request.Verbose)
+	resp, err := this.doChatCompletion(request.Ctx, req, request.Verbose)
+	return gptJSONResponse(request, resp, err)
 }
 
 func (this *GPT) SimpleChatCompletion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
@@ -874,12 +984,14 @@ func (this *GPT) SimpleChatCompletion(request *util.CompletionRequest) (*util.Co
 		Model:       request.Model,
 		Messages:    messages,
 		MaxTokens:   request.MaxTokens,
-		Temperature: request.Temperature,
+		Temperature: gptTemperature(request.Temperature),
 		N:           1,
 		Functions:   convertToOpenaiFunctions(request.Functions),
 	}
+	gptStructuredOutput(request, &req)
 
-	return this.doChatCompletion(request.Ctx, req, request.Verbose)
+	resp, err := this.doChatCompletion(request.Ctx, req, request.Verbose)
+	return gptJSONResponse(request, resp, err)
 }
 
 func (this *GPT) doChatCompletion(ctx context.Context, request openai.ChatCompletionRequest, verbose bool) (*util.CompletionResponse, error) {
@@ -901,6 +1013,7 @@ func (this *GPT) doChatCompletion(ctx context.Context, request openai.ChatComple
 
 	response := util.CompletionResponse{
 		Completion: responseText,
+		Usage:      gptUsage(resp.Usage),
 	}
 
 	funcCall := resp.Choices[0].Message.FunctionCall
@@ -909,12 +1022,30 @@ func (this *GPT) doChatCompletion(ctx context.Context, request openai.ChatComple
 		response.FunctionParameters = funcCall.Arguments
 	}
 
+	for _, toolCall := range resp.Choices[0].Message.ToolCalls {
+		response.ToolCalls = append(response.ToolCalls, &util.ToolCall{
+			Id:   toolCall.ID,
+			Type: string(toolCall.Type),
+			Function: util.FunctionCall{
+				Name:       toolCall.Function.Name,
+				Parameters: toolCall.Function.Arguments,
+			},
+		})
+	}
+
 	if verbose {
 		LogCompletionResponse(response, resp.ID)
 	}
 	return &response, nil
 }
 
+func gptUsage(usage openai.Usage) *util.Usage {
+	return &util.Usage{
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+	}
+}
+
 const GPTEmbeddingsMaxTokens = 8192
 const GPTEmbeddingsModel = openai.AdaEmbeddingV2
 
@@ -940,7 +1071,7 @@ func withExponentialBackoff(f func() error) error {
 func (this *GPT) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
 	req := openai.EmbeddingRequest{
 		Input: input,
-		Model: GPTEmbeddingsModel,
+		Model: openai.EmbeddingModel(this.EmbeddingModel),
 	}
 
 	if verbose {
@@ -968,6 +1099,8 @@ func (this *GPT) Embeddings(ctx context.Context, input []string, verbose bool) (
 		for _, embedding := range resp.Data {
 			result = append(result, embedding.Embedding)
 		}
+		reportModel(ctx, this.EmbeddingModel)
+		reportUsage(ctx, resp.Usage.PromptTokens, 0)
 		return nil
 	})
 
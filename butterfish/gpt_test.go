@@ -0,0 +1,16 @@
+package butterfish
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGPTStreamUsage(t *testing.T) {
+	assert.True(t, NewGPT("key", "").streamUsage)
+	assert.True(t, NewGPT("key", "https://api.openai.com/v1").streamUsage)
+
+	// OpenAI-compatible servers may reject stream_options
+	assert.False(t, NewGPT("key", "http://localhost:8000/v1").streamUsage)
+	assert.False(t, NewGPT("key", "https://openrouter.ai/api/v1").streamUsage)
+}
@@ -0,0 +1,348 @@
+package butterfish
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// A validator for the parts of JSON Schema that structured output schemas
+// use: type, enum, const, properties, required, additionalProperties, items,
+// string and array lengths, pattern, numeric bounds, allOf/anyOf/oneOf and
+// local $refs into $defs or definitions. Unknown keywords are ignored, as
+// the spec says, so a schema using them validates less strictly rather than
+// failing.
+
+type jsonSchema map[string]interface{}
+
+// Load a schema file, it must be a JSON object
+func LoadJSONSchema(path string) (json.RawMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var schema jsonSchema
+	err = json.Unmarshal(data, &schema)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing JSON schema %s: %s", path, err)
+	}
+
+	return json.RawMessage(data), nil
+}
+
+// Validate JSON data against a schema, the error describes the first
+// problem found and where it is, e.g. "$.items[2].name: expected string".
+func ValidateJSONSchema(schema json.RawMessage, data []byte) error {
+	var root jsonSchema
+	err := json.Unmarshal(schema, &root)
+	if err != nil {
+		return fmt.Errorf("Invalid JSON schema: %s", err)
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	err = decoder.Decode(&value)
+	if err != nil {
+		return fmt.Errorf("Response is not valid JSON: %s", err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("Response has data after the JSON value")
+	}
+
+	validator := &jsonSchemaValidator{root: root}
+	return validator.validate(root, value, "$")
+}
+
+type jsonSchemaValidator struct {
+	root jsonSchema
+}
+
+func (this *jsonSchemaValidator) resolve(ref string) (jsonSchema, error) {
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("Unsupported $ref %s, only local refs are supported", ref)
+	}
+
+	var node interface{} = map[string]interface{}(this.root)
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		obj, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Can't resolve $ref %s", ref)
+		}
+		node, ok = obj[part]
+		if !ok {
+			return nil, fmt.Errorf("Can't resolve $ref %s", ref)
+		}
+	}
+
+	schema, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("$ref %s is not a schema", ref)
+	}
+	return schema, nil
+}
+
+func asSchema(v interface{}) (jsonSchema, bool) {
+	schema, ok := v.(map[string]interface{})
+	return schema, ok
+}
+
+func asNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func jsonTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+func typeMatches(expected, actual string) bool {
+	return expected == actual || (expected == "number" && actual == "integer")
+}
+
+// Compare JSON values, numbers by value
+func jsonEqual(a, b interface{}) bool {
+	if x, ok := asNumber(a); ok {
+		y, ok := asNumber(b)
+		return ok && x == y
+	}
+	aJson, _ := json.Marshal(a)
+	bJson, _ := json.Marshal(b)
+	return string(aJson) == string(bJson)
+}
+
+func (this *jsonSchemaValidator) validate(schema jsonSchema, value interface{}, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, err := this.resolve(ref)
+		if err != nil {
+			return err
+		}
+		return this.validate(resolved, value, path)
+	}
+
+	actual := jsonTypeOf(value)
+	switch expected := schema["type"].(type) {
+	case string:
+		if !typeMatches(expected, actual) {
+			return fmt.Errorf("%s: expected %s, got %s", path, expected, actual)
+		}
+	case []interface{}:
+		matched := false
+		names := []string{}
+		for _, t := range expected {
+			name, _ := t.(string)
+			names = append(names, name)
+			matched = matched || typeMatches(name, actual)
+		}
+		if !matched {
+			return fmt.Errorf("%s: expected one of %s, got %s", path, strings.Join(names, ", "), actual)
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			found = found || jsonEqual(option, value)
+		}
+		if !found {
+			options, _ := json.Marshal(enum)
+			return fmt.Errorf("%s: must be one of %s", path, options)
+		}
+	}
+	if constant, ok := schema["const"]; ok && !jsonEqual(constant, value) {
+		expected, _ := json.Marshal(constant)
+		return fmt.Errorf("%s: must be %s", path, expected)
+	}
+
+	var err error
+	switch v := value.(type) {
+	case string:
+		err = this.validateString(schema, v, path)
+	case json.Number:
+		err = this.validateNumber(schema, v, path)
+	case []interface{}:
+		err = this.validateArray(schema, v, path)
+	case map[string]interface{}:
+		err = this.validateObject(schema, v, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	return this.validateCombinators(schema, value, path)
+}
+
+func (this *jsonSchemaValidator) validateString(schema jsonSchema, value, path string) error {
+	length := float64(utf8.RuneCountInString(value))
+	if min, ok := asNumber(schema["minLength"]); ok && length < min {
+		return fmt.Errorf("%s: must be at least %v characters", path, min)
+	}
+	if max, ok := asNumber(schema["maxLength"]); ok && length > max {
+		return fmt.Errorf("%s: must be at most %v characters", path, max)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid pattern %s in JSON schema: %s", pattern, err)
+		}
+		if !re.MatchString(value) {
+			return fmt.Errorf("%s: must match %s", path, pattern)
+		}
+	}
+	return nil
+}
+
+func (this *jsonSchemaValidator) validateNumber(schema jsonSchema, value json.Number, path string) error {
+	n, _ := asNumber(value)
+	if min, ok := asNumber(schema["minimum"]); ok && n < min {
+		return fmt.Errorf("%s: must be at least %v", path, min)
+	}
+	if max, ok := asNumber(schema["maximum"]); ok && n > max {
+		return fmt.Errorf("%s: must be at most %v", path, max)
+	}
+	if min, ok := asNumber(schema["exclusiveMinimum"]); ok && n <= min {
+		return fmt.Errorf("%s: must be greater than %v", path, min)
+	}
+	if max, ok := asNumber(schema["exclusiveMaximum"]); ok && n >= max {
+		return fmt.Errorf("%s: must be less than %v", path, max)
+	}
+	return nil
+}
+
+func (this *jsonSchemaValidator) validateArray(schema jsonSchema, value []interface{}, path string) error {
+	length := float64(len(value))
+	if min, ok := asNumber(schema["minItems"]); ok && length < min {
+		return fmt.Errorf("%s: must have at least %v items", path, min)
+	}
+	if max, ok := asNumber(schema["maxItems"]); ok && length > max {
+		return fmt.Errorf("%s: must have at most %v items", path, max)
+	}
+	if items, ok := asSchema(schema["items"]); ok {
+		for i, item := range value {
+			err := this.validate(items, item, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (this *jsonSchemaValidator) validateObject(schema jsonSchema, value map[string]interface{}, path string) error {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, ok := value[name]; !ok {
+				return fmt.Errorf("%s: missing required property %s", path, name)
+			}
+		}
+	}
+
+	properties, _ := asSchema(schema["properties"])
+	keys := make([]string, 0, len(value))
+	for key := range value {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		propertyPath := path + "." + key
+		if property, ok := asSchema(properties[key]); ok {
+			err := this.validate(property, value[key], propertyPath)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return fmt.Errorf("%s: unexpected property", propertyPath)
+			}
+		case map[string]interface{}:
+			err := this.validate(additional, value[key], propertyPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (this *jsonSchemaValidator) validateCombinators(schema jsonSchema, value interface{}, path string) error {
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, s := range allOf {
+			if sub, ok := asSchema(s); ok {
+				err := this.validate(sub, value, path)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	matches := func(options []interface{}) (int, error) {
+		count := 0
+		var firstErr error
+		for _, s := range options {
+			sub, ok := asSchema(s)
+			if !ok {
+				continue
+			}
+			err := this.validate(sub, value, path)
+			if err == nil {
+				count++
+			} else if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return count, firstErr
+	}
+
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		count, err := matches(anyOf)
+		if count == 0 {
+			return fmt.Errorf("%s: doesn't match any allowed schema (%s)", path, err)
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		count, err := matches(oneOf)
+		if count == 0 {
+			return fmt.Errorf("%s: doesn't match any allowed schema (%s)", path, err)
+		} else if count > 1 {
+			return fmt.Errorf("%s: matches more than one schema in oneOf", path)
+		}
+	}
+	return nil
+}
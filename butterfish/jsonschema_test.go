@@ -0,0 +1,113 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+var testSchema = json.RawMessage(`{
+  "type": "object",
+  "properties": {
+    "name": {"type": "string", "minLength": 1},
+    "tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}},
+    "count": {"type": "integer", "minimum": 0}
+  },
+  "required": ["name"],
+  "additionalProperties": false,
+  "$defs": {
+    "tag": {"enum": ["a", "b"]}
+  }
+}`)
+
+func TestValidateJSONSchema(t *testing.T) {
+	assert.NoError(t, ValidateJSONSchema(testSchema, []byte(`{"name": "x", "tags": ["a"], "count": 2}`)))
+
+	tests := map[string]string{
+		`{"tags": []}`:                 "$: missing required property name",
+		`{"name": ""}`:                 "$.name: must be at least 1 characters",
+		`{"name": "x", "count": 1.5}`:  "$.count: expected integer, got number",
+		`{"name": "x", "count": -1}`:   "$.count: must be at least 0",
+		`{"name": "x", "tags": ["c"]}`: `$.tags[0]: must be one of ["a","b"]`,
+		`{"name": "x", "other": 1}`:    "$.other: unexpected property",
+		`["x"]`:                        "$: expected object, got array",
+		`{"name": "x"} {}`:             "Response has data after the JSON value",
+	}
+	for data, expected := range tests {
+		err := ValidateJSONSchema(testSchema, []byte(data))
+		if assert.Error(t, err, data) {
+			assert.Equal(t, expected, err.Error(), data)
+		}
+	}
+}
+
+// LLM that answers Completion calls from a list and records the requests
+type jsonLLM struct {
+	namedLLM
+	responses []string
+	requests  []*util.CompletionRequest
+}
+
+func (this *jsonLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.requests = append(this.requests, request)
+	response := this.responses[len(this.requests)-1]
+	return &util.CompletionResponse{Completion: response}, nil
+}
+
+func TestCompleteJSONRetries(t *testing.T) {
+	llm := &jsonLLM{responses: []string{
+		`{"name": 1}`,
+		"```json\n{\"name\": \"x\"}\n```",
+	}}
+	ctx := &ButterfishCtx{Ctx: context.Background(), LLMClient: llm}
+
+	request := &util.CompletionRequest{Prompt: "name something", ResponseSchema: testSchema}
+	resp, err := ctx.CompleteJSON(request, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"name": "x"}`, resp.Completion)
+
+	// the retry has the bad answer in history and the error as the prompt
+	retry := llm.requests[1]
+	assert.Equal(t, "name something", retry.HistoryBlocks[0].Content)
+	assert.Equal(t, `{"name": 1}`, retry.HistoryBlocks[1].Content)
+	assert.Contains(t, retry.Prompt, "$.name: expected string, got integer")
+	assert.Empty(t, request.HistoryBlocks)
+
+	llm = &jsonLLM{responses: []string{"no", "still no"}}
+	ctx.LLMClient = llm
+	_, err = ctx.CompleteJSON(request, 1)
+	assert.ErrorContains(t, err, "after 2 attempts")
+}
+
+func TestPromptJSONSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.json")
+	assert.NoError(t, os.WriteFile(path, testSchema, 0644))
+
+	out := &bytes.Buffer{}
+	llm := &jsonLLM{responses: []string{`{"name": "x"}`}}
+	ctx := &ButterfishCtx{
+		Ctx:       context.Background(),
+		Out:       out,
+		Config:    MakeButterfishConfig(),
+		LLMClient: llm,
+	}
+
+	_, err := ctx.Prompt(&promptCommand{Prompt: "hi", SysMsg: "sys", JsonSchema: path})
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"name\": \"x\"}\n", out.String())
+	assert.JSONEq(t, string(testSchema), string(llm.requests[0].ResponseSchema))
+}
+
+func TestParseGencmdResponse(t *testing.T) {
+	request := &util.CompletionRequest{ResponseSchema: gencmdSchema}
+	assert.Equal(t, "ls -la", parseGencmdResponse(request, `{"command": "ls -la"}`))
+	// providers that ignore the schema answer with the bare command
+	assert.Equal(t, "ls -la", parseGencmdResponse(request, "ls -la"))
+}
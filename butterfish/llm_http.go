@@ -0,0 +1,235 @@
+package butterfish
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+// Shared plumbing for LLM clients that talk to a provider's HTTP API
+// directly rather than through an SDK (Anthropic, Gemini, etc).
+
+// APIError is returned when a provider responds with a non-2xx status. The
+// status code is kept so that callers can decide whether an error is worth
+// retrying or failing over on.
+type APIError struct {
+	Provider   string
+	StatusCode int
+	Type       string
+	Message    string
+}
+
+func (this *APIError) Error() string {
+	if this.StatusCode == 0 {
+		// errors reported inside a stream don't have a status
+		return fmt.Sprintf("%s API error %s: %s", this.Provider, this.Type, this.Message)
+	}
+	if this.Type != "" {
+		return fmt.Sprintf("%s API error %d %s: %s", this.Provider, this.StatusCode, this.Type, this.Message)
+	}
+	return fmt.Sprintf("%s API error %d: %s", this.Provider, this.StatusCode, this.Message)
+}
+
+// TokenTimeoutError is returned when a streaming response stalls, this is
+// shared by all clients so that the message (and its detection) is
+// consistent.
+type TokenTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (this *TokenTimeoutError) Error() string {
+	return fmt.Sprintf("Timed out waiting for streaming response, this call set a timeout of %v between streaming token responses, set by the --token-timeout (-z) parameter.", this.Timeout)
+}
+
+func newTokenTimeoutError(tokenTimeout time.Duration) error {
+	return &TokenTimeoutError{Timeout: tokenTimeout}
+}
+
+// Send a JSON POST request and return the response if it has a 2xx status.
+// On any other status the body is handed to parseErr to build an error.
+func postJSON(
+	ctx context.Context,
+	client *http.Client,
+	url string,
+	headers map[string]string,
+	body any,
+	parseErr func(status int, body []byte) error,
+) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		errBody, _ := io.ReadAll(resp.Body)
+		return nil, parseErr(resp.StatusCode, errBody)
+	}
+
+	return resp, nil
+}
+
+// Read a server-sent events stream and call the callback with the payload of
+// each data: line. Event names are ignored since the providers we talk to
+// repeat the event type inside the JSON payload. If tokenTimeout is non-zero
+// and no line arrives within it then cancel is called and the timeout error
+// is returned.
+func readEventStream(
+	body io.Reader,
+	tokenTimeout time.Duration,
+	cancel context.CancelFunc,
+	callback func(data []byte) error,
+) error {
+	return readLineStream(body, tokenTimeout, cancel, func(line string) error {
+		if !strings.HasPrefix(line, "data:") {
+			return nil
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "" || data == "[DONE]" {
+			return nil
+		}
+		return callback([]byte(data))
+	})
+}
+
+// Read a streamed response line by line, e.g. newline delimited JSON, with
+// the same token timeout handling as readEventStream.
+func readLineStream(
+	body io.Reader,
+	tokenTimeout time.Duration,
+	cancel context.CancelFunc,
+	callback func(line string) error,
+) error {
+	var timedOut atomic.Bool
+	var timer *time.Timer
+	if tokenTimeout > 0 {
+		timer = time.AfterFunc(tokenTimeout, func() {
+			timedOut.Store(true)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	for scanner.Scan() {
+		if timer != nil {
+			timer.Reset(tokenTimeout)
+		}
+
+		err := callback(scanner.Text())
+		if err != nil {
+			return err
+		}
+	}
+
+	if timedOut.Load() {
+		return newTokenTimeoutError(tokenTimeout)
+	}
+	return scanner.Err()
+}
+
+// Function arguments as a JSON object for providers that take them as an
+// object rather than a string, invalid arguments become an empty object.
+func toolCallArgs(params string) json.RawMessage {
+	if strings.TrimSpace(params) == "" || !json.Valid([]byte(params)) {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(params)
+}
+
+// For providers that don't give tool calls ids. Ids have to be unique across
+// the whole history, not just a response, since outputs are matched to calls
+// by id.
+func newToolCallId() string {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	return "call_" + hex.EncodeToString(suffix)
+}
+
+// Name of the tool or schema used to ask for a JSON response
+const jsonResponseName = "json_response"
+
+// Providers without structured output are made to call a tool whose input is
+// the response, so move that call's input to the completion.
+func takeJSONResponse(request *util.CompletionRequest, response *util.CompletionResponse, toolCalls []*util.ToolCall) []*util.ToolCall {
+	if len(request.ResponseSchema) == 0 {
+		return toolCalls
+	}
+
+	remaining := []*util.ToolCall{}
+	for _, toolCall := range toolCalls {
+		if toolCall.Function.Name == jsonResponseName {
+			response.Completion = toolCall.Function.Parameters
+		} else {
+			remaining = append(remaining, toolCall)
+		}
+	}
+	return remaining
+}
+
+// Put function calls parsed from a provider's response on the response. If
+// the caller used the legacy functions API the first call is returned as a
+// function call, otherwise they're returned as tool calls.
+func setResponseToolCalls(request *util.CompletionRequest, response *util.CompletionResponse, toolCalls []*util.ToolCall) {
+	if len(toolCalls) == 0 {
+		return
+	}
+
+	if len(request.Functions) > 0 && len(request.Tools) == 0 {
+		response.FunctionName = toolCalls[0].Function.Name
+		response.FunctionParameters = toolCalls[0].Function.Parameters
+		return
+	}
+
+	response.ToolCalls = toolCalls
+}
+
+// Log a request that isn't going through the OpenAI client. We render it as
+// the equivalent chat completion request so verbose output looks the same
+// regardless of provider.
+func logGenericCompletionRequest(request *util.CompletionRequest) {
+	messages := ShellHistoryBlocksToGPTChat(request.SystemMessage, request.HistoryBlocks)
+	if request.Prompt != "" {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    "user",
+			Content: request.Prompt,
+		})
+	}
+
+	LogChatCompletionRequest(openai.ChatCompletionRequest{
+		Model:       request.Model,
+		Messages:    messages,
+		MaxTokens:   request.MaxTokens,
+		Temperature: request.Temperature,
+		Functions:   convertToOpenaiFunctions(request.Functions),
+		Tools:       convertToOpenaiTools(request.Tools),
+	})
+}
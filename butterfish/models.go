@@ -0,0 +1,235 @@
+package butterfish
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+
+	"github.com/mitchellh/go-homedir"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+// A registry of what we know about each model: how big its context window
+// is, how to count its tokens, and which APIs it supports. Butterfish ships
+// with defaults and they can be overridden or extended with a yaml file, by
+// default ~/.config/butterfish/models.yaml, so that new or local models work
+// without a new build:
+//
+//	llama3.1:
+//	  context_window: 131072
+//	  max_output: 4096
+//	  tokenizer: cl100k_base
+//	  tools: true
+//
+// Models are matched by name, then by dropping trailing -segments, so
+// gpt-4-0613 uses the gpt-4 entry unless it has its own.
+
+type ModelInfo struct {
+	// Total tokens for prompt and response
+	ContextWindow int `yaml:"context_window"`
+	// Most tokens the model will generate, requests for more are clamped
+	MaxOutput int `yaml:"max_output"`
+	// Overhead of each chat message in tokens
+	TokensPerMessage int `yaml:"tokens_per_message"`
+	// How to count tokens, see TokenizerForModel: a tiktoken encoding like
+	// cl100k_base, an estimator family like claude, or a tokenizer.json path
+	Tokenizer string `yaml:"tokenizer"`
+
+	// Capabilities, unset means the default given by the accessor
+	Streaming  *bool `yaml:"streaming"`
+	Tools      *bool `yaml:"tools"`
+	Vision     *bool `yaml:"vision"`
+	Completion *bool `yaml:"completion"` // uses the legacy completions API
+	// Can constrain responses to a JSON schema, otherwise a tool call is
+	// forced to get the same result
+	StructuredOutput *bool `yaml:"structured_output"`
+}
+
+func boolOr(b *bool, def bool) bool {
+	if b == nil {
+		return def
+	}
+	return *b
+}
+
+func (this ModelInfo) SupportsStreaming() bool { return boolOr(this.Streaming, true) }
+func (this ModelInfo) SupportsTools() bool     { return boolOr(this.Tools, true) }
+func (this ModelInfo) SupportsVision() bool    { return boolOr(this.Vision, false) }
+func (this ModelInfo) IsCompletionModel() bool { return boolOr(this.Completion, false) }
+func (this ModelInfo) SupportsStructuredOutput() bool {
+	return boolOr(this.StructuredOutput, true)
+}
+
+type ModelRegistry map[string]ModelInfo
+
+var supported, unsupported = true, false
+
+// See https://platform.openai.com/docs/models/overview
+// Token per message numbers come from
+// https://github.com/pkoukk/tiktoken-go#counting-tokens-for-chat-api-calls
+var DefaultModelRegistry = ModelRegistry{
+	"gpt-4o":                      {ContextWindow: 128000, MaxOutput: 16384, TokensPerMessage: 3, Tokenizer: "cl100k_base", Vision: &supported},
+	"gpt-4o-2024-05-13":           {ContextWindow: 128000, MaxOutput: 4096, TokensPerMessage: 3, Tokenizer: "cl100k_base", Vision: &supported, StructuredOutput: &unsupported},
+	"gpt-4o-mini":                 {ContextWindow: 128000, MaxOutput: 16384, TokensPerMessage: 3, Tokenizer: "cl100k_base", Vision: &supported},
+	"gpt-4":                       {ContextWindow: 8192, MaxOutput: 8192, TokensPerMessage: 3, Tokenizer: "cl100k_base", StructuredOutput: &unsupported},
+	"gpt-4-1106":                  {ContextWindow: 128000, MaxOutput: 4096, TokensPerMessage: 3, Tokenizer: "cl100k_base", StructuredOutput: &unsupported},
+	"gpt-4-0125-preview":          {ContextWindow: 128000, MaxOutput: 4096, TokensPerMessage: 3, Tokenizer: "cl100k_base", StructuredOutput: &unsupported},
+	"gpt-4-vision":                {ContextWindow: 128000, MaxOutput: 4096, TokensPerMessage: 3, Tokenizer: "cl100k_base", Tools: &unsupported, Vision: &supported, StructuredOutput: &unsupported},
+	"gpt-4-0314":                  {ContextWindow: 8192, MaxOutput: 8192, TokensPerMessage: 3, Tokenizer: "cl100k_base", StructuredOutput: &unsupported},
+	"gpt-4-0613":                  {ContextWindow: 8192, MaxOutput: 8192, TokensPerMessage: 3, Tokenizer: "cl100k_base", StructuredOutput: &unsupported},
+	"gpt-4-32k":                   {ContextWindow: 32768, TokensPerMessage: 3, Tokenizer: "cl100k_base", StructuredOutput: &unsupported},
+	"gpt-4-32k-0314":              {ContextWindow: 32768, TokensPerMessage: 3, Tokenizer: "cl100k_base", StructuredOutput: &unsupported},
+	"gpt-4-32k-0613":              {ContextWindow: 32768, TokensPerMessage: 3, Tokenizer: "cl100k_base", StructuredOutput: &unsupported},
+	"gpt-4-turbo":                 {ContextWindow: 128000, MaxOutput: 4096, TokensPerMessage: 3, Tokenizer: "cl100k_base", Vision: &supported, StructuredOutput: &unsupported},
+	"gpt-4-turbo-preview":         {ContextWindow: 128000, MaxOutput: 4096, TokensPerMessage: 3, Tokenizer: "cl100k_base", StructuredOutput: &unsupported},
+	"gpt-4-turbo-2024-04-09":      {ContextWindow: 128000, MaxOutput: 4096, TokensPerMessage: 3, Tokenizer: "cl100k_base", Vision: &supported, StructuredOutput: &unsupported},
+	"gpt-3.5-turbo":               {ContextWindow: 16384, MaxOutput: 4096, TokensPerMessage: 4, Tokenizer: "cl100k_base", StructuredOutput: &unsupported},
+	"gpt-3.5-turbo-0301":          {ContextWindow: 4096, TokensPerMessage: 4, Tokenizer: "cl100k_base", Tools: &unsupported, StructuredOutput: &unsupported},
+	"gpt-3.5-turbo-0613":          {ContextWindow: 4096, TokensPerMessage: 4, Tokenizer: "cl100k_base", StructuredOutput: &unsupported},
+	"gpt-3.5-turbo-1106":          {ContextWindow: 16384, MaxOutput: 4096, TokensPerMessage: 4, Tokenizer: "cl100k_base", StructuredOutput: &unsupported},
+	"gpt-3.5-turbo-0125":          {ContextWindow: 16384, MaxOutput: 4096, TokensPerMessage: 4, Tokenizer: "cl100k_base", StructuredOutput: &unsupported},
+	"gpt-3.5-turbo-16k":           {ContextWindow: 16384, TokensPerMessage: 4, Tokenizer: "cl100k_base", StructuredOutput: &unsupported},
+	"gpt-3.5-turbo-16k-0613":      {ContextWindow: 16384, TokensPerMessage: 4, Tokenizer: "cl100k_base", StructuredOutput: &unsupported},
+	"gpt-3.5-turbo-instruct":      {ContextWindow: 4096, Tokenizer: "cl100k_base", Tools: &unsupported, Completion: &supported},
+	"gpt-3.5-turbo-instruct-0913": {ContextWindow: 4096, Tokenizer: "cl100k_base", Tools: &unsupported, Completion: &supported},
+	"text-davinci-003":            {ContextWindow: 2047, Tokenizer: "p50k_base", Tools: &unsupported, Completion: &supported},
+	"text-davinci-002":            {ContextWindow: 2047, Tokenizer: "p50k_base", Tools: &unsupported, Completion: &supported},
+	"code-davinci-002":            {ContextWindow: 8001, Tokenizer: "p50k_base", Tools: &unsupported, Completion: &supported},
+	"code-davinci-001":            {ContextWindow: 8001, Tokenizer: "p50k_base", Tools: &unsupported, Completion: &supported},
+	"text-curie-001":              {ContextWindow: 2049, Tokenizer: "r50k_base", Tools: &unsupported, Completion: &supported},
+	"text-babbage-001":            {ContextWindow: 2049, Tokenizer: "r50k_base", Tools: &unsupported, Completion: &supported},
+	"text-ada-001":                {ContextWindow: 2049, Tokenizer: "r50k_base", Tools: &unsupported, Completion: &supported},
+	"davinci":                     {ContextWindow: 2049, Tokenizer: "r50k_base", Tools: &unsupported, Completion: &supported},
+	"curie":                       {ContextWindow: 2049, Tokenizer: "r50k_base", Tools: &unsupported, Completion: &supported},
+	"babbage":                     {ContextWindow: 2049, Tokenizer: "r50k_base", Tools: &unsupported, Completion: &supported},
+	"ada":                         {ContextWindow: 2049, Tokenizer: "r50k_base", Tools: &unsupported, Completion: &supported},
+	"code-cushman-002":            {ContextWindow: 2048, Tokenizer: "p50k_base", Tools: &unsupported, Completion: &supported},
+	"code-cushman-001":            {ContextWindow: 2048, Tokenizer: "p50k_base", Tools: &unsupported, Completion: &supported},
+	"claude":                      {ContextWindow: 200000, MaxOutput: 8192, Tokenizer: TokenizerClaude, Vision: &supported},
+	"claude-3-opus":               {ContextWindow: 200000, MaxOutput: 4096, Tokenizer: TokenizerClaude, Vision: &supported},
+	"claude-3-sonnet":             {ContextWindow: 200000, MaxOutput: 4096, Tokenizer: TokenizerClaude, Vision: &supported},
+	"claude-3-haiku":              {ContextWindow: 200000, MaxOutput: 4096, Tokenizer: TokenizerClaude, Vision: &supported},
+	"gemini":                      {ContextWindow: 1000000, MaxOutput: 8192, Tokenizer: TokenizerGemini, Vision: &supported},
+}
+
+// Copy the capability flags so decoding into the copy can't change the
+// defaults they point at.
+func (this ModelInfo) clone() ModelInfo {
+	copyBool := func(b *bool) *bool {
+		if b == nil {
+			return nil
+		}
+		c := *b
+		return &c
+	}
+	this.Streaming = copyBool(this.Streaming)
+	this.Tools = copyBool(this.Tools)
+	this.Vision = copyBool(this.Vision)
+	this.Completion = copyBool(this.Completion)
+	this.StructuredOutput = copyBool(this.StructuredOutput)
+	return this
+}
+
+// Load the registry from a yaml file of model names to model info, merged
+// over the defaults. Fields in the file override the same fields of the
+// default entry for that model, so gpt-4o: {streaming: false} keeps the
+// default context window. A missing file just gives the defaults.
+func LoadModelRegistry(path string) (ModelRegistry, error) {
+	registry := ModelRegistry{}
+	for model, info := range DefaultModelRegistry {
+		registry[model] = info
+	}
+
+	if path == "" {
+		return registry, nil
+	}
+
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return registry, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// decode each entry onto the default so unset fields keep their values
+	overrides := map[string]interface{}{}
+	err = yaml.Unmarshal(data, &overrides)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", path, err)
+	}
+	for model, override := range overrides {
+		entry, err := yaml.Marshal(override)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing %s: %s", path, err)
+		}
+
+		info := registry[model].clone()
+		err = yaml.UnmarshalStrict(entry, &info)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing %s model %s: %s", path, model, err)
+		}
+		registry[model] = info
+	}
+
+	return registry, nil
+}
+
+// Find the entry for a model, returns the name of the entry that matched or
+// an empty string if none did.
+func (this ModelRegistry) Lookup(model string) (string, ModelInfo) {
+	return findModelValue(model, this)
+}
+
+var modelRegistry atomic.Pointer[ModelRegistry]
+
+// The registry used by NumTokensForModel and friends, the defaults until
+// SetModelRegistry is called.
+func Models() ModelRegistry {
+	if registry := modelRegistry.Load(); registry != nil {
+		return *registry
+	}
+	return DefaultModelRegistry
+}
+
+func SetModelRegistry(registry ModelRegistry) {
+	modelRegistry.Store(&registry)
+}
+
+// Clamp a requested response length to what the model can produce, asking
+// for more is an error with some APIs.
+func MaxOutputForModel(model string, maxTokens int) int {
+	_, info := Models().Lookup(model)
+	if info.MaxOutput > 0 && maxTokens > info.MaxOutput {
+		return info.MaxOutput
+	}
+	return maxTokens
+}
+
+// Fit a request to what its model can do, on a copy so the caller's request
+// isn't changed. Max tokens is clamped to the model's max output and tools
+// are dropped for models that can't call them.
+func fitRequestToModel(request *util.CompletionRequest) *util.CompletionRequest {
+	foundModel, info := Models().Lookup(request.Model)
+	if foundModel == "" {
+		return request
+	}
+
+	fitted := *request
+	if info.MaxOutput > 0 && fitted.MaxTokens > info.MaxOutput {
+		fitted.MaxTokens = info.MaxOutput
+	}
+	if !info.SupportsTools() && (len(fitted.Tools) > 0 || len(fitted.Functions) > 0) {
+		log.Printf("Model %s doesn't support tools, sending the request without them", request.Model)
+		fitted.Tools = nil
+		fitted.Functions = nil
+	}
+	return &fitted
+}
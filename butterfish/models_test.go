@@ -0,0 +1,71 @@
+package butterfish
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+func TestModelRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "models.yaml")
+	err := os.WriteFile(path, []byte(`
+llama3.1:
+  context_window: 131072
+  max_output: 2048
+  tokenizer: cl100k_base
+gpt-4:
+  context_window: 10000
+  streaming: false
+gpt-4o:
+  streaming: false
+`), 0644)
+	assert.NoError(t, err)
+
+	registry, err := LoadModelRegistry(path)
+	assert.NoError(t, err)
+	SetModelRegistry(registry)
+	defer SetModelRegistry(DefaultModelRegistry)
+
+	// user entries are added and override defaults
+	assert.Equal(t, 131072, NumTokensForModel("llama3.1"))
+	assert.Equal(t, 10000, NumTokensForModel("gpt-4-custom"))
+	_, info := Models().Lookup("gpt-4")
+	assert.False(t, info.SupportsStreaming())
+
+	// a partial override keeps the rest of the default entry
+	assert.Equal(t, 128000, NumTokensForModel("gpt-4o"))
+	_, info = Models().Lookup("gpt-4o")
+	assert.False(t, info.SupportsStreaming())
+	assert.True(t, info.SupportsVision())
+	assert.Equal(t, "cl100k_base", info.Tokenizer)
+	assert.Nil(t, DefaultModelRegistry["gpt-4o"].Streaming)
+	assert.True(t, supported)
+
+	// tools are dropped for models that can't call them
+	request := fitRequestToModel(&util.CompletionRequest{
+		Model:     "gpt-3.5-turbo-instruct",
+		Functions: []util.FunctionDefinition{{Name: "command"}},
+	})
+	assert.Nil(t, request.Functions)
+
+	assert.Equal(t, 2048, MaxOutputForModel("llama3.1", 4096))
+	assert.Equal(t, 1024, MaxOutputForModel("llama3.1", 1024))
+	assert.Equal(t, 4096, MaxOutputForModel("unknown", 4096))
+	assert.Equal(t, 4096, MaxOutputForModel("claude-3-opus-20240229", 8192))
+	assert.Equal(t, 4096, MaxOutputForModel("claude-3-haiku-20240307", 8192))
+	assert.Equal(t, 8192, MaxOutputForModel("claude-3-5-haiku-latest", 8192))
+
+	assert.True(t, IsCompletionModel("text-davinci-003"))
+	assert.True(t, IsCompletionModel("my-model-instruct"))
+	assert.False(t, IsCompletionModel("gpt-4o"))
+	assert.Equal(t, 4, NumTokensPerMessageForModel("gpt-3.5-turbo-0125"))
+
+	err = os.WriteFile(path, []byte("gpt-4:\n  context: 10\n"), 0644)
+	assert.NoError(t, err)
+	_, err = LoadModelRegistry(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,467 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+// Client for Ollama's native API, see
+// https://github.com/ollama/ollama/blob/main/docs/api.md
+// Ollama also has an OpenAI compatible endpoint but the native API lets us
+// run embeddings with a local model and look up each model's context length,
+// so everything works without network access.
+
+const OllamaDefaultBaseURL = "http://localhost:11434"
+const OllamaEmbeddingsModel = "nomic-embed-text"
+
+type Ollama struct {
+	baseUrl string
+	client  *http.Client
+
+	// Model used for the Embeddings call
+	EmbeddingModel string
+	// If set, caps the context window we ask the server for. Ollama
+	// allocates memory for the whole window so large models may need this.
+	MaxContextLength int
+
+	mutex          sync.Mutex
+	contextLengths map[string]int
+}
+
+func NewOllama(baseUrl string) *Ollama {
+	if baseUrl == "" {
+		baseUrl = OllamaDefaultBaseURL
+	}
+	// accept the OpenAI compatible URL too
+	baseUrl = strings.TrimSuffix(strings.TrimSuffix(baseUrl, "/"), "/v1")
+
+	return &Ollama{
+		baseUrl:        baseUrl,
+		client:         &http.Client{},
+		EmbeddingModel: OllamaEmbeddingsModel,
+		contextLengths: map[string]int{},
+	}
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+type ollamaOptions struct {
+	Temperature float32 `json:"temperature"`
+	NumPredict  int     `json:"num_predict,omitempty"`
+	NumCtx      int     `json:"num_ctx,omitempty"`
+}
+
+type ollamaChatRequest struct {
+	Model    string                `json:"model"`
+	Messages []ollamaMessage       `json:"messages"`
+	Tools    []util.ToolDefinition `json:"tools,omitempty"`
+	Stream   bool                  `json:"stream"`
+	Options  ollamaOptions         `json:"options"`
+	// JSON schema the response must match
+	Format json.RawMessage `json:"format,omitempty"`
+}
+
+type ollamaChatResponse struct {
+	Model           string        `json:"model"`
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+func (this *ollamaChatResponse) usage() *util.Usage {
+	if !this.Done {
+		return nil
+	}
+	return &util.Usage{
+		PromptTokens:     this.PromptEvalCount,
+		CompletionTokens: this.EvalCount,
+	}
+}
+
+func parseOllamaError(status int, body []byte) error {
+	var errBody struct {
+		Error string `json:"error"`
+	}
+	err := json.Unmarshal(body, &errBody)
+	if err != nil || errBody.Error == "" {
+		return &APIError{Provider: "Ollama", StatusCode: status, Message: string(body)}
+	}
+	return &APIError{Provider: "Ollama", StatusCode: status, Message: errBody.Error}
+}
+
+// Convert butterfish history into Ollama chat messages. Ollama follows the
+// OpenAI roles except that tool call arguments are objects rather than
+// strings and there are no call ids, so tool outputs carry the tool name.
+func ShellHistoryBlocksToOllama(systemMsg string, blocks []util.HistoryBlock) []ollamaMessage {
+	messages := []ollamaMessage{}
+	if systemMsg != "" && systemMsg != "N/A" {
+		messages = append(messages, ollamaMessage{Role: "system", Content: systemMsg})
+	}
+
+	toolCallNames := map[string]string{}
+	toolCall := func(name, params string) ollamaToolCall {
+		call := ollamaToolCall{}
+		call.Function.Name = name
+		call.Function.Arguments = toolCallArgs(params)
+		return call
+	}
+
+	for _, block := range blocks {
+		role := ShellHistoryTypeToRole(block.Type)
+		message := ollamaMessage{Role: role, Content: block.Content}
+
+		switch role {
+		case "assistant":
+			if block.FunctionName != "" {
+				message.ToolCalls = append(message.ToolCalls,
+					toolCall(block.FunctionName, block.FunctionParams))
+			}
+			for _, call := range block.ToolCalls {
+				toolCallNames[call.Id] = call.Function.Name
+				message.ToolCalls = append(message.ToolCalls,
+					toolCall(call.Function.Name, call.Function.Parameters))
+			}
+
+		case "function", "tool":
+			message.Role = "tool"
+			message.ToolName = block.FunctionName
+			if message.ToolName == "" {
+				message.ToolName = toolCallNames[block.ToolCallId]
+			}
+
+		default:
+			if block.Content == "" {
+				continue
+			}
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages
+}
+
+func (this *Ollama) buildRequest(request *util.CompletionRequest, stream bool) *ollamaChatRequest {
+	messages := ShellHistoryBlocksToOllama(request.SystemMessage, request.HistoryBlocks)
+
+	if request.Prompt != "" || len(request.Images) > 0 {
+		message := ollamaMessage{Role: "user", Content: request.Prompt}
+		for _, img := range request.Images {
+			message.Images = append(message.Images, img.Base64Content)
+		}
+		messages = append(messages, message)
+	}
+
+	tools := request.Tools
+	for _, f := range request.Functions {
+		tools = append(tools, util.ToolDefinition{Type: "function", Function: f})
+	}
+
+	req := &ollamaChatRequest{
+		Model:    request.Model,
+		Messages: messages,
+		Tools:    tools,
+		Stream:   stream,
+		Options: ollamaOptions{
+			Temperature: request.Temperature,
+			NumPredict:  request.MaxTokens,
+		},
+		Format: request.ResponseSchema,
+	}
+	reportModel(request.Ctx, req.Model)
+
+	// Ollama defaults to a small window and silently drops the start of
+	// longer prompts, so ask for the model's full window
+	contextLength, err := this.ContextLength(request.Ctx, request.Model)
+	if err != nil {
+		log.Printf("Ollama: couldn't get context length for %s: %s", request.Model, err)
+	} else {
+		req.Options.NumCtx = contextLength
+	}
+
+	return req
+}
+
+func (this *ollamaMessage) toolCalls() []*util.ToolCall {
+	toolCalls := []*util.ToolCall{}
+	for _, call := range this.ToolCalls {
+		args := string(call.Function.Arguments)
+		if args == "" {
+			args = "{}"
+		}
+		toolCalls = append(toolCalls, &util.ToolCall{
+			Id:   newToolCallId(),
+			Type: "function",
+			Function: util.FunctionCall{
+				Name:       call.Function.Name,
+				Parameters: args,
+			},
+		})
+	}
+	return toolCalls
+}
+
+func (this *Ollama) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	request = fitRequestToModel(request)
+	req := this.buildRequest(request, false)
+
+	if request.Verbose {
+		logGenericCompletionRequest(request)
+	}
+
+	var resp ollamaChatResponse
+	err := withExponentialBackoff(func() error {
+		httpResp, innerErr := postJSON(request.Ctx, this.client, this.baseUrl+"/api/chat",
+			nil, req, parseOllamaError)
+		if innerErr != nil {
+			return innerErr
+		}
+		defer httpResp.Body.Close()
+		return json.NewDecoder(httpResp.Body).Decode(&resp)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response := util.CompletionResponse{
+		Completion: strings.TrimSpace(resp.Message.Content),
+		Usage:      resp.usage(),
+	}
+	setResponseToolCalls(request, &response, resp.Message.toolCalls())
+
+	if request.Verbose {
+		LogCompletionResponse(response, "")
+	}
+	return &response, nil
+}
+
+func (this *Ollama) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	request = fitRequestToModel(request)
+	req := this.buildRequest(request, true)
+
+	if request.Verbose {
+		logGenericCompletionRequest(request)
+	}
+
+	innerCtx, cancel := context.WithCancel(request.Ctx)
+	defer cancel()
+
+	var httpResp *http.Response
+	err := withExponentialBackoff(func() error {
+		var innerErr error
+		httpResp, innerErr = postJSON(innerCtx, this.client, this.baseUrl+"/api/chat",
+			nil, req, parseOllamaError)
+		return innerErr
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	var usage *util.Usage
+	text := strings.Builder{}
+	toolCalls := []*util.ToolCall{}
+
+	// the stream is newline delimited JSON, one partial message per line
+	err = readLineStream(httpResp.Body, request.TokenTimeout, cancel, func(line string) error {
+		if strings.TrimSpace(line) == "" {
+			return nil
+		}
+
+		var chunk ollamaChatResponse
+		err := json.Unmarshal([]byte(line), &chunk)
+		if err != nil {
+			return err
+		}
+		if chunk.Error != "" {
+			return &APIError{Provider: "Ollama", Message: chunk.Error}
+		}
+
+		writer.Write([]byte(chunk.Message.Content))
+		text.WriteString(chunk.Message.Content)
+
+		// tool calls arrive whole
+		for _, toolCall := range chunk.Message.toolCalls() {
+			toolCalls = append(toolCalls, toolCall)
+			fmt.Fprintf(writer, "%s(%s)", toolCall.Function.Name, toolCall.Function.Parameters)
+		}
+
+		if chunk.Done {
+			usage = chunk.usage()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(writer, "\n")
+
+	response := util.CompletionResponse{
+		Completion: text.String(),
+		Usage:      usage,
+	}
+	setResponseToolCalls(request, &response, toolCalls)
+
+	if request.Verbose {
+		LogCompletionResponse(response, "")
+	}
+	return &response, nil
+}
+
+type ollamaShowResponse struct {
+	Parameters string         `json:"parameters"`
+	ModelInfo  map[string]any `json:"model_info"`
+}
+
+// The context length from /api/show. A num_ctx parameter in the Modelfile
+// wins since it's what the model was configured to use, otherwise we take
+// the <architecture>.context_length from the model metadata.
+func (this *ollamaShowResponse) contextLength() int {
+	for _, line := range strings.Split(this.Parameters, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "num_ctx" {
+			if n, err := strconv.Atoi(fields[1]); err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+
+	for key, value := range this.ModelInfo {
+		if !strings.HasSuffix(key, ".context_length") {
+			continue
+		}
+		if n, ok := value.(float64); ok && n > 0 {
+			return int(n)
+		}
+	}
+
+	return 0
+}
+
+// Look up the context lengths of models before they're used, so prompts are
+// sized right from the first request.
+func (this *Ollama) DiscoverContextLengths(models []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, model := range models {
+		if model == "" {
+			continue
+		}
+		_, err := this.ContextLength(ctx, model)
+		if err != nil {
+			log.Printf("Ollama: couldn't get context length for %s: %s", model, err)
+		}
+	}
+}
+
+// Look up a model's context length from the server, results are cached and
+// registered so that NumTokensForModel knows about the model.
+func (this *Ollama) ContextLength(ctx context.Context, model string) (int, error) {
+	this.mutex.Lock()
+	contextLength, ok := this.contextLengths[model]
+	this.mutex.Unlock()
+	if ok {
+		return contextLength, nil
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	httpResp, err := postJSON(ctx, this.client, this.baseUrl+"/api/show",
+		nil, map[string]string{"model": model}, parseOllamaError)
+	if err != nil {
+		return 0, err
+	}
+	defer httpResp.Body.Close()
+
+	var resp ollamaShowResponse
+	err = json.NewDecoder(httpResp.Body).Decode(&resp)
+	if err != nil {
+		return 0, err
+	}
+
+	contextLength = resp.contextLength()
+	if contextLength == 0 {
+		return 0, errors.New("Model info has no context length")
+	}
+	if this.MaxContextLength > 0 && contextLength > this.MaxContextLength {
+		contextLength = this.MaxContextLength
+	}
+
+	this.mutex.Lock()
+	this.contextLengths[model] = contextLength
+	this.mutex.Unlock()
+	SetNumTokensForModel(model, contextLength)
+
+	return contextLength, nil
+}
+
+type ollamaEmbedRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type ollamaEmbedResponse struct {
+	Embeddings      [][]float32 `json:"embeddings"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+}
+
+func (this *Ollama) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	if verbose {
+		fmt.Printf("Embedding %d strings with %s\n", len(input), this.EmbeddingModel)
+	}
+
+	req := ollamaEmbedRequest{
+		Model: this.EmbeddingModel,
+		Input: input,
+	}
+	var resp ollamaEmbedResponse
+
+	err := withExponentialBackoff(func() error {
+		httpResp, err := postJSON(ctx, this.client, this.baseUrl+"/api/embed",
+			nil, req, parseOllamaError)
+		if err != nil {
+			return err
+		}
+		defer httpResp.Body.Close()
+		return json.NewDecoder(httpResp.Body).Decode(&resp)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Embeddings) != len(input) {
+		return nil, fmt.Errorf("Ollama returned %d embeddings for %d inputs", len(resp.Embeddings), len(input))
+	}
+	reportModel(ctx, this.EmbeddingModel)
+	reportUsage(ctx, resp.PromptEvalCount, 0)
+	return resp.Embeddings, nil
+}
@@ -0,0 +1,121 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+func newOllamaTestServer(t *testing.T, chat func(w http.ResponseWriter, req ollamaChatRequest)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/show":
+			fmt.Fprint(w, `{"parameters":"stop \"<|eot_id|>\"","model_info":{"general.architecture":"llama","llama.context_length":131072}}`)
+		case "/api/chat":
+			var req ollamaChatRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			chat(w, req)
+		case "/api/embed":
+			var req ollamaEmbedRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			assert.Equal(t, "nomic-embed-text", req.Model)
+			fmt.Fprint(w, `{"embeddings":[[0.1,0.2],[0.3,0.4]]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestOllamaCompletionStream(t *testing.T) {
+	var received ollamaChatRequest
+	server := newOllamaTestServer(t, func(w http.ResponseWriter, req ollamaChatRequest) {
+		received = req
+		chunks := []string{
+			`{"message":{"role":"assistant","content":"Hello "},"done":false}`,
+			`{"message":{"role":"assistant","content":"there","tool_calls":[{"function":{"name":"command","arguments":{"cmd":"ls"}}}]},"done":false}`,
+			`{"message":{"role":"assistant","content":""},"done":true,"prompt_eval_count":20,"eval_count":5}`,
+		}
+		for _, chunk := range chunks {
+			fmt.Fprintln(w, chunk)
+		}
+	})
+	defer server.Close()
+
+	client := NewOllama(server.URL + "/v1")
+	request := &util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "what is this",
+		Model:         "llama3.1",
+		SystemMessage: "be helpful",
+		HistoryBlocks: []util.HistoryBlock{
+			{Type: historyTypeLLMOutput, ToolCalls: []*util.ToolCall{
+				{Id: "call_0", Function: util.FunctionCall{Name: "edit", Parameters: `{"path":"foo.txt"}`}},
+			}},
+			{Type: historyTypeToolOutput, ToolCallId: "call_0", Content: "done"},
+		},
+		Tools: []util.ToolDefinition{
+			{Type: "function", Function: util.FunctionDefinition{Name: "command"}},
+		},
+	}
+
+	out := &bytes.Buffer{}
+	response, err := client.CompletionStream(request, out)
+	assert.NoError(t, err)
+
+	assert.True(t, received.Stream)
+	assert.Equal(t, 131072, received.Options.NumCtx)
+	assert.Equal(t, 4, len(received.Messages))
+	assert.Equal(t, "system", received.Messages[0].Role)
+	assert.JSONEq(t, `{"path":"foo.txt"}`, string(received.Messages[1].ToolCalls[0].Function.Arguments))
+	assert.Equal(t, "edit", received.Messages[2].ToolName)
+
+	assert.Equal(t, "Hello there", response.Completion)
+	assert.Equal(t, 1, len(response.ToolCalls))
+	assert.JSONEq(t, `{"cmd":"ls"}`, response.ToolCalls[0].Function.Parameters)
+	assert.Regexp(t, `^call_[0-9a-f]{16}$`, response.ToolCalls[0].Id)
+	assert.Equal(t, &util.Usage{PromptTokens: 20, CompletionTokens: 5}, response.Usage)
+
+	// the context length is now known for prompt sizing
+	assert.Equal(t, 131072, NumTokensForModel("llama3.1"))
+}
+
+func TestOllamaEmbeddings(t *testing.T) {
+	server := newOllamaTestServer(t, nil)
+	defer server.Close()
+
+	client := NewOllama(server.URL)
+	embeddings, err := client.Embeddings(context.Background(), []string{"a", "b"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]float32{{0.1, 0.2}, {0.3, 0.4}}, embeddings)
+}
+
+func TestOllamaProviderDiscovery(t *testing.T) {
+	server := newOllamaTestServer(t, nil)
+	defer server.Close()
+
+	config := MakeButterfishConfig()
+	config.LLMClient = namedLLM("default")
+	config.ShellPromptModel = "qwen2.5"
+	config.Providers = &ProvidersConfig{
+		Providers: []ProviderConfig{{
+			Name:             "local",
+			Dialect:          DialectOllama,
+			BaseURL:          server.URL,
+			MaxContextLength: 32768,
+		}},
+		Roles: map[string]string{ModelRolePrompt: "local"},
+	}
+
+	// the routed ollama provider is capped and its models are known upfront
+	_, err := initLLM(config, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 32768, NumTokensForModel("qwen2.5"))
+}
@@ -0,0 +1,134 @@
+package butterfish
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// In goal mode the agent starts by calling the plan tool with the steps it
+// will take, and calls it again with the whole plan to mark progress or to
+// revise it. The plan is shown to the user as a box and in Status.
+
+type PlanStepStatus int
+
+const (
+	PlanPending PlanStepStatus = iota
+	PlanRunning
+	PlanDone
+	PlanFailed
+)
+
+var planStepStatusNames = []string{"pending", "running", "done", "failed"}
+
+func (this PlanStepStatus) String() string {
+	return planStepStatusNames[this]
+}
+
+func ParsePlanStepStatus(name string) (PlanStepStatus, error) {
+	if name == "" {
+		return PlanPending, nil
+	}
+	for i, statusName := range planStepStatusNames {
+		if name == statusName {
+			return PlanStepStatus(i), nil
+		}
+	}
+	return PlanPending, fmt.Errorf("Unknown step status %s, must be one of %s",
+		name, strings.Join(planStepStatusNames, ", "))
+}
+
+type PlanStep struct {
+	Description string
+	Status      PlanStepStatus
+}
+
+type GoalPlan struct {
+	Steps []*PlanStep
+	// How many times the plan was changed after it was made
+	Revisions int
+}
+
+func (this *GoalPlan) count(status PlanStepStatus) int {
+	count := 0
+	for _, step := range this.Steps {
+		if step.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// Summary of progress like "2/5 steps done, 1 failed"
+func (this *GoalPlan) Progress() string {
+	progress := fmt.Sprintf("%d/%d steps done", this.count(PlanDone), len(this.Steps))
+	if failed := this.count(PlanFailed); failed > 0 {
+		progress += fmt.Sprintf(", %d failed", failed)
+	}
+	return progress
+}
+
+// The numbered steps with their status, one per line
+func (this *GoalPlan) String() string {
+	builder := strings.Builder{}
+	for i, step := range this.Steps {
+		builder.WriteString(fmt.Sprintf("%d. [%s] %s\n", i+1, step.Status, step.Description))
+	}
+	return builder.String()
+}
+
+// Whether the plans have the same steps, whatever their status
+func (this *GoalPlan) sameSteps(other *GoalPlan) bool {
+	if len(this.Steps) != len(other.Steps) {
+		return false
+	}
+	for i, step := range this.Steps {
+		if step.Description != other.Steps[i].Description {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *GoalPlan) Box() LoggingBox {
+	title := "Plan, " + this.Progress()
+	if this.Revisions > 0 {
+		title += fmt.Sprintf(", revision %d", this.Revisions)
+	}
+	return LoggingBox{
+		Title:   title,
+		Content: strings.TrimSuffix(this.String(), "\n"),
+		Color:   3,
+	}
+}
+
+type PlanParams struct {
+	Steps []struct {
+		Description string `json:"description"`
+		Status      string `json:"status"`
+	} `json:"steps"`
+}
+
+func parsePlanParams(params string) (*GoalPlan, error) {
+	var planParams PlanParams
+	if err := json.Unmarshal([]byte(params), &planParams); err != nil {
+		return nil, err
+	}
+	if len(planParams.Steps) == 0 {
+		return nil, fmt.Errorf("The plan must have at least one step")
+	}
+
+	plan := &GoalPlan{}
+	for i, paramStep := range planParams.Steps {
+		description := strings.TrimSpace(paramStep.Description)
+		if description == "" {
+			return nil, fmt.Errorf("Step %d has no description", i+1)
+		}
+		status, err := ParsePlanStepStatus(paramStep.Status)
+		if err != nil {
+			return nil, fmt.Errorf("Step %d: %s", i+1, err)
+		}
+		plan.Steps = append(plan.Steps, &PlanStep{Description: description, Status: status})
+	}
+	return plan, nil
+}
@@ -0,0 +1,74 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+func TestParsePlanParams(t *testing.T) {
+	plan, err := parsePlanParams(`{"steps": [
+		{"description": "Find the failing test", "status": "done"},
+		{"description": "Fix it", "status": "running"},
+		{"description": "Run the tests", "status": "pending"},
+		{"description": "Update the changelog"}]}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "1/4 steps done", plan.Progress())
+	assert.Equal(t, "1. [done] Find the failing test\n2. [running] Fix it\n3. [pending] Run the tests\n4. [pending] Update the changelog\n",
+		plan.String())
+
+	plan.Steps[2].Status = PlanFailed
+	assert.Equal(t, "1/4 steps done, 1 failed", plan.Progress())
+
+	_, err = parsePlanParams(`{"steps": []}`)
+	assert.ErrorContains(t, err, "at least one step")
+	_, err = parsePlanParams(`{"steps": [{"description": "a", "status": "skipped"}]}`)
+	assert.ErrorContains(t, err, "Step 1: Unknown step status skipped")
+}
+
+func TestGoalModePlan(t *testing.T) {
+	out := &bytes.Buffer{}
+	state := &ShellState{
+		Butterfish:         &ButterfishCtx{Config: &ButterfishConfig{}},
+		ParentOut:          out,
+		PromptAnswerWriter: &bytes.Buffer{},
+		PromptOutputChan:   make(chan *util.CompletionResponse, 1),
+		Color:              DarkShellColorScheme,
+		History:            NewShellHistory(),
+		GoalMode:           true,
+	}
+	tools := state.goalModeTools()
+	plan := func(params string) (string, error) {
+		call := &util.ToolCall{Id: "1", Function: util.FunctionCall{Name: "plan", Parameters: params}}
+		return tools.Get("plan").Handler(context.Background(), call)
+	}
+
+	// commands wait for a plan
+	_, err := tools.Get("command").Handler(context.Background(), &util.ToolCall{Id: "1",
+		Function: util.FunctionCall{Name: "command", Parameters: `{"cmd": "make"}`}})
+	assert.ErrorContains(t, err, "call plan first")
+	assert.Nil(t, state.ActiveToolCall)
+
+	output, err := plan(`{"steps": [{"description": "Build", "status": "running"}, {"description": "Test", "status": "pending"}]}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "The plan is saved, 0/2 steps done.", output)
+	assert.Contains(t, out.String(), "Plan, 0/2 steps done")
+	assert.Contains(t, out.String(), "1. [running] Build")
+
+	// progress on the same steps isn't a revision
+	_, err = plan(`{"steps": [{"description": "Build", "status": "done"}, {"description": "Test", "status": "running"}]}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, state.GoalModePlan.Revisions)
+	_, err = plan(`{"steps": [{"description": "Build", "status": "done"}, {"description": "Fix the build", "status": "running"}, {"description": "Test", "status": "pending"}]}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, state.GoalModePlan.Revisions)
+	assert.Equal(t, "Plan, 1/3 steps done, revision 1", state.GoalModePlan.Box().Title)
+
+	state.PrintStatus()
+	status := <-state.PromptOutputChan
+	assert.Contains(t, status.Completion, "The agent's plan, 1/3 steps done:\n1. [done] Build\n2. [running] Fix the build\n")
+}
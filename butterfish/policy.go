@@ -0,0 +1,1125 @@
+package butterfish
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	yaml "gopkg.in/yaml.v2"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// The command policy checks commands goal mode wants to run before they're
+// sent to the shell. Commands are parsed as bash and each simple command in
+// them, including ones in pipes, subshells, command substitutions and
+// wrappers like sudo or xargs, is classified by how risky it is. The riskiest
+// part decides the command's risk.
+//
+// Rules in ~/.config/butterfish/policy.yaml allow, confirm or deny commands
+// by glob pattern, and set the risk above which unsafe goal mode asks before
+// running a command:
+//
+//	confirm_above: network
+//	allow: ["make *", "go test *"]
+//	confirm: ["docker *"]
+//	deny: ["git push*", "rm -rf /*"]
+//
+// Patterns match a whole simple command, with its words separated by single
+// spaces, and deny and confirm patterns also match the whole command line.
+// * matches anything and ? matches one character. A command matching an allow
+// pattern doesn't add to the risk.
+
+type CommandRisk int
+
+const (
+	RiskReadOnly CommandRisk = iota
+	RiskWritesCwd
+	RiskNetwork
+	RiskPrivileged
+	RiskDestructive
+)
+
+var commandRiskNames = []string{"read_only", "writes_cwd", "network", "privileged", "destructive"}
+
+func (this CommandRisk) String() string {
+	if this < 0 || int(this) >= len(commandRiskNames) {
+		return fmt.Sprintf("CommandRisk(%d)", int(this))
+	}
+	return commandRiskNames[this]
+}
+
+func ParseCommandRisk(name string) (CommandRisk, error) {
+	for i, riskName := range commandRiskNames {
+		if name == riskName {
+			return CommandRisk(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown command risk %s, must be one of %s",
+		name, strings.Join(commandRiskNames, ", "))
+}
+
+func (this *CommandRisk) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err != nil {
+		return err
+	}
+	risk, err := ParseCommandRisk(name)
+	if err != nil {
+		return err
+	}
+	*this = risk
+	return nil
+}
+
+// A simple command in a command line, e.g. "rm -rf build" in
+// "make clean && rm -rf build"
+type ClassifiedCommand struct {
+	// The command's words separated by spaces
+	Text    string
+	Risk    CommandRisk
+	Reasons []string
+}
+
+func (this *ClassifiedCommand) add(risk CommandRisk, reason string) {
+	if risk > this.Risk {
+		this.Risk = risk
+	}
+	if reason != "" {
+		this.Reasons = append(this.Reasons, reason)
+	}
+}
+
+type CommandClassification struct {
+	Risk     CommandRisk
+	Reasons  []string
+	Commands []*ClassifiedCommand
+	// Risk from how the commands are combined, like piping a download into
+	// a shell, rather than from any one of them
+	Line *ClassifiedCommand
+}
+
+// Parse a command line and classify it, cwd is the directory it runs in and
+// is used to tell whether paths it writes are outside it. Commands that
+// can't be parsed are classified as destructive.
+func ClassifyCommand(cmd, cwd string) *CommandClassification {
+	classifier := &commandClassifier{cwd: cwd}
+	classification := classifier.classify(cmd, 0)
+	classification.update(nil)
+	return classification
+}
+
+// Set the risk and reasons from the commands, leaving out the ones that are
+// allowed
+func (this *CommandClassification) update(allowed map[*ClassifiedCommand]bool) {
+	this.Risk = this.Line.Risk
+	this.Reasons = append([]string{}, this.Line.Reasons...)
+	for _, command := range this.Commands {
+		if allowed[command] {
+			continue
+		}
+		if command.Risk > this.Risk {
+			this.Risk = command.Risk
+		}
+		this.Reasons = append(this.Reasons, command.Reasons...)
+	}
+}
+
+// e.g. "destructive: rm -r deletes recursively"
+func (this *CommandClassification) Summary() string {
+	if len(this.Reasons) == 0 {
+		return this.Risk.String()
+	}
+	return this.Risk.String() + ": " + strings.Join(this.Reasons, "; ")
+}
+
+// Commands run by sh -c and eval are parsed too, up to this depth
+const commandClassifierMaxDepth = 4
+
+type commandClassifier struct {
+	cwd string
+}
+
+func (this *commandClassifier) classify(cmd string, depth int) *CommandClassification {
+	classification := &CommandClassification{
+		Line: &ClassifiedCommand{Text: cmd},
+	}
+
+	file, err := syntax.NewParser(syntax.Variant(syntax.LangBash)).
+		Parse(strings.NewReader(cmd), "")
+	if err != nil {
+		classification.Line.add(RiskDestructive, fmt.Sprintf("couldn't parse the command: %s", err))
+		return classification
+	}
+
+	var current *ClassifiedCommand
+	syntax.Walk(file, func(node syntax.Node) bool {
+		switch node := node.(type) {
+		case *syntax.Stmt:
+			// redirections belong to the command of their statement
+			if call, ok := node.Cmd.(*syntax.CallExpr); ok && len(call.Args) > 0 {
+				current = this.command(call, depth, classification)
+			} else {
+				current = classification.Line
+			}
+			this.redirects(node.Redirs, current)
+			if stmtInterpretsDownload(node) {
+				classification.Line.add(RiskDestructive, "runs a download with an interpreter")
+			}
+
+		case *syntax.BinaryCmd:
+			if (node.Op == syntax.Pipe || node.Op == syntax.PipeAll) &&
+				stmtDownloads(node.X) && stmtInterprets(node.Y) {
+				classification.Line.add(RiskDestructive, "pipes a download into an interpreter")
+			}
+		}
+		return true
+	})
+
+	return classification
+}
+
+func (this *commandClassifier) command(call *syntax.CallExpr, depth int, classification *CommandClassification) *ClassifiedCommand {
+	args := make([]string, len(call.Args))
+	dynamic := false
+	for i, word := range call.Args {
+		var ok bool
+		args[i], ok = wordString(word)
+		dynamic = dynamic || (i == 0 && !ok)
+	}
+
+	command := &ClassifiedCommand{Text: strings.Join(args, " ")}
+	classification.Commands = append(classification.Commands, command)
+	if dynamic {
+		command.add(RiskDestructive, fmt.Sprintf("can't tell what %s runs", args[0]))
+		return command
+	}
+
+	this.classifyArgs(args, depth, command, classification)
+	return command
+}
+
+// The word's value if it's made only of literal text and quotes, otherwise
+// it's printed as is and false is returned
+func wordString(word *syntax.Word) (string, bool) {
+	var builder strings.Builder
+	literal := true
+
+	for _, part := range word.Parts {
+		switch part := part.(type) {
+		case *syntax.Lit:
+			builder.WriteString(unescapeLit(part.Value))
+		case *syntax.SglQuoted:
+			builder.WriteString(part.Value)
+		case *syntax.DblQuoted:
+			for _, inner := range part.Parts {
+				lit, ok := inner.(*syntax.Lit)
+				if !ok {
+					literal = false
+					break
+				}
+				builder.WriteString(lit.Value)
+			}
+		default:
+			literal = false
+		}
+	}
+
+	if !literal {
+		var buf bytes.Buffer
+		syntax.NewPrinter().Print(&buf, word)
+		return buf.String(), false
+	}
+	return builder.String(), true
+}
+
+// Backslashes outside quotes escape the next character, e.g. \rm
+func unescapeLit(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var builder strings.Builder
+	escaped := false
+	for _, r := range value {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+var outputRedirects = map[syntax.RedirOperator]bool{
+	syntax.RdrOut:   true,
+	syntax.AppOut:   true,
+	syntax.RdrInOut: true,
+	syntax.ClbOut:   true,
+	syntax.RdrAll:   true,
+	syntax.AppAll:   true,
+}
+
+func (this *commandClassifier) redirects(redirs []*syntax.Redirect, command *ClassifiedCommand) {
+	for _, redir := range redirs {
+		if !outputRedirects[redir.Op] || redir.Word == nil {
+			continue
+		}
+
+		path, ok := wordString(redir.Word)
+		switch {
+		case !ok:
+			command.add(RiskWritesCwd, fmt.Sprintf("writes to %s", path))
+		case path == "/dev/null" || path == "/dev/stdout" || path == "/dev/stderr" || path == "/dev/tty":
+		case strings.HasPrefix(path, "/dev/"):
+			command.add(RiskDestructive, fmt.Sprintf("writes to the device %s", path))
+		default:
+			this.writes(path, command)
+		}
+	}
+}
+
+// Record a write to path, which is riskier outside the working directory
+func (this *commandClassifier) writes(path string, command *ClassifiedCommand) {
+	if this.outside(path) {
+		command.add(RiskPrivileged, fmt.Sprintf("writes to %s, outside the working directory", path))
+	} else {
+		command.add(RiskWritesCwd, "")
+	}
+}
+
+// Whether path is outside the working directory and the temp directory,
+// paths starting with a variable could be anywhere
+func (this *commandClassifier) outside(path string) bool {
+	if strings.HasPrefix(path, "$") {
+		return true
+	}
+	if expanded, err := homedir.Expand(path); err == nil {
+		path = expanded
+	}
+
+	if !filepath.IsAbs(path) {
+		if this.cwd == "" {
+			clean := filepath.Clean(path)
+			return clean == ".." || strings.HasPrefix(clean, "../")
+		}
+		path = filepath.Join(this.cwd, path)
+	}
+	path = filepath.Clean(path)
+
+	for _, dir := range []string{this.cwd, os.TempDir(), "/tmp"} {
+		if dir == "" || dir == "/" {
+			continue
+		}
+		if path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	readOnlyCommands = wordSet(`: [ alias basename cal cat cd cmp column comm command
+		cut date df diff dirname du echo egrep env export expr false fgrep file fold
+		free grep head help hexdump history hostname id jq less ls man md5sum more nl
+		nproc od popd printenv printf ps pushd pwd readlink realpath rg seq set
+		sha1sum sha256sum shasum shopt sleep sort stat strings tail test time top tr
+		tree true type uname uniq unset uptime wc whereis which whoami xxd yq`)
+	writeCommands = wordSet(`awk bzip2 cc chmod clang cmake cp g++ gcc gunzip gzip
+		install javac ln make mkdir mv ninja patch rmdir source tar tee touch unzip xz
+		zip`)
+	networkCommands = wordSet(`curl dig ftp gh host http https nc ncat netcat nslookup
+		ping scp sftp ssh telnet traceroute wget`)
+	privilegedCommands = wordSet(`apt apt-get chgrp chown chroot crontab dnf doas
+		insmod iptables kill killall launchctl modprobe mount passwd pacman pkill
+		service snap su sudo sysctl systemctl ufw umount useradd userdel usermod
+		visudo yum`)
+	destructiveCommands = wordSet(`dd fdisk halt mkfs parted poweroff reboot shred
+		shutdown truncate wipefs`)
+	interpreterCommands = wordSet(`bash dash fish ksh node perl php python python2
+		python3 ruby sh zsh`)
+	shellCommands    = wordSet(`bash dash fish ksh sh zsh`)
+	systemBinDirs    = []string{"/bin/", "/sbin/", "/usr/bin/", "/usr/sbin/", "/usr/local/bin/", "/opt/homebrew/bin/"}
+	downloadCommands = wordSet(`curl wget`)
+	dockerReadOnly   = wordSet(`images info inspect logs ps version`)
+)
+
+func wordSet(words string) map[string]bool {
+	set := map[string]bool{}
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+	return set
+}
+
+// Name of the command with any directory removed, e.g. rm for /bin/rm
+func commandName(arg string) string {
+	return filepath.Base(arg)
+}
+
+func (this *commandClassifier) classifyArgs(args []string, depth int, command *ClassifiedCommand, classification *CommandClassification) {
+	// skip variable assignments like FOO=1 before the command
+	for len(args) > 0 && isAssignment(args[0]) {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return
+	}
+
+	// programs run by path, like ./install.sh, could do anything
+	if localProgram(args[0]) {
+		command.add(RiskPrivileged, fmt.Sprintf("%s isn't a known command", args[0]))
+		return
+	}
+
+	name := commandName(args[0])
+	if strings.HasPrefix(name, "mkfs.") {
+		name = "mkfs"
+	}
+
+	switch name {
+	case "rm":
+		if hasFlag(args[1:], 'r', "--recursive") || hasFlag(args[1:], 'R') {
+			command.add(RiskDestructive, "rm -r deletes recursively")
+		} else {
+			command.add(RiskWritesCwd, "")
+		}
+		for _, path := range operands(args[1:]) {
+			if this.outside(path) {
+				command.add(RiskDestructive, fmt.Sprintf("deletes %s, outside the working directory", path))
+			}
+		}
+		return
+
+	case "git":
+		this.classifyGit(args, command)
+		return
+
+	case "rsync":
+		this.classifyRsync(args, command)
+		return
+
+	case "find":
+		this.classifyFind(args, depth, command, classification)
+		return
+
+	case "sed":
+		if hasFlag(args[1:], 'i', "--in-place") {
+			command.add(RiskWritesCwd, "")
+			for _, path := range operands(args[1:]) {
+				if this.outside(path) {
+					command.add(RiskPrivileged, fmt.Sprintf("edits %s, outside the working directory", path))
+				}
+			}
+		}
+		return
+
+	case "go":
+		switch subcommand(args) {
+		case "version", "env", "list", "doc", "help", "":
+		case "get", "install":
+			command.add(RiskNetwork, "go "+subcommand(args)+" downloads modules")
+		case "mod":
+			if len(args) > 2 && args[2] == "download" {
+				command.add(RiskNetwork, "go mod download downloads modules")
+			} else {
+				command.add(RiskWritesCwd, "")
+			}
+		default:
+			command.add(RiskWritesCwd, "")
+		}
+		return
+
+	case "npm", "yarn", "pnpm", "pip", "pip3", "gem", "cargo":
+		switch subcommand(args) {
+		case "install", "i", "add", "ci", "update", "upgrade", "publish", "download", "fetch":
+			command.add(RiskNetwork, fmt.Sprintf("%s %s uses the network", name, subcommand(args)))
+		case "list", "ls", "show", "freeze", "view", "outdated", "":
+		default:
+			command.add(RiskWritesCwd, "")
+		}
+		return
+
+	case "docker", "podman":
+		// e.g. docker rm, docker system prune or docker volume rm
+		ops := operands(args[1:])
+		if len(ops) > 2 {
+			ops = ops[:2]
+		}
+		switch {
+		case containsArg(ops, "rm") || containsArg(ops, "rmi") || containsArg(ops, "prune"):
+			command.add(RiskDestructive, fmt.Sprintf("%s %s removes containers or data", name, strings.Join(ops, " ")))
+		case len(ops) > 0 && dockerReadOnly[ops[0]]:
+		default:
+			command.add(RiskPrivileged, fmt.Sprintf("%s has root access", name))
+		}
+		return
+
+	case "eval":
+		this.classifyNested(strings.Join(args[1:], " "), depth, command, classification)
+		return
+	}
+
+	// commands that run another command given in their arguments
+	if inner, ok := wrappedCommand(name, args); ok {
+		if privilegedCommands[name] {
+			command.add(RiskPrivileged, fmt.Sprintf("runs as root with %s", name))
+		}
+		this.classifyArgs(inner, depth, command, classification)
+		return
+	}
+
+	if interpreterCommands[name] {
+		// the commands given to a shell with -c are checked too, programs for
+		// other interpreters or in scripts can do anything
+		ops := operands(args[1:])
+		if script, ok := flagValue(args[1:], "-c"); ok && shellCommands[name] {
+			this.classifyNested(script, depth, command, classification)
+		} else if inlineCode(name, args) {
+			command.add(RiskPrivileged, fmt.Sprintf("%s runs inline code", name))
+		} else if len(ops) > 0 {
+			command.add(RiskPrivileged, fmt.Sprintf("%s runs %s", name, ops[0]))
+		} else {
+			command.add(RiskWritesCwd, "")
+		}
+		return
+	}
+
+	switch {
+	case destructiveCommands[name]:
+		command.add(RiskDestructive, fmt.Sprintf("%s can destroy data", name))
+	case privilegedCommands[name]:
+		command.add(RiskPrivileged, fmt.Sprintf("%s changes the system", name))
+	case networkCommands[name]:
+		command.add(RiskNetwork, fmt.Sprintf("%s uses the network", name))
+		if name == "curl" || name == "wget" {
+			this.classifyDownload(name, args, command)
+		}
+	case writeCommands[name]:
+		command.add(RiskWritesCwd, "")
+		targets := operands(args[1:])
+		// copies and links only write their last operand
+		if (name == "cp" || name == "ln" || name == "install") && len(targets) > 0 {
+			targets = targets[len(targets)-1:]
+		}
+		if name == "awk" || name == "source" || name == "tar" {
+			targets = nil
+		}
+		for _, path := range targets {
+			this.writes(path, command)
+		}
+	case readOnlyCommands[name]:
+	default:
+		command.add(RiskPrivileged, fmt.Sprintf("%s isn't a known command", name))
+	}
+}
+
+// Whether the program is run by a path outside the system's bin directories
+func localProgram(arg string) bool {
+	if !strings.Contains(arg, "/") {
+		return false
+	}
+	for _, dir := range systemBinDirs {
+		if strings.HasPrefix(arg, dir) {
+			return false
+		}
+	}
+	return true
+}
+
+// Flags that give an interpreter its program on the command line, shells'
+// -c is checked separately
+var inlineCodeFlags = map[string][]byte{
+	"python":  {'c'},
+	"python2": {'c'},
+	"python3": {'c'},
+	"perl":    {'e', 'E'},
+	"ruby":    {'e'},
+	"node":    {'e', 'p'},
+	"php":     {'r'},
+}
+
+func inlineCode(name string, args []string) bool {
+	for _, flag := range inlineCodeFlags[name] {
+		if hasFlag(args[1:], flag) {
+			return true
+		}
+	}
+	return name == "node" && hasFlag(args[1:], 0, "--eval", "--print")
+}
+
+// rsync is like cp when it's local, and like rm with --delete, which removes
+// whatever in the destination isn't in the source
+func (this *commandClassifier) classifyRsync(args []string, command *ClassifiedCommand) {
+	ops := operands(args[1:])
+	for _, op := range ops {
+		if remotePath(op) {
+			command.add(RiskNetwork, "rsync uses the network")
+			break
+		}
+	}
+
+	deletes := hasFlag(args[1:], 0, "--delete", "--del", "--delete-before", "--delete-during",
+		"--delete-delay", "--delete-after", "--delete-excluded")
+	if deletes {
+		command.add(RiskDestructive, "rsync --delete deletes files")
+	}
+	if hasFlag(args[1:], 0, "--remove-source-files") {
+		command.add(RiskDestructive, "rsync --remove-source-files deletes the source files")
+	}
+
+	// with a single operand it only lists files
+	if len(ops) < 2 || remotePath(ops[len(ops)-1]) {
+		return
+	}
+	dest := ops[len(ops)-1]
+	if deletes && this.outside(dest) {
+		command.add(RiskDestructive, fmt.Sprintf("deletes files in %s, outside the working directory", dest))
+	} else {
+		this.writes(dest, command)
+	}
+}
+
+// Whether an rsync path is on another host, like host:dir or rsync://host/dir
+func remotePath(path string) bool {
+	if strings.HasPrefix(path, "rsync://") {
+		return true
+	}
+	colon := strings.Index(path, ":")
+	return colon > 0 && !strings.Contains(path[:colon], "/")
+}
+
+// Files curl and wget write to, other than stdout
+func (this *commandClassifier) classifyDownload(name string, args []string, command *ClassifiedCommand) {
+	flags := []string{"-o", "--output"}
+	if name == "wget" {
+		flags = []string{"-O", "--output-document"}
+	}
+	for _, flag := range flags {
+		if path, ok := flagValue(args[1:], flag); ok && path != "-" {
+			this.writes(path, command)
+		}
+	}
+}
+
+func (this *commandClassifier) classifyNested(cmd string, depth int, command *ClassifiedCommand, classification *CommandClassification) {
+	if depth >= commandClassifierMaxDepth {
+		command.add(RiskDestructive, "commands are nested too deeply to check")
+		return
+	}
+
+	// the nested commands are checked like the others, so an allow rule for
+	// the shell doesn't allow what it runs
+	nested := this.classify(cmd, depth+1)
+	command.add(nested.Line.Risk, "")
+	command.Reasons = append(command.Reasons, nested.Line.Reasons...)
+	classification.Commands = append(classification.Commands, nested.Commands...)
+}
+
+var (
+	gitReadOnly = wordSet(`blame describe diff grep help log ls-files ls-tree reflog
+		rev-parse shortlog show status version`)
+	gitNetwork = wordSet(`clone fetch ls-remote pull push submodule`)
+)
+
+func (this *commandClassifier) classifyGit(args []string, command *ClassifiedCommand) {
+	// skip options before the subcommand, some of which take a value
+	i := 1
+	for i < len(args) && strings.HasPrefix(args[i], "-") {
+		if args[i] == "-C" || args[i] == "-c" {
+			i++
+		}
+		i++
+	}
+	if i >= len(args) {
+		return
+	}
+	sub, rest := args[i], args[i+1:]
+
+	switch sub {
+	case "push":
+		for _, arg := range operands(rest) {
+			if strings.HasPrefix(arg, "+") || strings.HasPrefix(arg, ":") {
+				command.add(RiskDestructive, "git push "+arg+" overwrites or deletes a remote branch")
+			}
+		}
+		if hasFlag(rest, 'f', "--force", "--force-with-lease", "--mirror") {
+			command.add(RiskDestructive, "git push --force rewrites remote history")
+		}
+		if hasFlag(rest, 'd', "--delete") {
+			command.add(RiskDestructive, "git push --delete deletes remote branches")
+		}
+		command.add(RiskNetwork, "git push uses the network")
+	case "reset":
+		if hasFlag(rest, 0, "--hard") {
+			command.add(RiskDestructive, "git reset --hard discards changes")
+		} else {
+			command.add(RiskWritesCwd, "")
+		}
+	case "clean":
+		if hasFlag(rest, 'f', "--force") {
+			command.add(RiskDestructive, "git clean -f deletes untracked files")
+		} else {
+			command.add(RiskWritesCwd, "")
+		}
+	case "checkout", "restore":
+		if len(operands(rest)) > 0 && (containsArg(rest, "--") || containsArg(rest, ".")) {
+			command.add(RiskDestructive, "git "+sub+" discards changes to files")
+		} else {
+			command.add(RiskWritesCwd, "")
+		}
+	case "branch":
+		if hasFlag(rest, 'D') {
+			command.add(RiskDestructive, "git branch -D deletes unmerged branches")
+		} else if len(operands(rest)) > 0 || hasFlag(rest, 'd', "--delete") {
+			command.add(RiskWritesCwd, "")
+		}
+	case "stash":
+		if len(rest) > 0 && (rest[0] == "drop" || rest[0] == "clear") {
+			command.add(RiskDestructive, "git stash "+rest[0]+" deletes stashed changes")
+		} else if len(rest) == 0 || rest[0] != "list" && rest[0] != "show" {
+			command.add(RiskWritesCwd, "")
+		}
+	case "filter-branch", "filter-repo":
+		command.add(RiskDestructive, "git "+sub+" rewrites history")
+	case "remote", "tag", "config":
+		if len(operands(rest)) > 1 {
+			command.add(RiskWritesCwd, "")
+		}
+	default:
+		switch {
+		case gitReadOnly[sub]:
+		case gitNetwork[sub]:
+			command.add(RiskNetwork, "git "+sub+" uses the network")
+		default:
+			command.add(RiskWritesCwd, "")
+		}
+	}
+}
+
+func (this *commandClassifier) classifyFind(args []string, depth int, command *ClassifiedCommand, classification *CommandClassification) {
+	for i := 1; i < len(args); i++ {
+		switch args[i] {
+		case "-delete":
+			command.add(RiskDestructive, "find -delete deletes the files it finds")
+		case "-exec", "-execdir", "-ok", "-okdir":
+			end := i + 1
+			for end < len(args) && args[end] != ";" && args[end] != "+" {
+				end++
+			}
+			inner := []string{}
+			for _, arg := range args[i+1 : end] {
+				if arg != "{}" {
+					inner = append(inner, arg)
+				}
+			}
+			if len(inner) > 0 {
+				this.classifyArgs(inner, depth, command, classification)
+			}
+			i = end
+		case "-fprint", "-fprintf", "-fls":
+			if i+1 < len(args) {
+				this.writes(args[i+1], command)
+			}
+		}
+	}
+}
+
+// Options of wrapper commands that take a value, so the value isn't taken
+// for the wrapped command
+var wrapperValueFlags = map[string][]string{
+	"sudo":    {"-u", "-g", "-C", "-D", "-h", "-p", "-r", "-t", "-U"},
+	"doas":    {"-u", "-C"},
+	"env":     {"-u", "-C", "-S"},
+	"nice":    {"-n"},
+	"timeout": {"-s", "-k"},
+	"watch":   {"-n", "-d"},
+	"xargs":   {"-a", "-d", "-E", "-I", "-L", "-n", "-P", "-s"},
+	"stdbuf":  {"-i", "-o", "-e"},
+	"ionice":  {"-c", "-n", "-p"},
+	"flock":   {"-w", "-E"},
+}
+
+// The command a wrapper like sudo or xargs runs, false if name isn't a
+// wrapper or it doesn't run anything
+func wrappedCommand(name string, args []string) ([]string, bool) {
+	switch name {
+	case "sudo", "doas", "env", "nice", "nohup", "time", "timeout", "watch",
+		"xargs", "exec", "builtin", "stdbuf", "ionice", "flock", "command":
+	default:
+		return nil, false
+	}
+
+	valueFlags := wrapperValueFlags[name]
+	i := 1
+	for i < len(args) && strings.HasPrefix(args[i], "-") && args[i] != "-" {
+		if args[i] == "--" {
+			i++
+			break
+		}
+		// command -v only looks a command up
+		if name == "command" && (args[i] == "-v" || args[i] == "-V") {
+			return nil, false
+		}
+		for _, flag := range valueFlags {
+			if args[i] == flag {
+				i++
+				break
+			}
+		}
+		i++
+	}
+
+	if name == "env" {
+		for i < len(args) && isAssignment(args[i]) {
+			i++
+		}
+	}
+	// timeout takes a duration and flock a lock file before the command
+	if (name == "timeout" || name == "flock") && i < len(args) {
+		i++
+	}
+
+	if i >= len(args) {
+		return nil, false
+	}
+	return args[i:], true
+}
+
+func isAssignment(arg string) bool {
+	eq := strings.Index(arg, "=")
+	if eq <= 0 {
+		return false
+	}
+	for _, r := range arg[:eq] {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether args include the short flag, alone or combined like -rf, or one
+// of the long flags. A short flag of 0 only checks the long ones.
+func hasFlag(args []string, short byte, long ...string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		for _, flag := range long {
+			if arg == flag || strings.HasPrefix(arg, flag+"=") {
+				return true
+			}
+		}
+		if short != 0 && len(arg) > 1 && arg[0] == '-' && arg[1] != '-' &&
+			strings.IndexByte(arg[1:], short) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// The value of a flag like -o file, -ofile or --output=file
+func flagValue(args []string, flag string) (string, bool) {
+	for i, arg := range args {
+		switch {
+		case arg == flag && i+1 < len(args):
+			return args[i+1], true
+		case strings.HasPrefix(flag, "--") && strings.HasPrefix(arg, flag+"="):
+			return arg[len(flag)+1:], true
+		case !strings.HasPrefix(flag, "--") && strings.HasPrefix(arg, flag) && len(arg) > len(flag):
+			return arg[len(flag):], true
+		}
+	}
+	return "", false
+}
+
+// Arguments that aren't flags
+func operands(args []string) []string {
+	result := []string{}
+	flags := true
+	for _, arg := range args {
+		if flags && arg == "--" {
+			flags = false
+			continue
+		}
+		if flags && strings.HasPrefix(arg, "-") && arg != "-" {
+			continue
+		}
+		result = append(result, arg)
+	}
+	return result
+}
+
+func subcommand(args []string) string {
+	ops := operands(args[1:])
+	if len(ops) == 0 {
+		return ""
+	}
+	return ops[0]
+}
+
+func containsArg(args []string, value string) bool {
+	for _, arg := range args {
+		if arg == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the statement runs curl or wget anywhere in it
+func stmtDownloads(stmt *syntax.Stmt) bool {
+	found := false
+	syntax.Walk(stmt, func(node syntax.Node) bool {
+		if call, ok := node.(*syntax.CallExpr); ok && len(call.Args) > 0 {
+			name, _ := wordString(call.Args[0])
+			found = found || downloadCommands[commandName(name)]
+		}
+		return !found
+	})
+	return found
+}
+
+// Whether the statement is an interpreter or source, which can read their
+// program from stdin or a file, possibly run with sudo or another wrapper
+func stmtInterprets(stmt *syntax.Stmt) bool {
+	call, ok := stmt.Cmd.(*syntax.CallExpr)
+	if !ok || len(call.Args) == 0 {
+		return false
+	}
+
+	args := []string{}
+	for _, word := range call.Args {
+		arg, _ := wordString(word)
+		args = append(args, arg)
+	}
+	for {
+		name := commandName(args[0])
+		inner, ok := wrappedCommand(name, args)
+		if !ok {
+			return interpreterCommands[name] || name == "source" || name == "."
+		}
+		args = inner
+	}
+}
+
+// Whether the statement runs an interpreter on a download given through a
+// process or command substitution, like bash <(curl -fsSL url)
+func stmtInterpretsDownload(stmt *syntax.Stmt) bool {
+	if !stmtInterprets(stmt) {
+		return false
+	}
+
+	nodes := []syntax.Node{}
+	for _, word := range stmt.Cmd.(*syntax.CallExpr).Args[1:] {
+		nodes = append(nodes, word)
+	}
+	for _, redir := range stmt.Redirs {
+		if redir.Word != nil {
+			nodes = append(nodes, redir.Word)
+		}
+	}
+
+	found := false
+	for _, node := range nodes {
+		syntax.Walk(node, func(node syntax.Node) bool {
+			var stmts []*syntax.Stmt
+			switch node := node.(type) {
+			case *syntax.ProcSubst:
+				stmts = node.Stmts
+			case *syntax.CmdSubst:
+				stmts = node.Stmts
+			}
+			for _, inner := range stmts {
+				found = found || stmtDownloads(inner)
+			}
+			return !found
+		})
+	}
+	return found
+}
+
+type PolicyDecision int
+
+const (
+	PolicyAllow PolicyDecision = iota
+	PolicyConfirm
+	PolicyDeny
+)
+
+var policyDecisionNames = []string{"allow", "confirm", "deny"}
+
+func (this PolicyDecision) String() string {
+	return policyDecisionNames[this]
+}
+
+// Unsafe goal mode asks before running commands riskier than this by default
+const DefaultConfirmAbove = RiskNetwork
+
+type CommandPolicyConfig struct {
+	// Unsafe goal mode asks before running commands riskier than this
+	ConfirmAbove CommandRisk `yaml:"confirm_above"`
+	Allow        []string    `yaml:"allow"`
+	Confirm      []string    `yaml:"confirm"`
+	Deny         []string    `yaml:"deny"`
+}
+
+// Load the command policy config, returns nil if the file doesn't exist
+func LoadCommandPolicyConfig(path string) (*CommandPolicyConfig, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	config := &CommandPolicyConfig{ConfirmAbove: DefaultConfirmAbove}
+	err = yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing command policy file %s: %s", path, err)
+	}
+
+	return config, nil
+}
+
+type commandPolicyRule struct {
+	pattern string
+	regex   *regexp.Regexp
+}
+
+type CommandPolicy struct {
+	confirmAbove CommandRisk
+	allow        []commandPolicyRule
+	confirm      []commandPolicyRule
+	deny         []commandPolicyRule
+}
+
+// Create a policy from the config, which may be nil
+func NewCommandPolicy(config *CommandPolicyConfig) (*CommandPolicy, error) {
+	if config == nil {
+		config = &CommandPolicyConfig{ConfirmAbove: DefaultConfirmAbove}
+	}
+
+	policy := &CommandPolicy{confirmAbove: config.ConfirmAbove}
+	var err error
+	if policy.allow, err = compilePolicyRules(config.Allow); err != nil {
+		return nil, err
+	}
+	if policy.confirm, err = compilePolicyRules(config.Confirm); err != nil {
+		return nil, err
+	}
+	if policy.deny, err = compilePolicyRules(config.Deny); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func compilePolicyRules(patterns []string) ([]commandPolicyRule, error) {
+	rules := []commandPolicyRule{}
+	for _, pattern := range patterns {
+		pattern = strings.Join(strings.Fields(pattern), " ")
+		if pattern == "" {
+			return nil, fmt.Errorf("Command policy patterns can't be empty")
+		}
+
+		var builder strings.Builder
+		builder.WriteString("^")
+		for _, r := range pattern {
+			switch r {
+			case '*':
+				builder.WriteString(".*")
+			case '?':
+				builder.WriteString(".")
+			default:
+				builder.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		builder.WriteString("$")
+
+		rules = append(rules, commandPolicyRule{
+			pattern: pattern,
+			regex:   regexp.MustCompile(builder.String()),
+		})
+	}
+	return rules, nil
+}
+
+// The first rule matching the whole command line or one of its commands
+func matchPolicyRule(rules []commandPolicyRule, texts []string) string {
+	for _, rule := range rules {
+		for _, text := range texts {
+			if rule.regex.MatchString(strings.Join(strings.Fields(text), " ")) {
+				return rule.pattern
+			}
+		}
+	}
+	return ""
+}
+
+type CommandCheck struct {
+	Decision PolicyDecision
+	*CommandClassification
+	// The pattern that decided, empty if the command's risk did
+	Rule string
+}
+
+// e.g. "confirm, destructive: rm -r deletes recursively"
+func (this *CommandCheck) Summary() string {
+	summary := this.Decision.String()
+	if this.Rule != "" {
+		summary += fmt.Sprintf(" (rule %q)", this.Rule)
+	}
+	return summary + ", " + this.CommandClassification.Summary()
+}
+
+// Classify the command and decide whether it can run. Deny rules come first,
+// then confirm rules, then commands riskier than the confirm level need
+// confirmation unless an allow rule covers them. A nil policy uses the
+// defaults.
+func (this *CommandPolicy) Check(cmd, cwd string) *CommandCheck {
+	if this == nil {
+		this, _ = NewCommandPolicy(nil)
+	}
+
+	classification := ClassifyCommand(cmd, cwd)
+	texts := []string{cmd}
+	for _, command := range classification.Commands {
+		texts = append(texts, command.Text)
+	}
+
+	check := &CommandCheck{CommandClassification: classification}
+	if rule := matchPolicyRule(this.deny, texts); rule != "" {
+		check.Decision = PolicyDeny
+		check.Rule = rule
+		return check
+	}
+	if rule := matchPolicyRule(this.confirm, texts); rule != "" {
+		check.Decision = PolicyConfirm
+		check.Rule = rule
+		return check
+	}
+
+	// allowed commands don't count towards the risk, but how they're
+	// combined, like piping a download into sh, still does
+	allowed := map[*ClassifiedCommand]bool{}
+	for _, command := range classification.Commands {
+		if matchPolicyRule(this.allow, []string{command.Text}) != "" {
+			allowed[command] = true
+		}
+	}
+	classification.update(allowed)
+
+	if classification.Risk > this.confirmAbove {
+		check.Decision = PolicyConfirm
+	}
+	return check
+}
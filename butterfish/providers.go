@@ -0,0 +1,332 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mitchellh/go-homedir"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+// A provider registry lets each feature of Butterfish talk to a different
+// backend, for example autosuggest can go to a local llama.cpp server while
+// prompts go to OpenAI. Providers and the roles that use them are defined in
+// a yaml file, by default ~/.config/butterfish/providers.yaml:
+//
+//	providers:
+//	  - name: openai
+//	    dialect: openai
+//	    api_key_env: OPENAI_API_KEY
+//	  - name: local
+//	    dialect: openai
+//	    base_url: http://localhost:8080/v1
+//	roles:
+//	  default: openai
+//	  autosuggest: local
+//
+// Roles that aren't listed use the "default" role's provider if there is
+// one, otherwise the client picked from the API keys as before.
+//
+// A role can instead have a fallback chain, an ordered list of providers
+// (optionally with a model to use on that provider) that are tried in turn
+// when a provider is down or out of quota:
+//
+//	fallbacks:
+//	  prompt:
+//	    - provider: openai
+//	    - provider: anthropic
+//	      model: claude-3-5-sonnet-latest
+//
+// Providers can also be rate limited, see RateLimiter.
+
+// Model roles, these correspond to the model fields on ButterfishConfig and
+// are set on each CompletionRequest as ModelRole
+const (
+	ModelRoleDefault     = "default"
+	ModelRolePrompt      = "prompt"
+	ModelRoleAutosuggest = "autosuggest"
+	ModelRoleGencmd      = "gencmd"
+	ModelRoleExeccheck   = "execcheck"
+	ModelRoleSummarize   = "summarize"
+	ModelRoleImage       = "image"
+	ModelRoleEmbeddings  = "embeddings"
+)
+
+var modelRoles = []string{
+	ModelRoleDefault,
+	ModelRolePrompt,
+	ModelRoleAutosuggest,
+	ModelRoleGencmd,
+	ModelRoleExeccheck,
+	ModelRoleSummarize,
+	ModelRoleImage,
+	ModelRoleEmbeddings,
+}
+
+// API dialects a provider can speak
+const (
+	DialectOpenAI    = "openai"
+	DialectAnthropic = "anthropic"
+	DialectGemini    = "gemini"
+	DialectOllama    = "ollama"
+)
+
+type ProviderConfig struct {
+	Name    string `yaml:"name"`
+	Dialect string `yaml:"dialect"`
+	// Optional, defaults to the dialect's public API
+	BaseURL string `yaml:"base_url"`
+	// The key can be given literally or as the name of an environment
+	// variable to read it from, local servers often need neither
+	APIKey    string `yaml:"api_key"`
+	APIKeyEnv string `yaml:"api_key_env"`
+	// Optional, the model this provider uses for embeddings
+	EmbeddingModel string `yaml:"embedding_model"`
+	// Optional, caps the context window an ollama provider asks for
+	MaxContextLength int `yaml:"max_context_length"`
+}
+
+type FallbackConfig struct {
+	Provider string `yaml:"provider"`
+	// Optional, replaces the request's model when using this provider
+	Model string `yaml:"model"`
+}
+
+type ProvidersConfig struct {
+	Providers []ProviderConfig `yaml:"providers"`
+	// Map of model role to provider name
+	Roles map[string]string `yaml:"roles"`
+	// Map of model role to an ordered list of providers to try
+	Fallbacks map[string][]FallbackConfig `yaml:"fallbacks"`
+	// Map of provider or provider/model to its rate limit
+	RateLimits map[string]RateLimitConfig `yaml:"rate_limits"`
+
+	// shared by all clients, created on first use
+	limiter *RateLimiter
+}
+
+// Load a providers file, returns nil without an error if it doesn't exist.
+func LoadProvidersConfig(path string) (*ProvidersConfig, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	config := &ProvidersConfig{}
+	err = yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", path, err)
+	}
+
+	return config, nil
+}
+
+func (this *ProviderConfig) key() string {
+	if this.APIKey != "" {
+		return this.APIKey
+	}
+	if this.APIKeyEnv != "" {
+		return os.Getenv(this.APIKeyEnv)
+	}
+	return ""
+}
+
+func (this *ProviderConfig) NewLLM() (LLM, error) {
+	switch this.Dialect {
+	case DialectOpenAI, "":
+		gpt := NewGPT(this.key(), this.BaseURL)
+		setEmbeddingModel(gpt, this.EmbeddingModel)
+		return gpt, nil
+	case DialectAnthropic:
+		return NewAnthropic(this.key(), this.BaseURL), nil
+	case DialectGemini:
+		gemini := NewGemini(this.key(), this.BaseURL)
+		setEmbeddingModel(gemini, this.EmbeddingModel)
+		return gemini, nil
+	case DialectOllama:
+		ollama := NewOllama(this.BaseURL)
+		ollama.MaxContextLength = this.MaxContextLength
+		setEmbeddingModel(ollama, this.EmbeddingModel)
+		return ollama, nil
+	default:
+		return nil, fmt.Errorf("Provider %s has unknown dialect %s", this.Name, this.Dialect)
+	}
+}
+
+// Override a client's default embedding model if one is configured
+func setEmbeddingModel(llm LLM, model string) {
+	if model == "" {
+		return
+	}
+	switch client := llm.(type) {
+	case *GPT:
+		client.EmbeddingModel = model
+	case *Gemini:
+		client.EmbeddingModel = model
+	case *Ollama:
+		client.EmbeddingModel = model
+	}
+}
+
+// The rate limiter for the configured limits, nil if there are none.
+func (this *ProvidersConfig) RateLimiter() (*RateLimiter, error) {
+	if len(this.RateLimits) == 0 {
+		return nil, nil
+	}
+	if this.limiter == nil {
+		err := validateRateLimits(this.RateLimits, this.Providers)
+		if err != nil {
+			return nil, err
+		}
+		this.limiter = NewRateLimiter(this.RateLimits)
+	}
+	return this.limiter, nil
+}
+
+// Build a client for each provider and map roles to those clients.
+func (this *ProvidersConfig) RoleClients() (map[string]LLM, error) {
+	limiter, err := this.RateLimiter()
+	if err != nil {
+		return nil, err
+	}
+
+	clients := map[string]LLM{}
+	for i := range this.Providers {
+		provider := &this.Providers[i]
+		if provider.Name == "" {
+			return nil, fmt.Errorf("Provider %d has no name", i+1)
+		}
+		if _, ok := clients[provider.Name]; ok {
+			return nil, fmt.Errorf("Provider %s is defined more than once", provider.Name)
+		}
+
+		client, err := provider.NewLLM()
+		if err != nil {
+			return nil, err
+		}
+		clients[provider.Name] = limiter.Wrap(provider.Name, client)
+	}
+
+	roleClients := map[string]LLM{}
+	for role, name := range this.Roles {
+		if !isModelRole(role) {
+			return nil, fmt.Errorf("Unknown model role %s, expected one of %v", role, modelRoles)
+		}
+		client, ok := clients[name]
+		if !ok {
+			return nil, fmt.Errorf("Role %s uses provider %s which is not defined", role, name)
+		}
+		roleClients[role] = client
+	}
+
+	for role, chain := range this.Fallbacks {
+		if !isModelRole(role) {
+			return nil, fmt.Errorf("Unknown model role %s, expected one of %v", role, modelRoles)
+		}
+		if _, ok := this.Roles[role]; ok {
+			return nil, fmt.Errorf("Role %s has both a provider and a fallback chain, use one or the other", role)
+		}
+		if len(chain) == 0 {
+			return nil, fmt.Errorf("Fallback chain for role %s is empty", role)
+		}
+
+		backends := []FallbackBackend{}
+		for _, entry := range chain {
+			client, ok := clients[entry.Provider]
+			if !ok {
+				return nil, fmt.Errorf("Fallback chain for role %s uses provider %s which is not defined", role, entry.Provider)
+			}
+			backends = append(backends, FallbackBackend{
+				Name:  entry.Provider,
+				LLM:   client,
+				Model: entry.Model,
+			})
+		}
+		roleClients[role] = NewFallbackLLM(backends...)
+	}
+
+	return roleClients, nil
+}
+
+func isModelRole(role string) bool {
+	for _, r := range modelRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// RoutedLLM implements the LLM interface by passing each request on to the
+// client for the request's ModelRole.
+type RoutedLLM struct {
+	Default LLM
+	Roles   map[string]LLM
+}
+
+func (this *RoutedLLM) route(role string) LLM {
+	if client, ok := this.Roles[role]; ok {
+		return client
+	}
+	return this.Default
+}
+
+func (this *RoutedLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	return this.route(request.ModelRole).CompletionStream(request, writer)
+}
+
+func (this *RoutedLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	return this.route(request.ModelRole).Completion(request)
+}
+
+func (this *RoutedLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return this.route(ModelRoleEmbeddings).Embeddings(ctx, input, verbose)
+}
+
+// Wrap the default client in a router if providers are configured. If the
+// default client couldn't be created (e.g. no API key) then the providers
+// must supply a default role.
+func newRoutedLLM(providers *ProvidersConfig, defaultLLM LLM, defaultErr error) (LLM, error) {
+	if providers == nil {
+		return defaultLLM, defaultErr
+	}
+
+	limiter, err := providers.RateLimiter()
+	if err != nil {
+		return nil, err
+	}
+	defaultLLM = limiter.Wrap(ProviderDefault, defaultLLM)
+
+	if len(providers.Roles) == 0 && len(providers.Fallbacks) == 0 {
+		return defaultLLM, defaultErr
+	}
+
+	roleClients, err := providers.RoleClients()
+	if err != nil {
+		return nil, err
+	}
+
+	if client, ok := roleClients[ModelRoleDefault]; ok {
+		defaultLLM = client
+	} else if defaultErr != nil {
+		return nil, errors.Join(defaultErr,
+			errors.New("Set a default role in the providers file to route requests without an API key."))
+	}
+
+	return &RoutedLLM{
+		Default: defaultLLM,
+		Roles:   roleClients,
+	}, nil
+}
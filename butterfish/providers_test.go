@@ -0,0 +1,82 @@
+package butterfish
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+type namedLLM string
+
+func (this namedLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	return this.Completion(request)
+}
+
+func (this namedLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	return &util.CompletionResponse{Completion: string(this)}, nil
+}
+
+func (this namedLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return [][]float32{{float32(len(this))}}, nil
+}
+
+func TestLoadProvidersConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "providers.yaml")
+	config, err := LoadProvidersConfig(path)
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+
+	os.WriteFile(path, []byte(`
+providers:
+  - name: openai
+    dialect: openai
+    api_key_env: BUTTERFISH_TEST_KEY
+  - name: local
+    dialect: openai
+    base_url: http://localhost:8080/v1
+roles:
+  default: openai
+  autosuggest: local
+`), 0644)
+
+	config, err = LoadProvidersConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(config.Providers))
+	assert.Equal(t, "local", config.Roles[ModelRoleAutosuggest])
+
+	clients, err := config.RoleClients()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(clients))
+
+	config.Roles["gencmd"] = "missing"
+	_, err = config.RoleClients()
+	assert.Error(t, err)
+	delete(config.Roles, "gencmd")
+
+	config.Roles["typo"] = "local"
+	_, err = config.RoleClients()
+	assert.Error(t, err)
+}
+
+func TestRoutedLLM(t *testing.T) {
+	router := &RoutedLLM{
+		Default: namedLLM("default"),
+		Roles: map[string]LLM{
+			ModelRoleAutosuggest: namedLLM("local"),
+		},
+	}
+
+	resp, err := router.Completion(&util.CompletionRequest{ModelRole: ModelRoleAutosuggest})
+	assert.NoError(t, err)
+	assert.Equal(t, "local", resp.Completion)
+
+	resp, err = router.CompletionStream(&util.CompletionRequest{ModelRole: ModelRolePrompt}, io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, "default", resp.Completion)
+}
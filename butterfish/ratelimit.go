@@ -0,0 +1,306 @@
+package butterfish
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+// Client side rate limiting. The shell makes autosuggest, prompt and goal
+// mode calls concurrently and index sends embeddings as fast as it can, so
+// rather than hitting 429s and backing off we queue calls in front of each
+// provider. Limits are set in the providers file, keyed by provider name or
+// provider/model, the provider "default" is the client picked from the API
+// keys when no role routes elsewhere:
+//
+//	rate_limits:
+//	  openai:
+//	    requests_per_minute: 500
+//	    tokens_per_minute: 200000
+//	  openai/gpt-4o:
+//	    tokens_per_minute: 30000
+//
+// Each model gets its own token bucket, using the provider/model limit if
+// there is one and the provider limit otherwise. Interactive calls go ahead
+// of background calls (autosuggest and embeddings) waiting on the same bucket.
+
+// The provider name of the client picked from the API keys
+const ProviderDefault = "default"
+
+type RateLimitConfig struct {
+	RequestsPerMinute int `yaml:"requests_per_minute"`
+	TokensPerMinute   int `yaml:"tokens_per_minute"`
+}
+
+// A bucket that refills continuously up to a minute's worth of capacity.
+type tokenBucket struct {
+	capacity float64
+	level    float64
+	updated  time.Time
+}
+
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		capacity: float64(perMinute),
+		level:    float64(perMinute),
+		updated:  now,
+	}
+}
+
+func (this *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(this.updated).Minutes()
+	this.level = math.Min(this.capacity, this.level+elapsed*this.capacity)
+	this.updated = now
+}
+
+// How long until n can be taken, zero if it can be taken now. Requests for
+// more than the capacity wait for a full bucket rather than forever.
+func (this *tokenBucket) wait(n float64) time.Duration {
+	n = math.Min(n, this.capacity)
+	if this.level >= n {
+		return 0
+	}
+	minutes := (n - this.level) / this.capacity
+	return time.Duration(minutes * float64(time.Minute))
+}
+
+// The request and token buckets for one provider and model
+type rateLimitBuckets struct {
+	requests *tokenBucket
+	tokens   *tokenBucket
+	// number of interactive calls waiting, background calls wait for these
+	interactiveWaiting int
+}
+
+type RateLimiter struct {
+	limits map[string]RateLimitConfig
+
+	mutex   sync.Mutex
+	buckets map[string]*rateLimitBuckets
+}
+
+func NewRateLimiter(limits map[string]RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		limits:  limits,
+		buckets: map[string]*rateLimitBuckets{},
+	}
+}
+
+func (this *RateLimiter) hasLimits(provider string) bool {
+	for key := range this.limits {
+		if key == provider || strings.HasPrefix(key, provider+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap a provider's client so its calls go through the limiter, clients for
+// providers without limits are returned as is.
+func (this *RateLimiter) Wrap(provider string, llm LLM) LLM {
+	if this == nil || llm == nil || !this.hasLimits(provider) {
+		return llm
+	}
+	return &RateLimitedLLM{
+		inner:    llm,
+		provider: provider,
+		limiter:  this,
+	}
+}
+
+// Get the buckets for a provider and model, must hold the mutex.
+func (this *RateLimiter) bucketsFor(provider, model string, now time.Time) *rateLimitBuckets {
+	key := provider + "/" + model
+	if buckets, ok := this.buckets[key]; ok {
+		return buckets
+	}
+
+	limit, ok := this.limits[key]
+	if !ok {
+		limit = this.limits[provider]
+	}
+
+	buckets := &rateLimitBuckets{
+		requests: newTokenBucket(limit.RequestsPerMinute, now),
+		tokens:   newTokenBucket(limit.TokensPerMinute, now),
+	}
+	this.buckets[key] = buckets
+	return buckets
+}
+
+// Wait until a call using the given number of tokens can be made, or the
+// context is done.
+func (this *RateLimiter) Wait(ctx context.Context, provider, model string, tokens int, interactive bool) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	registered := false
+	defer func() {
+		if registered {
+			this.mutex.Lock()
+			this.bucketsFor(provider, model, time.Now()).interactiveWaiting--
+			this.mutex.Unlock()
+		}
+	}()
+
+	for {
+		this.mutex.Lock()
+		now := time.Now()
+		buckets := this.bucketsFor(provider, model, now)
+
+		delay := time.Duration(0)
+		if buckets.requests != nil {
+			buckets.requests.refill(now)
+			delay = buckets.requests.wait(1)
+		}
+		if buckets.tokens != nil {
+			buckets.tokens.refill(now)
+			if wait := buckets.tokens.wait(float64(tokens)); wait > delay {
+				delay = wait
+			}
+		}
+
+		// background calls let waiting interactive calls go first
+		if !interactive && buckets.interactiveWaiting > 0 && delay < 50*time.Millisecond {
+			delay = 50 * time.Millisecond
+		} else if delay == 0 {
+			if buckets.requests != nil {
+				buckets.requests.level--
+			}
+			if buckets.tokens != nil {
+				buckets.tokens.level -= math.Min(float64(tokens), buckets.tokens.capacity)
+			}
+			this.mutex.Unlock()
+			return nil
+		}
+
+		if interactive && !registered {
+			buckets.interactiveWaiting++
+			registered = true
+		}
+		this.mutex.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Correct a token reservation once the actual usage is known, the bucket can
+// go into debt if we underestimated.
+func (this *RateLimiter) Adjust(provider, model string, reserved, actual int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	buckets := this.bucketsFor(provider, model, time.Now())
+	if buckets.tokens != nil {
+		reserved := math.Min(float64(reserved), buckets.tokens.capacity)
+		buckets.tokens.level = math.Min(buckets.tokens.capacity,
+			buckets.tokens.level+reserved-float64(actual))
+	}
+}
+
+// Check that limits name known providers and aren't negative
+func validateRateLimits(limits map[string]RateLimitConfig, providers []ProviderConfig) error {
+	for key, limit := range limits {
+		provider, _, _ := strings.Cut(key, "/")
+		known := provider == ProviderDefault
+		for _, p := range providers {
+			if p.Name == provider {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("Rate limit %s is for provider %s which is not defined", key, provider)
+		}
+		if limit.RequestsPerMinute < 0 || limit.TokensPerMinute < 0 {
+			return fmt.Errorf("Rate limit %s is negative", key)
+		}
+	}
+	return nil
+}
+
+// Autosuggest is speculative and embeddings are mostly bulk indexing, so
+// these wait behind everything else.
+func isInteractiveRequest(request *util.CompletionRequest) bool {
+	return requestFeature(request) != FeatureAutosuggest &&
+		request.ModelRole != ModelRoleAutosuggest
+}
+
+// RateLimitedLLM implements the LLM interface by waiting on the rate limiter
+// before passing calls through to a provider's client.
+type RateLimitedLLM struct {
+	inner    LLM
+	provider string
+	limiter  *RateLimiter
+}
+
+// Tokens to reserve for a request, providers count max_tokens against the
+// limit so we do too.
+func (this *RateLimitedLLM) reserve(request *util.CompletionRequest) (int, error) {
+	tokens := estimateRequestTokens(request) + request.MaxTokens
+	err := this.limiter.Wait(request.Ctx, this.provider, request.Model,
+		tokens, isInteractiveRequest(request))
+	if err != nil {
+		return tokens, &requestNotSentError{err}
+	}
+	return tokens, nil
+}
+
+func (this *RateLimitedLLM) settle(request *util.CompletionRequest, reserved int, response *util.CompletionResponse) {
+	if response == nil || response.Usage == nil {
+		return
+	}
+	actual := response.Usage.PromptTokens + response.Usage.CompletionTokens
+	this.limiter.Adjust(this.provider, request.Model, reserved, actual)
+}
+
+func (this *RateLimitedLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	reserved, err := this.reserve(request)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := this.inner.CompletionStream(request, writer)
+	this.settle(request, reserved, response)
+	return response, err
+}
+
+func (this *RateLimitedLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	reserved, err := this.reserve(request)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := this.inner.Completion(request)
+	this.settle(request, reserved, response)
+	return response, err
+}
+
+func (this *RateLimitedLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	tokens := 0
+	for _, s := range input {
+		tokens += estimateTokens(s)
+	}
+
+	err := this.limiter.Wait(ctx, this.provider, embeddingModelName(this.inner), tokens, false)
+	if err != nil {
+		return nil, &requestNotSentError{err}
+	}
+
+	return this.inner.Embeddings(ctx, input, verbose)
+}
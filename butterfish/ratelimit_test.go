@@ -0,0 +1,82 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(map[string]RateLimitConfig{
+		"openai":        {RequestsPerMinute: 1},
+		"openai/gpt-4o": {TokensPerMinute: 1000},
+	})
+
+	// one request a minute, the second has to wait
+	ctx := context.Background()
+	assert.NoError(t, limiter.Wait(ctx, "openai", "gpt-4o-mini", 10, true))
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	err := limiter.Wait(timeoutCtx, "openai", "gpt-4o-mini", 10, true)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// gpt-4o has its own bucket and only a token limit
+	assert.NoError(t, limiter.Wait(ctx, "openai", "gpt-4o", 600, true))
+	timeoutCtx, cancel = context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	err = limiter.Wait(timeoutCtx, "openai", "gpt-4o", 600, true)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// we reserved more than was used, so there's room again
+	limiter.Adjust("openai", "gpt-4o", 600, 100)
+	assert.NoError(t, limiter.Wait(ctx, "openai", "gpt-4o", 600, true))
+}
+
+func TestRateLimiterPriority(t *testing.T) {
+	limiter := NewRateLimiter(map[string]RateLimitConfig{
+		"local": {RequestsPerMinute: 100},
+	})
+
+	// pretend an interactive call is queued, background calls wait for it
+	limiter.bucketsFor("local", "llama", time.Now()).interactiveWaiting = 1
+
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := limiter.Wait(timeoutCtx, "local", "llama", 0, false)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NoError(t, limiter.Wait(context.Background(), "local", "llama", 0, true))
+}
+
+func TestRateLimitedProviders(t *testing.T) {
+	config := &ProvidersConfig{
+		Providers: []ProviderConfig{{Name: "local"}},
+		Roles:     map[string]string{ModelRoleAutosuggest: "local"},
+		RateLimits: map[string]RateLimitConfig{
+			"local":   {RequestsPerMinute: 10},
+			"default": {RequestsPerMinute: 10},
+		},
+	}
+
+	llm, err := newRoutedLLM(config, namedLLM("default"), nil)
+	assert.NoError(t, err)
+	routed := llm.(*RoutedLLM)
+	assert.IsType(t, &RateLimitedLLM{}, routed.Default)
+	assert.IsType(t, &RateLimitedLLM{}, routed.Roles[ModelRoleAutosuggest])
+
+	response, err := llm.CompletionStream(&util.CompletionRequest{
+		Ctx:   context.Background(),
+		Model: "gpt-4o",
+	}, &bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.Equal(t, "default", response.Completion)
+
+	config.RateLimits["missing/model"] = RateLimitConfig{RequestsPerMinute: 1}
+	config.limiter = nil
+	_, err = newRoutedLLM(config, namedLLM("default"), nil)
+	assert.Error(t, err)
+}
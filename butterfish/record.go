@@ -0,0 +1,193 @@
+package butterfish
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// Commands run in the shell are recorded on their historyTypeShellInput
+// block: the working directory and git branch they ran in, when they
+// started and finished, and their exit code. Prompts show this after the
+// command compactly, e.g. "make test [exit 2, 3.1s, ~/proj (main)]".
+//
+// The working directory comes from an OSC 7 escape that our PS1 prints
+// (and some shells print themselves), the exit code from the PS1 suffix,
+// see SetPS1. The branch is read from the repo's HEAD file.
+
+// OSC 7 reports the working directory as a file URL,
+// ESC ] 7 ; file://host/path BEL, and can also end with ESC \
+const osc7Pattern = "\x1b\\]7;([^\x07\x1b]*)(?:\x07|\x1b\\\\)"
+
+var osc7Regex = regexp.MustCompile(osc7Pattern)
+
+// The last working directory reported in terminal output with OSC 7, or
+// an empty string if there isn't one
+func ParseOSC7Cwd(data string) string {
+	matches := osc7Regex.FindAllStringSubmatch(data, -1)
+	if len(matches) == 0 {
+		return ""
+	}
+
+	location := matches[len(matches)-1][1]
+	if !strings.HasPrefix(location, "file://") {
+		return ""
+	}
+	// drop the host, the path starts at the next slash
+	path := strings.TrimPrefix(location, "file://")
+	slash := strings.Index(path, "/")
+	if slash < 0 {
+		return ""
+	}
+	path = path[slash:]
+
+	// shells that send OSC 7 themselves percent-encode the path, ours isn't
+	// so a path that doesn't decode is used as is
+	if decoded, err := url.PathUnescape(path); err == nil {
+		path = decoded
+	}
+	return path
+}
+
+// The branch checked out in the git repo containing dir, or the start of the
+// commit hash if HEAD is detached. Empty if dir isn't in a repo.
+func gitBranch(dir string) string {
+	if dir == "" {
+		return ""
+	}
+
+	for {
+		gitPath := filepath.Join(dir, ".git")
+		info, err := os.Stat(gitPath)
+		if err == nil {
+			// worktrees and submodules have a file pointing to the git dir
+			if !info.IsDir() {
+				data, err := os.ReadFile(gitPath)
+				if err != nil {
+					return ""
+				}
+				gitPath = strings.TrimSpace(strings.TrimPrefix(string(data), "gitdir:"))
+				if !filepath.IsAbs(gitPath) {
+					gitPath = filepath.Join(dir, gitPath)
+				}
+			}
+
+			head, err := os.ReadFile(filepath.Join(gitPath, "HEAD"))
+			if err != nil {
+				return ""
+			}
+			ref := strings.TrimSpace(string(head))
+			if strings.HasPrefix(ref, "ref: refs/heads/") {
+				return strings.TrimPrefix(ref, "ref: refs/heads/")
+			}
+			if len(ref) >= 7 {
+				return ref[:7]
+			}
+			return ""
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// A command run in the shell along with its output
+type CommandRecord struct {
+	Input  string
+	Output string
+	// nil if the command is still running
+	ExitCode  *int
+	Start     time.Time
+	End       time.Time
+	Cwd       string
+	GitBranch string
+}
+
+// Make a record from the command's input block and the blocks after it,
+// its output is the shell output that follows
+func newCommandRecord(blocks []*HistoryBuffer) *CommandRecord {
+	input := blocks[0]
+	record := &CommandRecord{
+		Input:     input.Content.String(),
+		ExitCode:  input.ExitCode,
+		Start:     input.Time,
+		End:       input.End,
+		Cwd:       input.Cwd,
+		GitBranch: input.GitBranch,
+	}
+
+	var output strings.Builder
+	for _, block := range blocks[1:] {
+		if block.Type != historyTypeShellOutput {
+			break
+		}
+		output.WriteString(block.Content.String())
+	}
+	record.Output = output.String()
+	return record
+}
+
+func (this *CommandRecord) Summary() string {
+	return commandSummary(this.ExitCode, this.Start, this.End, this.Cwd, this.GitBranch)
+}
+
+// The summary of a finished command's input block, empty for other blocks
+func (this *HistoryBuffer) CommandSummary() string {
+	if this.Type != historyTypeShellInput || this.ExitCode == nil {
+		return ""
+	}
+	return commandSummary(this.ExitCode, this.Time, this.End, this.Cwd, this.GitBranch)
+}
+
+// e.g. [exit 2, 3.1s, ~/proj (main)], the date and time are added for
+// commands from an earlier day, like ones in a resumed session
+func commandSummary(exitCode *int, start, end time.Time, cwd, branch string) string {
+	parts := []string{}
+	if exitCode != nil {
+		parts = append(parts, fmt.Sprintf("exit %d", *exitCode))
+	} else {
+		parts = append(parts, "running")
+	}
+	if !start.IsZero() && !end.IsZero() {
+		parts = append(parts, formatCommandDuration(end.Sub(start)))
+	}
+
+	if cwd != "" {
+		if home, err := homedir.Dir(); err == nil && home != "" && home != "/" {
+			if cwd == home {
+				cwd = "~"
+			} else if strings.HasPrefix(cwd, home+"/") {
+				cwd = "~" + cwd[len(home):]
+			}
+		}
+		if branch != "" {
+			cwd += " (" + branch + ")"
+		}
+		parts = append(parts, cwd)
+	}
+
+	if !start.IsZero() {
+		start, now := start.Local(), time.Now()
+		if start.YearDay() != now.YearDay() || start.Year() != now.Year() {
+			parts = append(parts, start.Format("Jan 2 15:04"))
+		}
+	}
+
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+func formatCommandDuration(duration time.Duration) string {
+	if duration < time.Minute {
+		return fmt.Sprintf("%.1fs", duration.Seconds())
+	}
+	return duration.Round(time.Second).String()
+}
@@ -0,0 +1,72 @@
+package butterfish
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOSC7Cwd(t *testing.T) {
+	assert.Equal(t, "", ParseOSC7Cwd("no escapes here"))
+	assert.Equal(t, "/home/me/my proj",
+		ParseOSC7Cwd("\x1b]7;file://laptop/tmp\x07 ls\r\n\x1b]7;file://laptop/home/me/my%20proj\x1b\\"))
+	// our PS1 sends the path unencoded
+	assert.Equal(t, "/tmp/100%", ParseOSC7Cwd("\x1b]7;file:///tmp/100%\x07"))
+
+	// the escape after the prompt prefix is removed along with it
+	data := PROMPT_PREFIX + "\x1b]7;file:///tmp\x07$ " + EMOJI_DEFAULT + " 1" + PROMPT_SUFFIX
+	status, prompts, cleaned := ParsePS1(data, ps1FullRegex, EMOJI_DEFAULT)
+	assert.Equal(t, 1, status)
+	assert.Equal(t, 1, prompts)
+	assert.Equal(t, "$ "+EMOJI_DEFAULT, cleaned)
+}
+
+func TestGitBranch(t *testing.T) {
+	repo := t.TempDir()
+	sub := filepath.Join(repo, "src", "pkg")
+	assert.NoError(t, os.MkdirAll(filepath.Join(repo, ".git"), 0755))
+	assert.NoError(t, os.MkdirAll(sub, 0755))
+
+	head := filepath.Join(repo, ".git", "HEAD")
+	assert.NoError(t, os.WriteFile(head, []byte("ref: refs/heads/feature/x\n"), 0644))
+	assert.Equal(t, "feature/x", gitBranch(sub))
+
+	assert.NoError(t, os.WriteFile(head, []byte("9fceb02d0ae598e95dc970b74767f19372d61af8\n"), 0644))
+	assert.Equal(t, "9fceb02", gitBranch(repo))
+
+	assert.Equal(t, "", gitBranch(t.TempDir()))
+}
+
+func TestCommandRecords(t *testing.T) {
+	history := NewShellHistory()
+	history.SetCwd("/tmp/proj")
+	history.Append(historyTypeShellInput, "make test")
+	history.Append(historyTypeShellOutput, "FAIL\n")
+
+	command := history.LastCommand()
+	assert.Nil(t, command.ExitCode)
+	assert.Equal(t, "[running, /tmp/proj]", command.Summary())
+
+	history.FinishCommand(2)
+	input := history.Blocks[0]
+	input.End = input.Time.Add(3100 * time.Millisecond)
+
+	command = history.LastCommand()
+	assert.Equal(t, "make test", command.Input)
+	assert.Equal(t, "FAIL\n", command.Output)
+	assert.Equal(t, 2, *command.ExitCode)
+	assert.Equal(t, "[exit 2, 3.1s, /tmp/proj]", command.Summary())
+
+	// prompts show the record after the command
+	blocks, _ := getHistoryBlocksByTokens(history, NewEstimateTokenizer(TokenizerClaude), 512, 4096, 0)
+	assert.Equal(t, "make test [exit 2, 3.1s, /tmp/proj]", blocks[0].Content)
+	assert.Equal(t, "FAIL\n", blocks[1].Content)
+
+	// older commands show when they ran
+	yesterday := time.Date(2024, 3, 1, 9, 30, 0, 0, time.Local)
+	assert.Equal(t, "[exit 0, 1m5s, Mar 1 09:30]",
+		commandSummary(new(int), yesterday, yesterday.Add(65*time.Second), "", ""))
+}
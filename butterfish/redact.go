@@ -0,0 +1,258 @@
+package butterfish
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/mitchellh/go-homedir"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Redaction of secrets from shell history before it's sent to the LLM. Shell
+// output includes whatever was printed, like a cat of a .env file, so each
+// history block is passed through a Redactor which replaces secrets with a
+// placeholder like [REDACTED:aws_access_key]. The placeholders are what the
+// History command shows, so it can be used to audit what leaves the machine.
+//
+// Built-in detectors cover well known key formats, secret assignments and
+// high-entropy strings. More patterns can be added, and built-ins turned off,
+// in ~/.config/butterfish/redaction.yaml:
+//
+//	disable: [high_entropy]
+//	patterns:
+//	  - name: internal_host
+//	    regex: '[a-z0-9-]+\.corp\.example\.com'
+//	  - name: db_password
+//	    regex: 'postgres://[^:]+:(?P<secret>[^@]+)@'
+//
+// If a pattern has a group named "secret" only that part of the match is
+// replaced, otherwise the whole match is.
+
+const redactedSecretGroup = "secret"
+
+var redactedPlaceholderRegex = regexp.MustCompile(`\[REDACTED:[A-Za-z0-9_-]+\]`)
+
+type redactionDetector struct {
+	name  string
+	regex *regexp.Regexp
+	// optional check of the matched secret, e.g. for entropy
+	check func(secret string) bool
+}
+
+// Detectors run in order, high_entropy last so that a more specific name is
+// used where one applies
+var builtinRedactionDetectors = []redactionDetector{
+	{
+		name:  "private_key",
+		regex: regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY( BLOCK)?-----(?s:.*?)(-----END [A-Z0-9 ]*PRIVATE KEY( BLOCK)?-----|$)`),
+	},
+	{
+		name:  "aws_access_key",
+		regex: regexp.MustCompile(`\b(AKIA|ASIA|ABIA|ACCA)[0-9A-Z]{16}\b`),
+	},
+	{
+		name:  "aws_secret_key",
+		regex: regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[=:]\s*["']?(?P<secret>[A-Za-z0-9/+=]{40})`),
+	},
+	{
+		name:  "jwt",
+		regex: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}`),
+	},
+	{
+		// OpenAI, Anthropic, GitHub, Slack, Google and Stripe style keys
+		name:  "api_key",
+		regex: regexp.MustCompile(`\b(sk-[A-Za-z0-9_-]{20,}|gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{40,}|xox[abprs]-[A-Za-z0-9-]{10,}|AIza[0-9A-Za-z_-]{35}|[rs]k_live_[0-9A-Za-z]{20,})`),
+	},
+	{
+		name:  "bearer_token",
+		regex: regexp.MustCompile(`(?i)\bbearer\s+(?P<secret>[A-Za-z0-9._~+/-]{16,}=*)`),
+	},
+	{
+		// FOO_TOKEN=..., "password": "...", api_key: ... and so on, values
+		// that are variable references are left alone
+		name:  "secret_assignment",
+		regex: regexp.MustCompile(`(?i)\b[a-z0-9_.-]*(token|secret|passwd|password|api_?key|access_?key|private_?key|credentials?)["']?\s*[=:]\s*(?P<secret>"[^"\n]{4,}"|'[^'\n]{4,}'|[^\s"'$][^\s"']{3,})`),
+		check: func(secret string) bool {
+			return !strings.HasPrefix(strings.Trim(secret, `"'`), "$")
+		},
+	},
+	{
+		name:  "high_entropy",
+		regex: regexp.MustCompile(`[A-Za-z0-9+_-]{24,}=*`),
+		check: isHighEntropySecret,
+	},
+}
+
+// Random keys and tokens mix upper case, lower case and digits and have a
+// Shannon entropy per character close to the most a string of their length
+// can have. Hex strings like git hashes and UUIDs have no upper case and so
+// aren't matched, and identifiers mostly repeat a few letters.
+func isHighEntropySecret(s string) bool {
+	var upper, lower, digit bool
+	counts := map[rune]int{}
+	for _, r := range s {
+		counts[r]++
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !upper || !lower || !digit {
+		return false
+	}
+
+	maxEntropy := math.Log2(math.Min(float64(len(s)), 32))
+	return shannonEntropy(counts, len(s)) >= 0.85*maxEntropy
+}
+
+// Bits per character
+func shannonEntropy(counts map[rune]int, length int) float64 {
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(length)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+type RedactionPattern struct {
+	Name  string `yaml:"name"`
+	Regex string `yaml:"regex"`
+}
+
+type RedactionConfig struct {
+	// Names of built-in detectors to turn off, or "all"
+	Disable  []string           `yaml:"disable"`
+	Patterns []RedactionPattern `yaml:"patterns"`
+}
+
+// Load the redaction config, returns nil if the file doesn't exist
+func LoadRedactionConfig(path string) (*RedactionConfig, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	config := &RedactionConfig{}
+	err = yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing redaction file %s: %s", path, err)
+	}
+
+	return config, nil
+}
+
+type Redactor struct {
+	detectors []redactionDetector
+}
+
+// Create a redactor with the built-in detectors plus the config's patterns,
+// the config may be nil
+func NewRedactor(config *RedactionConfig) (*Redactor, error) {
+	if config == nil {
+		config = &RedactionConfig{}
+	}
+
+	disabled := map[string]bool{}
+	for _, name := range config.Disable {
+		disabled[name] = true
+	}
+
+	redactor := &Redactor{}
+	for _, detector := range builtinRedactionDetectors {
+		if disabled["all"] || disabled[detector.name] {
+			continue
+		}
+		redactor.detectors = append(redactor.detectors, detector)
+	}
+
+	// user patterns go before high_entropy so they get their own name
+	custom := []redactionDetector{}
+	for _, pattern := range config.Patterns {
+		if pattern.Name == "" || pattern.Regex == "" {
+			return nil, fmt.Errorf("Redaction patterns need a name and a regex")
+		}
+		regex, err := regexp.Compile(pattern.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing redaction pattern %s: %s", pattern.Name, err)
+		}
+		custom = append(custom, redactionDetector{name: pattern.Name, regex: regex})
+	}
+
+	i := len(redactor.detectors)
+	if i > 0 && redactor.detectors[i-1].name == "high_entropy" {
+		i--
+	}
+	tail := append(custom, redactor.detectors[i:]...)
+	redactor.detectors = append(redactor.detectors[:i], tail...)
+
+	return redactor, nil
+}
+
+// Replace secrets in s with placeholders. A nil Redactor returns s unchanged.
+func (this *Redactor) Redact(s string) string {
+	if this == nil {
+		return s
+	}
+
+	for _, detector := range this.detectors {
+		s = detector.redact(s)
+	}
+	return s
+}
+
+func (this redactionDetector) redact(s string) string {
+	matches := this.regex.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s
+	}
+
+	group := this.regex.SubexpIndex(redactedSecretGroup)
+	placeholder := "[REDACTED:" + this.name + "]"
+
+	var builder strings.Builder
+	last := 0
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		if group > 0 {
+			start, end = match[2*group], match[2*group+1]
+		}
+		if start < 0 || start < last {
+			continue
+		}
+
+		secret := s[start:end]
+		if redactedPlaceholderRegex.MatchString(secret) {
+			continue
+		}
+		if this.check != nil && !this.check(secret) {
+			continue
+		}
+
+		builder.WriteString(s[last:start])
+		builder.WriteString(placeholder)
+		last = end
+	}
+	builder.WriteString(s[last:])
+	return builder.String()
+}
+
+// Number of placeholders in redacted text
+func CountRedactions(s string) int {
+	return len(redactedPlaceholderRegex.FindAllStringIndex(s, -1))
+}
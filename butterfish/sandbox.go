@@ -0,0 +1,519 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// Goal mode can run commands in a sandbox rather than the user's shell. Each
+// command runs in new Linux user, mount, network and pid namespaces made with
+// unshare, where the whole filesystem is read-only, /tmp, /var/tmp and
+// /dev/shm are empty private tmpfs mounts, there's no network and the working
+// directory is an overlay whose changes go to a temporary directory. Changes
+// build up across commands until they're applied to the real directory or
+// discarded.
+//
+// The sandbox needs unshare from util-linux and a kernel that allows
+// unprivileged user namespaces and overlay mounts (5.11 or later).
+
+// Runs inside the namespaces, $1 is the working directory, $2-$4 the overlay
+// upper, work and merged directories, $5 the shell and $6 the command. A
+// failed setup is reported with sandboxSetupFailed.
+//
+// The overlay keeps its own writable reference to the upper directory, so it
+// still works once every other mount is read-only. The temporary directories
+// are replaced from inside the overlay, and the working directory is bound
+// last since it may be in one of them.
+const sandboxScript = `
+fail() { echo "sandbox setup failed: $1" >&2; exit 125; }
+mount -t overlay overlay -o "lowerdir=$1,upperdir=$2,workdir=$3,userxattr" "$4" || fail "overlay mount"
+mount -o remount,bind,ro / || fail "read-only root"
+awk '{ print $5 }' /proc/self/mountinfo | while IFS= read -r mnt; do
+	mnt=$(printf '%b' "$mnt")
+	[ "$mnt" = "$4" ] || mount -o remount,bind,ro "$mnt" 2>/dev/null
+done
+cd "$4" || fail "cd"
+for tmp in /tmp /var/tmp /dev/shm; do
+	if [ -d "$tmp" ]; then
+		mount -t tmpfs -o mode=1777 tmpfs "$tmp" || fail "tmpfs on $tmp"
+	fi
+done
+mkdir -p "$1" && mount --no-canonicalize --bind . "$1" || fail "working directory mount"
+cd "$1" || fail "cd"
+exec "$5" -c "$6"
+`
+
+const sandboxSetupFailed = "sandbox setup failed"
+
+// Output kept from a sandboxed command, the end is kept if there's more
+const sandboxMaxOutputBytes = 64 * 1024
+
+type Sandbox struct {
+	// The directory commands run in and whose changes are sandboxed
+	Dir   string
+	Shell string
+
+	root   string
+	upper  string
+	work   string
+	merged string
+}
+
+// Create a sandbox for dir and check it works, shell runs the commands
+func NewSandbox(ctx context.Context, dir, shell string) (*Sandbox, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("The goal mode sandbox only works on Linux")
+	}
+	if _, err := exec.LookPath("unshare"); err != nil {
+		return nil, fmt.Errorf("The goal mode sandbox needs unshare: %s", err)
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("The sandbox needs a working directory")
+	}
+	if shell == "" {
+		shell = "sh"
+	}
+
+	root, err := os.MkdirTemp("", "butterfish-sandbox-")
+	if err != nil {
+		return nil, err
+	}
+
+	sandbox := &Sandbox{
+		Dir:    dir,
+		Shell:  shell,
+		root:   root,
+		upper:  filepath.Join(root, "upper"),
+		work:   filepath.Join(root, "work"),
+		merged: filepath.Join(root, "merged"),
+	}
+	for _, path := range []string{sandbox.upper, sandbox.work, sandbox.merged} {
+		if err := os.Mkdir(path, 0700); err != nil {
+			sandbox.Close()
+			return nil, err
+		}
+	}
+
+	output, exitCode, err := sandbox.Run(ctx, "true")
+	if err == nil && exitCode != 0 {
+		err = errors.New(strings.TrimSpace(output))
+	}
+	if err != nil {
+		sandbox.Close()
+		return nil, fmt.Errorf("Error starting the sandbox: %s", err)
+	}
+	return sandbox, nil
+}
+
+// Run a command in the sandbox and return its output and exit code. Killing
+// the command when ctx is done kills everything it started, since they're
+// all in its pid namespace.
+func (this *Sandbox) Run(ctx context.Context, command string) (string, int, error) {
+	cmd := exec.CommandContext(ctx, "unshare",
+		"--user", "--map-root-user", "--mount", "--net",
+		"--pid", "--fork", "--kill-child", "--mount-proc",
+		"sh", "-c", sandboxScript, "sandbox",
+		this.Dir, this.upper, this.work, this.merged, this.Shell, command)
+	cmd.Dir = this.Dir
+	output := &tailBuffer{max: sandboxMaxOutputBytes}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return "", -1, err
+	}
+	if ctx.Err() != nil {
+		return output.String(), -1, ctx.Err()
+	}
+
+	exitCode := cmd.ProcessState.ExitCode()
+	if exitCode == 125 && strings.Contains(output.String(), sandboxSetupFailed) {
+		return "", exitCode, errors.New(strings.TrimSpace(output.String()))
+	}
+	return output.String(), exitCode, nil
+}
+
+// Remove the sandbox and any changes that weren't applied
+func (this *Sandbox) Close() error {
+	// overlayfs leaves a directory in work that no one can read
+	filepath.WalkDir(this.root, func(path string, entry fs.DirEntry, err error) error {
+		if entry != nil && entry.IsDir() {
+			os.Chmod(path, 0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(this.root)
+}
+
+type SandboxChangeKind int
+
+const (
+	SandboxAdded SandboxChangeKind = iota
+	SandboxModified
+	SandboxDeleted
+)
+
+// A file or directory that's different in the sandbox
+type SandboxChange struct {
+	// Relative to the sandbox's directory
+	Path  string
+	Kind  SandboxChangeKind
+	IsDir bool
+}
+
+func (this *SandboxChange) String() string {
+	prefix := map[SandboxChangeKind]string{
+		SandboxAdded:    "A",
+		SandboxModified: "M",
+		SandboxDeleted:  "D",
+	}[this.Kind]
+	path := this.Path
+	if this.IsDir {
+		path += "/"
+	}
+	return prefix + " " + path
+}
+
+// The files and directories commands have changed, sorted by path. They're
+// found in the overlay's upper directory, where a deleted file is left as a
+// 0/0 character device and a directory that replaced a deleted one is marked
+// opaque.
+func (this *Sandbox) Changes() ([]*SandboxChange, error) {
+	changes := []*SandboxChange{}
+
+	err := filepath.WalkDir(this.upper, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(this.upper, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		lower, lowerErr := os.Lstat(filepath.Join(this.Dir, rel))
+		inLower := lowerErr == nil
+
+		if isOverlayWhiteout(info) {
+			if inLower {
+				changes = append(changes, &SandboxChange{Path: rel, Kind: SandboxDeleted, IsDir: lower.IsDir()})
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			if !inLower || !lower.IsDir() {
+				if inLower {
+					changes = append(changes, &SandboxChange{Path: rel, Kind: SandboxDeleted})
+				}
+				changes = append(changes, &SandboxChange{Path: rel, Kind: SandboxAdded, IsDir: true})
+			} else if isOverlayOpaque(path) {
+				// nothing from the lower directory shows through
+				deleted, err := this.opaqueDeletions(rel)
+				if err != nil {
+					return err
+				}
+				changes = append(changes, deleted...)
+			}
+			return nil
+		}
+
+		switch {
+		case !inLower:
+			changes = append(changes, &SandboxChange{Path: rel, Kind: SandboxAdded})
+		case lower.IsDir():
+			changes = append(changes,
+				&SandboxChange{Path: rel, Kind: SandboxDeleted, IsDir: true},
+				&SandboxChange{Path: rel, Kind: SandboxAdded})
+		case !sameFile(path, info, filepath.Join(this.Dir, rel), lower):
+			changes = append(changes, &SandboxChange{Path: rel, Kind: SandboxModified})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// Entries of the lower directory rel that aren't in the upper one
+func (this *Sandbox) opaqueDeletions(rel string) ([]*SandboxChange, error) {
+	entries, err := os.ReadDir(filepath.Join(this.Dir, rel))
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []*SandboxChange{}
+	for _, entry := range entries {
+		path := filepath.Join(rel, entry.Name())
+		if _, err := os.Lstat(filepath.Join(this.upper, path)); err == nil {
+			continue
+		}
+		changes = append(changes, &SandboxChange{Path: path, Kind: SandboxDeleted, IsDir: entry.IsDir()})
+	}
+	return changes, nil
+}
+
+func isOverlayWhiteout(info fs.FileInfo) bool {
+	if info.Mode()&fs.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+func isOverlayOpaque(path string) bool {
+	value := make([]byte, 1)
+	for _, attr := range []string{"user.overlay.opaque", "trusted.overlay.opaque"} {
+		n, err := syscall.Getxattr(path, attr, value)
+		if err == nil && n == 1 && value[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether two files have the same type, permissions and content
+func sameFile(pathA string, a fs.FileInfo, pathB string, b fs.FileInfo) bool {
+	if a.Mode() != b.Mode() {
+		return false
+	}
+	if a.Mode()&fs.ModeSymlink != 0 {
+		targetA, errA := os.Readlink(pathA)
+		targetB, errB := os.Readlink(pathB)
+		return errA == nil && errB == nil && targetA == targetB
+	}
+	if a.Size() != b.Size() {
+		return false
+	}
+	dataA, errA := os.ReadFile(pathA)
+	dataB, errB := os.ReadFile(pathB)
+	return errA == nil && errB == nil && bytes.Equal(dataA, dataB)
+}
+
+// Lines of diff shown for each file, and of unchanged lines around changes
+const (
+	sandboxDiffMaxLines     = 200
+	sandboxDiffContextLines = 3
+)
+
+// A diff of the changes, with a line per change followed by the changed
+// lines of text files, starting with + or -
+func (this *Sandbox) Diff(changes []*SandboxChange) string {
+	var builder strings.Builder
+	for _, change := range changes {
+		builder.WriteString(change.String() + "\n")
+		if change.IsDir || change.Kind == SandboxDeleted {
+			continue
+		}
+
+		var before, after []byte
+		if change.Kind == SandboxModified {
+			before, _ = os.ReadFile(filepath.Join(this.Dir, change.Path))
+		}
+		after, err := os.ReadFile(filepath.Join(this.upper, change.Path))
+		if err != nil {
+			continue
+		}
+		if !isText(before) || !isText(after) {
+			builder.WriteString("  (binary file)\n")
+			continue
+		}
+		builder.WriteString(diffLines(string(before), string(after)))
+	}
+	return builder.String()
+}
+
+func isText(data []byte) bool {
+	return utf8.Valid(data) && !bytes.ContainsRune(data, 0)
+}
+
+// Changed lines prefixed with + or -, with a few unchanged lines around them
+func diffLines(before, after string) string {
+	if before == after {
+		return ""
+	}
+
+	// diff lines rather than characters by giving each distinct line a rune
+	lines := []string{}
+	index := map[string]rune{}
+	toRunes := func(text string) []rune {
+		runes := []rune{}
+		for _, line := range strings.SplitAfter(text, "\n") {
+			if line == "" {
+				continue
+			}
+			r, ok := index[line]
+			if !ok {
+				r = rune(len(lines))
+				index[line] = r
+				lines = append(lines, line)
+			}
+			runes = append(runes, r)
+		}
+		return runes
+	}
+	a, b := toRunes(before), toRunes(after)
+	diffs := diffmatchpatch.New().DiffMainRunes(a, b, false)
+
+	output := []string{}
+	for i, diff := range diffs {
+		text := []string{}
+		for _, r := range diff.Text {
+			text = append(text, strings.TrimSuffix(lines[r], "\n"))
+		}
+		switch diff.Type {
+		case diffmatchpatch.DiffInsert:
+			for _, line := range text {
+				output = append(output, "+"+line)
+			}
+		case diffmatchpatch.DiffDelete:
+			for _, line := range text {
+				output = append(output, "-"+line)
+			}
+		case diffmatchpatch.DiffEqual:
+			// keep context after the previous change and before the next one
+			keep := map[int]bool{}
+			if i > 0 {
+				for j := 0; j < sandboxDiffContextLines && j < len(text); j++ {
+					keep[j] = true
+				}
+			}
+			if i < len(diffs)-1 {
+				for j := len(text) - sandboxDiffContextLines; j < len(text); j++ {
+					keep[j] = j >= 0
+				}
+			}
+			skipped := false
+			for j, line := range text {
+				if keep[j] {
+					output = append(output, " "+line)
+					skipped = false
+				} else if !skipped {
+					output = append(output, "@@")
+					skipped = true
+				}
+			}
+		}
+	}
+
+	if len(output) > sandboxDiffMaxLines {
+		more := len(output) - sandboxDiffMaxLines
+		output = append(output[:sandboxDiffMaxLines], fmt.Sprintf("... %d more lines", more))
+	}
+	return strings.Join(output, "\n") + "\n"
+}
+
+// Copy the changes into the real directory, deletions first so a file can
+// be replaced by a directory or the other way around
+func (this *Sandbox) Apply(changes []*SandboxChange) error {
+	for _, change := range changes {
+		if change.Kind != SandboxDeleted {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(this.Dir, change.Path)); err != nil {
+			return err
+		}
+	}
+
+	// changes are sorted, so directories come before what's in them
+	for _, change := range changes {
+		if change.Kind == SandboxDeleted {
+			continue
+		}
+		src := filepath.Join(this.upper, change.Path)
+		dst := filepath.Join(this.Dir, change.Path)
+		if err := copySandboxFile(src, dst); err != nil {
+			return fmt.Errorf("Error applying %s: %s", change.Path, err)
+		}
+	}
+	return nil
+}
+
+func copySandboxFile(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.IsDir():
+		if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		return os.Chmod(dst, info.Mode().Perm())
+
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		os.Remove(dst)
+		return os.Symlink(target, dst)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dst, info.Mode().Perm())
+}
+
+// Keeps the last max bytes written, or a little more
+type tailBuffer struct {
+	max       int
+	buf       []byte
+	truncated bool
+}
+
+func (this *tailBuffer) Write(data []byte) (int, error) {
+	this.buf = append(this.buf, data...)
+	if len(this.buf) > 2*this.max {
+		this.buf = append([]byte{}, this.buf[len(this.buf)-this.max:]...)
+		this.truncated = true
+	}
+	return len(data), nil
+}
+
+func (this *tailBuffer) String() string {
+	if this.truncated {
+		return "...\n" + string(this.buf)
+	}
+	return string(this.buf)
+}
@@ -0,0 +1,163 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+func TestSandbox(t *testing.T) {
+	dir := t.TempDir()
+	write := func(path, content string) {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, path), []byte(content), 0644))
+	}
+	write("a.txt", "one\ntwo\nthree\n")
+	write("b.txt", "delete me\n")
+	write("sub/old.txt", "old\n")
+
+	sandbox, err := NewSandbox(context.Background(), dir, "sh")
+	if err != nil {
+		t.Skipf("Sandbox isn't supported here: %s", err)
+	}
+	defer sandbox.Close()
+
+	output, exitCode, err := sandbox.Run(context.Background(), `
+		echo two-and-a-half > a.txt.new && sed 's/two/2/' a.txt > a.txt.new && mv a.txt.new a.txt
+		rm b.txt
+		rm -r sub && mkdir sub && echo new > sub/new.txt
+		mkdir -p d && echo f > d/f.txt
+		pwd
+		exit 3`)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, exitCode)
+	assert.Equal(t, dir+"\n", output)
+
+	// nothing outside the working directory can be written
+	cwd, err := os.Getwd()
+	assert.NoError(t, err)
+	outside := filepath.Join(cwd, "sandbox-write-test")
+	defer os.Remove(outside)
+	output, exitCode, err = sandbox.Run(context.Background(), "touch "+outside)
+	assert.NoError(t, err)
+	assert.NotEqual(t, 0, exitCode)
+	assert.Contains(t, output, "Read-only file system")
+
+	// temporary directories are private and start empty
+	tmp := "/tmp/butterfish-sandbox-test"
+	defer os.Remove(tmp)
+	output, exitCode, err = sandbox.Run(context.Background(),
+		"ls -A /var/tmp /dev/shm && touch "+tmp+" /var/tmp/x /dev/shm/x && ls -A /tmp")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, exitCode)
+	assert.True(t, strings.HasPrefix(output, "/dev/shm:\n\n/var/tmp:\n"))
+	assert.Contains(t, output, "butterfish-sandbox-test\n")
+	assert.NotContains(t, output, filepath.Base(sandbox.root))
+	assert.NoFileExists(t, tmp)
+
+	// the real directory is untouched
+	data, err := os.ReadFile(filepath.Join(dir, "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "one\ntwo\nthree\n", string(data))
+
+	changes, err := sandbox.Changes()
+	assert.NoError(t, err)
+	summary := []string{}
+	for _, change := range changes {
+		summary = append(summary, change.String())
+	}
+	assert.Equal(t, []string{"M a.txt", "D b.txt", "A d/", "A d/f.txt", "A sub/new.txt", "D sub/old.txt"}, summary)
+	assert.Contains(t, sandbox.Diff(changes), "M a.txt\n one\n-two\n+2\n three\n")
+
+	assert.NoError(t, sandbox.Apply(changes))
+	data, err = os.ReadFile(filepath.Join(dir, "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "one\n2\nthree\n", string(data))
+	assert.NoFileExists(t, filepath.Join(dir, "b.txt"))
+	assert.NoFileExists(t, filepath.Join(dir, "sub", "old.txt"))
+	assert.FileExists(t, filepath.Join(dir, "sub", "new.txt"))
+	assert.FileExists(t, filepath.Join(dir, "d", "f.txt"))
+
+	// Close removes everything, including the directory overlayfs locks
+	root := sandbox.root
+	assert.NoError(t, sandbox.Close())
+	assert.NoDirExists(t, root)
+}
+
+func TestGoalModeSandbox(t *testing.T) {
+	dir := t.TempDir()
+	sandbox, err := NewSandbox(context.Background(), dir, "sh")
+	if err != nil {
+		t.Skipf("Sandbox isn't supported here: %s", err)
+	}
+
+	parentOut := &bytes.Buffer{}
+	answers := &bytes.Buffer{}
+	state := &ShellState{
+		Butterfish:             &ButterfishCtx{Ctx: context.Background(), Config: &ButterfishConfig{}},
+		ParentOut:              parentOut,
+		ChildIn:                &bytes.Buffer{},
+		PromptGoalAnswerWriter: answers,
+		Color:                  DarkShellColorScheme,
+		History:                NewShellHistory(),
+		GoalModePlan:           &GoalPlan{},
+		GoalMode:               true,
+		GoalModeUnsafe:         true,
+		Sandbox:                sandbox,
+		SandboxOutputChan:      make(chan *sandboxOutput, 1),
+	}
+
+	// even risky commands run straight away, but not in the shell
+	call := &util.ToolCall{Id: "1", Function: util.FunctionCall{
+		Name: "command", Parameters: `{"cmd": "rm -rf build; echo hi | tee out.txt"}`}}
+	_, err = state.goalModeTools().Get("command").Handler(context.Background(), call)
+	assert.Equal(t, ErrToolOutputPending, err)
+	assert.Equal(t, "", state.ChildIn.(*bytes.Buffer).String())
+
+	output := <-state.SandboxOutputChan
+	assert.Equal(t, call, output.call)
+	assert.Equal(t, "hi\nExit Code: 0\n", state.printSandboxOutput(output))
+	assert.Contains(t, parentOut.String(), "hi\r\n")
+	state.sandboxCancel = nil
+	state.ActiveToolCall = nil
+
+	// a confirm rule still asks first, Enter runs the command
+	state.Butterfish.CommandPolicy, err = NewCommandPolicy(&CommandPolicyConfig{
+		ConfirmAbove: DefaultConfirmAbove,
+		Confirm:      []string{"echo confirmed*"},
+	})
+	assert.NoError(t, err)
+	call = &util.ToolCall{Id: "2", Function: util.FunctionCall{
+		Name: "command", Parameters: `{"cmd": "echo confirmed"}`}}
+	_, err = state.goalModeTools().Get("command").Handler(context.Background(), call)
+	assert.Equal(t, ErrToolOutputPending, err)
+	assert.Contains(t, answers.String(), "This command needs confirmation")
+	assert.Len(t, state.SandboxOutputChan, 0)
+	state.ParentInput(context.Background(), []byte("\r"))
+	output = <-state.SandboxOutputChan
+	assert.Equal(t, call, output.call)
+	assert.Equal(t, "confirmed\nExit Code: 0\n", state.printSandboxOutput(output))
+
+	// once goal mode ends the changes are shown and wait to be applied
+	state.GoalModeExit()
+	assert.Contains(t, parentOut.String(), "A out.txt")
+	assert.Contains(t, answers.String(), "Type Apply to copy them to "+dir)
+	assert.NotNil(t, state.Sandbox)
+	assert.NoFileExists(t, filepath.Join(dir, "out.txt"))
+	state.Sandbox.Close()
+}
+
+func TestDiffLines(t *testing.T) {
+	before := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	after := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n"
+	assert.Equal(t, " 1\n 2\n-3\n+three\n 4\n 5\n 6\n@@\n 9\n 10\n 11\n-12\n+twelve\n", diffLines(before, after))
+	assert.Equal(t, "+new\n", diffLines("", "new\n"))
+	assert.Equal(t, "", diffLines("same\n", "same\n"))
+}
@@ -0,0 +1,483 @@
+package butterfish
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mitchellh/go-homedir"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+// Shell sessions persist ShellHistory so that a later shell can pick up
+// where an earlier one left off with `butterfish shell --resume`. Each
+// session is a JSON lines file in the sessions directory, by default
+// ~/.butterfish/sessions, with one record per history block. A block is
+// written once a newer block is started, since until then it may still be
+// appended to, and the rest are written when the shell exits.
+//
+// Block content is capped at sessionMaxBlockBytes, keeping the end of the
+// block since that's where errors usually are. Sessions older than the max
+// age are removed, then the oldest sessions until the directory is under its
+// size limit. Pruning happens when a shell starts and with
+// `butterfish sessions --prune`.
+
+const DefaultSessionsMaxAge = 30 * 24 * time.Hour
+const DefaultSessionsMaxBytes = 64 * 1024 * 1024
+const sessionMaxBlockBytes = 32 * 1024
+const sessionFileSuffix = ".jsonl"
+
+// Resume id that picks the most recently updated session
+const SessionLatest = "last"
+
+// History types are saved by name so that the file doesn't depend on the
+// order of the historyType constants
+var sessionHistoryTypes = map[int]string{
+	historyTypePrompt:         "prompt",
+	historyTypeShellInput:     "shell_input",
+	historyTypeShellOutput:    "shell_output",
+	historyTypeLLMOutput:      "llm_output",
+	historyTypeFunctionOutput: "function_output",
+	historyTypeToolOutput:     "tool_output",
+}
+
+type sessionRecord struct {
+	Type       string           `json:"type"`
+	Content    string           `json:"content"`
+	ToolCalls  []*util.ToolCall `json:"tool_calls,omitempty"`
+	ToolCallId string           `json:"tool_call_id,omitempty"`
+	Time       time.Time        `json:"time"`
+	Cwd        string           `json:"cwd,omitempty"`
+	GitBranch  string           `json:"git_branch,omitempty"`
+	ExitCode   *int             `json:"exit_code,omitempty"`
+	End        *time.Time       `json:"end,omitempty"`
+}
+
+func newSessionRecord(block *HistoryBuffer) sessionRecord {
+	content := block.Content.String()
+	if len(content) > sessionMaxBlockBytes {
+		start := len(content) - sessionMaxBlockBytes
+		for start < len(content) && !utf8.RuneStart(content[start]) {
+			start++
+		}
+		content = content[start:]
+	}
+
+	record := sessionRecord{
+		Type:       sessionHistoryTypes[block.Type],
+		Content:    content,
+		ToolCalls:  block.ToolCalls,
+		ToolCallId: block.ToolCallId,
+		Time:       block.Time,
+		Cwd:        block.Cwd,
+		GitBranch:  block.GitBranch,
+		ExitCode:   block.ExitCode,
+	}
+	if !block.End.IsZero() {
+		record.End = &block.End
+	}
+	return record
+}
+
+func (this sessionRecord) historyBuffer() (*HistoryBuffer, bool) {
+	historyType := -1
+	for t, name := range sessionHistoryTypes {
+		if name == this.Type {
+			historyType = t
+		}
+	}
+	if historyType < 0 {
+		return nil, false
+	}
+
+	content := NewShellBuffer()
+	content.Write(this.Content)
+	block := &HistoryBuffer{
+		Type:       historyType,
+		Content:    content,
+		ToolCalls:  this.ToolCalls,
+		ToolCallId: this.ToolCallId,
+		Time:       this.Time,
+		Cwd:        this.Cwd,
+		GitBranch:  this.GitBranch,
+		ExitCode:   this.ExitCode,
+	}
+	if this.End != nil {
+		block.End = *this.End
+	}
+	return block, true
+}
+
+type SessionStore struct {
+	path     string
+	maxAge   time.Duration
+	maxBytes int64
+}
+
+// Open the sessions directory, zero max age and size use the defaults
+func NewSessionStore(path string, maxAge time.Duration, maxBytes int64) (*SessionStore, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// sessions have everything printed in the shell, so keep them private
+	err = os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxAge <= 0 {
+		maxAge = DefaultSessionsMaxAge
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultSessionsMaxBytes
+	}
+
+	return &SessionStore{
+		path:     path,
+		maxAge:   maxAge,
+		maxBytes: maxBytes,
+	}, nil
+}
+
+func (this *SessionStore) sessionPath(id string) (string, error) {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("Invalid session id: %s", id)
+	}
+	return filepath.Join(this.path, id+sessionFileSuffix), nil
+}
+
+// Start a new session, ids sort by the time they were created
+func (this *SessionStore) Create() (*ShellSession, error) {
+	suffix := make([]byte, 3)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return nil, err
+	}
+	id := time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+
+	path, err := this.sessionPath(id)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ShellSession{Id: id, file: file}, nil
+}
+
+// Reopen an existing session to continue writing to it, returns the
+// history blocks saved so far. The id can be SessionLatest.
+func (this *SessionStore) Open(id string) (*ShellSession, []*HistoryBuffer, error) {
+	if id == SessionLatest {
+		sessions, err := this.List()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(sessions) == 0 {
+			return nil, nil, fmt.Errorf("No sessions found in %s", this.path)
+		}
+		id = sessions[0].Id
+	}
+
+	blocks, err := this.Load(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	path, _ := this.sessionPath(id)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &ShellSession{Id: id, file: file}, blocks, nil
+}
+
+// Read the history blocks of a session. Lines that don't parse, like a
+// partial line from a shell that was killed mid-write, are skipped.
+func (this *SessionStore) Load(id string) ([]*HistoryBuffer, error) {
+	records, err := this.read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := []*HistoryBuffer{}
+	for _, record := range records {
+		block, ok := record.historyBuffer()
+		if !ok {
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func (this *SessionStore) read(id string) ([]sessionRecord, error) {
+	path, err := this.sessionPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("Session %s not found in %s", id, this.path)
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := []sessionRecord{}
+	scanner := bufio.NewScanner(file)
+	// records are capped at sessionMaxBlockBytes of content, but escaping
+	// can make the JSON several times larger
+	scanner.Buffer(make([]byte, 64*1024), 8*sessionMaxBlockBytes)
+	for scanner.Scan() {
+		var record sessionRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+type SessionInfo struct {
+	Id      string
+	Started time.Time
+	Updated time.Time
+	Size    int64
+	Blocks  int
+	// Working directory of the first block
+	Cwd string
+	// Start of the first command or prompt
+	Summary string
+}
+
+// Sessions newest first, by when they were last written to
+func (this *SessionStore) List() ([]SessionInfo, error) {
+	dirEntries, err := os.ReadDir(this.path)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []SessionInfo{}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if !strings.HasSuffix(name, sessionFileSuffix) {
+			continue
+		}
+		fileInfo, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+
+		info := SessionInfo{
+			Id:      strings.TrimSuffix(name, sessionFileSuffix),
+			Started: fileInfo.ModTime(),
+			Updated: fileInfo.ModTime(),
+			Size:    fileInfo.Size(),
+		}
+
+		records, err := this.read(info.Id)
+		if err != nil {
+			log.Printf("Error reading session %s: %s", info.Id, err)
+			continue
+		}
+		info.Blocks = len(records)
+		if len(records) > 0 {
+			info.Started = records[0].Time
+			info.Cwd = records[0].Cwd
+		}
+		for _, record := range records {
+			if record.Type == "prompt" || record.Type == "shell_input" {
+				info.Summary = sanitizeTTYString(strings.TrimSpace(record.Content))
+				break
+			}
+		}
+
+		sessions = append(sessions, info)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Updated.After(sessions[j].Updated)
+	})
+	return sessions, nil
+}
+
+func (this *SessionStore) Delete(id string) error {
+	path, err := this.sessionPath(id)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Session %s not found in %s", id, this.path)
+	}
+	return err
+}
+
+// Remove expired sessions, then the oldest sessions until we're under the
+// size limit. The session with the active id is kept regardless.
+func (this *SessionStore) Prune(active string) int {
+	dirEntries, err := os.ReadDir(this.path)
+	if err != nil {
+		return 0
+	}
+
+	type sessionFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	removed := 0
+	files := []sessionFile{}
+	var total int64
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if !strings.HasSuffix(name, sessionFileSuffix) {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+
+		total += info.Size()
+		if strings.TrimSuffix(name, sessionFileSuffix) == active {
+			continue
+		}
+
+		path := filepath.Join(this.path, name)
+		if time.Since(info.ModTime()) > this.maxAge {
+			if os.Remove(path) == nil {
+				total -= info.Size()
+				removed++
+			}
+			continue
+		}
+
+		files = append(files, sessionFile{path, info.Size(), info.ModTime()})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, file := range files {
+		if total <= this.maxBytes {
+			break
+		}
+		if os.Remove(file.path) == nil {
+			total -= file.size
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// An open session that history blocks are appended to
+type ShellSession struct {
+	Id   string
+	file *os.File
+}
+
+func (this *ShellSession) Write(block *HistoryBuffer) error {
+	data, err := json.Marshal(newSessionRecord(block))
+	if err != nil {
+		return err
+	}
+	_, err = this.file.Write(append(data, '\n'))
+	return err
+}
+
+func (this *ShellSession) Close() error {
+	return this.file.Close()
+}
+
+// Working directory of a process, empty where /proc isn't available
+func processCwd(pid int) string {
+	cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+	if err != nil {
+		return ""
+	}
+	return cwd
+}
+
+// Open the session a shell should record to, either a new one or the one
+// being resumed along with its history.
+func OpenShellSession(config *ButterfishConfig) (*ShellSession, []*HistoryBuffer, error) {
+	store, err := NewSessionStore(config.SessionsPath, config.SessionsMaxAge, config.SessionsMaxBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var session *ShellSession
+	var blocks []*HistoryBuffer
+	if config.ShellResume != "" {
+		session, blocks, err = store.Open(config.ShellResume)
+	} else {
+		session, err = store.Create()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if removed := store.Prune(session.Id); removed > 0 {
+		log.Printf("Pruned %d old shell sessions", removed)
+	}
+	return session, blocks, nil
+}
+
+func PrintSessions(writer io.Writer, sessionsPath string) error {
+	store, err := NewSessionStore(sessionsPath, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := store.List()
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		fmt.Fprintf(writer, "No sessions in %s\n", store.path)
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Id\tStarted\tUpdated\tBlocks\tSize\tDirectory\tFirst command\t\n")
+	for _, session := range sessions {
+		summary := session.Summary
+		if firstLine, _, found := strings.Cut(summary, "\n"); found {
+			summary = firstLine + "..."
+		}
+		if len(summary) > 40 {
+			summary = summary[:37] + "..."
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%dK\t%s\t%s\t\n", session.Id,
+			session.Started.Local().Format("2006-01-02 15:04"),
+			session.Updated.Local().Format("2006-01-02 15:04"),
+			session.Blocks, (session.Size+1023)/1024, session.Cwd, summary)
+	}
+	tw.Flush()
+	return nil
+}
@@ -0,0 +1,179 @@
+package butterfish
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+func TestShellHistorySession(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir(), 0, 0)
+	assert.NoError(t, err)
+	session, err := store.Create()
+	assert.NoError(t, err)
+
+	history := NewShellHistory()
+	history.Cwd = func() string { return "/proj" }
+	history.SetSession(session, nil)
+
+	history.Append(historyTypeShellInput, "make")
+	history.Append(historyTypeShellOutput, "error: ")
+
+	// a running command isn't written until it finishes
+	blocks, err := store.Load(session.Id)
+	assert.NoError(t, err)
+	assert.Len(t, blocks, 0)
+
+	history.Append(historyTypeShellOutput, "missing target")
+	history.FinishCommand(2)
+	history.Append(historyTypePrompt, "why did that fail?")
+	history.AddToolCalls([]*util.ToolCall{agentTestCall("1", "command")})
+	history.AppendToolOutput("1", "ok")
+
+	// only finished blocks are written until the history is closed
+	blocks, err = store.Load(session.Id)
+	assert.NoError(t, err)
+	assert.Len(t, blocks, 4)
+	assert.NoError(t, history.Close())
+
+	blocks, err = store.Load(session.Id)
+	assert.NoError(t, err)
+	assert.Len(t, blocks, 5)
+	assert.Equal(t, historyTypeShellOutput, blocks[1].Type)
+	assert.Equal(t, "error: missing target", blocks[1].Content.String())
+	assert.Equal(t, 2, *blocks[0].ExitCode)
+	assert.False(t, blocks[0].End.IsZero())
+	assert.Equal(t, "/proj", blocks[1].Cwd)
+	assert.False(t, blocks[1].Time.IsZero())
+	assert.Nil(t, blocks[1].ExitCode)
+	assert.Equal(t, "command", blocks[3].ToolCalls[0].Function.Name)
+	assert.Equal(t, "1", blocks[4].ToolCallId)
+
+	// resuming continues the same session after the loaded blocks
+	session, loaded, err := store.Open(SessionLatest)
+	assert.NoError(t, err)
+	history = NewShellHistory()
+	history.SetSession(session, loaded)
+	assert.Len(t, history.Blocks, 5)
+
+	// the first prompt after resuming isn't the end of a loaded command
+	history.FinishCommand(0)
+	assert.Nil(t, history.Blocks[4].ExitCode)
+
+	history.Append(historyTypeShellInput, "ls")
+	assert.NoError(t, history.Close())
+
+	blocks, err = store.Load(session.Id)
+	assert.NoError(t, err)
+	assert.Len(t, blocks, 6)
+	assert.Equal(t, "ls", blocks[5].Content.String())
+}
+
+func TestShellHistorySessionUnansweredCalls(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir(), 0, 0)
+	assert.NoError(t, err)
+	session, err := store.Create()
+	assert.NoError(t, err)
+
+	// the shell exits while a command is running, so the command call has no
+	// output, and an older output lost its call
+	history := NewShellHistory()
+	history.SetSession(session, nil)
+	history.Append(historyTypeToolOutput, "lost")
+	history.Blocks[0].ToolCallId = "0"
+	history.Append(historyTypePrompt, "!fix the build")
+	history.Append(historyTypeLLMOutput, "Planning first.")
+	history.AddToolCalls([]*util.ToolCall{agentTestCall("1", "plan"), agentTestCall("2", "command")})
+	history.AppendToolOutput("1", "Plan updated.")
+	history.Append(historyTypeLLMOutput, "")
+	history.AddToolCalls([]*util.ToolCall{agentTestCall("3", "command")})
+	history.Append(historyTypeShellOutput, "make: ***")
+	assert.NoError(t, history.Close())
+
+	session, loaded, err := store.Open(session.Id)
+	assert.NoError(t, err)
+	history = NewShellHistory()
+	history.SetSession(session, loaded)
+	defer history.Close()
+	assert.Len(t, history.Blocks, 6)
+
+	encoder := NewEstimateTokenizer(TokenizerClaude)
+	blocks, _ := getHistoryBlocksByTokens(history, encoder, 512, 4096, 0)
+	assert.Len(t, blocks, 4)
+	assert.Equal(t, historyTypePrompt, blocks[0].Type)
+	assert.Equal(t, "Planning first.", blocks[1].Content)
+	assert.Equal(t, []*util.ToolCall{agentTestCall("1", "plan")}, blocks[1].ToolCalls)
+	assert.Equal(t, "1", blocks[2].ToolCallId)
+	assert.Equal(t, "make: ***", blocks[3].Content)
+}
+
+func TestSessionStoreList(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewSessionStore(dir, 0, 0)
+	assert.NoError(t, err)
+
+	session, err := store.Create()
+	assert.NoError(t, err)
+	history := NewShellHistory()
+	history.SetSession(session, nil)
+	history.Append(historyTypeShellInput, "go test ./...")
+	history.Append(historyTypeShellOutput, strings.Repeat("x", 2*sessionMaxBlockBytes))
+	assert.NoError(t, history.Close())
+
+	// partial lines are skipped
+	f, err := os.OpenFile(filepath.Join(dir, session.Id+".jsonl"), os.O_APPEND|os.O_WRONLY, 0600)
+	assert.NoError(t, err)
+	f.WriteString(`{"type": "prompt", "cont`)
+	f.Close()
+
+	sessions, err := store.List()
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, session.Id, sessions[0].Id)
+	assert.Equal(t, 2, sessions[0].Blocks)
+	assert.Equal(t, "go test ./...", sessions[0].Summary)
+
+	blocks, err := store.Load(session.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, sessionMaxBlockBytes, blocks[1].Content.Size())
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, PrintSessions(out, dir))
+	assert.Contains(t, out.String(), session.Id)
+
+	_, _, err = store.Open("missing")
+	assert.ErrorContains(t, err, "Session missing not found")
+	_, err = store.Load("../usage")
+	assert.ErrorContains(t, err, "Invalid session id")
+}
+
+func TestSessionStorePrune(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewSessionStore(dir, time.Hour, 100)
+	assert.NoError(t, err)
+
+	write := func(id string, size int, age time.Duration) {
+		path := filepath.Join(dir, id+".jsonl")
+		assert.NoError(t, os.WriteFile(path, bytes.Repeat([]byte("x"), size), 0600))
+		modTime := time.Now().Add(-age)
+		assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	write("expired", 10, 2*time.Hour)
+	write("old", 60, 30*time.Minute)
+	write("new", 60, time.Minute)
+	write("active", 60, 40*time.Minute)
+
+	// the active session is kept even though it's older and puts us over
+	assert.Equal(t, 3, store.Prune("active"))
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "active.jsonl", entries[0].Name())
+}
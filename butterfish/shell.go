@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -21,7 +22,6 @@ import (
 	"github.com/xuzhougeng/butterfish/util"
 	"github.com/sashabaranov/go-openai/jsonschema"
 
-	"github.com/bakks/tiktoken-go"
 	"github.com/mitchellh/go-ps"
 	"golang.org/x/term"
 )
@@ -51,8 +51,13 @@ const EMOJI_DEFAULT = "🐠"
 const EMOJI_GOAL = "🟦"
 const EMOJI_GOAL_UNSAFE = "⚡"
 
-var ps1Regex = regexp.MustCompile(" ([0-9]+)" + PROMPT_SUFFIX)
-var ps1FullRegex = regexp.MustCompile(EMOJI_DEFAULT + " ([0-9]+)" + PROMPT_SUFFIX)
+// bash and zsh print the exit status as text hidden from the line editor,
+// fish can't hide text so it prints the status in an escape sequence
+const ps1StatusPattern = "(?: ([0-9]+)|\x1b\\]133;D;([0-9]+)\x07)"
+
+var ps1Regex = regexp.MustCompile(ps1StatusPattern + PROMPT_SUFFIX)
+var ps1FullRegex = regexp.MustCompile(EMOJI_DEFAULT + ps1StatusPattern + PROMPT_SUFFIX)
+var promptPrefixRegex = regexp.MustCompile(PROMPT_PREFIX + "(" + osc7Pattern + ")?")
 
 var DarkShellColorScheme = &ShellColorScheme{
 	Prompt:           "\x1b[38;5;154m",
@@ -81,7 +86,7 @@ var LightShellColorScheme = &ShellColorScheme{
 func RunShell(ctx context.Context, config *ButterfishConfig) error {
 	envVars := []string{"BUTTERFISH_SHELL=1"}
 
-	ptmx, ptyCleanup, err := ptyCommand(ctx, envVars, []string{config.ShellBinary})
+	ptmx, shellPid, ptyCleanup, err := ptyCommand(ctx, envVars, []string{config.ShellBinary})
 	if err != nil {
 		return err
 	}
@@ -93,7 +98,20 @@ func RunShell(ctx context.Context, config *ButterfishConfig) error {
 	}
 	//fmt.Println("Starting butterfish shell")
 
-	bf.ShellMultiplexer(ptmx, ptmx, os.Stdin, os.Stdout)
+	history := NewShellHistory()
+	history.Cwd = func() string { return processCwd(shellPid) }
+	history.Redactor = bf.Redactor
+	if config.SessionsPath != "" {
+		session, blocks, err := OpenShellSession(config)
+		if err != nil {
+			return err
+		}
+		history.SetSession(session, blocks)
+		defer history.Close()
+		log.Printf("Recording shell history to session %s", session.Id)
+	}
+
+	bf.ShellMultiplexer(ptmx, ptmx, os.Stdin, os.Stdout, history)
 	return nil
 }
 
@@ -119,6 +137,8 @@ func HistoryTypeToString(historyType int) string {
 		return "LLM Output"
 	case historyTypeFunctionOutput:
 		return "Function Output"
+	case historyTypeToolOutput:
+		return "Tool Output"
 	default:
 		return "Unknown"
 	}
@@ -132,16 +152,26 @@ type Tokenization struct {
 
 // HistoryBuffer keeps a content buffer, plus an enum of the type of content
 // (user prompt, shell output, etc), plus a cache of tokenizations of the
-// content. Tokenizations are cached for specific encodings, for example
-// newer models use a different encoding than older models.
+// content. Tokenizations are cached per tokenizer, for example newer models
+// use a different encoding than older models and Claude is estimated.
 type HistoryBuffer struct {
-	Type           int
-	Content        *ShellBuffer
-	FunctionName   string
-	FunctionParams string
+	Type    int
+	Content *ShellBuffer
+	// Tool calls the model made, on historyTypeLLMOutput blocks
+	ToolCalls []*util.ToolCall
+	// The call this is the output of, on historyTypeToolOutput blocks
+	ToolCallId string
+	// When the block was started and the shell's working directory then
+	Time time.Time
+	Cwd  string
+	// On historyTypeShellInput blocks, the command's git branch, and once
+	// it's finished its exit code and end time. See CommandRecord.
+	GitBranch string
+	ExitCode  *int
+	End       time.Time
 
 	// This is to cache tokenization plus truncation of the content
-	// It maps from encoding name to the tokenization of the output
+	// It maps from tokenizer name to the tokenization of the output
 	Tokenizations map[string]Tokenization
 }
 
@@ -178,6 +208,22 @@ func (this *HistoryBuffer) GetTokenization(encoding string, length int) (string,
 type ShellHistory struct {
 	Blocks []*HistoryBuffer
 	mutex  sync.Mutex
+
+	// If set, returns the shell's working directory to record on new blocks
+	// when the prompt hasn't reported it
+	Cwd func() string
+	cwd string
+	// If set, secrets are redacted from blocks returned by GetLastNBytes and
+	// getHistoryBlocksByTokens, i.e. whenever history is sent to the LLM
+	Redactor *Redactor
+
+	// If set, blocks are written to the session once they're finished, saved
+	// is the number of blocks written so far
+	session *ShellSession
+	saved   int
+
+	// Input block of the command that's running, until the next prompt
+	running *HistoryBuffer
 }
 
 func NewShellHistory() *ShellHistory {
@@ -186,13 +232,87 @@ func NewShellHistory() *ShellHistory {
 	}
 }
 
-func (this *ShellHistory) add(historyType int, block string) {
-	buffer := NewShellBuffer()
-	buffer.Write(block)
-	this.Blocks = append(this.Blocks, &HistoryBuffer{
+// Record history to a session, blocks loaded from the session when resuming
+// it go before any existing blocks and aren't written again.
+func (this *ShellHistory) SetSession(session *ShellSession, loaded []*HistoryBuffer) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.session = session
+	this.Blocks = append(loaded, this.Blocks...)
+	this.saved = len(loaded)
+}
+
+// Write the blocks that haven't been saved yet. Unless final is set this
+// stops at a command that's still running, since its exit code isn't known.
+func (this *ShellHistory) save(final bool) {
+	if this.session == nil {
+		return
+	}
+
+	for ; this.saved < len(this.Blocks); this.saved++ {
+		block := this.Blocks[this.saved]
+		if !final && block == this.running {
+			break
+		}
+		err := this.session.Write(block)
+		if err != nil {
+			log.Printf("Error saving history to session %s: %s", this.session.Id, err)
+		}
+	}
+}
+
+// Id of the session history is recorded to, empty if there isn't one
+func (this *ShellHistory) SessionId() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.session == nil {
+		return ""
+	}
+	return this.session.Id
+}
+
+// Save the remaining blocks and close the session
+func (this *ShellHistory) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.session == nil {
+		return nil
+	}
+	this.save(true)
+	err := this.session.Close()
+	this.session = nil
+	return err
+}
+
+func (this *ShellHistory) newBlock(historyType int) *HistoryBuffer {
+	// the block before this one is finished now
+	this.save(false)
+
+	block := &HistoryBuffer{
 		Type:    historyType,
-		Content: buffer,
-	})
+		Content: NewShellBuffer(),
+		Time:    time.Now(),
+		Cwd:     this.cwd,
+	}
+	if block.Cwd == "" && this.Cwd != nil {
+		block.Cwd = this.Cwd()
+	}
+
+	// shell input starts a command that runs until the next prompt
+	if historyType == historyTypeShellInput {
+		block.GitBranch = gitBranch(block.Cwd)
+		this.running = block
+	}
+
+	this.Blocks = append(this.Blocks, block)
+	return block
+}
+
+func (this *ShellHistory) add(historyType int, block string) {
+	this.newBlock(historyType).Content.Write(block)
 }
 
 func (this *ShellHistory) Append(historyType int, data string) {
@@ -219,19 +339,25 @@ func (this *ShellHistory) Append(historyType int, data string) {
 	this.add(historyType, data)
 }
 
-func (this *ShellHistory) AddFunctionCall(name, params string) {
+// Record tool calls made by the model, they go on the model's last output
+// if it hasn't already made calls.
+func (this *ShellHistory) AddToolCalls(toolCalls []*util.ToolCall) {
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
 
-	this.Blocks = append(this.Blocks, &HistoryBuffer{
-		Type:           historyTypeLLMOutput,
-		FunctionName:   name,
-		FunctionParams: params,
-		Content:        NewShellBuffer(),
-	})
+	numBlocks := len(this.Blocks)
+	if numBlocks > 0 {
+		lastBlock := this.Blocks[numBlocks-1]
+		if lastBlock.Type == historyTypeLLMOutput && len(lastBlock.ToolCalls) == 0 {
+			lastBlock.ToolCalls = toolCalls
+			return
+		}
+	}
+
+	this.newBlock(historyTypeLLMOutput).ToolCalls = toolCalls
 }
 
-func (this *ShellHistory) AppendFunctionOutput(name, data string) {
+func (this *ShellHistory) AppendToolOutput(toolCallId, data string) {
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
 
@@ -241,20 +367,66 @@ func (this *ShellHistory) AppendFunctionOutput(name, data string) {
 	}
 
 	numBlocks := len(this.Blocks)
-	var lastBlock *HistoryBuffer
-	// if we have a block already, and it matches the type, append to it
+	// if we have a block already, and it's output of the same call, append to it
 	if numBlocks > 0 {
-		lastBlock = this.Blocks[numBlocks-1]
-		if lastBlock.Type == historyTypeFunctionOutput && lastBlock.FunctionName == name {
+		lastBlock := this.Blocks[numBlocks-1]
+		if lastBlock.Type == historyTypeToolOutput && lastBlock.ToolCallId == toolCallId {
 			lastBlock.Content.Write(data)
 			return
 		}
 	}
 
 	// if the history type doesn't match we fall through and add a new block
-	this.add(historyTypeFunctionOutput, data)
-	lastBlock = this.Blocks[numBlocks]
-	lastBlock.FunctionName = name
+	this.add(historyTypeToolOutput, data)
+	this.Blocks[numBlocks].ToolCallId = toolCallId
+}
+
+// Record the working directory reported by the shell's prompt, used for new
+// blocks instead of the Cwd function
+func (this *ShellHistory) SetCwd(cwd string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.cwd = cwd
+}
+
+// The shell's working directory as last reported by the prompt, or from Cwd
+// if the prompt hasn't reported it
+func (this *ShellHistory) WorkingDir() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.cwd == "" && this.Cwd != nil {
+		return this.Cwd()
+	}
+	return this.cwd
+}
+
+// Record that the running command finished, called when the next prompt is
+// printed. Nothing happens if no command is running.
+func (this *ShellHistory) FinishCommand(exitCode int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.running == nil {
+		return
+	}
+	this.running.ExitCode = &exitCode
+	this.running.End = time.Now()
+	this.running = nil
+}
+
+// The last command run in the shell, nil if there hasn't been one
+func (this *ShellHistory) LastCommand() *CommandRecord {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for i := len(this.Blocks) - 1; i >= 0; i-- {
+		if this.Blocks[i].Type == historyTypeShellInput {
+			return newCommandRecord(this.Blocks[i:])
+		}
+	}
+	return nil
 }
 
 // Go back in history for a certain number of bytes.
@@ -266,7 +438,7 @@ func (this *ShellHistory) GetLastNBytes(numBytes int, truncateLength int) []util
 
 	for i := len(this.Blocks) - 1; i >= 0 && numBytes > 0; i-- {
 		block := this.Blocks[i]
-		content := sanitizeTTYString(block.Content.String())
+		content := this.Redactor.Redact(sanitizeTTYString(block.Content.String()))
 		if len(content) > truncateLength {
 			content = content[:truncateLength]
 		}
@@ -366,12 +538,29 @@ type ShellState struct {
 	AutosuggestMaxTokens int
 
 	// The current state of the shell
-	State                  int
-	GoalMode               bool
-	GoalModeBuffer         string
-	GoalModeGoal           string
-	GoalModeUnsafe         bool
-	ActiveFunction         string
+	State          int
+	GoalMode       bool
+	GoalModeBuffer string
+	GoalModeGoal   string
+	GoalModeUnsafe bool
+	GoalModeAgent  *Agent
+	ActiveToolCall *util.ToolCall // goal mode call waiting on the shell
+	GoalModePlan   *GoalPlan      // the steps the agent planned for the goal
+	// Commands run for the current goal, for its limits and summary
+	goalModeCommands []*goalModeCommand
+	// Fires once goal mode has run for GoalModeMaxDuration, even while a
+	// command that never returns is running
+	goalModeTimer *time.Timer
+	// Where goal mode commands run if sandboxing is on, kept after goal mode
+	// until its changes are applied or discarded
+	Sandbox           *Sandbox
+	SandboxOutputChan chan *sandboxOutput
+	sandboxCancel     context.CancelFunc // stops the running sandboxed command
+	sandboxConfirm    string             // sandboxed command waiting for Enter
+	// Files saved before each goal mode command for Undo and Rewind, a command
+	// waiting for confirmation is only checkpointed once it's submitted
+	Checkpoints            *Checkpoints
+	pendingCheckpoint      string
 	PromptSuffixCounter    int
 	ChildOutReader         chan *byteMsg
 	ParentInReader         chan *byteMsg
@@ -391,8 +580,8 @@ type ShellState struct {
 	LastTabPassthrough     time.Time
 	parentInBuffer         []byte
 	// these are used to estimate number of tokens
-	AutosuggestEncoder *tiktoken.Tiktoken
-	PromptEncoder      *tiktoken.Tiktoken
+	AutosuggestEncoder Tokenizer
+	PromptEncoder      Tokenizer
 
 	// autosuggest config
 	AutosuggestEnabled bool
@@ -472,7 +661,11 @@ Please submit an issue to https://github.com/xuzhougeng/butterfish.`)
 // We need to be able to parse the child shell's prompt to determine where
 // it starts, ends, exit code, and allow customization to show the user that
 // we're inside butterfish shell. The PS1 is roughly the following:
-// PS1 := promptPrefix $PS1 ShellCommandPrompt $? promptSuffix
+// PS1 := promptPrefix OSC7($PWD) $PS1 ShellCommandPrompt $? promptSuffix
+// The OSC 7 escape reports the working directory, see ParseOSC7Cwd. In fish
+// the status is sent as ESC ] 133 ; D ; $status BEL, the escape that marks
+// the end of a command in terminals with shell integration, since fish would
+// otherwise count it in the prompt's width.
 func (this *ButterfishCtx) SetPS1(childIn io.Writer) {
 	shell := this.Config.ParseShell()
 	var ps1 string
@@ -481,11 +674,19 @@ func (this *ButterfishCtx) SetPS1(childIn io.Writer) {
 	case "bash", "sh":
 		// the \[ and \] are bash-specific and tell bash to not count the enclosed
 		// characters when calculating the cursor position
-		ps1 = "PS1=$'\\[%s\\]'$PS1$'%s\\[ $?%s\\] '\n"
+		ps1 = "PS1=$'\\[%s\\033]7;file://$PWD\\007\\]'$PS1$'%s\\[ $?%s\\] '\n"
 	case "zsh":
 		// the %%{ and %%} are zsh-specific and tell zsh to not count the enclosed
 		// characters when calculating the cursor position
-		ps1 = "PS1=$'%%{%s%%}'$PS1$'%s%%{ %%?%s%%} '\n"
+		ps1 = "PS1=$'%%{%s\\033]7;file://%%d\\007%%}'$PS1$'%s%%{ %%?%s%%} '\n"
+	case "fish":
+		// fish has no PS1, so we wrap the fish_prompt function. The original
+		// prompt runs first so that it still sees the last command's $status.
+		ps1 = "functions -q __butterfish_prompt; or functions -c fish_prompt __butterfish_prompt; " +
+			"function fish_prompt; set -l butterfish_status $status; " +
+			"set -l butterfish_prompt (__butterfish_prompt | string collect); " +
+			"printf '%s\\e]7;file://%%s\\a%%s%s\\e]133;D;%%d\\a%s ' " +
+			"$PWD \"$butterfish_prompt\" $butterfish_status; end\n"
 	default:
 		log.Printf("Unknown shell %s, Butterfish is going to leave the PS1 alone. This means that you won't get a custom prompt in Butterfish, and Butterfish won't be able to parse the exit code of the previous command, used for certain features. Create an issue at https://github.com/xuzhougeng/butterfish.", shell)
 		return
@@ -521,8 +722,12 @@ func ParsePS1(data string, regex *regexp.Regexp, currIcon string) (int, int, str
 	prompts := 0
 
 	for _, match := range matches {
+		status := match[1]
+		if status == "" {
+			status = match[2]
+		}
 		var err error
-		lastStatus, err = strconv.Atoi(match[1])
+		lastStatus, err = strconv.Atoi(status)
 		if err != nil {
 			log.Printf("Error parsing PS1 match: %s", err)
 		}
@@ -531,8 +736,8 @@ func ParsePS1(data string, regex *regexp.Regexp, currIcon string) (int, int, str
 
 	// Remove matches of suffix
 	cleaned := regex.ReplaceAllString(data, currIcon)
-	// Remove the prefix
-	cleaned = strings.ReplaceAll(cleaned, PROMPT_PREFIX, "")
+	// Remove the prefix and the working directory escape after it
+	cleaned = promptPrefixRegex.ReplaceAllString(cleaned, "")
 
 	return lastStatus, prompts, cleaned
 }
@@ -582,7 +787,7 @@ func min(a, b int) int {
 
 func (this *ButterfishCtx) ShellMultiplexer(
 	childIn io.Writer, childOut io.Reader,
-	parentIn io.Reader, parentOut io.Writer) {
+	parentIn io.Reader, parentOut io.Writer, history *ShellHistory) {
 
 	this.SetPS1(childIn)
 
@@ -642,7 +847,7 @@ func (this *ButterfishCtx) ShellMultiplexer(
 		ParentInReader:         parentInReader,
 		CursorPosChan:          parentPositionChan,
 		PrintErrorChan:         make(chan error, 8),
-		History:                NewShellHistory(),
+		History:                history,
 		PromptOutputChan:       make(chan *util.CompletionResponse),
 		PromptAnswerWriter:     styleCodeblocksWriter,
 		PromptGoalAnswerWriter: styleCodeblocksWriterGoal,
@@ -652,6 +857,8 @@ func (this *ButterfishCtx) ShellMultiplexer(
 		TerminalWidth:          termWidth,
 		AutosuggestEnabled:     this.Config.ShellAutosuggestEnabled,
 		AutosuggestChan:        make(chan *AutosuggestResult),
+		SandboxOutputChan:      make(chan *sandboxOutput, 1),
+		Checkpoints:            NewCheckpoints(DefaultMaxCheckpoints),
 		Color:                  colorScheme,
 		parentInBuffer:         []byte{},
 		PromptMaxTokens:        promptMaxTokens,
@@ -669,6 +876,17 @@ func (this *ButterfishCtx) ShellMultiplexer(
 
 	// start
 	shellState.Mux()
+
+	// the session keeps the history, which needs output for a call that was
+	// running when the shell exited or it can't be resumed
+	if shellState.ActiveToolCall != nil {
+		shellState.finishActiveToolCall("The shell exited before this call finished.")
+	}
+
+	if shellState.Sandbox != nil {
+		shellState.Sandbox.Close()
+	}
+	shellState.Checkpoints.Close()
 }
 
 func (this *ShellState) Errorf(format string, args ...any) {
@@ -693,10 +911,16 @@ type CommandParams struct {
 
 var commandRegex = regexp.MustCompile("^\\s*\\{\\s*\"cmd\"\\s*:\\s*\"(.*)\"\\s*\\}\\s*$")
 
-// Parse the arguments from the command function returned in a Chat completion.
-// We parse this with a regex rather than unmarshalling because the command
-// may contain unescaped quotes, which would cause the unmarshal to fail.
+// Parse the arguments from the command tool call returned in a Chat
+// completion. If they don't unmarshal we fall back to a regex, because the
+// command may contain unescaped quotes, which would cause the unmarshal to
+// fail.
 func parseCommandParams(params string) (string, error) {
+	var commandParams CommandParams
+	if json.Unmarshal([]byte(params), &commandParams) == nil && commandParams.Cmd != "" {
+		return commandParams.Cmd, nil
+	}
+
 	// get cmd value using commandRegex
 	matches := commandRegex.FindStringSubmatch(params)
 	if len(matches) != 2 {
@@ -811,8 +1035,8 @@ func (this *ShellState) Mux() {
 			if historyData != "" {
 				this.History.Append(historyTypeLLMOutput, historyData)
 			}
-			if output.FunctionName != "" {
-				this.History.AddFunctionCall(output.FunctionName, output.FunctionParameters)
+			if len(output.ToolCalls) > 0 {
+				this.History.AddToolCalls(output.ToolCalls)
 			}
 
 			// If there is child output waiting to be printed, print that now
@@ -826,8 +1050,7 @@ func (this *ShellState) Mux() {
 			this.ChildIn.Write([]byte("\n"))
 
 			if this.GoalMode {
-				this.ActiveFunction = output.FunctionName
-				this.GoalModeFunction(output)
+				this.GoalModeToolCalls(output)
 				if this.GoalMode {
 					continue
 				}
@@ -837,6 +1060,19 @@ func (this *ShellState) Mux() {
 			this.setState(stateNormal)
 			this.ParentInputLoop([]byte{})
 
+		// A sandboxed goal mode command finished, its output goes to the model,
+		// unless goal mode was exited while it ran
+		case output := <-this.SandboxOutputChan:
+			if !this.GoalMode || output.call != this.ActiveToolCall {
+				continue
+			}
+			this.sandboxCancel = nil
+			this.goalModeCommandDone(output.exitCode)
+			this.GoalModeToolResponse(this.printSandboxOutput(output))
+
+		case <-this.goalModeTimeout():
+			this.GoalModeTimedOut()
+
 		case childOutMsg := <-this.ChildOutReader:
 			if childOutMsg == nil {
 				log.Println("Child out reader closed")
@@ -848,8 +1084,17 @@ func (this *ShellState) Mux() {
 				log.Printf("Child out: %x", string(childOutMsg.Data))
 			}
 
+			// the prompt reports the shell's working directory, which new
+			// commands are recorded with
+			if cwd := ParseOSC7Cwd(string(childOutMsg.Data)); cwd != "" {
+				this.History.SetCwd(cwd)
+			}
+
 			lastStatus, prompts, childOutStr := this.ParsePS1(string(childOutMsg.Data))
 			this.PromptSuffixCounter += prompts
+			if prompts > 0 {
+				this.History.FinishCommand(lastStatus)
+			}
 
 			if prompts > 0 && this.State == stateNormal && !this.GoalMode {
 				// If we get a prompt and we're at the start of a command
@@ -878,16 +1123,16 @@ func (this *ShellState) Mux() {
 					// is done and we can send the response back to the model
 					endOfFunctionCall = true
 				}
-			} else if this.ActiveFunction != "" {
-				this.ActiveFunction = ""
+			} else if this.ActiveToolCall != nil {
+				this.ActiveToolCall = nil
 			}
 
 			// If we're getting child output while typing in a shell command, this
 			// could mean the user is paging through old commands, or doing a tab
 			// completion, or something unknown, so we don't want to add to history.
 			if this.State != stateShell && !this.FilterChildOut(string(childOutMsg.Data)) {
-				if this.ActiveFunction != "" {
-					this.History.AppendFunctionOutput(this.ActiveFunction, childOutStr)
+				if this.ActiveToolCall != nil && this.ActiveToolCall.Id != "" {
+					this.History.AppendToolOutput(this.ActiveToolCall.Id, childOutStr)
 				} else {
 					this.History.Append(historyTypeShellOutput, childOutStr)
 				}
@@ -918,11 +1163,11 @@ func (this *ShellState) Mux() {
 				// move cursor to the beginning of the line and clear the line
 				fmt.Fprintf(this.ParentOut, "\r%s", ESC_CLEAR)
 				var status string
-				if this.ActiveFunction == "command" {
+				if this.ActiveToolCall != nil && this.ActiveToolCall.Function.Name == "command" {
 					status = fmt.Sprintf("Exit Code: %d\n", lastStatus)
+					this.goalModeCommandDone(lastStatus)
 				}
-				this.GoalModeFunctionResponse(status)
-				this.ActiveFunction = ""
+				this.GoalModeToolResponse(status)
 				this.GoalModeBuffer = ""
 				this.PromptSuffixCounter = 0
 			}
@@ -993,7 +1238,7 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			log.Printf("Canceling prompt response")
 			this.PromptResponseCancel()
 			this.PromptResponseCancel = nil
-			this.GoalMode = false
+			this.GoalModeExit()
 			this.setState(stateNormal)
 			if data[0] == 0x03 {
 				return data[1:]
@@ -1006,6 +1251,30 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 		return data
 
 	case stateNormal:
+		if this.sandboxConfirm != "" {
+			// A sandboxed goal mode command needs confirmation, Enter runs it and
+			// Ctrl-C exits goal mode, other input is ignored
+			if bytes.IndexByte(data, 0x03) >= 0 {
+				fmt.Fprintf(this.PromptGoalAnswerWriter, "\n%sExited goal mode.%s\n", this.Color.Answer, this.Color.Command)
+				this.GoalModeExit()
+			} else if hasCarriageReturn {
+				cmd := this.sandboxConfirm
+				this.sandboxConfirm = ""
+				this.runSandboxed(this.ActiveToolCall, cmd)
+			}
+			return nil
+		}
+
+		if this.sandboxCancel != nil {
+			// A sandboxed goal mode command is running, Ctrl-C stops it and
+			// goal mode, other input is ignored
+			if bytes.IndexByte(data, 0x03) >= 0 {
+				fmt.Fprintf(this.PromptGoalAnswerWriter, "\n%sExited goal mode.%s\n", this.Color.Answer, this.Color.Command)
+				this.GoalModeExit()
+			}
+			return nil
+		}
+
 		if HasRunningChildren() {
 			// If we have running children then the shell is running something,
 			// so just forward the input.
@@ -1017,7 +1286,7 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			if this.GoalMode {
 				// Ctrl-C while in goal mode
 				fmt.Fprintf(this.PromptGoalAnswerWriter, "\n%sExited goal mode.%s\n", this.Color.Answer, this.Color.Command)
-				this.GoalMode = false
+				this.GoalModeExit()
 			}
 
 			if this.Command != nil {
@@ -1067,6 +1336,7 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 
 		} else if data[0] == '\r' {
 			this.ClearAutosuggest(this.Color.Command)
+			this.checkpointSubmitted()
 			this.ChildIn.Write(data)
 			return data[1:]
 
@@ -1161,8 +1431,16 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			this.setState(stateNormal)
 
 			index := bytes.Index(data, []byte{'\r'})
+			this.checkpointSubmitted()
 			this.ChildIn.Write(data[:index+1])
-			this.History.Append(historyTypeShellInput, this.Command.String())
+			if call := this.ActiveToolCall; this.GoalMode && call != nil && call.Id != "" {
+				// the user edited a goal mode command, a user message can't come
+				// between the call and its output so the edit goes in the output
+				this.History.AppendToolOutput(call.Id,
+					fmt.Sprintf("The user typed %q into the command before running it.\n", this.Command.String()))
+			} else {
+				this.History.Append(historyTypeShellInput, this.Command.String())
+			}
 			this.Command = NewShellBuffer()
 
 			if this.AutosuggestCancel != nil {
@@ -1175,6 +1453,7 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 		} else if data[0] == 0x03 { // Ctrl-C
 			this.Command.Clear()
 			this.setState(stateNormal)
+			this.pendingCheckpoint = ""
 			this.ChildIn.Write([]byte{data[0]})
 
 			if this.AutosuggestCancel != nil {
@@ -1226,6 +1505,9 @@ func (this *ShellState) PrintStatus() {
 
 	if this.GoalMode {
 		text += fmt.Sprintf("You're in Goal mode, the goal you've given to the agent is:\n%s\n\n", this.GoalModeGoal)
+		if plan := this.GoalModePlan; plan != nil {
+			text += fmt.Sprintf("The agent's plan, %s:\n%s\n", plan.Progress(), plan.String())
+		}
 	}
 
 	text += fmt.Sprintf("Prompting model:       %s\n", this.Butterfish.Config.ShellPromptModel)
@@ -1234,6 +1516,30 @@ func (this *ShellState) PrintStatus() {
 	text += fmt.Sprintf("Autosuggest model:     %s\n", this.Butterfish.Config.ShellAutosuggestModel)
 	text += fmt.Sprintf("Autosuggest timeout:   %s\n", this.Butterfish.Config.ShellAutosuggestTimeout)
 	text += fmt.Sprintf("Autosuggest history:   %d tokens\n", this.AutosuggestMaxTokens)
+	if command := this.History.LastCommand(); command != nil {
+		text += fmt.Sprintf("Last command:          %s %s\n",
+			strings.TrimSpace(sanitizeTTYString(command.Input)), command.Summary())
+	}
+	if sessionId := this.History.SessionId(); sessionId != "" {
+		text += fmt.Sprintf("History session:       %s\n", sessionId)
+	}
+	if this.Butterfish.Config.GoalModeSandbox {
+		sandbox := "on"
+		if this.Sandbox != nil && !this.GoalMode {
+			sandbox += ", changes waiting for Apply or Discard"
+		}
+		text += fmt.Sprintf("Goal mode sandbox:     %s\n", sandbox)
+	}
+	if this.Checkpoints != nil && this.Checkpoints.Len() > 0 {
+		text += fmt.Sprintf("Goal mode checkpoints: %d, type Undo or Rewind N to restore one\n", this.Checkpoints.Len())
+	}
+
+	if budgetLines := this.Butterfish.Budget.Status(); len(budgetLines) > 0 {
+		text += "\nRemaining budget:\n"
+		for _, line := range budgetLines {
+			text += fmt.Sprintf("  %s\n", line)
+		}
+	}
 	fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s", this.Color.Answer, text, this.Color.Command)
 	this.SendPromptResponse(text)
 }
@@ -1247,6 +1553,8 @@ func (this *ShellState) PrintHelp() {
 	- GPT will be able to see your shell history, so you can ask contextual questions like "why didn't my last command work?"
 	- Type "Status" to show the current Butterfish configuration
 	- Type "History" to show the recent history that will be sent to GPT
+	- Type "Apply" or "Discard" to keep or throw away what sandboxed goal mode changed
+	- Type "Undo" to restore the files from before the last goal mode command, or "Rewind 3" for the third last
 `
 	fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s", this.Color.Answer, text, this.Color.Command)
 	this.SendPromptResponse(text)
@@ -1257,6 +1565,7 @@ func (this *ShellState) PrintHistory() {
 	historyBlocks, _ := getHistoryBlocksByTokens(this.History, this.getPromptEncoder(),
 		maxHistoryBlockTokens, this.PromptMaxTokens, 4)
 	strBuilder := strings.Builder{}
+	redactions := 0
 
 	for _, block := range historyBlocks {
 		// block header
@@ -1271,7 +1580,16 @@ func (this *ShellState) PrintHistory() {
 			blockColor = this.Color.PromptGoal
 		}
 
-		strBuilder.WriteString(fmt.Sprintf("%s%s\n", blockColor, block.Content))
+		// highlight redacted secrets so it's clear what was held back
+		redactions += CountRedactions(block.Content)
+		content := redactedPlaceholderRegex.ReplaceAllString(block.Content,
+			this.Color.Error+"$0"+blockColor)
+		strBuilder.WriteString(fmt.Sprintf("%s%s\n", blockColor, content))
+	}
+
+	if redactions > 0 {
+		strBuilder.WriteString(fmt.Sprintf("%s%d secrets were redacted from this history\n",
+			this.Color.GoalMode, redactions))
 	}
 
 	this.History.LogRecentHistory()
@@ -1298,12 +1616,38 @@ func (this *ShellState) GoalModeStart() {
 		log.Printf("[DEBUG] GoalMode: Safe mode enabled")
 	}
 
+	// a new goal continues in the sandbox of the last one if its changes
+	// haven't been applied or discarded
+	if this.Butterfish.Config.GoalModeSandbox && this.Sandbox == nil {
+		sandbox, err := NewSandbox(this.Butterfish.Ctx, this.History.WorkingDir(), this.Butterfish.Config.ShellBinary)
+		if err != nil {
+			log.Printf("[DEBUG] GoalMode: %s", err)
+			this.Prompt.Clear()
+			fmt.Fprintf(this.PromptGoalAnswerWriter, "%s%s%s\n", this.Color.Error, err, this.Color.Command)
+			this.SendPromptResponse("")
+			return
+		}
+		this.Sandbox = sandbox
+	}
+
 	this.GoalMode = true
+	this.GoalModeAgent = NewAgent(this.goalModeTools())
+	this.GoalModeAgent.MaxSteps = this.Butterfish.Config.GoalModeMaxTurns
+	this.GoalModeAgent.MaxDuration = this.Butterfish.Config.GoalModeMaxDuration
+	this.GoalModeAgent.Start()
+	if max := this.GoalModeAgent.MaxDuration; max > 0 {
+		this.goalModeTimer = time.NewTimer(max)
+	}
+	this.goalModeCommands = nil
 	fmt.Fprintf(this.PromptGoalAnswerWriter, "%sGoal mode starting...%s\n", this.Color.Answer, this.Color.Command)
 	this.GoalModeGoal = goal
+	this.GoalModePlan = nil
 	this.Prompt.Clear()
 
-	prompt := "Start now."
+	prompt := "Start by calling the plan tool with the steps you'll take to achieve the goal, then carry them out, calling plan again to update the status of each step or to revise the plan."
+	if this.Sandbox != nil {
+		prompt += fmt.Sprintf(" Your commands run in a sandbox in %s without network access. Each command starts in that directory, and changes to files are kept for the user to review when you finish.", this.Sandbox.Dir)
+	}
 	log.Printf("[DEBUG] GoalMode: Initiating with prompt: %s", prompt)
 	this.goalModePrompt(prompt)
 }
@@ -1313,126 +1657,474 @@ func (this *ShellState) GoalModeChat() {
 	this.Prompt.Clear()
 
 	log.Printf("Goal mode chat: %s\n", prompt)
+
+	// the user is answering a user_input call, that's the call's output
+	if call := this.ActiveToolCall; call != nil && call.Function.Name == "user_input" && call.Id != "" {
+		this.History.AppendToolOutput(call.Id, prompt)
+		this.ActiveToolCall = nil
+		this.goalModePrompt("")
+		return
+	}
+
+	// the user interrupted a call, most likely a command waiting for Enter.
+	// The call still needs output, and the unsubmitted command is cleared from
+	// the shell's line.
+	if call := this.ActiveToolCall; call != nil {
+		if this.pendingCheckpoint != "" {
+			this.ChildIn.Write([]byte{0x15})
+		}
+		this.finishActiveToolCall(fmt.Sprintf("The user interrupted this command and said: %s", prompt))
+		this.goalModePrompt("")
+		return
+	}
+
 	this.goalModePrompt(prompt)
 }
 
-func (this *ShellState) GoalModeFunctionResponse(output string) {
+// Send the output of the active tool call back to the model and prompt again
+func (this *ShellState) GoalModeToolResponse(output string) {
 	log.Printf("Goal mode response: %s\n", output)
-	if output != "" {
-		this.History.AppendFunctionOutput(this.ActiveFunction, output)
-	}
-	this.ActiveFunction = ""
+	this.finishActiveToolCall(output)
 	this.goalModePrompt("")
 }
 
-func extractCommandFromCodeBlock(response string) string {
-	// Check for command pattern first
-	cmdRegex := regexp.MustCompile(`command\(\s*{\s*"cmd"\s*:\s*"([^"]+)"\s*}\s*\)`)
-	if matches := cmdRegex.FindStringSubmatch(response); len(matches) > 1 {
-		// Remove command repetition check
-		return matches[1]
+// Add output for the active tool call to history. With the JSON protocol
+// calls have no id and the output goes in as a prompt instead.
+func (this *ShellState) finishActiveToolCall(output string) {
+	call := this.ActiveToolCall
+	this.ActiveToolCall = nil
+	this.pendingCheckpoint = ""
+	this.sandboxConfirm = ""
+	if output == "" {
+		return
+	}
+
+	if call != nil && call.Id != "" {
+		this.History.AppendToolOutput(call.Id, output)
+	} else {
+		this.History.Append(historyTypePrompt, output)
+	}
+}
+
+// Exiting goal mode in the middle of a call still needs output for the call,
+// otherwise APIs reject the history in later prompts.
+func (this *ShellState) GoalModeExit() {
+	if this.goalModeTimer != nil {
+		this.goalModeTimer.Stop()
+		this.goalModeTimer = nil
+	}
+	if this.ActiveToolCall != nil {
+		this.finishActiveToolCall("Goal mode was exited.")
+	}
+	if this.GoalMode {
+		this.GoalMode = false
+		this.ReviewSandbox()
+	}
+}
+
+const (
+	DefaultGoalModeMaxCommands = 20
+	DefaultGoalModeMaxFailures = 3
+)
+
+type goalModeCommand struct {
+	Cmd      string
+	ExitCode *int // nil until the command finishes
+}
+
+// Record the exit code of the command goal mode is running
+func (this *ShellState) goalModeCommandDone(exitCode int) {
+	if len(this.goalModeCommands) > 0 {
+		this.goalModeCommands[len(this.goalModeCommands)-1].ExitCode = &exitCode
+	}
+}
+
+// How many times in a row the last command failed
+func (this *ShellState) goalModeRepeatedFailures() int {
+	failures := 0
+	for i := len(this.goalModeCommands) - 1; i >= 0; i-- {
+		command := this.goalModeCommands[i]
+		if command.ExitCode == nil || *command.ExitCode == 0 ||
+			command.Cmd != this.goalModeCommands[len(this.goalModeCommands)-1].Cmd {
+			break
+		}
+		failures++
 	}
+	return failures
+}
 
-	// Look for complete_goal pattern
-	completeRegex := regexp.MustCompile(`complete_goal\(\s*{.*?"result"\s*:\s*"([^"]+)"\s*}.*?\)`)
-	if matches := completeRegex.FindStringSubmatch(response); len(matches) > 1 {
-		log.Printf("[DEBUG] GoalMode: Converting complete_goal to finish function")
-		return "finish"
+// Check the limits before prompting the model again, this counts a turn
+func (this *ShellState) goalModeLimits() error {
+	if max := this.Butterfish.Config.GoalModeMaxFailures; max > 0 && this.goalModeRepeatedFailures() >= max {
+		return &AgentLimitError{Limit: "repeated failures", Value: fmt.Sprintf("%d", max)}
 	}
+	return this.GoalModeAgent.NextStep()
+}
 
-	// Check completion phrases
-	completionPhrases := []string{
-		"goal is now fully achieved",
-		"task is now complete", 
-		"goal has been achieved",
-		"successfully completed",
-		"goal is accomplished",
-		"no further commands are needed",
-		"no more commands needed",
-		"task has been completed",
-		"we are done",
-		"that completes the",
+// The goal mode timer's channel, nil when there's no timer so the Mux select
+// never picks it
+func (this *ShellState) goalModeTimeout() <-chan time.Time {
+	if this.goalModeTimer == nil {
+		return nil
 	}
+	return this.goalModeTimer.C
+}
 
-	responseLower := strings.ToLower(response)
-	for _, phrase := range completionPhrases {
-		if strings.Contains(responseLower, phrase) {
-			log.Printf("[DEBUG] GoalMode: Detected completion phrase: %q", phrase)
-			return "finish"
+// Goal mode ran out of time. A command still running in the shell, like
+// tail -f, is interrupted and goal mode exits with FAILURE. While the model
+// is answering we leave it, the limit is checked before the next prompt.
+func (this *ShellState) GoalModeTimedOut() {
+	this.goalModeTimer = nil
+	if !this.GoalMode || this.State == statePromptResponse {
+		return
+	}
+
+	if this.ActiveToolCall != nil && this.sandboxCancel == nil && HasRunningChildren() {
+		this.ChildIn.Write([]byte{0x03})
+	}
+	err := &AgentLimitError{Limit: "time", Value: this.GoalModeAgent.MaxDuration.String()}
+	this.History.Append(historyTypePrompt, this.GoalModeAbort(err))
+}
+
+// Exit goal mode with FAILURE because it reached a limit, returns a summary
+// of what was tried, which is also printed
+func (this *ShellState) GoalModeAbort(err error) string {
+	log.Printf("[DEBUG] GoalMode: %s", err)
+	summary := fmt.Sprintf("Exited goal mode with FAILURE. %s.\n", err)
+	summary += fmt.Sprintf("The goal was: %s\n", this.GoalModeGoal)
+
+	const maxListed = 10
+	commands := this.goalModeCommands
+	switch {
+	case len(commands) == 0:
+		summary += "No commands were run.\n"
+	case len(commands) > maxListed:
+		summary += fmt.Sprintf("%d commands were run, the last %d were:\n", len(commands), maxListed)
+		commands = commands[len(commands)-maxListed:]
+	default:
+		summary += fmt.Sprintf("%d commands were run:\n", len(commands))
+	}
+	for _, command := range commands {
+		status := "not finished"
+		if command.ExitCode != nil {
+			status = fmt.Sprintf("exit %d", *command.ExitCode)
 		}
+		summary += fmt.Sprintf("  [%s] %s\n", status, command.Cmd)
+	}
+	if plan := this.GoalModePlan; plan != nil {
+		summary += fmt.Sprintf("The plan had %s:\n%s", plan.Progress(), plan.String())
 	}
 
-	return ""
+	fmt.Fprintf(this.PromptGoalAnswerWriter, "%s%s%s", this.Color.Error, summary, this.Color.Command)
+	this.GoalModeBuffer = ""
+	this.GoalModeExit()
+	this.setState(stateNormal)
+	return summary
 }
 
-func (this *ShellState) GoalModeFunction(output *util.CompletionResponse) {
-	// Try to extract command from code block if no function was called
-	if output.FunctionName == "" {
-		log.Printf("[DEBUG] GoalMode: Attempting to parse command from response: %s", output.Completion)
-		// Extract command from code block
-		if cmd := extractCommandFromCodeBlock(output.Completion); cmd != "" {
-			log.Printf("[DEBUG] GoalMode: Extracted command: %s", cmd)
-			if cmd == "finish" {
-				output.FunctionName = "finish"
-				output.FunctionParameters = `{"success": true}`
-				log.Printf("[DEBUG] GoalMode: Converting to finish function call")
-			} else {
-				output.FunctionName = "command"
-				output.FunctionParameters = fmt.Sprintf(`{"cmd": %q}`, cmd)
-			}
+type sandboxOutput struct {
+	call     *util.ToolCall
+	output   string
+	exitCode int
+	err      error
+}
+
+// Run a goal mode command in the sandbox rather than the shell, its output
+// comes back through SandboxOutputChan
+func (this *ShellState) runSandboxed(call *util.ToolCall, cmd string) {
+	log.Printf("[DEBUG] GoalMode: Running command in sandbox")
+	this.ActiveToolCall = call
+	this.GoalModeBuffer = ""
+	// prompts from the shell don't end the call
+	this.PromptSuffixCounter = -999999
+	this.setState(stateNormal)
+	fmt.Fprintf(this.PromptGoalAnswerWriter, "%ssandbox$ %s%s\n", this.Color.GoalMode, cmd, this.Color.Command)
+
+	ctx, cancel := context.WithCancel(this.Butterfish.Ctx)
+	this.sandboxCancel = cancel
+	sandbox := this.Sandbox
+	go func() {
+		output, exitCode, err := sandbox.Run(ctx, cmd)
+		cancel()
+		this.SandboxOutputChan <- &sandboxOutput{call: call, output: output, exitCode: exitCode, err: err}
+	}()
+}
+
+// Wait for the user to press Enter before running a sandboxed command
+func (this *ShellState) confirmSandboxed(call *util.ToolCall, cmd string, check *CommandCheck) {
+	log.Printf("[DEBUG] GoalMode: Waiting for user confirmation of sandboxed command")
+	this.ActiveToolCall = call
+	this.GoalModeBuffer = ""
+	this.PromptSuffixCounter = -999999
+	this.sandboxConfirm = cmd
+	this.setState(stateNormal)
+	fmt.Fprintf(this.PromptGoalAnswerWriter, "%sThis command needs confirmation, %s\n%s\nPress Enter to run it in the sandbox or Ctrl-C to exit goal mode.%s\n",
+		this.Color.Error, check.Summary(), cmd, this.Color.Command)
+}
+
+// Print a sandboxed command's output and return it for the model
+func (this *ShellState) printSandboxOutput(output *sandboxOutput) string {
+	if output.err != nil {
+		fmt.Fprintf(this.PromptGoalAnswerWriter, "%s%s%s\n", this.Color.Error, output.err, this.Color.Command)
+		return fmt.Sprintf("Error running the command in the sandbox: %s", output.err)
+	}
+
+	writer := util.NewReplaceWriter(this.ParentOut, "\n", "\r\n")
+	fmt.Fprintf(writer, "\r%s%s", ESC_CLEAR, output.output)
+	if output.output != "" && !strings.HasSuffix(output.output, "\n") {
+		fmt.Fprintf(writer, "\n")
+	}
+	return fmt.Sprintf("%sExit Code: %d\n", output.output, output.exitCode)
+}
+
+// Show what sandboxed commands changed once goal mode ends, the user keeps
+// or throws away the changes with the Apply and Discard prompts
+func (this *ShellState) ReviewSandbox() {
+	if this.sandboxCancel != nil {
+		this.sandboxCancel()
+		this.sandboxCancel = nil
+	}
+	if this.Sandbox == nil {
+		return
+	}
+
+	changes, err := this.Sandbox.Changes()
+	if err != nil {
+		fmt.Fprintf(this.PromptGoalAnswerWriter, "%sError reading the sandbox changes: %s%s\n", this.Color.Error, err, this.Color.Command)
+		this.Sandbox.Close()
+		this.Sandbox = nil
+		return
+	}
+	if len(changes) == 0 {
+		fmt.Fprintf(this.PromptGoalAnswerWriter, "%sNo files were changed in the sandbox.%s\n", this.Color.Answer, this.Color.Command)
+		this.Sandbox.Close()
+		this.Sandbox = nil
+		return
+	}
+
+	writer := util.NewReplaceWriter(this.ParentOut, "\n", "\r\n")
+	for _, line := range strings.Split(strings.TrimSuffix(this.Sandbox.Diff(changes), "\n"), "\n") {
+		color := this.Color.Answer
+		switch {
+		case strings.HasPrefix(line, "+"):
+			color = this.Color.Prompt
+		case strings.HasPrefix(line, "-"):
+			color = this.Color.Error
+		case strings.HasPrefix(line, " ") || line == "@@":
+			color = this.Color.Autosuggest
+		}
+		fmt.Fprintf(writer, "%s%s\n", color, line)
+	}
+	fmt.Fprintf(this.PromptGoalAnswerWriter, "%sThose are the changes made in the sandbox. Type Apply to copy them to %s, or Discard to throw them away. A new goal continues in the sandbox.%s\n",
+		this.Color.Answer, this.Sandbox.Dir, this.Color.Command)
+}
+
+// Apply the sandbox's changes to the real directory, or discard them, and
+// remove the sandbox
+func (this *ShellState) FinishSandbox(apply bool) {
+	sandbox := this.Sandbox
+	this.Sandbox = nil
+	defer sandbox.Close()
+
+	text := fmt.Sprintf("Discarded the sandbox changes to %s.\n", sandbox.Dir)
+	if apply {
+		// applying can be undone like a goal mode command
+		this.checkpoint(sandbox.Dir, "Apply")
+		changes, err := sandbox.Changes()
+		if err == nil {
+			err = sandbox.Apply(changes)
+		}
+		if err != nil {
+			text = fmt.Sprintf("Error applying the sandbox changes: %s\n", err)
 		} else {
-			log.Printf("[DEBUG] GoalMode: No command or completion detected in response")
+			text = fmt.Sprintf("Applied the sandbox changes to %s.\n", sandbox.Dir)
 		}
 	}
 
-	switch output.FunctionName {
-	case "command":
-		log.Printf("[DEBUG] GoalMode: Executing command function")
+	fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s", this.Color.Answer, text, this.Color.Command)
+	this.SendPromptResponse(text)
+}
+
+// Checkpoint a goal mode command the user confirmed, just before the shell
+// gets the Enter that runs it
+func (this *ShellState) checkpointSubmitted() {
+	if this.pendingCheckpoint == "" {
+		return
+	}
+	cmd := this.pendingCheckpoint
+	this.pendingCheckpoint = ""
+	this.checkpoint(this.History.WorkingDir(), cmd)
+}
+
+// Save the files in dir before running command so the user can undo it, the
+// command still runs if that fails
+func (this *ShellState) checkpoint(dir, command string) {
+	if this.Checkpoints == nil {
+		return
+	}
+	if _, err := this.Checkpoints.Create(dir, command); err != nil {
+		log.Printf("[DEBUG] GoalMode: %s", err)
+		fmt.Fprintf(this.PromptGoalAnswerWriter, "%s%s, Undo won't restore this command's changes%s\n",
+			this.Color.Error, err, this.Color.Command)
+	}
+}
+
+// Restore the checkpoint from before the nth last goal mode command. The
+// rollback goes in the history so the model knows the files changed back.
+func (this *ShellState) Rewind(n int) {
+	var text string
+	if this.Checkpoints == nil || this.Checkpoints.Len() == 0 {
+		text = "There are no goal mode checkpoints to restore.\n"
+	} else if checkpoint, err := this.Checkpoints.Rewind(n); err != nil {
+		text = fmt.Sprintf("%s\n", err)
+	} else {
+		if n == 1 {
+			text = fmt.Sprintf("Rewound %s to before the goal mode command `%s`, undoing its changes.\n",
+				checkpoint.Dir, checkpoint.Command)
+		} else {
+			text = fmt.Sprintf("Rewound %s to before the goal mode command `%s`, undoing the changes of the last %d commands.\n",
+				checkpoint.Dir, checkpoint.Command, n)
+		}
+		if len(checkpoint.IgnoredDirs) > 0 {
+			text += fmt.Sprintf("Ignored directories weren't checkpointed and weren't restored: %s\n",
+				strings.Join(checkpoint.IgnoredDirs, ", "))
+		}
+	}
+	fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s", this.Color.Answer, text, this.Color.Command)
+
+	// in goal mode the agent carries on from the restored files
+	if this.GoalMode {
+		this.Prompt.Clear()
+		this.finishActiveToolCall(text)
+		this.goalModePrompt("")
+		return
+	}
+	this.SendPromptResponse(text)
+}
+
+// Undo rewinds one command, "Rewind 3" three
+func parseRewind(prompt string) (int, bool) {
+	fields := strings.Fields(prompt)
+	switch {
+	case len(fields) == 1 && (fields[0] == "undo" || fields[0] == "rewind"):
+		return 1, true
+	case len(fields) == 2 && fields[0] == "rewind":
+		n, err := strconv.Atoi(fields[1])
+		return n, err == nil && n > 0
+	}
+	return 0, false
+}
+
+// The tools the model can call in goal mode. Commands and questions are
+// answered through the shell, so their handlers return ErrToolOutputPending
+// and the output is added once the command finishes or the user answers.
+func (this *ShellState) goalModeTools() *AgentToolRegistry {
+	command := func(ctx context.Context, call *util.ToolCall) (string, error) {
+		if this.ActiveToolCall != nil {
+			return "", errors.New("Only one command can run at a time, call it again once the other call has finished.")
+		}
+		// the start prompt asks for a plan first, models that skip it are told
+		if this.GoalModePlan == nil {
+			return "", errors.New("There's no plan yet, call plan first with the steps you'll take, then run the command.")
+		}
+		cmd, err := parseCommandParams(call.Function.Parameters)
+		if err != nil {
+			return "", fmt.Errorf("Error parsing your json, try again: %s", err)
+		}
+
+		log.Printf("[DEBUG] GoalMode: Parsed command: %s", cmd)
+
+		if max := this.Butterfish.Config.GoalModeMaxCommands; max > 0 && len(this.goalModeCommands) >= max {
+			return this.GoalModeAbort(&AgentLimitError{Limit: "commands", Value: fmt.Sprintf("%d", max)}), nil
+		}
+
+		// the policy can refuse the command, or make unsafe mode ask first
+		check := this.Butterfish.CommandPolicy.Check(cmd, this.History.WorkingDir())
+		log.Printf("[DEBUG] GoalMode: Command policy: %s", check.Summary())
+		if check.Decision == PolicyDeny {
+			fmt.Fprintf(this.PromptGoalAnswerWriter, "%sCommand blocked by policy: %s\n%s%s\n",
+				this.Color.Error, cmd, check.Summary(), this.Color.Command)
+			return "", fmt.Errorf("The command policy blocked this command (%s), don't run it again, find another way or ask the user.", check.Summary())
+		}
+
+		this.goalModeCommands = append(this.goalModeCommands, &goalModeCommand{Cmd: cmd})
+
+		// sandboxed commands can't do harm, so they only need confirmation
+		// when a confirm rule asks for it
+		if this.Sandbox != nil {
+			if check.Decision == PolicyConfirm && check.Rule != "" {
+				this.confirmSandboxed(call, cmd, check)
+			} else {
+				this.runSandboxed(call, cmd)
+			}
+			return "", ErrToolOutputPending
+		}
+
+		this.ActiveToolCall = call
 		this.GoalModeBuffer = ""
 		this.PromptSuffixCounter = 0
 		this.setState(stateNormal)
-		cmd, err := parseCommandParams(output.FunctionParameters)
-		if err != nil {
-			log.Printf("[DEBUG] GoalMode: Error parsing command: %v", err)
-			modelStr := fmt.Sprintf("Error parsing your json, try again: %s", err)
-			this.GoalModeFunctionResponse(modelStr)
-			return
+		if check.Decision == PolicyConfirm {
+			fmt.Fprintf(this.PromptGoalAnswerWriter, "%sThis command needs confirmation, %s\nPress Enter to run it or Ctrl-C to exit goal mode.%s\n",
+				this.Color.Error, check.Summary(), this.Color.Command)
 		}
-		log.Printf("[DEBUG] GoalMode: Parsed command: %s", cmd)
 		fmt.Fprintf(this.ChildIn, "%s", cmd)
-		if this.GoalModeUnsafe {
+		if this.GoalModeUnsafe && check.Decision == PolicyAllow {
 			log.Printf("[DEBUG] GoalMode: Unsafe mode - auto executing command")
+			this.checkpoint(this.History.WorkingDir(), cmd)
 			fmt.Fprintf(this.ChildIn, "\n")
 		} else {
-			log.Printf("[DEBUG] GoalMode: Safe mode - waiting for user confirmation")
+			log.Printf("[DEBUG] GoalMode: Waiting for user confirmation")
+			this.pendingCheckpoint = cmd
+		}
+		return "", ErrToolOutputPending
+	}
+
+	userInput := func(ctx context.Context, call *util.ToolCall) (string, error) {
+		if this.ActiveToolCall != nil {
+			return "", errors.New("Only one tool call can wait on the user at a time, call it again once the other call has finished.")
+		}
+		question, err := parseUserInputParams(call.Function.Parameters)
+		if err != nil {
+			return "", fmt.Errorf("Error parsing your json, try again: %s", err)
 		}
 
-	case "user_input":
-		log.Printf("[DEBUG] GoalMode: Requesting user input")
+		log.Printf("[DEBUG] GoalMode: Asking user: %s", question)
+		this.ActiveToolCall = call
 		this.GoalModeBuffer = ""
 		this.PromptSuffixCounter = -999999
 		this.setState(stateNormal)
-		question, err := parseUserInputParams(output.FunctionParameters)
+		fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s\n", this.Color.Answer, question, this.Color.Command)
+		return "", ErrToolOutputPending
+	}
+
+	plan := func(ctx context.Context, call *util.ToolCall) (string, error) {
+		plan, err := parsePlanParams(call.Function.Parameters)
 		if err != nil {
-			log.Printf("[DEBUG] GoalMode: Error parsing user input: %v", err)
-			modelStr := fmt.Sprintf("Error parsing your json, try again: %s", err)
-			this.GoalModeFunctionResponse(modelStr)
-			return
+			return "", fmt.Errorf("Error parsing your json, try again: %s", err)
 		}
-		log.Printf("[DEBUG] GoalMode: Asking user: %s", question)
-		fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s\n", this.Color.Answer, question, this.Color.Command)
 
-	case "finish":
-		log.Printf("[DEBUG] GoalMode: Finishing goal mode")
-		this.GoalModeBuffer = ""
-		this.setState(stateNormal)
-		success, err := parseFinishParams(output.FunctionParameters)
+		// a plan with different steps is a revision, otherwise just progress
+		if last := this.GoalModePlan; last != nil {
+			plan.Revisions = last.Revisions
+			if !plan.sameSteps(last) {
+				plan.Revisions++
+			}
+		}
+		this.GoalModePlan = plan
+		log.Printf("[DEBUG] GoalMode: Plan, %s:\n%s", plan.Progress(), plan.String())
+
+		writer := util.NewReplaceWriter(this.ParentOut, "\n", "\r\n")
+		fmt.Fprintf(writer, "\r%s", ESC_CLEAR)
+		FprintLoggingBox(writer, plan.Box())
+		fmt.Fprintf(writer, "%s", this.Color.Command)
+		return fmt.Sprintf("The plan is saved, %s.", plan.Progress()), nil
+	}
+
+	finish := func(ctx context.Context, call *util.ToolCall) (string, error) {
+		success, err := parseFinishParams(call.Function.Parameters)
 		if err != nil {
-			log.Printf("[DEBUG] GoalMode: Error parsing finish params: %v", err)
-			modelStr := fmt.Sprintf("Error parsing your json, try again: %s", err)
-			this.History.AppendFunctionOutput(output.FunctionName, modelStr)
-			this.GoalModeFunctionResponse(modelStr)
-			return
+			return "", fmt.Errorf("Error parsing your json, try again: %s", err)
 		}
 
 		result := "SUCCESS"
@@ -1440,29 +2132,73 @@ func (this *ShellState) GoalModeFunction(output *util.CompletionResponse) {
 			result = "FAILURE"
 			log.Printf("[DEBUG] GoalMode: Finished with failure")
 		} else {
-			log.Printf("[DEBUG] GoalMode: Finished successfully") 
+			log.Printf("[DEBUG] GoalMode: Finished successfully")
 		}
 
+		this.GoalModeBuffer = ""
+		this.setState(stateNormal)
 		fmt.Fprintf(this.PromptGoalAnswerWriter, "%sExited goal mode with %s.%s\n", this.Color.Answer, result, this.Color.Command)
 		this.GoalMode = false
+		this.ReviewSandbox()
+		return fmt.Sprintf("Exited goal mode with %s.", result), nil
+	}
 
-	case "":
-		log.Printf("[DEBUG] GoalMode: Error - no function called")
-		modelStr := fmt.Sprintf("You must call a function in goal mode responses.")
-		this.History.Append(historyTypePrompt, modelStr)
-		this.GoalModeFunctionResponse("")
+	return NewAgentToolRegistry(
+		&AgentTool{Definition: goalModeToolDefinitions[0], Handler: command},
+		&AgentTool{Definition: goalModeToolDefinitions[1], Handler: userInput},
+		&AgentTool{Definition: goalModeToolDefinitions[2], Handler: finish},
+		&AgentTool{Definition: goalModeToolDefinitions[3], Handler: plan},
+	)
+}
 
-	default:
-		log.Printf("[DEBUG] GoalMode: Error - invalid function: %s", output.FunctionName)
-		modelStr := fmt.Sprintf("Invalid function name: %s", output.FunctionName)
-		this.GoalModeFunctionResponse(modelStr)
+// Handle a goal mode response by running the tools it calls. Models without
+// tool support answer with JSON instead, see goalModeJSONProtocol.
+func (this *ShellState) GoalModeToolCalls(output *util.CompletionResponse) {
+	calls := output.ToolCalls
+	if !this.goalModeUsesTools() {
+		call, err := parseGoalModeJSON(output.Completion)
+		if err != nil {
+			log.Printf("[DEBUG] GoalMode: Error parsing JSON response: %v", err)
+			this.History.Append(historyTypePrompt, fmt.Sprintf(
+				"Your response must be only a JSON object matching the schema, it failed validation: %s", err))
+			this.goalModePrompt("")
+			return
+		}
+		calls = []*util.ToolCall{call}
+	}
+
+	if len(calls) == 0 {
+		log.Printf("[DEBUG] GoalMode: Error - no tool called")
+		this.History.Append(historyTypePrompt, "You must call a tool in goal mode responses.")
+		this.goalModePrompt("")
+		return
+	}
+
+	for _, call := range calls {
+		log.Printf("[DEBUG] GoalMode: Calling tool %s", call.Function.Name)
+	}
+
+	blocks := this.GoalModeAgent.RunToolCalls(this.Butterfish.Ctx, calls)
+	for _, block := range blocks {
+		if block.ToolCallId != "" {
+			this.History.AppendToolOutput(block.ToolCallId, block.Content)
+		} else {
+			this.History.Append(historyTypePrompt, block.Content)
+		}
+	}
+
+	// if nothing is waiting on the shell then the model gets the output now
+	if this.GoalMode && this.ActiveToolCall == nil {
+		this.goalModePrompt("")
 	}
 }
 
-var goalModeFunctions = []util.FunctionDefinition{
+var goalModeToolDefinitions = []util.ToolDefinition{
 	{
-		Name:        "command",
-		Description: "Run a command in the shell to help achieve your goal",
+		Type: "function",
+		Function: util.FunctionDefinition{
+			Name:        "command",
+			Description: "Run a command in the shell to help achieve your goal",
 			Parameters: jsonschema.Definition{
 				Type: jsonschema.Object,
 				Properties: map[string]jsonschema.Definition{
@@ -1473,56 +2209,152 @@ var goalModeFunctions = []util.FunctionDefinition{
 				},
 				Required: []string{"cmd"},
 			},
+		},
 	},
 
 	{
-		Name:        "user_input",
-		Description: "Resolve an ambiguity in the goal or provide additional information or hand off a goal that can't be accomplished to the user.",
-		Parameters: jsonschema.Definition{
-			Type: jsonschema.Object,
-			Properties: map[string]jsonschema.Definition{
-				"question": {
-					Type:        jsonschema.String,
-					Description: "The question to ask the user",
+		Type: "function",
+		Function: util.FunctionDefinition{
+			Name:        "user_input",
+			Description: "Resolve an ambiguity in the goal or provide additional information or hand off a goal that can't be accomplished to the user.",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"question": {
+						Type:        jsonschema.String,
+						Description: "The question to ask the user",
+					},
 				},
+				Required: []string{"question"},
 			},
-			Required: []string{"question"},
 		},
 	},
 
 	{
-		Name:        "finish",
-		Description: "Finish the goal and exit goal mode, call only if the goal is accomplished or multiple strategies have been attempted and the goal is impossible.",
-		Parameters: jsonschema.Definition{
-			Type: jsonschema.Object,
-			Properties: map[string]jsonschema.Definition{
-				"success": {
-					Type:        jsonschema.Boolean,
-					Description: "Whether the goal was accomplished",
+		Type: "function",
+		Function: util.FunctionDefinition{
+			Name:        "finish",
+			Description: "Finish the goal and exit goal mode, call only if the goal is accomplished or multiple strategies have been attempted and the goal is impossible.",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"success": {
+						Type:        jsonschema.Boolean,
+						Description: "Whether the goal was accomplished",
+					},
 				},
+				Required: []string{"success"},
+			},
+		},
+	},
+
+	{
+		Type: "function",
+		Function: util.FunctionDefinition{
+			Name:        "plan",
+			Description: "Set the numbered steps you'll take to achieve the goal. Call it before running commands, then again with the whole plan whenever a step's status changes or the plan needs revising.",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"steps": {
+						Type:        jsonschema.Array,
+						Description: "The steps in order",
+						Items: &jsonschema.Definition{
+							Type: jsonschema.Object,
+							Properties: map[string]jsonschema.Definition{
+								"description": {
+									Type:        jsonschema.String,
+									Description: "What the step does",
+								},
+								"status": {
+									Type:        jsonschema.String,
+									Enum:        planStepStatusNames,
+									Description: "The step's status, pending if it hasn't been started",
+								},
+							},
+							Required: []string{"description", "status"},
+						},
+					},
+				},
+				Required: []string{"steps"},
 			},
-			Required: []string{"success"},
 		},
 	},
 }
 
-var goalModeFunctionsString string
+// Models that can't call tools get the tools described in the system message
+// and must answer with a JSON object naming one, which is also sent as the
+// response schema for providers that can enforce it.
+const goalModeJSONProtocol = `
+You can't call tools directly. Instead your whole response must be a single JSON object, with no other text, of the form:
+{"reasoning": "<why you're calling the tool>", "tool": "<tool name>", "arguments": {<tool arguments>}}
+These are the tools you can call:
+%s`
+
+var goalModeJSONSchema = json.RawMessage(`{
+  "type": "object",
+  "properties": {
+    "reasoning": {"type": "string"},
+    "tool": {"enum": ["command", "user_input", "finish", "plan"]},
+    "arguments": {"type": "object"}
+  },
+  "required": ["tool", "arguments"],
+  "additionalProperties": false
+}`)
+
+type goalModeJSONResponse struct {
+	Reasoning string          `json:"reasoning"`
+	Tool      string          `json:"tool"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// Turn a JSON protocol response into a tool call, it has no id since there's
+// no tool call in the request history to pair output with.
+func parseGoalModeJSON(completion string) (*util.ToolCall, error) {
+	completion = cleanJSONResponse(completion)
+	err := ValidateJSONSchema(goalModeJSONSchema, []byte(completion))
+	if err != nil {
+		return nil, err
+	}
 
-// serialize goalModeFunctions to json and cache in goalModeFunctionsString
-func getGoalModeFunctionsString() string {
-	if goalModeFunctionsString == "" {
-		bytes, err := json.Marshal(goalModeFunctions)
-		if err != nil {
-			log.Fatal(err)
-		}
-		goalModeFunctionsString = string(bytes)
-		log.Printf("goalModeFunctionsString: %s", goalModeFunctionsString)
+	var response goalModeJSONResponse
+	err = json.Unmarshal([]byte(completion), &response)
+	if err != nil {
+		return nil, err
 	}
-	return goalModeFunctionsString
+
+	return &util.ToolCall{
+		Type: "function",
+		Function: util.FunctionCall{
+			Name:       response.Tool,
+			Parameters: string(response.Arguments),
+		},
+	}, nil
+}
+
+func (this *ShellState) goalModeUsesTools() bool {
+	_, info := Models().Lookup(this.Butterfish.Config.ShellPromptModel)
+	return info.SupportsTools()
 }
 
 func (this *ShellState) goalModePrompt(lastPrompt string) {
 	log.Printf("[DEBUG] GoalMode: Processing prompt: %s", lastPrompt)
+
+	// refuse further turns once over budget, this stops a runaway goal loop
+	if err := this.Butterfish.Budget.Check(FeatureGoalMode); err != nil {
+		log.Printf("[DEBUG] GoalMode: Over budget: %s", err)
+		fmt.Fprintf(this.PromptGoalAnswerWriter, "%s%s\nExited goal mode.%s\n", this.Color.Error, err, this.Color.Command)
+		this.GoalModeExit()
+		this.setState(stateNormal)
+		return
+	}
+
+	// each prompt is a step of the agent, stop once it's over its limits
+	if err := this.goalModeLimits(); err != nil {
+		this.History.Append(historyTypePrompt, this.GoalModeAbort(err))
+		return
+	}
+
 	this.setState(statePromptResponse)
 	requestCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	this.PromptResponseCancel = cancel
@@ -1539,8 +2371,27 @@ func (this *ShellState) goalModePrompt(lastPrompt string) {
 		return
 	}
 
+	tools := this.GoalModeAgent.Tools.Definitions()
+	toolsJson, err := json.Marshal(tools)
+	if err != nil {
+		this.PrintError(err)
+		return
+	}
+
+	// the plan goes in every request in case its call is out of the history
+	if this.GoalModePlan != nil {
+		sysMsg += fmt.Sprintf("\nYour current plan, %s:\n%s", this.GoalModePlan.Progress(), this.GoalModePlan.String())
+	}
+
+	var responseSchema json.RawMessage
+	if !this.goalModeUsesTools() {
+		sysMsg += fmt.Sprintf(goalModeJSONProtocol, toolsJson)
+		responseSchema = goalModeJSONSchema
+		tools = nil
+	}
+
 	tokensForAnswer := 1024
-	lastPrompt, historyBlocks, err := this.AssembleChat(lastPrompt, sysMsg, getGoalModeFunctionsString(), tokensForAnswer)
+	lastPrompt, historyBlocks, err := this.AssembleChat(lastPrompt, sysMsg, string(toolsJson), tokensForAnswer)
 	if err != nil {
 		log.Printf("[DEBUG] GoalMode: Error assembling chat: %v", err)
 		this.PrintError(err)
@@ -1549,15 +2400,18 @@ func (this *ShellState) goalModePrompt(lastPrompt string) {
 
 	log.Printf("[DEBUG] GoalMode: Sending request to LLM with prompt: %s", lastPrompt)
 	request := &util.CompletionRequest{
-		Ctx:           requestCtx,
-		Prompt:        lastPrompt,
-		Model:         this.Butterfish.Config.ShellPromptModel,
-		MaxTokens:     tokensForAnswer,
-		Temperature:   0.6,
-		HistoryBlocks: historyBlocks,
-		SystemMessage: sysMsg,
-		Functions:     goalModeFunctions,
-		Verbose:       this.Butterfish.Config.Verbose > 0,
+		Ctx:            requestCtx,
+		Prompt:         lastPrompt,
+		Model:          this.Butterfish.Config.ShellPromptModel,
+		ModelRole:      ModelRolePrompt,
+		Feature:        FeatureGoalMode,
+		MaxTokens:      tokensForAnswer,
+		Temperature:    0.6,
+		HistoryBlocks:  historyBlocks,
+		SystemMessage:  sysMsg,
+		Tools:          tools,
+		ResponseSchema: responseSchema,
+		Verbose:        this.Butterfish.Config.Verbose > 0,
 	}
 
 	// we run this in a goroutine so that we can still receive input
@@ -1571,6 +2425,12 @@ func (this *ShellState) HandleLocalPrompt() bool {
 	promptStr := strings.ToLower(this.Prompt.String())
 	promptStr = strings.TrimSpace(promptStr)
 
+	// only while there are checkpoints, otherwise "undo" is a prompt
+	if n, ok := parseRewind(promptStr); ok && this.Checkpoints != nil && this.Checkpoints.Len() > 0 {
+		this.Rewind(n)
+		return true
+	}
+
 	switch promptStr {
 	case "status":
 		this.PrintStatus()
@@ -1578,6 +2438,12 @@ func (this *ShellState) HandleLocalPrompt() bool {
 		this.PrintHelp()
 	case "history":
 		this.PrintHistory()
+	case "apply", "discard":
+		// only while there are sandbox changes to review
+		if this.Sandbox == nil || this.GoalMode {
+			return false
+		}
+		this.FinishSandbox(promptStr == "apply")
 	default:
 		return false
 	}
@@ -1585,24 +2451,6 @@ func (this *ShellState) HandleLocalPrompt() bool {
 	return true
 }
 
-// Given an encoder, a string, and a maximum number of takens, we count the
-// number of tokens in the string and truncate to the max tokens if the would
-// exceed it. Returns the number of tokens, the truncated string, and a bool
-// indicating whether the string was truncated.
-func countAndTruncate(data string,
-	encoder *tiktoken.Tiktoken,
-	maxTokens int) (int, string, bool) {
-	tokens := encoder.Encode(data, nil, nil)
-	truncated := false
-	if len(tokens) >= maxTokens {
-		tokens = tokens[:maxTokens]
-		data = encoder.Decode(tokens)
-		truncated = true
-	}
-
-	return len(tokens), data, truncated
-}
-
 // Prepare to call assembleChat() based on the ShellState variables for
 // calculating token limits.
 func (this *ShellState) AssembleChat(prompt, sysMsg, functions string, reserveForAnswer int) (string, []util.HistoryBlock, error) {
@@ -1611,6 +2459,8 @@ func (this *ShellState) AssembleChat(prompt, sysMsg, functions string, reserveFo
 	maxPromptTokens := 512 // for the prompt specifically
 	// for each individual history block
 	maxHistoryBlockTokens := this.Butterfish.Config.ShellMaxHistoryBlockTokens
+	// No need to reserve more than the model can answer with
+	reserveForAnswer = MaxOutputForModel(this.Butterfish.Config.ShellPromptModel, reserveForAnswer)
 	// How much for the total request (prompt, history, sys msg)
 	maxCombinedPromptTokens := totalTokens - reserveForAnswer
 
@@ -1628,7 +2478,7 @@ func assembleChat(
 	functions string,
 	history *ShellHistory,
 	model string,
-	encoder *tiktoken.Tiktoken,
+	encoder Tokenizer,
 	maxPromptTokens int,
 	maxHistoryBlockTokens int,
 	maxTokens int,
@@ -1640,30 +2490,30 @@ func assembleChat(
 	usedTokens := 3
 
 	// account for prompt
-	numPromptTokens, prompt, truncated := countAndTruncate(prompt, encoder, maxPromptTokens)
+	numPromptTokens, prompt, truncated := encoder.Truncate(prompt, maxPromptTokens)
 	if truncated {
 		log.Printf("WARNING: truncated the prompt to %d tokens", numPromptTokens)
 	}
 	usedTokens += numPromptTokens
 
 	// account for system message
-	sysMsgTokens := encoder.Encode(sysMsg, nil, nil)
-	if len(sysMsgTokens) > 1028 {
+	sysMsgTokens := encoder.Count(sysMsg)
+	if sysMsgTokens > 1028 {
 		log.Printf("WARNING: the system message is very long, this may cause you to hit the token limit. Recommend you reduce the size in prompts.yaml")
 	}
 
-	usedTokens += usedTokens + len(sysMsgTokens)
+	usedTokens += usedTokens + sysMsgTokens
 	if usedTokens > maxTokens {
 		return "", nil, fmt.Errorf("System message too long, %d tokens, max is %d", usedTokens, maxTokens)
 	}
 
 	// account for functions
-	functionTokens := encoder.Encode(functions, nil, nil)
-	if len(functionTokens) > 1028 {
+	functionTokens := encoder.Count(functions)
+	if functionTokens > 1028 {
 		log.Printf("WARNING: the functions are very long and are taking up %d tokens. This may cause you to hit the token limit.", functionTokens)
 	}
 
-	usedTokens += usedTokens + len(functionTokens)
+	usedTokens += usedTokens + functionTokens
 	if usedTokens > maxTokens {
 		return "", nil, fmt.Errorf("System message plus functions too long, %d tokens, max is %d", usedTokens, maxTokens)
 	}
@@ -1688,9 +2538,62 @@ func assembleChat(
 // the maxHistoryBlockTokens number. Each block will start at a baseline of
 // tokensPerMessage number of tokens.
 // We return the history blocks and the number of tokens it uses.
+// APIs reject tool calls that aren't directly followed by their output, and
+// output without the call before it. That happens when the call is older than
+// the history we have room for, or when the shell exited while a call ran and
+// the session was resumed, so those calls and outputs are dropped.
+func pairToolCalls(blocks []util.HistoryBlock) []util.HistoryBlock {
+	paired := []util.HistoryBlock{}
+
+	for i := 0; i < len(blocks); i++ {
+		block := blocks[i]
+		if block.Type == historyTypeToolOutput {
+			// not directly after its call
+			continue
+		}
+		if len(block.ToolCalls) == 0 {
+			paired = append(paired, block)
+			continue
+		}
+
+		outputs := []util.HistoryBlock{}
+		answered := map[string]bool{}
+		for i+1 < len(blocks) && blocks[i+1].Type == historyTypeToolOutput {
+			i++
+			outputs = append(outputs, blocks[i])
+			answered[blocks[i].ToolCallId] = true
+		}
+
+		calls := []*util.ToolCall{}
+		called := map[string]bool{}
+		for _, call := range block.ToolCalls {
+			if answered[call.Id] {
+				calls = append(calls, call)
+				called[call.Id] = true
+			}
+		}
+		if len(calls) == 0 {
+			if block.Content == "" {
+				continue
+			}
+			calls = nil
+		}
+		block.ToolCalls = calls
+		paired = append(paired, block)
+
+		for _, output := range outputs {
+			if called[output.ToolCallId] {
+				paired = append(paired, output)
+			}
+		}
+	}
+
+	return paired
+}
+
 func getHistoryBlocksByTokens(
 	history *ShellHistory,
-	encoder *tiktoken.Tiktoken,
+	encoder Tokenizer,
 	maxHistoryBlockTokens,
 	maxTokens,
 	tokensPerMessage int,
@@ -1700,7 +2603,7 @@ func getHistoryBlocksByTokens(
 	usedTokens := 0
 
 	history.IterateBlocks(func(block *HistoryBuffer) bool {
-		if block.Content.Size() == 0 && block.FunctionName == "" {
+		if block.Content.Size() == 0 && len(block.ToolCalls) == 0 {
 			// empty block, skip
 			return true
 		}
@@ -1708,20 +2611,17 @@ func getHistoryBlocksByTokens(
 		roleString := ShellHistoryTypeToRole(block.Type)
 
 		// add tokens for role
-		msgTokens += len(encoder.Encode(roleString, nil, nil))
+		msgTokens += encoder.Count(roleString)
 
-		if block.FunctionName != "" {
-			// add tokens for function name
-			msgTokens += len(encoder.Encode(block.FunctionName, nil, nil))
-		}
-		if block.FunctionParams != "" {
-			// add tokens for function params
-			msgTokens += len(encoder.Encode(block.FunctionParams, nil, nil))
+		for _, toolCall := range block.ToolCalls {
+			// add tokens for tool call name and params
+			msgTokens += encoder.Count(toolCall.Function.Name)
+			msgTokens += encoder.Count(toolCall.Function.Parameters)
 		}
 
 		// check existing block tokenizations
 		contentLen := block.Content.Size()
-		content, contentTokens, ok := block.GetTokenization(encoder.EncoderName(), contentLen)
+		content, contentTokens, ok := block.GetTokenization(encoder.Name(), contentLen)
 
 		if !ok { // cache miss
 			contentStr := block.Content.String()
@@ -1731,15 +2631,22 @@ func getHistoryBlocksByTokens(
 				contentStr = contentStr[:ceiling]
 			}
 
-			// remove ANSI escape codes
-			historyContent := sanitizeTTYString(contentStr)
+			// remove ANSI escape codes and secrets
+			historyContent := history.Redactor.Redact(sanitizeTTYString(contentStr))
 			// encode and truncate
-			contentTokens, content, _ = countAndTruncate(historyContent, encoder, maxHistoryBlockTokens)
+			contentTokens, content, _ = encoder.Truncate(historyContent, maxHistoryBlockTokens)
 			// save truncated string
-			block.SetTokenization(encoder.EncoderName(), contentLen, contentTokens, content)
+			block.SetTokenization(encoder.Name(), contentLen, contentTokens, content)
 		}
 		msgTokens += contentTokens
 
+		// finished commands are followed by their exit code, duration and
+		// where they ran, this isn't cached since it's set after the input
+		if summary := block.CommandSummary(); summary != "" {
+			content += " " + summary
+			msgTokens += encoder.Count(" " + summary)
+		}
+
 		if usedTokens+msgTokens > maxTokens {
 			// we're done adding blocks
 			return false
@@ -1747,10 +2654,10 @@ func getHistoryBlocksByTokens(
 
 		usedTokens += msgTokens
 		newBlock := util.HistoryBlock{
-			Type:           block.Type,
-			Content:        content,
-			FunctionName:   block.FunctionName,
-			FunctionParams: block.FunctionParams,
+			Type:       block.Type,
+			Content:    content,
+			ToolCalls:  block.ToolCalls,
+			ToolCallId: block.ToolCallId,
 		}
 
 		// we prepend the block so that the history is in the correct order
@@ -1758,7 +2665,7 @@ func getHistoryBlocksByTokens(
 		return true
 	})
 
-	return blocks, usedTokens
+	return pairToolCalls(blocks), usedTokens
 }
 
 func (this *ShellState) SendPrompt() {
@@ -1787,6 +2694,8 @@ func (this *ShellState) SendPrompt() {
 		Ctx:           requestCtx,
 		Prompt:        prompt,
 		Model:         this.Butterfish.Config.ShellPromptModel,
+		ModelRole:     ModelRolePrompt,
+		Feature:       FeatureShellPrompt,
 		MaxTokens:     tokensReservedForAnswer,
 		Temperature:   0.7,
 		HistoryBlocks: historyBlocks,
@@ -1989,15 +2898,16 @@ func (this *ShellState) ClearAutosuggest(colorStr string) {
 	this.AutosuggestBuffer = nil
 }
 
-func (this *ShellState) getAutosuggestEncoder() *tiktoken.Tiktoken {
+func (this *ShellState) getAutosuggestEncoder() Tokenizer {
 	if this.AutosuggestEncoder == nil {
 		modelName := this.Butterfish.Config.ShellAutosuggestModel
-		encoder, err := tiktoken.EncodingForModel(modelName)
+		encoder, err := TokenizerForModel(modelName)
 		if err != nil {
-			log.Printf("Warning: Error getting encoder for autosuggest model %s: %s", modelName, err)
-			encoder, err = tiktoken.EncodingForModel(DEFAULT_AUTOSUGGEST_ENCODER)
+			log.Printf("Warning: Error getting tokenizer for autosuggest model %s: %s", modelName, err)
+			encoder, err = TokenizerForModel(DEFAULT_AUTOSUGGEST_ENCODER)
 			if err != nil {
-				panic(fmt.Sprintf("Error getting encoder for fallback autosuggest model %s: %s", modelName, err))
+				log.Printf("Warning: Error getting tokenizer for fallback autosuggest model %s, estimating tokens instead: %s", DEFAULT_AUTOSUGGEST_ENCODER, err)
+				encoder = NewEstimateTokenizer(TokenizerLlama)
 			}
 		}
 
@@ -2007,15 +2917,16 @@ func (this *ShellState) getAutosuggestEncoder() *tiktoken.Tiktoken {
 	return this.AutosuggestEncoder
 }
 
-func (this *ShellState) getPromptEncoder() *tiktoken.Tiktoken {
+func (this *ShellState) getPromptEncoder() Tokenizer {
 	if this.PromptEncoder == nil {
 		modelName := this.Butterfish.Config.ShellPromptModel
-		encoder, err := tiktoken.EncodingForModel(modelName)
+		encoder, err := TokenizerForModel(modelName)
 		if err != nil {
-			log.Printf("Warning: Error getting encoder for prompt model %s: %s", modelName, err)
-			encoder, err = tiktoken.EncodingForModel(DEFAULT_PROMPT_ENCODER)
+			log.Printf("Warning: Error getting tokenizer for prompt model %s: %s", modelName, err)
+			encoder, err = TokenizerForModel(DEFAULT_PROMPT_ENCODER)
 			if err != nil {
-				panic(fmt.Sprintf("Error getting encoder for fallback prompt model %s: %s", modelName, err))
+				log.Printf("Warning: Error getting tokenizer for fallback prompt model %s, estimating tokens instead: %s", DEFAULT_PROMPT_ENCODER, err)
+				encoder = NewEstimateTokenizer(TokenizerLlama)
 			}
 		}
 
@@ -2031,6 +2942,14 @@ func (this *ShellState) RequestAutosuggest(delay time.Duration, command string)
 		return
 	}
 
+	// stop suggesting once the autosuggest budget is used up
+	if err := this.Butterfish.Budget.Check(FeatureAutosuggest); err != nil {
+		if this.Butterfish.Config.Verbose > 1 {
+			log.Printf("Skipping autosuggest: %s", err)
+		}
+		return
+	}
+
 	if this.AutosuggestCancel != nil {
 		// clear out a previous request
 		this.AutosuggestCancel()
@@ -2068,6 +2987,7 @@ func (this *ShellState) RequestAutosuggest(delay time.Duration, command string)
 		suggestPrompt,
 		this.Butterfish.LLMClient,
 		this.Butterfish.Config.ShellAutosuggestModel,
+		this.Butterfish.Config.ShellAutosuggestTemperature,
 		this.Butterfish.Config.Verbose > 1,
 		this.History,
 		this.Butterfish.Config.ShellMaxHistoryBlockTokens,
@@ -2085,11 +3005,12 @@ func RequestCancelableAutosuggest(
 	rawPrompt string,
 	llmClient LLM,
 	model string,
+	temperature float32,
 	verbose bool,
 	history *ShellHistory,
 	maxHistoryBlockTokens int,
 	autosuggestChan chan<- *AutosuggestResult,
-	encoder *tiktoken.Tiktoken,
+	encoder Tokenizer,
 ) {
 
 	if delay > 0 {
@@ -2127,8 +3048,10 @@ func RequestCancelableAutosuggest(
 		Ctx:         ctx,
 		Prompt:      prmpt,
 		Model:       model,
+		ModelRole:   ModelRoleAutosuggest,
+		Feature:     FeatureAutosuggest,
 		MaxTokens:   reserveForAnswer,
-		Temperature: 0.2,
+		Temperature: temperature,
 		Verbose:     verbose,
 		SystemMessage: rawPrompt, // Add system message
 	}
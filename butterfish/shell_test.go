@@ -0,0 +1,134 @@
+package butterfish
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/stretchr/testify/assert"
+)
+
+// A shell running in a pty with the butterfish prompt set, which collects
+// everything the shell prints
+type scriptedShell struct {
+	t      *testing.T
+	ptmx   *os.File
+	mutex  sync.Mutex
+	output strings.Builder
+}
+
+func startScriptedShell(t *testing.T, shell string, args ...string) *scriptedShell {
+	path, err := exec.LookPath(shell)
+	if err != nil {
+		t.Skipf("%s isn't installed", shell)
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), "TERM=xterm", "HOME="+t.TempDir())
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ptmx.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	this := &scriptedShell{t: t, ptmx: ptmx}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := ptmx.Read(buf)
+			if err != nil {
+				return
+			}
+			this.mutex.Lock()
+			this.output.Write(buf[:n])
+			this.mutex.Unlock()
+		}
+	}()
+
+	ctx := &ButterfishCtx{Config: &ButterfishConfig{ShellBinary: path}}
+	ctx.SetPS1(ptmx)
+	return this
+}
+
+// Wait for the shell to have printed the given number of butterfish
+// prompts, returns the last exit status and the working directory
+func (this *scriptedShell) waitForPrompts(prompts int) (int, string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		this.mutex.Lock()
+		output := this.output.String()
+		this.mutex.Unlock()
+
+		status, seen, _ := ParsePS1(output, ps1FullRegex, EMOJI_DEFAULT)
+		if seen >= prompts {
+			return status, ParseOSC7Cwd(output)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	this.t.Fatalf("Timed out waiting for %d prompts, output: %q", prompts, this.output.String())
+	return 0, ""
+}
+
+func (this *scriptedShell) run(command string) {
+	this.ptmx.Write([]byte(command + "\n"))
+}
+
+func TestShellPrompts(t *testing.T) {
+	shells := map[string][]string{
+		"bash": {"--norc", "--noprofile"},
+		"zsh":  {"-f"},
+		"fish": {"--no-config"},
+	}
+
+	for shell, args := range shells {
+		t.Run(shell, func(t *testing.T) {
+			sh := startScriptedShell(t, shell, args...)
+			dir, err := filepath.EvalSymlinks(t.TempDir())
+			assert.NoError(t, err)
+
+			// the first prompt is the one after setting the PS1
+			sh.waitForPrompts(1)
+
+			sh.run("true")
+			status, _ := sh.waitForPrompts(2)
+			assert.Equal(t, 0, status)
+
+			sh.run("false")
+			status, _ = sh.waitForPrompts(3)
+			assert.Equal(t, 1, status)
+
+			sh.run("cd " + dir)
+			status, cwd := sh.waitForPrompts(4)
+			assert.Equal(t, 0, status)
+			assert.Equal(t, dir, cwd)
+
+			sh.run("sh -c 'exit 3'")
+			status, _ = sh.waitForPrompts(5)
+			assert.Equal(t, 3, status)
+		})
+	}
+}
+
+func TestParsePS1Fish(t *testing.T) {
+	// fish sends the status in an escape sequence rather than as text
+	data := PROMPT_PREFIX + "\x1b]7;file:///tmp\x07~> " + EMOJI_DEFAULT + "\x1b]133;D;127\x07" + PROMPT_SUFFIX + " "
+	status, prompts, cleaned := ParsePS1(data, ps1FullRegex, EMOJI_GOAL)
+	assert.Equal(t, 127, status)
+	assert.Equal(t, 1, prompts)
+	assert.Equal(t, "~> "+EMOJI_GOAL+" ", cleaned)
+
+	data = "\x1b]133;D;2\x07" + PROMPT_SUFFIX
+	status, prompts, _ = ParsePS1(data, ps1Regex, "")
+	assert.Equal(t, 2, status)
+	assert.Equal(t, 1, prompts)
+}
@@ -0,0 +1,294 @@
+package butterfish
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bakks/tiktoken-go"
+	"github.com/mitchellh/go-homedir"
+)
+
+// Token counting for sizing prompts. OpenAI models use their tiktoken
+// encoding. Other providers don't publish a tokenizer we can run locally, so
+// by default they get an estimator calibrated for the model family, with a
+// margin so we err on the side of sending less. For local models the
+// registry's tokenizer can instead point at the model's tokenizer.json.
+
+type Tokenizer interface {
+	// Identifies the tokenizer, cached tokenizations are keyed by this
+	Name() string
+	// Count the tokens in a string
+	Count(data string) int
+	// Count the tokens in a string and truncate it to maxTokens if it would
+	// exceed it. Returns the number of tokens, the truncated string, and
+	// whether it was truncated.
+	Truncate(data string, maxTokens int) (int, string, bool)
+}
+
+// Estimator families, these can be used as the tokenizer in the registry
+const (
+	TokenizerClaude = "claude"
+	TokenizerGemini = "gemini"
+	TokenizerLlama  = "llama"
+)
+
+// Average characters per token of English text and code
+var estimatorCharsPerToken = map[string]float64{
+	TokenizerClaude: 3.5,
+	TokenizerGemini: 4.0,
+	TokenizerLlama:  3.8,
+}
+
+// Estimates overcount by this fraction to make up for text that tokenizes
+// worse than average, e.g. shell output with lots of punctuation
+const estimatorMargin = 0.15
+
+type tiktokenTokenizer struct {
+	encoder *tiktoken.Tiktoken
+}
+
+func (this *tiktokenTokenizer) Name() string {
+	return this.encoder.EncoderName()
+}
+
+func (this *tiktokenTokenizer) Count(data string) int {
+	return len(this.encoder.Encode(data, nil, nil))
+}
+
+func (this *tiktokenTokenizer) Truncate(data string, maxTokens int) (int, string, bool) {
+	tokens := this.encoder.Encode(data, nil, nil)
+	truncated := false
+	if len(tokens) >= maxTokens {
+		tokens = tokens[:maxTokens]
+		data = this.encoder.Decode(tokens)
+		truncated = true
+	}
+
+	return len(tokens), data, truncated
+}
+
+// Estimates tokens from character counts. ASCII characters cost a fraction
+// of a token, anything else is counted as a whole token since non-latin
+// scripts tokenize much worse.
+type estimateTokenizer struct {
+	family        string
+	charsPerToken float64
+}
+
+func NewEstimateTokenizer(family string) Tokenizer {
+	charsPerToken, ok := estimatorCharsPerToken[family]
+	if !ok {
+		charsPerToken = estimatorCharsPerToken[TokenizerLlama]
+	}
+	return &estimateTokenizer{
+		family:        family,
+		charsPerToken: charsPerToken,
+	}
+}
+
+func (this *estimateTokenizer) Name() string {
+	return "estimate:" + this.family
+}
+
+func (this *estimateTokenizer) cost(r rune) float64 {
+	if r < utf8.RuneSelf {
+		return (1 + estimatorMargin) / this.charsPerToken
+	}
+	return 1 + estimatorMargin
+}
+
+func (this *estimateTokenizer) Count(data string) int {
+	total := 0.0
+	for _, r := range data {
+		total += this.cost(r)
+	}
+	return int(math.Ceil(total))
+}
+
+func (this *estimateTokenizer) Truncate(data string, maxTokens int) (int, string, bool) {
+	total := 0.0
+	for i, r := range data {
+		next := total + this.cost(r)
+		if next > float64(maxTokens) {
+			return int(math.Ceil(total)), data[:i], true
+		}
+		total = next
+	}
+	return int(math.Ceil(total)), data, false
+}
+
+// Counts tokens with the vocabulary of a Hugging Face tokenizer.json, by
+// greedily matching the longest known piece. This isn't exactly what BPE or
+// sentencepiece would do but it's close, and errs towards more tokens.
+// Characters not in the vocabulary count a token per byte, as with byte
+// fallback.
+type vocabTokenizer struct {
+	path  string
+	vocab map[string]bool
+	// longest piece in runes
+	maxPiece int
+	// how the vocabulary writes a space, ▁ for sentencepiece, Ġ for
+	// byte-level BPE
+	space rune
+	// sentencepiece models add a space to the start of the text
+	prefixSpace bool
+}
+
+type tokenizerFile struct {
+	Model struct {
+		Type  string          `json:"type"`
+		Vocab json.RawMessage `json:"vocab"`
+	} `json:"model"`
+}
+
+func LoadVocabTokenizer(path string) (Tokenizer, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file tokenizerFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing tokenizer %s: %s", path, err)
+	}
+
+	pieces := []string{}
+	var bpeVocab map[string]int
+	var unigramVocab [][]interface{}
+	if err := json.Unmarshal(file.Model.Vocab, &bpeVocab); err == nil {
+		for piece := range bpeVocab {
+			pieces = append(pieces, piece)
+		}
+	} else if err := json.Unmarshal(file.Model.Vocab, &unigramVocab); err == nil {
+		for _, entry := range unigramVocab {
+			if len(entry) > 0 {
+				if piece, ok := entry[0].(string); ok {
+					pieces = append(pieces, piece)
+				}
+			}
+		}
+	}
+	if len(pieces) == 0 {
+		return nil, fmt.Errorf("Tokenizer %s has no vocabulary", path)
+	}
+
+	tokenizer := &vocabTokenizer{
+		path:  path,
+		vocab: make(map[string]bool, len(pieces)),
+		space: ' ',
+	}
+	for _, piece := range pieces {
+		tokenizer.vocab[piece] = true
+		if n := utf8.RuneCountInString(piece); n > tokenizer.maxPiece {
+			tokenizer.maxPiece = n
+		}
+		if strings.HasPrefix(piece, "▁") {
+			tokenizer.space = '▁'
+		} else if strings.HasPrefix(piece, "Ġ") && tokenizer.space != '▁' {
+			tokenizer.space = 'Ġ'
+		}
+	}
+	tokenizer.prefixSpace = tokenizer.space == '▁'
+
+	return tokenizer, nil
+}
+
+func (this *vocabTokenizer) Name() string {
+	return "file:" + this.path
+}
+
+func (this *vocabTokenizer) Count(data string) int {
+	count, _, _ := this.Truncate(data, math.MaxInt)
+	return count
+}
+
+func (this *vocabTokenizer) Truncate(data string, maxTokens int) (int, string, bool) {
+	runes := []rune(data)
+	text := make([]rune, 0, len(runes)+1)
+	offset := 0
+	if this.prefixSpace {
+		text = append(text, this.space)
+		offset = 1
+	}
+	for _, r := range runes {
+		if r == ' ' {
+			r = this.space
+		}
+		text = append(text, r)
+	}
+
+	count := 0
+	for i := 0; i < len(text); {
+		length := 1
+		cost := utf8.RuneLen(text[i])
+		for j := min(len(text), i+this.maxPiece); j > i; j-- {
+			if this.vocab[string(text[i:j])] {
+				length = j - i
+				cost = 1
+				break
+			}
+		}
+
+		if count+cost > maxTokens {
+			end := max(i-offset, 0)
+			return count, string(runes[:end]), true
+		}
+		count += cost
+		i += length
+	}
+
+	return count, data, false
+}
+
+// Get the tokenizer for a model. The registry's tokenizer can be a tiktoken
+// encoding, an estimator family or the path of a tokenizer.json. Otherwise
+// models tiktoken knows use their encoding and anything else gets the llama
+// estimator.
+func TokenizerForModel(model string) (Tokenizer, error) {
+	_, info := Models().Lookup(model)
+
+	switch name := info.Tokenizer; {
+	case name == "":
+	case estimatorCharsPerToken[name] > 0:
+		return NewEstimateTokenizer(name), nil
+	case strings.HasSuffix(name, "_base"):
+		encoder, err := tiktoken.GetEncoding(name)
+		if err != nil {
+			return nil, err
+		}
+		return &tiktokenTokenizer{encoder}, nil
+	default:
+		return LoadVocabTokenizer(name)
+	}
+
+	if !isTiktokenModel(model) {
+		return NewEstimateTokenizer(TokenizerLlama), nil
+	}
+	encoder, err := tiktoken.EncodingForModel(model)
+	if err != nil {
+		return nil, err
+	}
+	return &tiktokenTokenizer{encoder}, nil
+}
+
+func isTiktokenModel(model string) bool {
+	if _, ok := tiktoken.MODEL_TO_ENCODING[model]; ok {
+		return true
+	}
+	for prefix := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package butterfish
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateTokenizer(t *testing.T) {
+	tokenizer := NewEstimateTokenizer(TokenizerClaude)
+	assert.Equal(t, "estimate:claude", tokenizer.Name())
+
+	// 35 ascii characters at 3.5 per token plus the margin
+	data := "abcdefghijklmnopqrstuvwxyz123456789"
+	assert.Equal(t, 12, tokenizer.Count(data))
+	// non-ascii characters are a token each
+	assert.Equal(t, 4, tokenizer.Count("日本語"))
+
+	count, truncated, ok := tokenizer.Truncate(data, 6)
+	assert.True(t, ok)
+	assert.LessOrEqual(t, count, 6)
+	assert.Equal(t, data[:len(truncated)], truncated)
+	assert.LessOrEqual(t, tokenizer.Count(truncated), 6)
+
+	count, truncated, ok = tokenizer.Truncate(data, 100)
+	assert.False(t, ok)
+	assert.Equal(t, 12, count)
+	assert.Equal(t, data, truncated)
+}
+
+func TestVocabTokenizer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokenizer.json")
+	err := os.WriteFile(path, []byte(`{"model":{"type":"Unigram","vocab":[
+		["▁hello",-1.0],["▁world",-1.0],["▁",-2.0],["lo",-3.0],["l",-4.0]]}}`), 0644)
+	assert.NoError(t, err)
+
+	tokenizer, err := LoadVocabTokenizer(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, tokenizer.Count("hello world"))
+	// ▁ l lo, then 2 bytes for é which isn't in the vocabulary
+	assert.Equal(t, 5, tokenizer.Count("lloé"))
+
+	count, truncated, ok := tokenizer.Truncate("hello world hello", 2)
+	assert.True(t, ok)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, "hello world", truncated)
+
+	// the registry can point a model at the file
+	SetModelRegistry(ModelRegistry{"llama3.1": {ContextWindow: 8192, Tokenizer: path}})
+	defer SetModelRegistry(DefaultModelRegistry)
+	tokenizer, err = TokenizerForModel("llama3.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "file:"+path, tokenizer.Name())
+}
+
+func TestTokenizerForModel(t *testing.T) {
+	tokenizer, err := TokenizerForModel("claude-3-5-sonnet-latest")
+	assert.NoError(t, err)
+	assert.Equal(t, "estimate:claude", tokenizer.Name())
+
+	tokenizer, err = TokenizerForModel("gemini-1.5-pro")
+	assert.NoError(t, err)
+	assert.Equal(t, "estimate:gemini", tokenizer.Name())
+
+	tokenizer, err = TokenizerForModel("qwen2.5:7b")
+	assert.NoError(t, err)
+	assert.Equal(t, "estimate:llama", tokenizer.Name())
+}
+
+func TestHistoryTokenizationPerTokenizer(t *testing.T) {
+	history := NewShellHistory()
+	history.Append(historyTypeShellOutput, "some output from a command")
+
+	claude := NewEstimateTokenizer(TokenizerClaude)
+	gemini := NewEstimateTokenizer(TokenizerGemini)
+	blocks, claudeTokens := getHistoryBlocksByTokens(history, claude, 512, 4096, 0)
+	assert.Equal(t, 1, len(blocks))
+	_, geminiTokens := getHistoryBlocksByTokens(history, gemini, 512, 4096, 0)
+	assert.Less(t, geminiTokens, claudeTokens)
+
+	block := history.Blocks[0]
+	assert.Contains(t, block.Tokenizations, "estimate:claude")
+	assert.Contains(t, block.Tokenizations, "estimate:gemini")
+}
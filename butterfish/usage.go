@@ -0,0 +1,579 @@
+package butterfish
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bakks/tiktoken-go"
+	"github.com/mitchellh/go-homedir"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+// Token usage and cost accounting. MeteredLLM wraps the LLM client and
+// appends a record for every call to a JSON lines ledger, by default
+// ~/.butterfish/usage.jsonl, which the usage command summarizes.
+
+// Features that usage is tagged with, set on each CompletionRequest. These
+// are finer grained than model roles, e.g. shell prompts and goal mode both
+// use the prompt model.
+const (
+	FeatureShellPrompt   = "shell_prompt"
+	FeatureGoalMode      = "goal_mode"
+	FeatureAutosuggest   = "autosuggest"
+	FeaturePrompt        = "prompt"
+	FeatureEdit          = "edit"
+	FeatureGencmd        = "gencmd"
+	FeatureExeccheck     = "execcheck"
+	FeatureSummarize     = "summarize"
+	FeatureImage         = "image"
+	FeatureIndexQuestion = "indexquestion"
+	FeatureEmbeddings    = "embeddings"
+)
+
+// Price per million tokens in USD
+type ModelPrice struct {
+	Input  float64 `yaml:"input"`
+	Output float64 `yaml:"output"`
+}
+
+type PriceTable map[string]ModelPrice
+
+// Default prices, these go out of date so they can be overridden (and
+// extended) with a prices.yaml file.
+var DefaultPrices = PriceTable{
+	"gpt-4o":                 {2.50, 10.00},
+	"gpt-4o-mini":            {0.15, 0.60},
+	"gpt-4-turbo":            {10.00, 30.00},
+	"gpt-4":                  {30.00, 60.00},
+	"gpt-3.5-turbo":          {0.50, 1.50},
+	"gpt-3.5-turbo-instruct": {1.50, 2.00},
+	"o1":                     {15.00, 60.00},
+	"o1-mini":                {3.00, 12.00},
+	"o3-mini":                {1.10, 4.40},
+	"text-embedding-ada-002": {0.10, 0},
+	"text-embedding-3-small": {0.02, 0},
+	"text-embedding-3-large": {0.13, 0},
+	"claude-3-5-sonnet":      {3.00, 15.00},
+	"claude-3-7-sonnet":      {3.00, 15.00},
+	"claude-3-5-haiku":       {0.80, 4.00},
+	"claude-3-opus":          {15.00, 75.00},
+	"claude-3-haiku":         {0.25, 1.25},
+	"gemini-1.5-pro":         {1.25, 5.00},
+	"gemini-1.5-flash":       {0.075, 0.30},
+	"gemini-2.0-flash":       {0.10, 0.40},
+	"text-embedding-004":     {0, 0},
+}
+
+// Load a price table from a yaml file of model names to input and output
+// prices per million tokens, merged over the defaults. A missing file just
+// gives the defaults.
+func LoadPriceTable(path string) (PriceTable, error) {
+	prices := PriceTable{}
+	for model, price := range DefaultPrices {
+		prices[model] = price
+	}
+
+	if path == "" {
+		return prices, nil
+	}
+
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return prices, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	overrides := PriceTable{}
+	err = yaml.UnmarshalStrict(data, &overrides)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", path, err)
+	}
+	for model, price := range overrides {
+		prices[model] = price
+	}
+
+	return prices, nil
+}
+
+// Find the price for a model, using the longest entry that prefixes the
+// model name so that dated versions (gpt-4o-2024-08-06) match their family.
+func (this PriceTable) Lookup(model string) (ModelPrice, bool) {
+	if i := strings.Index(model, "/"); i != -1 {
+		model = model[i+1:]
+	}
+
+	var best string
+	for name := range this {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return ModelPrice{}, false
+	}
+	return this[best], true
+}
+
+func (this PriceTable) Cost(model string, promptTokens, completionTokens int) float64 {
+	price, ok := this.Lookup(model)
+	if !ok {
+		return 0
+	}
+	return (float64(promptTokens)*price.Input + float64(completionTokens)*price.Output) / 1e6
+}
+
+type UsageRecord struct {
+	Time             time.Time `json:"time"`
+	Feature          string    `json:"feature"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Cost             float64   `json:"cost"`
+	// true if the API didn't report usage and we counted tokens ourselves
+	Estimated bool `json:"estimated,omitempty"`
+}
+
+type UsageLedger struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func NewUsageLedger(path string) (*UsageLedger, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UsageLedger{path: path}, nil
+}
+
+func (this *UsageLedger) Append(record UsageRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	file, err := os.OpenFile(this.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// Read all records since the given time, lines that don't parse are skipped.
+func (this *UsageLedger) Read(since time.Time) ([]UsageRecord, error) {
+	file, err := os.Open(this.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := []UsageRecord{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record UsageRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			continue
+		}
+		if record.Time.Before(since) {
+			continue
+		}
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+var usageEncoder *tiktoken.Tiktoken
+var usageEncoderOnce sync.Once
+
+// Count tokens locally for calls where the API doesn't report usage (e.g.
+// streaming legacy completions and embeddings). This uses the OpenAI
+// tokenizer regardless of model so it's an estimate for other providers.
+func estimateTokens(s string) int {
+	usageEncoderOnce.Do(func() {
+		encoder, err := tiktoken.EncodingForModel(DEFAULT_PROMPT_ENCODER)
+		if err != nil {
+			log.Printf("Warning: Error getting encoder for usage estimates: %s", err)
+			return
+		}
+		usageEncoder = encoder
+	})
+
+	if usageEncoder == nil {
+		return len(s) / 4
+	}
+	return len(usageEncoder.Encode(s, nil, nil))
+}
+
+func estimateRequestTokens(request *util.CompletionRequest) int {
+	tokens := estimateTokens(request.Prompt) + estimateTokens(request.SystemMessage)
+	for _, block := range request.HistoryBlocks {
+		tokens += estimateTokens(block.Content) + estimateTokens(block.FunctionParams)
+	}
+	return tokens
+}
+
+func estimateResponseTokens(response *util.CompletionResponse) int {
+	tokens := estimateTokens(response.Completion) + estimateTokens(response.FunctionParameters)
+	for _, toolCall := range response.ToolCalls {
+		tokens += estimateTokens(toolCall.Function.Parameters)
+	}
+	return tokens
+}
+
+// Name of the model a client uses for embeddings, the Embeddings call
+// doesn't take a model so we have to ask the client.
+func embeddingModelName(llm LLM) string {
+	switch client := llm.(type) {
+	case *GPT:
+		return client.EmbeddingModel
+	case *Gemini:
+		return client.EmbeddingModel
+	case *Ollama:
+		return client.EmbeddingModel
+	case *RoutedLLM:
+		return embeddingModelName(client.route(ModelRoleEmbeddings))
+	case *RateLimitedLLM:
+		return embeddingModelName(client.inner)
+	case *MeteredLLM:
+		return embeddingModelName(client.inner)
+	case *CachedLLM:
+		return embeddingModelName(client.inner)
+	case *CassetteLLM:
+		if client.inner != nil {
+			return embeddingModelName(client.inner)
+		}
+	case *FallbackLLM:
+		if len(client.Backends) > 0 {
+			return embeddingModelName(client.Backends[0].LLM)
+		}
+	}
+	return "unknown"
+}
+
+// An error from before a request reached the provider, e.g. waiting on the
+// rate limiter was cancelled, so nothing was billed.
+type requestNotSentError struct {
+	err error
+}
+
+func (this *requestNotSentError) Error() string { return this.err.Error() }
+func (this *requestNotSentError) Unwrap() error { return this.err }
+
+// Whether a failed call may still have been billed. Calls cancelled or timed
+// out mid-stream were, calls that never got a connection weren't.
+func requestWasSent(err error) bool {
+	var notSent *requestNotSentError
+	if errors.As(err, &notSent) {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return false
+	}
+	return true
+}
+
+type usageReportKey struct{}
+
+// What clients report through a sink in the context about a call they made.
+// The Embeddings call only returns vectors, so the usage the API gave them
+// comes this way, see MeteredLLM.Embeddings. The model is the one the client
+// actually called, which isn't the requested one when a fallback backend or
+// the client's default model replaced it.
+type usageReport struct {
+	util.Usage
+	Model string
+}
+
+// The model to price a call at, the reported one if there is one
+func (this *usageReport) model(requested string) string {
+	if this.Model != "" {
+		return this.Model
+	}
+	return requested
+}
+
+func withUsageReport(ctx context.Context) (context.Context, *usageReport) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	report := &usageReport{}
+	return context.WithValue(ctx, usageReportKey{}, report), report
+}
+
+func reportUsage(ctx context.Context, promptTokens, completionTokens int) {
+	if ctx == nil {
+		return
+	}
+	if report, ok := ctx.Value(usageReportKey{}).(*usageReport); ok {
+		report.PromptTokens += promptTokens
+		report.CompletionTokens += completionTokens
+	}
+}
+
+func reportModel(ctx context.Context, model string) {
+	if ctx == nil {
+		return
+	}
+	if report, ok := ctx.Value(usageReportKey{}).(*usageReport); ok {
+		report.Model = model
+	}
+}
+
+// MeteredLLM implements the LLM interface by passing calls through to inner
+// and recording the token usage of calls in the ledger, including calls that
+// failed or were cancelled after they were sent since those are still
+// billed. If a budget is set then calls for features that are over budget
+// are refused.
+type MeteredLLM struct {
+	inner  LLM
+	ledger *UsageLedger
+	prices PriceTable
+	budget *Budget
+}
+
+func NewMeteredLLM(inner LLM, ledger *UsageLedger, prices PriceTable, budget *Budget) *MeteredLLM {
+	return &MeteredLLM{
+		inner:  inner,
+		ledger: ledger,
+		prices: prices,
+		budget: budget,
+	}
+}
+
+func (this *MeteredLLM) record(feature, model string, promptTokens, completionTokens int, estimated bool) {
+	record := UsageRecord{
+		Time:             time.Now(),
+		Feature:          feature,
+		Model:            model,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		Cost:             this.prices.Cost(model, promptTokens, completionTokens),
+		Estimated:        estimated,
+	}
+	this.budget.Add(record)
+
+	err := this.ledger.Append(record)
+	if err != nil {
+		log.Printf("Error writing usage ledger: %s", err)
+	}
+}
+
+func requestFeature(request *util.CompletionRequest) string {
+	if request.Feature != "" {
+		return request.Feature
+	}
+	return request.ModelRole
+}
+
+func (this *MeteredLLM) recordCompletion(request *util.CompletionRequest, model string, response *util.CompletionResponse) {
+	feature := requestFeature(request)
+
+	if response.Usage != nil {
+		this.record(feature, model,
+			response.Usage.PromptTokens, response.Usage.CompletionTokens, false)
+		return
+	}
+
+	this.record(feature, model,
+		estimateRequestTokens(request), estimateResponseTokens(response), true)
+}
+
+// Record an estimate for a call that failed, using whatever was streamed
+// before it did as the completion.
+func (this *MeteredLLM) recordFailure(request *util.CompletionRequest, model string, response *util.CompletionResponse, output string, err error) {
+	if !requestWasSent(err) {
+		return
+	}
+
+	feature := requestFeature(request)
+	if response != nil && response.Usage != nil {
+		this.record(feature, model,
+			response.Usage.PromptTokens, response.Usage.CompletionTokens, false)
+		return
+	}
+
+	this.record(feature, model,
+		estimateRequestTokens(request), estimateTokens(output), true)
+}
+
+// A copy of the request whose context collects the client's report
+func (this *MeteredLLM) reportedRequest(request *util.CompletionRequest) (*util.CompletionRequest, *usageReport) {
+	ctx, report := withUsageReport(request.Ctx)
+	reported := *request
+	reported.Ctx = ctx
+	return &reported, report
+}
+
+func (this *MeteredLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	err := this.budget.Check(requestFeature(request))
+	if err != nil {
+		return nil, err
+	}
+
+	output := &strings.Builder{}
+	reported, report := this.reportedRequest(request)
+	response, err := this.inner.CompletionStream(reported, io.MultiWriter(writer, output))
+	model := report.model(request.Model)
+	if err == nil {
+		this.recordCompletion(request, model, response)
+	} else {
+		this.recordFailure(request, model, response, output.String(), err)
+	}
+	return response, err
+}
+
+func (this *MeteredLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	err := this.budget.Check(requestFeature(request))
+	if err != nil {
+		return nil, err
+	}
+
+	reported, report := this.reportedRequest(request)
+	response, err := this.inner.Completion(reported)
+	model := report.model(request.Model)
+	if err == nil {
+		this.recordCompletion(request, model, response)
+	} else {
+		this.recordFailure(request, model, response, "", err)
+	}
+	return response, err
+}
+
+func (this *MeteredLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	err := this.budget.Check(FeatureEmbeddings)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, report := withUsageReport(ctx)
+	embeddings, err := this.inner.Embeddings(ctx, input, verbose)
+	model := report.model(embeddingModelName(this.inner))
+
+	if report.PromptTokens > 0 {
+		this.record(FeatureEmbeddings, model, report.PromptTokens, 0, false)
+	} else if err == nil || requestWasSent(err) {
+		tokens := 0
+		for _, s := range input {
+			tokens += estimateTokens(s)
+		}
+		this.record(FeatureEmbeddings, model, tokens, 0, true)
+	}
+	return embeddings, err
+}
+
+type usageTotal struct {
+	Key              string
+	Calls            int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+}
+
+func totalUsageBy(records []UsageRecord, key func(UsageRecord) string) []*usageTotal {
+	totals := map[string]*usageTotal{}
+	for _, record := range records {
+		k := key(record)
+		total, ok := totals[k]
+		if !ok {
+			total = &usageTotal{Key: k}
+			totals[k] = total
+		}
+		total.Calls++
+		total.PromptTokens += record.PromptTokens
+		total.CompletionTokens += record.CompletionTokens
+		total.Cost += record.Cost
+	}
+
+	out := []*usageTotal{}
+	for _, total := range totals {
+		out = append(out, total)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+// Print usage totals by day, model and feature for records in the ledger
+// from the last number of days.
+func PrintUsageReport(writer io.Writer, ledgerPath string, days int) error {
+	ledger, err := NewUsageLedger(ledgerPath)
+	if err != nil {
+		return err
+	}
+
+	since := time.Now().AddDate(0, 0, -days)
+	records, err := ledger.Read(since)
+	if err != nil {
+		return err
+	}
+
+	if len(records) == 0 {
+		fmt.Fprintf(writer, "No usage recorded in the last %d days in %s\n", days, ledger.path)
+		return nil
+	}
+
+	sections := []struct {
+		title string
+		key   func(UsageRecord) string
+	}{
+		{"Day", func(r UsageRecord) string { return r.Time.Local().Format("2006-01-02") }},
+		{"Model", func(r UsageRecord) string { return r.Model }},
+		{"Feature", func(r UsageRecord) string { return r.Feature }},
+	}
+
+	for i, section := range sections {
+		if i > 0 {
+			fmt.Fprintln(writer)
+		}
+
+		tw := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "%s\tCalls\tPrompt tokens\tCompletion tokens\tCost\t\n", section.title)
+		for _, total := range totalUsageBy(records, section.key) {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t$%.4f\t\n", total.Key, total.Calls,
+				total.PromptTokens, total.CompletionTokens, total.Cost)
+		}
+		tw.Flush()
+	}
+
+	all := totalUsageBy(records, func(UsageRecord) string { return "" })[0]
+	fmt.Fprintf(writer, "\nTotal over the last %d days: %d calls, $%.4f\n", days, all.Calls, all.Cost)
+	return nil
+}
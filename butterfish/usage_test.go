@@ -0,0 +1,173 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xuzhougeng/butterfish/util"
+)
+
+func TestPriceTableLookup(t *testing.T) {
+	prices := PriceTable{
+		"gpt-4":       {30, 60},
+		"gpt-4o":      {2.5, 10},
+		"gpt-4o-mini": {0.15, 0.6},
+	}
+
+	price, ok := prices.Lookup("gpt-4o-mini-2024-07-18")
+	assert.True(t, ok)
+	assert.Equal(t, 0.15, price.Input)
+
+	price, ok = prices.Lookup("openai/gpt-4o")
+	assert.True(t, ok)
+	assert.Equal(t, 2.5, price.Input)
+
+	_, ok = prices.Lookup("llama3")
+	assert.False(t, ok)
+
+	assert.InDelta(t, 0.0025+0.01, prices.Cost("gpt-4o", 1000, 1000), 1e-9)
+}
+
+func TestMeteredLLM(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	ledger, err := NewUsageLedger(path)
+	assert.NoError(t, err)
+
+	scripted := &scriptedLLM{responses: []*util.CompletionResponse{
+		{Completion: "ls", Usage: &util.Usage{PromptTokens: 1000, CompletionTokens: 10}},
+		{Completion: "hello world"},
+	}}
+	metered := NewMeteredLLM(scripted, ledger, PriceTable{"gpt-4o": {2.5, 10}}, nil)
+
+	_, err = metered.CompletionStream(&util.CompletionRequest{
+		Ctx:       context.Background(),
+		Model:     "gpt-4o",
+		ModelRole: ModelRoleAutosuggest,
+		Feature:   FeatureAutosuggest,
+	}, &bytes.Buffer{})
+	assert.NoError(t, err)
+
+	// without reported usage we estimate, and fall back to the role
+	_, err = metered.CompletionStream(&util.CompletionRequest{
+		Ctx:       context.Background(),
+		Model:     "gpt-4o",
+		Prompt:    "say hello",
+		ModelRole: ModelRoleGencmd,
+	}, &bytes.Buffer{})
+	assert.NoError(t, err)
+
+	records, err := ledger.Read(time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, FeatureAutosuggest, records[0].Feature)
+	assert.InDelta(t, 0.0026, records[0].Cost, 1e-9)
+	assert.False(t, records[0].Estimated)
+	assert.Equal(t, ModelRoleGencmd, records[1].Feature)
+	assert.True(t, records[1].Estimated)
+	assert.Greater(t, records[1].PromptTokens, 0)
+
+	out := &bytes.Buffer{}
+	err = PrintUsageReport(out, path, 1)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "autosuggest")
+	assert.Contains(t, out.String(), "2 calls")
+}
+
+// Streams some output then fails with err, and reports embedding usage
+type partialLLM struct {
+	namedLLM
+	err error
+}
+
+func (this *partialLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	writer.Write([]byte("partial answer"))
+	return nil, this.err
+}
+
+func (this *partialLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	reportUsage(ctx, 42, 0)
+	return [][]float32{{1}}, nil
+}
+
+func TestMeteredLLMFailures(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	ledger, err := NewUsageLedger(path)
+	assert.NoError(t, err)
+
+	request := &util.CompletionRequest{
+		Ctx:     context.Background(),
+		Model:   "gpt-4o",
+		Prompt:  "complete this command",
+		Feature: FeatureAutosuggest,
+	}
+
+	// cancelled mid-stream is still billed
+	metered := NewMeteredLLM(&partialLLM{err: context.Canceled}, ledger, nil, nil)
+	_, err = metered.CompletionStream(request, &bytes.Buffer{})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// cancelled while waiting on the rate limiter never reached the provider
+	metered = NewMeteredLLM(&partialLLM{err: &requestNotSentError{context.Canceled}}, ledger, nil, nil)
+	_, err = metered.CompletionStream(request, &bytes.Buffer{})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = metered.Embeddings(context.Background(), []string{"a"}, false)
+	assert.NoError(t, err)
+
+	records, err := ledger.Read(time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.True(t, records[0].Estimated)
+	assert.Greater(t, records[0].PromptTokens, 0)
+	assert.Greater(t, records[0].CompletionTokens, 0)
+
+	// embeddings use the usage the API reported
+	assert.Equal(t, FeatureEmbeddings, records[1].Feature)
+	assert.Equal(t, 42, records[1].PromptTokens)
+	assert.False(t, records[1].Estimated)
+}
+
+// Reports the model it called, like a client that swapped in its default
+type reportingLLM struct {
+	namedLLM
+	model string
+}
+
+func (this *reportingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	reportModel(request.Ctx, this.model)
+	return &util.CompletionResponse{
+		Completion: "ls",
+		Usage:      &util.Usage{PromptTokens: 1000, CompletionTokens: 0},
+	}, nil
+}
+
+func TestMeteredLLMReportedModel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	ledger, err := NewUsageLedger(path)
+	assert.NoError(t, err)
+
+	prices := PriceTable{"gpt-4o": {2.5, 10}, "claude-3-5-haiku": {0.8, 4}}
+	metered := NewMeteredLLM(&reportingLLM{model: "claude-3-5-haiku-latest"}, ledger, prices, nil)
+
+	request := &util.CompletionRequest{
+		Ctx:     context.Background(),
+		Model:   "gpt-4o",
+		Feature: FeatureAutosuggest,
+	}
+	_, err = metered.CompletionStream(request, &bytes.Buffer{})
+	assert.NoError(t, err)
+	// the caller's request is left alone
+	assert.Equal(t, context.Background(), request.Ctx)
+
+	records, err := ledger.Read(time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, "claude-3-5-haiku-latest", records[0].Model)
+	assert.InDelta(t, 0.0008, records[0].Cost, 1e-9)
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,7 +30,7 @@ const description = `Do useful things with LLMs from the command line, with a be
 
 Butterfish is a command line tool for working with LLMs. It has two modes: CLI command mode, used to prompt LLMs, summarize files, and manage embeddings, and Shell mode: Wraps your local shell to provide easy prompting and autocomplete.
 
-Butterfish looks for an API key in OPENAI_API_KEY, or alternatively stores an OpenAI auth token at ~/.config/butterfish/butterfish.env.
+Butterfish looks for an API key in OPENAI_API_KEY, or alternatively stores an OpenAI auth token at ~/.config/butterfish/butterfish.env. Claude models use the Anthropic API directly with a key from ANTHROPIC_API_KEY, Gemini models use the Gemini API with a key from GEMINI_API_KEY.
 
 Prompts are stored in ~/.config/butterfish/prompts.yaml. Butterfish logs to ~/.butterfish/logs/butterfish.log. To print the full prompts and responses from the OpenAI API, use the --verbose flag. Support can be found at https://github.com/xuzhougeng/butterfish.
 
@@ -38,6 +39,15 @@ If you do not have OpenAI free credits then you will need a subscription and you
 const license = "MIT License - Copyright (c) 2023 Peter Bakkum"
 const defaultEnvPath = "~/.config/butterfish/butterfish.env"
 const defaultPromptPath = "~/.config/butterfish/prompts.yaml"
+const defaultProvidersPath = "~/.config/butterfish/providers.yaml"
+const defaultCachePath = "~/.butterfish/cache"
+const defaultUsageLedgerPath = "~/.butterfish/usage.jsonl"
+const defaultSessionsPath = "~/.butterfish/sessions"
+const defaultPricesPath = "~/.config/butterfish/prices.yaml"
+const defaultBudgetsPath = "~/.config/butterfish/budgets.yaml"
+const defaultModelsPath = "~/.config/butterfish/models.yaml"
+const defaultRedactionPath = "~/.config/butterfish/redaction.yaml"
+const defaultCommandPolicyPath = "~/.config/butterfish/policy.yaml"
 
 const shell_help = `Start the Butterfish shell wrapper. This wraps your existing shell, giving you access to LLM prompting by starting your command with a capital letter. LLM calls include prior shell context. This is great for keeping a chat-like terminal open, sending written prompts, debugging commands, and iterating on past actions.
 
@@ -47,7 +57,7 @@ Use:
   - Autosuggest will print command completions, press tab to fill them in
   - GPT will be able to see your shell history, so you can ask contextual questions like 'why didnt my last command work?'
 	- Start a command with ! to enter Goal Mode, in which GPT will act as an Agent attempting to accomplish your goal by executing commands, for example '!Run make in this directory and debug any problems'.
-	- Start a command with !! to enter Unsafe Goal Mode, in which GPT will execute commands without confirmation. USE WITH CAUTION.
+	- Start a command with !! to enter Unsafe Goal Mode, in which GPT will execute commands without confirmation, except risky ones like rm -rf. USE WITH CAUTION.
 
 Here are special Butterfish commands:
   - Help : Give hints about usage.
@@ -77,18 +87,27 @@ type CliConfig struct {
 	BaseURL      string           `short:"u" default:"https://api.openai.com/v1" help:"Base URL for OpenAI-compatible API. Enables local models with a compatible interface."`
 	TokenTimeout int              `short:"z" default:"10000" help:"Timeout before first prompt token is received and between individual tokens. In milliseconds."`
 	LightColor   bool             `short:"l" default:"false" help:"Light color mode, appropriate for a terminal with a white(ish) background"`
+	NoCache      bool             `default:"false" help:"Don't cache responses to identical temperature 0 requests in ~/.butterfish/cache."`
 
 	Shell struct {
-		Bin                        string  `short:"b" default:"" help:"Shell binary to use, defaults to $SHELL."`
-		Model                      string  `short:"m" default:"" help:"LLM to use for shell prompts."`
-		AutosuggestModel           string  `short:"a" default:"" help:"LLM to use for shell autosuggestions."`
-		AutosuggestDisabled        bool    `short:"A" default:"false" help:"Disable shell autosuggestions."`
-		AutosuggestTimeout         int     `short:"t" default:"1000" help:"Timeout for shell autosuggestions in milliseconds."`
-		NewlineAutosuggestTimeout  int     `short:"T" default:"2000" help:"Timeout for shell autosuggestions after newline in milliseconds."`
-		NoCommandPrompt            bool    `short:"P" default:"false" help:"Don't modify the command prompt."`
-		MaxPromptTokens            int     `short:"p" default:"4096" help:"Maximum number of tokens to use for shell prompts."`
-		MaxHistoryBlockTokens      int     `short:"H" default:"2048" help:"Maximum number of tokens to use for shell history blocks."`
-		MaxResponseTokens          int     `short:"r" default:"1024" help:"Maximum number of tokens to generate for shell responses."`
+		Bin                       string        `short:"b" default:"" help:"Shell binary to use, defaults to $SHELL."`
+		Model                     string        `short:"m" default:"" help:"LLM to use for shell prompts."`
+		AutosuggestModel          string        `short:"a" default:"" help:"LLM to use for shell autosuggestions."`
+		AutosuggestDisabled       bool          `short:"A" default:"false" help:"Disable shell autosuggestions."`
+		AutosuggestTemperature    float32       `default:"0.2" help:"Temperature for shell autosuggestions, 0 lets repeated requests be answered from the response cache."`
+		AutosuggestTimeout        int           `short:"t" default:"1000" help:"Timeout for shell autosuggestions in milliseconds."`
+		NewlineAutosuggestTimeout int           `short:"T" default:"2000" help:"Timeout for shell autosuggestions after newline in milliseconds."`
+		NoCommandPrompt           bool          `short:"P" default:"false" help:"Don't modify the command prompt."`
+		MaxPromptTokens           int           `short:"p" default:"4096" help:"Maximum number of tokens to use for shell prompts."`
+		MaxHistoryBlockTokens     int           `short:"H" default:"2048" help:"Maximum number of tokens to use for shell history blocks."`
+		MaxResponseTokens         int           `short:"r" default:"1024" help:"Maximum number of tokens to generate for shell responses."`
+		Resume                    string        `short:"R" default:"" help:"Resume the history of an earlier session, by id or 'last' for the most recent. See 'butterfish sessions'."`
+		NoSession                 bool          `default:"false" help:"Don't record shell history to a session in ~/.butterfish/sessions."`
+		Sandbox                   bool          `default:"false" help:"Run goal mode commands in a sandbox without network access or writes outside the working directory, and review their changes before applying them. Linux only."`
+		GoalMaxTurns              int           `default:"25" help:"Most model turns in goal mode before it gives up, 0 for no limit."`
+		GoalMaxCommands           int           `default:"20" help:"Most commands goal mode runs before it gives up, 0 for no limit."`
+		GoalMaxFailures           int           `default:"3" help:"Most times in a row the same command can fail in goal mode before it gives up, 0 for no limit."`
+		GoalTimeout               time.Duration `default:"10m" help:"Longest goal mode works on a goal before it gives up, like 30m, 0 for no limit."`
 	} `cmd:"shell" help:"${shell_help}"`
 
 	Completion struct {
@@ -104,7 +123,7 @@ _butterfish_completion() {
     COMPREPLY=()
     cur="${COMP_WORDS[COMP_CWORD]}"
     prev="${COMP_WORDS[COMP_CWORD-1]}"
-    opts="shell prompt promptedit edit summarize gencmd exec index clearindex loadindex showindex indexsearch indexquestion image completion"
+    opts="shell prompt promptedit edit summarize gencmd exec index clearindex loadindex showindex indexsearch indexquestion image usage sessions completion"
 
     case "${prev}" in
         butterfish)
@@ -144,6 +163,8 @@ _butterfish() {
         'indexsearch:Search in indexed files'
         'indexquestion:Ask questions about indexed files'
         'image:Analyze images'
+        'usage:Report token usage and cost'
+        'sessions:List and prune shell sessions'
         'completion:Generate shell completion script'
     )
 
@@ -191,6 +212,8 @@ complete -c butterfish -n '__fish_butterfish_no_subcommand' -a showindex -d 'Sho
 complete -c butterfish -n '__fish_butterfish_no_subcommand' -a indexsearch -d 'Search in indexed files'
 complete -c butterfish -n '__fish_butterfish_no_subcommand' -a indexquestion -d 'Ask questions about indexed files'
 complete -c butterfish -n '__fish_butterfish_no_subcommand' -a image -d 'Analyze images'
+complete -c butterfish -n '__fish_butterfish_no_subcommand' -a usage -d 'Report token usage and cost'
+complete -c butterfish -n '__fish_butterfish_no_subcommand' -a sessions -d 'List and prune shell sessions'
 complete -c butterfish -n '__fish_butterfish_no_subcommand' -a completion -d 'Generate shell completion script'
 
 complete -c butterfish -n '__fish_seen_subcommand_from completion' -a "bash zsh fish" -d 'Shell type'
@@ -236,6 +259,39 @@ func getOpenAIToken() string {
 	return ""
 }
 
+func getAnthropicToken() string {
+	path, err := homedir.Expand(defaultEnvPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the env file may have already been loaded, godotenv won't override
+	godotenv.Load(path)
+
+	token := os.Getenv("ANTHROPIC_API_KEY")
+	if token != "" {
+		return token
+	}
+
+	return os.Getenv("ANTHROPIC_TOKEN")
+}
+
+func getGeminiToken() string {
+	path, err := homedir.Expand(defaultEnvPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	godotenv.Load(path)
+
+	token := os.Getenv("GEMINI_API_KEY")
+	if token != "" {
+		return token
+	}
+
+	return os.Getenv("GOOGLE_API_KEY")
+}
+
 func isAnthropicModel(model string) bool {
 	model = strings.ToLower(model)
 	return strings.Contains(model, "claude") || strings.HasPrefix(model, "anthropic/")
@@ -282,6 +338,19 @@ func loadModelConfig(config *bf.ButterfishConfig) {
 func makeButterfishConfig(options *CliConfig) *bf.ButterfishConfig {
 	config := bf.MakeButterfishConfig()
 	config.OpenAIToken = getOpenAIToken()
+	config.AnthropicToken = getAnthropicToken()
+	config.AnthropicBaseURL = os.Getenv("BUTTERFISH_ANTHROPIC_BASE_URL")
+	config.GeminiToken = getGeminiToken()
+	config.GeminiBaseURL = os.Getenv("BUTTERFISH_GEMINI_BASE_URL")
+	config.OllamaBaseURL = os.Getenv("BUTTERFISH_OLLAMA_URL")
+	if maxContext := os.Getenv("BUTTERFISH_OLLAMA_MAX_CONTEXT"); maxContext != "" {
+		n, err := strconv.Atoi(maxContext)
+		if err != nil {
+			log.Fatalf("Invalid BUTTERFISH_OLLAMA_MAX_CONTEXT %q: %s", maxContext, err)
+		}
+		config.OllamaMaxContextLength = n
+	}
+	config.EmbeddingModel = os.Getenv("BUTTERFISH_EMBEDDING_MODEL")
 	
 	// Check env for BASE_URL first
 	if baseURL := os.Getenv("BUTTERFISH_BASE_URL"); baseURL != "" {
@@ -298,8 +367,15 @@ func makeButterfishConfig(options *CliConfig) *bf.ButterfishConfig {
 		config.ShellPromptModel = "gpt-3.5-turbo"
 		config.ModelType = bf.ModelTypeOpenAI
 	}
+
 	if config.ShellAutosuggestModel == "" {
 		config.ShellAutosuggestModel = "gpt-3.5-turbo-instruct"
+		// the Anthropic, Gemini and Ollama clients can't serve an OpenAI
+		// instruct model
+		if isAnthropicModel(config.ShellPromptModel) || bf.IsGeminiModel(config.ShellPromptModel) ||
+			config.OllamaBaseURL != "" {
+			config.ShellAutosuggestModel = config.ShellPromptModel
+		}
 	}
 	if config.GencmdModel == "" {
 		config.GencmdModel = "gpt-3.5-turbo"
@@ -324,6 +400,19 @@ func makeButterfishConfig(options *CliConfig) *bf.ButterfishConfig {
 	}
 	
 	config.PromptLibraryPath = defaultPromptPath
+	config.ProvidersPath = defaultProvidersPath
+	if !options.NoCache {
+		config.CachePath = defaultCachePath
+	}
+	config.UsageLedgerPath = defaultUsageLedgerPath
+	config.SessionsPath = defaultSessionsPath
+	config.PricesPath = defaultPricesPath
+	config.BudgetsPath = defaultBudgetsPath
+	config.ModelsPath = defaultModelsPath
+	config.RedactionPath = defaultRedactionPath
+	config.CommandPolicyPath = defaultCommandPolicyPath
+	config.CassettePath = os.Getenv("BUTTERFISH_CASSETTE")
+	config.CassetteMode = os.Getenv("BUTTERFISH_CASSETTE_MODE")
 	config.TokenTimeout = time.Duration(options.TokenTimeout) * time.Millisecond
 
 	if options.Verbose {
@@ -406,12 +495,14 @@ func main() {
 		// Command line args override env settings
 		if cli.Shell.Model != "" {
 			config.ShellPromptModel = cli.Shell.Model
+			config.ModelType = getModelType(cli.Shell.Model)
 		}
 		if cli.Shell.AutosuggestModel != "" {
 			config.ShellAutosuggestModel = cli.Shell.AutosuggestModel
 		}
 		
 		config.ShellAutosuggestEnabled = !cli.Shell.AutosuggestDisabled
+		config.ShellAutosuggestTemperature = cli.Shell.AutosuggestTemperature
 		config.ShellAutosuggestTimeout = time.Duration(cli.Shell.AutosuggestTimeout) * time.Millisecond
 		config.ShellNewlineAutosuggestTimeout = time.Duration(cli.Shell.NewlineAutosuggestTimeout) * time.Millisecond
 		config.ColorDark = !cli.LightColor
@@ -420,6 +511,19 @@ func main() {
 		config.ShellMaxPromptTokens = cli.Shell.MaxPromptTokens
 		config.ShellMaxHistoryBlockTokens = cli.Shell.MaxHistoryBlockTokens
 		config.ShellMaxResponseTokens = cli.Shell.MaxResponseTokens
+		config.ShellResume = cli.Shell.Resume
+		config.GoalModeSandbox = cli.Shell.Sandbox
+		config.GoalModeMaxTurns = cli.Shell.GoalMaxTurns
+		config.GoalModeMaxCommands = cli.Shell.GoalMaxCommands
+		config.GoalModeMaxFailures = cli.Shell.GoalMaxFailures
+		config.GoalModeMaxDuration = cli.Shell.GoalTimeout
+		if cli.Shell.NoSession {
+			if cli.Shell.Resume != "" {
+				fmt.Fprintf(errorWriter, "Can't resume a session with --no-session\n")
+				os.Exit(9)
+			}
+			config.SessionsPath = ""
+		}
 
 		bf.RunShell(ctx, config)
 
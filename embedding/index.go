@@ -83,6 +83,37 @@ type DiskCachedEmbeddingIndex struct {
 
 	// When we embed a path we skip these files
 	IgnoreFiles []string
+
+	// The model the Embedder uses. Indexes made with a different model are
+	// not loaded (and so are rebuilt when indexing) since their vectors can't
+	// be compared with ours. If empty the model isn't checked.
+	EmbeddingModel string
+}
+
+// Indexes written before the model was recorded were all made with OpenAI's
+// ada v2 model
+const LegacyEmbeddingModel = "text-embedding-ada-002"
+
+// The model a directory index was made with
+func IndexEmbeddingModel(dirIndex *pb.DirectoryIndex) string {
+	if dirIndex.EmbeddingModel == "" {
+		return LegacyEmbeddingModel
+	}
+	return dirIndex.EmbeddingModel
+}
+
+// Return an error if a directory index was made with a different model than
+// the one we're using
+func (this *DiskCachedEmbeddingIndex) checkModel(path string, dirIndex *pb.DirectoryIndex) error {
+	if this.EmbeddingModel == "" || len(dirIndex.Files) == 0 {
+		return nil
+	}
+
+	indexModel := IndexEmbeddingModel(dirIndex)
+	if indexModel != this.EmbeddingModel {
+		return fmt.Errorf("Index at %s was made with embedding model %s but the current model is %s, run index to rebuild it", path, indexModel, this.EmbeddingModel)
+	}
+	return nil
 }
 
 func NewDiskCachedEmbeddingIndex(embedder Embedder, writer io.Writer) *DiskCachedEmbeddingIndex {
@@ -171,12 +202,23 @@ func (this *DiskCachedEmbeddingIndex) SearchWithVector(ctx context.Context,
 	results := []*VectorSearchResult{}
 
 	for dirIndexAbsPath, dirIndex := range this.Index {
+		err := this.checkModel(dirIndexAbsPath, dirIndex)
+		if err != nil {
+			return nil, err
+		}
+
 		for filename, fileIndex := range dirIndex.Files {
 			if ctx.Err() != nil {
 				return nil, ctx.Err()
 			}
 
+			// files are embedded separately, so each is checked rather than
+			// trusting the dimension recorded for the directory
+			absPath := filepath.Join(dirIndexAbsPath, filename)
 			for _, embedding := range fileIndex.Embeddings {
+				if len(embedding.Vector) != len(queryVector) {
+					return nil, fmt.Errorf("Index of %s has %d dimensional vectors but the query vector has %d, run index --force to rebuild it", absPath, len(embedding.Vector), len(queryVector))
+				}
 				govec, err := govector.AsVector(embedding.Vector)
 
 				distance, err := govector.Cosine(query, govec)
@@ -184,7 +226,6 @@ func (this *DiskCachedEmbeddingIndex) SearchWithVector(ctx context.Context,
 					return nil, err
 				}
 
-				absPath := filepath.Join(dirIndexAbsPath, filename)
 				result := &VectorSearchResult{
 					Score:    distance,
 					FilePath: absPath,
@@ -280,6 +321,14 @@ func (this *DiskCachedEmbeddingIndex) LoadDotfile(dotfile string) error {
 	}
 	indexName := filepath.Dir(absPath)
 
+	// comparing vectors from different models gives meaningless scores, so
+	// leave the index out, indexing will then rebuild it
+	err = this.checkModel(indexName, &dirIndex)
+	if err != nil {
+		fmt.Fprintf(this.Out, "Skipping index: %s\n", err)
+		return nil
+	}
+
 	// put the loaded info in the memory index
 	this.Index[indexName] = &dirIndex
 
@@ -615,9 +664,10 @@ func (this *DiskCachedEmbeddingIndex) IndexPath(ctx context.Context, path string
 		}
 	}
 
-	// Fetch directory index, create a new one if none found
+	// Fetch directory index, create a new one if none found or if it was
+	// made with a different model
 	dirIndex, ok := this.Index[dirPath]
-	if !ok {
+	if !ok || this.checkModel(dirPath, dirIndex) != nil {
 		dirIndex = NewDirectoryIndex()
 		this.Index[dirPath] = dirIndex
 	}
@@ -634,8 +684,14 @@ func (this *DiskCachedEmbeddingIndex) IndexPath(ctx context.Context, path string
 		}
 
 		dirIndex.Files[name] = fileEmbeddings
+		if len(fileEmbeddings.Embeddings) > 0 {
+			dirIndex.EmbeddingDimension = uint32(len(fileEmbeddings.Embeddings[0].Vector))
+		}
 		fmt.Fprintf(this.Out, "Indexed %s\n", path)
 	}
+	if this.EmbeddingModel != "" {
+		dirIndex.EmbeddingModel = this.EmbeddingModel
+	}
 
 	// TODO remove indexes for files that have been deleted
 
@@ -56,6 +56,14 @@ func TestSearch(t *testing.T) {
 	assert.Equal(t, "/path/foo/test.txt", results[0].FilePath)
 	// The first and second vectors should be the closest matches
 	assert.Equal(t, uint64(0), results[0].Start)
+
+	// each file is checked, not just the dimension recorded for the directory
+	index.Index["/path/foo"].EmbeddingDimension = 5
+	index.Index["/path/foo"].Files["old.txt"] = &pb.FileEmbeddings{
+		Embeddings: []*pb.AnnotatedEmbedding{{Vector: []float32{1, 0, 0}}},
+	}
+	_, err = index.SearchWithVector(context.Background(), []float32{1, 0.5, 0, 0, 0}, 3)
+	assert.ErrorContains(t, err, "Index of /path/foo/old.txt has 3 dimensional vectors but the query vector has 5")
 }
 
 // A mock embedder that implements the Embedder interface
@@ -172,3 +180,34 @@ func TestFileCaching(t *testing.T) {
 
 	// TODO test showindexed
 }
+
+// Indexes made with another embedding model shouldn't be searched, they're
+// rebuilt when indexing instead
+func TestEmbeddingModelMismatch(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	index.EmbeddingModel = "model-a"
+	ctx := context.Background()
+
+	err := index.IndexPath(ctx, "/a/b/c", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, "model-a", index.Index["/a/b/c/d"].EmbeddingModel)
+	assert.Equal(t, uint32(128), index.Index["/a/b/c/d"].EmbeddingDimension)
+
+	// a different model doesn't load the cached index
+	index, embedder := newTestDiskCachedEmbeddingIndex(fs)
+	index.EmbeddingModel = "model-b"
+	err = index.LoadPath(ctx, "/a/b/c")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(index.IndexedFiles()))
+
+	// so indexing embeds the file again with the new model
+	err = index.IndexPath(ctx, "/a/b/c", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, embedder.Calls)
+	assert.Equal(t, "model-b", index.Index["/a/b/c/d"].EmbeddingModel)
+
+	// and searching with a vector of the wrong size is refused
+	_, err = index.SearchWithVector(ctx, []float32{1, 0, 0}, 1)
+	assert.Error(t, err)
+}
@@ -38,6 +38,15 @@ type CompletionRequest struct {
 	Verbose       bool
 	TokenTimeout  time.Duration
 	Images        []ImageContent
+	// Which feature the request is for (prompt, autosuggest, etc), used to
+	// route the request to that feature's provider
+	ModelRole string
+	// Finer grained than ModelRole (e.g. shell prompt vs goal mode), used to
+	// tag usage records
+	Feature string
+	// If set the response should be JSON matching this schema, providers
+	// enforce it with structured output or a forced tool call
+	ResponseSchema json.RawMessage
 }
 
 type FunctionCall struct {
@@ -56,6 +65,13 @@ type CompletionResponse struct {
 	FunctionName       string
 	FunctionParameters string
 	ToolCalls          []*ToolCall
+	// Token counts reported by the API, nil if the API didn't report them
+	Usage *Usage
+}
+
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
 }
 
 type FunctionDefinition struct {